@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// runSummary is the run_end event of a recorded run, as read back by
+// --compare-baseline. Its counters are the DedupStats fields it was
+// written from.
+type runSummary struct {
+	TS     string `json:"ts"`
+	Event  string `json:"event"`
+	Root   string `json:"root"`
+	DryRun bool   `json:"dry_run"`
+	DedupStats
+}
+
+// loadBaseline returns the last run_end event in path, which may hold
+// just that line or a whole --events-file.
+func loadBaseline(path string) (*runSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readBaseline(f)
+}
+
+// readBaseline is loadBaseline for an open file. Lines that are not JSON
+// objects are skipped, so a truncated last line does not hide the runs
+// before it.
+func readBaseline(r io.Reader) (*runSummary, error) {
+	var last *runSummary
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for sc.Scan() {
+		var s runSummary
+		if json.Unmarshal(sc.Bytes(), &s) != nil || s.Event != eventRunEnd {
+			continue
+		}
+		last = &s
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, fmt.Errorf("no %s event found", eventRunEnd)
+	}
+	return last, nil
+}
+
+// baselineDelta is how a run's totals moved from a baseline run's.
+// Converged is the change in ConvergedRatio.
+type baselineDelta struct {
+	FilesDeduped   int64
+	BytesSaved     int64
+	AlreadyDeduped int64
+	Errors         int64
+	FilesScanned   int64
+	Converged      float64
+}
+
+// compareBaseline returns cur's totals minus base's.
+func compareBaseline(base, cur *DedupStats) baselineDelta {
+	return baselineDelta{
+		FilesDeduped:   cur.FilesDeduped - base.FilesDeduped,
+		BytesSaved:     cur.BytesSaved - base.BytesSaved,
+		AlreadyDeduped: cur.AlreadyDeduped - base.AlreadyDeduped,
+		Errors:         cur.Errors - base.Errors,
+		FilesScanned:   cur.FilesScanned - base.FilesScanned,
+		Converged:      cur.ConvergedRatio() - base.ConvergedRatio(),
+	}
+}
+
+// Write prints the delta as a summary block, labelled with the baseline's
+// timestamp.
+func (d baselineDelta) Write(w io.Writer, base *runSummary, raw bool) {
+	fmt.Fprintf(w, "\nCompared with baseline (%s):\n", base.TS)
+	fmt.Fprintf(w, "  Files deduped:    %s\n", signedCount(d.FilesDeduped))
+	fmt.Fprintf(w, "  Space saved:      %s\n", signedSize(d.BytesSaved, raw))
+	fmt.Fprintf(w, "  Already deduped:  %s\n", signedCount(d.AlreadyDeduped))
+	fmt.Fprintf(w, "  Files scanned:    %s\n", signedCount(d.FilesScanned))
+	fmt.Fprintf(w, "  Converged:        %+.1f points\n", 100*d.Converged)
+	fmt.Fprintf(w, "  Errors:           %s\n", signedCount(d.Errors))
+}
+
+// Line summarizes the delta on one line, for quiet mode.
+func (d baselineDelta) Line(raw bool) string {
+	return fmt.Sprintf("%s deduped, %s saved, %s already, %+.1f points converged, %s errors vs baseline",
+		signedCount(d.FilesDeduped), signedSize(d.BytesSaved, raw),
+		signedCount(d.AlreadyDeduped), 100*d.Converged, signedCount(d.Errors))
+}
+
+// signedCount is formatCount with an explicit sign on nonzero counts.
+func signedCount(n int64) string {
+	if n > 0 {
+		return "+" + formatCount(n)
+	}
+	return formatCount(n)
+}
+
+// signedSize is formatSize with an explicit sign on nonzero sizes.
+func signedSize(b int64, raw bool) string {
+	switch {
+	case b > 0:
+		return "+" + formatSize(b, raw)
+	case b < 0:
+		return "-" + formatSize(-b, raw)
+	}
+	return formatSize(0, raw)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBaselineLastRunEnd(t *testing.T) {
+	in := `{"ts":"2026-01-01T00:00:00Z","event":"pass_start","pass":1}
+{"ts":"2026-01-01T01:00:00Z","event":"run_end","root":"/data","files_deduped":5,"bytes_saved":500}
+{"ts":"2026-01-02T00:00:00Z","event":"dedup","path":"/data/a","bytes_saved":100}
+{"ts":"2026-01-02T01:00:00Z","event":"run_end","root":"/data","files_deduped":7,"bytes_saved":900,"already_deduped":3}
+{"ts":"2026-01-03T00:00:00Z","event":"run_e`
+	s, err := readBaseline(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.TS != "2026-01-02T01:00:00Z" || s.Root != "/data" {
+		t.Errorf("got run at %s over %s, want the last complete run_end", s.TS, s.Root)
+	}
+	if s.FilesDeduped != 7 || s.BytesSaved != 900 || s.AlreadyDeduped != 3 {
+		t.Errorf("got %+v", s.DedupStats)
+	}
+
+	if _, err := readBaseline(strings.NewReader(`{"event":"pass_start"}`)); err == nil {
+		t.Error("a file without run_end should fail")
+	}
+}
+
+func TestCompareBaseline(t *testing.T) {
+	// Write a real run_end event and read it back as the baseline.
+	var buf bytes.Buffer
+	events := NewEventLog(&buf)
+	events.now = func() time.Time { return time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC) }
+	prev := &DedupStats{FilesDeduped: 100, BytesSaved: 10 << 30, AlreadyDeduped: 900, Errors: 2, FilesScanned: 5000}
+	events.Emit(eventRunEnd, map[string]any{"root": "/data", "files_deduped": prev.FilesDeduped,
+		"bytes_saved": prev.BytesSaved, "already_deduped": prev.AlreadyDeduped, "errors": prev.Errors,
+		"files_scanned": prev.FilesScanned, "converged_ratio": prev.ConvergedRatio()})
+	base, err := readBaseline(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur := &DedupStats{FilesDeduped: 10, BytesSaved: 1 << 30, AlreadyDeduped: 990, Errors: 0, FilesScanned: 5200}
+	d := compareBaseline(&base.DedupStats, cur)
+	want := baselineDelta{FilesDeduped: -90, BytesSaved: -9 << 30, AlreadyDeduped: 90, Errors: -2, FilesScanned: 200}
+	if got := d; got.FilesDeduped != want.FilesDeduped || got.BytesSaved != want.BytesSaved ||
+		got.AlreadyDeduped != want.AlreadyDeduped || got.Errors != want.Errors || got.FilesScanned != want.FilesScanned {
+		t.Errorf("delta = %+v, want %+v", got, want)
+	}
+	// 90% converged before, 99% now.
+	if d.Converged < 0.089 || d.Converged > 0.091 {
+		t.Errorf("converged delta = %v, want 0.09", d.Converged)
+	}
+
+	var out bytes.Buffer
+	d.Write(&out, base, false)
+	for _, line := range []string{
+		"Compared with baseline (2026-03-01T02:00:00Z):",
+		"Files deduped:    -90",
+		"Space saved:      -9.0 GiB",
+		"Already deduped:  +90",
+		"Files scanned:    +200",
+		"Converged:        +9.0 points",
+		"Errors:           -2",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("output lacks %q:\n%s", line, out.String())
+		}
+	}
+	if got := d.Line(true); !strings.HasPrefix(got, "-90 deduped, -9663676416 saved, +90 already, +9.0 points converged") {
+		t.Errorf("Line = %q", got)
+	}
+}
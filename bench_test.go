@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// treeSpec describes a synthetic directory tree for benchmarks.
+type treeSpec struct {
+	Files           int     // total number of files
+	Sizes           []int64 // file sizes, assigned round-robin
+	DistinctPerSize int     // distinct contents per size (1 = all identical)
+	FanOut          int     // maximum files per directory before nesting
+	Seed            uint64  // PRNG seed for reproducible content
+}
+
+// genTree materializes spec under root and returns the created file paths.
+// Files with the same size cycle through DistinctPerSize content variants, so
+// the expected number of dedups per size is (files of that size) - DistinctPerSize.
+func genTree(tb testing.TB, root string, spec treeSpec) []string {
+	tb.Helper()
+	if spec.FanOut < 1 {
+		spec.FanOut = 100
+	}
+	if spec.DistinctPerSize < 1 {
+		spec.DistinctPerSize = 1
+	}
+	rng := rand.New(rand.NewPCG(spec.Seed, spec.Seed^0x9e3779b97f4a7c15))
+
+	// Pre-generate content variants per size.
+	contents := make(map[int64][][]byte)
+	for _, size := range spec.Sizes {
+		if _, ok := contents[size]; ok {
+			continue
+		}
+		variants := make([][]byte, spec.DistinctPerSize)
+		for v := range variants {
+			buf := make([]byte, size)
+			for i := range buf {
+				buf[i] = byte(rng.Uint32())
+			}
+			variants[v] = buf
+		}
+		contents[size] = variants
+	}
+
+	paths := make([]string, 0, spec.Files)
+	for i := range spec.Files {
+		size := spec.Sizes[i%len(spec.Sizes)]
+		variant := (i / len(spec.Sizes)) % spec.DistinctPerSize
+
+		// Nest directories so no directory exceeds FanOut entries.
+		dir := root
+		for n := i / spec.FanOut; n > 0; n /= spec.FanOut {
+			dir = filepath.Join(dir, fmt.Sprintf("d%d", n%spec.FanOut))
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		p := filepath.Join(dir, fmt.Sprintf("f%07d.bin", i))
+		if err := os.WriteFile(p, contents[size][variant], 0644); err != nil {
+			tb.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// benchDir returns a directory for benchmark trees. By default this is a
+// regular temp dir. Set FASTDEDUP_BENCH_DIR to use an existing directory
+// (e.g. a btrfs mount), or FASTDEDUP_BENCH_LOOPBACK=1 to create and mount a
+// throwaway btrfs loopback image (requires root and mkfs.btrfs).
+func benchDir(b *testing.B) string {
+	b.Helper()
+	if dir := os.Getenv("FASTDEDUP_BENCH_DIR"); dir != "" {
+		d, err := os.MkdirTemp(dir, "fastdedup-bench.*")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { os.RemoveAll(d) })
+		return d
+	}
+	if os.Getenv("FASTDEDUP_BENCH_LOOPBACK") == "1" {
+		return loopbackBtrfs(b)
+	}
+	return b.TempDir()
+}
+
+// loopbackBtrfs creates a sparse image, formats it as btrfs, and mounts it
+// on a temp dir. The mount and image are removed on cleanup.
+func loopbackBtrfs(b *testing.B) string {
+	b.Helper()
+	if os.Geteuid() != 0 {
+		b.Skip("loopback btrfs requires root")
+	}
+	if _, err := exec.LookPath("mkfs.btrfs"); err != nil {
+		b.Skip("mkfs.btrfs not found")
+	}
+	work := b.TempDir()
+	img := filepath.Join(work, "btrfs.img")
+	mnt := filepath.Join(work, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.Create(img)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Truncate(1 << 30); err != nil {
+		f.Close()
+		b.Fatal(err)
+	}
+	f.Close()
+	if out, err := exec.Command("mkfs.btrfs", "-q", img).CombinedOutput(); err != nil {
+		b.Fatalf("mkfs.btrfs: %v: %s", err, out)
+	}
+	if out, err := exec.Command("mount", "-o", "loop", img, mnt).CombinedOutput(); err != nil {
+		b.Skipf("mount loopback: %v: %s", err, out)
+	}
+	b.Cleanup(func() {
+		//goland:noinspection GoUnhandledErrorResult
+		exec.Command("umount", mnt).Run()
+	})
+	return mnt
+}
+
+func TestGenTree(t *testing.T) {
+	root := t.TempDir()
+	paths := genTree(t, root, treeSpec{Files: 25, Sizes: []int64{64, 128}, DistinctPerSize: 2, FanOut: 10, Seed: 1})
+	if len(paths) != 25 {
+		t.Fatalf("got %d paths, want 25", len(paths))
+	}
+	sm := NewSizeMap(100)
+	count, _, err := WalkSizes(root, sm, WalkOptions{}, nil, nil, nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 25 {
+		t.Errorf("walked %d files, want 25", count)
+	}
+	// Same index maps to same content, so a regenerated tree is identical.
+	again := genTree(t, t.TempDir(), treeSpec{Files: 25, Sizes: []int64{64, 128}, DistinctPerSize: 2, FanOut: 10, Seed: 1})
+	for i := range paths {
+		if eq, err := filesEqual(paths[i], again[i]); err != nil || !eq {
+			t.Fatalf("file %d differs between runs with the same seed", i)
+		}
+	}
+}
+
+func BenchmarkWalkSizes(b *testing.B) {
+	root := benchDir(b)
+	genTree(b, root, treeSpec{Files: 5000, Sizes: []int64{1024, 2048, 4096}, DistinctPerSize: 4, FanOut: 50, Seed: 1})
+	b.ResetTimer()
+	for range b.N {
+		sm := NewSizeMap(1_000_000)
+		if _, _, err := WalkSizes(root, sm, WalkOptions{}, nil, nil, nil, time.Time{}, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSizeMapAdd(b *testing.B) {
+	sm := NewSizeMap(1_000_000)
+	for i := range b.N {
+		sm.Add(int64(i % 500_000))
+	}
+}
+
+func BenchmarkSizeMapTopN(b *testing.B) {
+	sm := NewSizeMap(1_000_000)
+	for i := range 1_000_000 {
+		sm.Add(int64(i % 200_000))
+	}
+	b.ResetTimer()
+	for range b.N {
+		sm.TopN(10_000)
+	}
+}
+
+func BenchmarkSizeMapEvict(b *testing.B) {
+	// Every Add beyond the cap triggers a 10% eviction.
+	sm := NewSizeMap(100_000)
+	for i := range 100_000 {
+		sm.Add(int64(i))
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		sm.Add(int64(100_000 + i))
+	}
+}
+
+func BenchmarkProcessSizeGroup(b *testing.B) {
+	root := benchDir(b)
+	const size = 64 * 1024
+	paths := genTree(b, root, treeSpec{Files: 200, Sizes: []int64{size}, DistinctPerSize: 4, FanOut: 50, Seed: 1})
+
+	// Use a real dedup on filesystems with reflink support, dry-run elsewhere.
+	dryRun := reflinkCopy(paths[0], filepath.Join(root, "probe"), 0644) != nil
+	if dryRun {
+		discardStdout(b)
+	}
+	b.SetBytes(size * int64(len(paths)))
+	b.ResetTimer()
+	for range b.N {
+		ProcessSizeGroup(paths, size, DedupOptions{DryRun: dryRun}, nil)
+	}
+}
+
+// BenchmarkProcessSizeGroupDominant measures a size class where one content
+// dominates but its ref was created after a number of rarer contents, as
+// with a default config file among a few edited copies. Dry-run keeps every
+// iteration on the comparison path.
+func BenchmarkProcessSizeGroupDominant(b *testing.B) {
+	root := benchDir(b)
+	const size = 64 * 1024
+	rare := genTree(b, filepath.Join(root, "rare"), treeSpec{Files: 16, Sizes: []int64{size}, DistinctPerSize: 16, Seed: 1})
+	common := genTree(b, filepath.Join(root, "common"), treeSpec{Files: 200, Sizes: []int64{size}, DistinctPerSize: 1, FanOut: 50, Seed: 2})
+	paths := append(rare, common...)
+
+	discardStdout(b)
+	b.SetBytes(size * int64(len(paths)))
+	b.ResetTimer()
+	for range b.N {
+		ProcessSizeGroup(paths, size, DedupOptions{DryRun: true}, nil)
+	}
+}
+
+// BenchmarkProcessSizeGroupDistinct measures a size class of mostly
+// distinct contents, where every file is compared against a long ref list,
+// with and without --compare-workers.
+func BenchmarkProcessSizeGroupDistinct(b *testing.B) {
+	root := benchDir(b)
+	const size = 64 * 1024
+	paths := genTree(b, root, treeSpec{Files: 200, Sizes: []int64{size}, DistinctPerSize: 100, FanOut: 50, Seed: 1})
+
+	discardStdout(b)
+	for _, workers := range []int{0, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(size * int64(len(paths)))
+			for range b.N {
+				ProcessSizeGroup(paths, size, DedupOptions{DryRun: true, CompareWorkers: workers}, nil)
+			}
+		})
+	}
+}
+
+// filesEqualSequential is the original non-overlapped comparison, kept as a
+// baseline for BenchmarkFilesEqual.
+func filesEqualSequential(pathA, pathB string) (bool, error) {
+	fa, err := os.Open(pathA)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(pathB)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	const chunkSize = 256 * 1024
+	bufA := make([]byte, chunkSize)
+	bufB := make([]byte, chunkSize)
+	for {
+		nA, errA := io.ReadFull(fa, bufA)
+		nB, errB := io.ReadFull(fb, bufB)
+		if nA != nB || !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		eofA, eofB := isEOF(errA), isEOF(errB)
+		if eofA && eofB {
+			return true, nil
+		}
+		if eofA != eofB {
+			return false, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+func BenchmarkFilesEqual(b *testing.B) {
+	root := benchDir(b)
+	const size = 64 << 20
+	paths := genTree(b, root, treeSpec{Files: 2, Sizes: []int64{size}, DistinctPerSize: 1, Seed: 1})
+
+	for _, impl := range []struct {
+		name string
+		fn   func(a, b string) (bool, error)
+	}{
+		{"sequential", filesEqualSequential},
+		{"overlapped", filesEqual},
+		{"mmap", func(a, b string) (bool, error) {
+			mmapCompare = true
+			defer func() { mmapCompare = false }()
+			return filesEqual(a, b)
+		}},
+		{"hdd", func(a, b string) (bool, error) {
+			hddCompare = true
+			defer func() { hddCompare = false }()
+			return filesEqual(a, b)
+		}},
+	} {
+		b.Run(impl.name, func(b *testing.B) {
+			b.SetBytes(2 * size)
+			for range b.N {
+				if eq, err := impl.fn(paths[0], paths[1]); err != nil || !eq {
+					b.Fatalf("eq=%v err=%v", eq, err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDeviceScheduler simulates two disks that each serve one request
+// at a time, with the work split evenly between them. A single shared pool
+// (every task keyed to one device) is compared against per-device pools of
+// the same total size.
+func BenchmarkDeviceScheduler(b *testing.B) {
+	const tasks = 64
+	const latency = 200 * time.Microsecond
+	var disks [2]sync.Mutex
+	access := func(disk int) {
+		disks[disk].Lock()
+		time.Sleep(latency)
+		disks[disk].Unlock()
+	}
+
+	for _, tc := range []struct {
+		name      string
+		perDevice int
+		key       func(disk int) uint64
+	}{
+		// Without device awareness, ordering can queue all workers on one
+		// busy disk while the other idles.
+		{"shared-pool", 2, func(int) uint64 { return 0 }},
+		{"per-device", 1, func(disk int) uint64 { return uint64(disk) }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			for range b.N {
+				s := newDeviceScheduler(tc.perDevice)
+				for i := range tasks {
+					// Bursty layout: runs of four tasks per disk.
+					disk := (i / 4) % 2
+					s.Submit(tc.key(disk), func() { access(disk) })
+				}
+				s.Wait()
+			}
+		})
+	}
+}
+
+// BenchmarkSizeMapAddParallel compares a single lock (one shard) with the
+// sharded map under contention from many goroutines.
+func BenchmarkSizeMapAddParallel(b *testing.B) {
+	for _, tc := range []struct {
+		name   string
+		shards int
+	}{{"single-lock", 1}, {"sharded", maxSizeShards}} {
+		b.Run(tc.name, func(b *testing.B) {
+			sm := newSizeMapShards(1_000_000, tc.shards)
+			b.SetParallelism(8)
+			var seed atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine walks the sizes from its own offset, as
+				// parallel walkers of different subtrees would.
+				i := seed.Add(7919)
+				for pb.Next() {
+					sm.Add(i % 500_000 * 512)
+					i++
+				}
+			})
+		})
+	}
+}
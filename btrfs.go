@@ -93,20 +93,17 @@ func runDefrag(path string, estimatedFiles int64) error {
 
 	var defragCount int64
 	defragStart := time.Now()
-	lastUpdate := defragStart
+	tick := newProgressTicker(progressEvery)
+	defer tick.Stop()
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
 		defragCount++
-		if defragCount%100 == 0 {
-			now := time.Now()
-			if now.Sub(lastUpdate) >= 200*time.Millisecond {
-				lastUpdate = now
-				if estimatedFiles > 0 {
-					eta := formatETA(time.Since(defragStart), defragCount, estimatedFiles)
-					printProgressBar("  Defragmenting:", defragCount, estimatedFiles, eta)
-				} else {
-					printStatus(fmt.Sprintf("  Defragmented: %s files", formatCount(defragCount)))
-				}
+		if tick.Due() {
+			if estimatedFiles > 0 {
+				eta := formatETA(time.Since(defragStart), defragCount, estimatedFiles)
+				printProgressBar("  Defragmenting:", defragCount, estimatedFiles, eta)
+			} else {
+				printStatus(fmt.Sprintf("  Defragmented: %s files", formatCount(defragCount)))
 			}
 		}
 	}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"os"
 	"testing"
 )
 
@@ -40,3 +41,17 @@ func TestRunDefragFailsWithoutBtrfs(t *testing.T) {
 		t.Error("runDefrag on /proc should fail")
 	}
 }
+
+func TestDefragFileFailsWithoutBtrfs(t *testing.T) {
+	dir := t.TempDir()
+	if isBtrfs(dir) {
+		t.Skip("temp dir is on btrfs")
+	}
+	p := dir + "/f"
+	if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := defragFile(p); err == nil {
+		t.Error("defragFile on non-btrfs should fail")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"hash/fnv"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // cachePath returns the OS-appropriate cache file for the given root directory.
@@ -65,6 +66,47 @@ func saveCache(path string, hashes map[int64]uint64) error {
 	return os.Rename(tmp, path)
 }
 
+// sizeCountsSaveEvery is how often pass 1 saves its size counts with
+// --sizemap-cache.
+const sizeCountsSaveEvery = time.Minute
+
+// loadSizeCounts reads the SizeMap counts saved by saveSizeCounts.
+func loadSizeCounts(path string) (map[int64]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var counts map[int64]int64
+	if err := gob.NewDecoder(f).Decode(&counts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return counts, nil
+}
+
+// saveSizeCounts atomically writes the counts of sm to path, for
+// --sizemap-cache.
+func saveSizeCounts(path string, sm *SizeMap) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(sm.Counts()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 // metaPath returns the path for the scan metadata cache file.
 func metaPath(cacheFile string) string {
 	return cacheFile[:len(cacheFile)-len(filepath.Ext(cacheFile))] + ".meta"
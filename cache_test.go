@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -198,6 +199,46 @@ func TestMetaRoundTrip(t *testing.T) {
 	})
 }
 
+func TestSizeCountsRoundTrip(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "sub", "sizes.gob")
+	sm := NewSizeMap(100)
+	for _, size := range []int64{4096, 4096, 4096, 8192, 100} {
+		sm.Add(size)
+	}
+	if err := saveSizeCounts(p, sm); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := loadSizeCounts(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]int64{4096: 3, 8192: 1, 100: 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("loaded %v, want %v", counts, want)
+	}
+
+	// A resumed pass 1 adds its own counts to the saved ones.
+	resumed := NewSizeMap(100)
+	resumed.Merge(counts)
+	resumed.Add(100)
+	resumed.Add(512)
+	want = map[int64]int64{4096: 3, 8192: 1, 100: 2, 512: 1}
+	if got := resumed.Counts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("merged %v, want %v", got, want)
+	}
+	if top := resumed.TopN(1); len(top) != 1 || top[0] != (SizeEntry{Size: 4096, Count: 3}) {
+		t.Errorf("TopN(1) = %v, want 4096 x3", top)
+	}
+
+	if _, err := loadSizeCounts(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file error = %v, want not exist", err)
+	}
+	os.WriteFile(p, []byte("garbage"), 0644)
+	if _, err := loadSizeCounts(p); err == nil {
+		t.Error("corrupt file loaded")
+	}
+}
+
 func TestHashFilename(t *testing.T) {
 	t.Run("deterministic", func(t *testing.T) {
 		a := hashFilename("test.txt")
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+	"time"
+)
+
+// cdcWindow is the rolling hash window in bytes. Chunk boundaries depend only
+// on the last cdcWindow bytes, so an insertion only disturbs nearby chunks.
+const cdcWindow = 48
+
+// buzTable maps each byte value to a pseudo-random 64-bit word for the
+// buzhash rolling hash. It is generated from a fixed seed so chunk
+// boundaries are stable across runs and versions.
+var buzTable = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x6a09e667f3bcc908)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// CDCParams controls content-defined chunk sizes.
+type CDCParams struct {
+	Min int // minimum chunk size in bytes
+	Avg int // target average chunk size in bytes (power of two)
+	Max int // maximum chunk size in bytes
+}
+
+// Validate checks that the chunk sizes are usable.
+func (p CDCParams) Validate() error {
+	if p.Min < cdcWindow {
+		return fmt.Errorf("minimum chunk size must be at least %d bytes, got %d", cdcWindow, p.Min)
+	}
+	if p.Avg < p.Min || p.Max < p.Avg {
+		return fmt.Errorf("chunk sizes must satisfy min <= avg <= max, got %d/%d/%d", p.Min, p.Avg, p.Max)
+	}
+	if p.Avg&(p.Avg-1) != 0 {
+		return fmt.Errorf("average chunk size must be a power of two, got %d", p.Avg)
+	}
+	return nil
+}
+
+// Chunk is a content-defined region of a file.
+type Chunk struct {
+	Offset int64
+	Length int64
+	Sum    [sha256.Size]byte
+}
+
+// chunkReader splits r into content-defined chunks using a buzhash rolling
+// hash. A boundary is placed after a byte when the chunk is at least p.Min
+// long and the hash of the trailing window has its low log2(p.Avg) bits
+// clear, or when the chunk reaches p.Max.
+func chunkReader(r io.Reader, p CDCParams) ([]Chunk, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	mask := uint64(p.Avg - 1)
+	buf := make([]byte, 0, p.Max)
+	var chunks []Chunk
+	var offset int64
+	var h uint64
+
+	emit := func() {
+		chunks = append(chunks, Chunk{Offset: offset, Length: int64(len(buf)), Sum: sha256.Sum256(buf)})
+		offset += int64(len(buf))
+		buf = buf[:0]
+		h = 0
+	}
+
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		n := len(buf)
+		buf = append(buf, b)
+		h = bits.RotateLeft64(h, 1) ^ buzTable[b]
+		if n >= cdcWindow {
+			h ^= bits.RotateLeft64(buzTable[buf[n-cdcWindow]], cdcWindow)
+		}
+		if l := len(buf); (l >= p.Min && h&mask == 0) || l >= p.Max {
+			emit()
+		}
+	}
+	if len(buf) > 0 {
+		emit()
+	}
+	return chunks, nil
+}
+
+// chunkFile splits the file at path into content-defined chunks.
+func chunkFile(path string, p CDCParams) ([]Chunk, error) {
+	f, err := openNoATime(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return chunkReader(f, p)
+}
+
+// chunkLoc records where a chunk's content was first seen.
+type chunkLoc struct {
+	path   string
+	offset int64
+}
+
+// alignedRange shrinks the matching region [dstOff, dstOff+length) inward to
+// block boundaries. Range dedup requires block-aligned offsets on both files,
+// so a match is only usable when the source and destination offsets are
+// congruent modulo the block size. It returns ok=false when nothing usable
+// remains.
+func alignedRange(srcOff, dstOff, length, blockSize int64) (alignedSrc, alignedDst, alignedLen int64, ok bool) {
+	if (dstOff-srcOff)%blockSize != 0 {
+		return 0, 0, 0, false
+	}
+	start := (dstOff + blockSize - 1) / blockSize * blockSize
+	end := (dstOff + length) / blockSize * blockSize
+	if end <= start {
+		return 0, 0, 0, false
+	}
+	return srcOff + (start - dstOff), start, end - start, true
+}
+
+// ProcessCDC deduplicates matching content-defined chunks across files using
+// range dedup (FIDEDUPERANGE), which has the kernel verify that both ranges
+// are identical before sharing them. The first file containing a chunk is
+// its reference; later occurrences are deduped against it.
+//
+// Only chunks whose offsets are congruent modulo blockSize can be shared, so
+// insertions that are a multiple of the block size (inserted pages in VM
+// images or database files) realign fully, while odd-sized insertions leave
+// subsequent data unshareable at block granularity.
+func ProcessCDC(paths []string, p CDCParams, blockSize int64, dryRun bool, onProgress func(current int)) *DedupStats {
+	stats := &DedupStats{}
+	index := make(map[[sha256.Size]byte]chunkLoc)
+
+	for i, path := range paths {
+		if onProgress != nil {
+			onProgress(i + 1)
+		}
+		chunks, err := chunkFile(path, p)
+		if err != nil {
+			slog.Debug("cannot chunk file", "path", path, "error", err)
+			stats.Errors++
+			continue
+		}
+
+		// Coalesce consecutive matching chunks whose sources are also
+		// consecutive, so alignment trims only the ends of each run.
+		var fileSaved int64
+		var run chunkRun
+		flush := func() {
+			if run.length == 0 {
+				return
+			}
+			fileSaved += dedupeRun(run, path, blockSize, dryRun, stats)
+			run = chunkRun{}
+		}
+		for _, c := range chunks {
+			loc, ok := index[c.Sum]
+			if !ok {
+				index[c.Sum] = chunkLoc{path: path, offset: c.Offset}
+				flush()
+				continue
+			}
+			if loc.path == path {
+				flush()
+				continue
+			}
+			if run.length > 0 && loc.path == run.src && loc.offset == run.srcOff+run.length && c.Offset == run.dstOff+run.length {
+				run.length += c.Length
+				continue
+			}
+			flush()
+			run = chunkRun{src: loc.path, srcOff: loc.offset, dstOff: c.Offset, length: c.Length}
+		}
+		flush()
+
+		if fileSaved > 0 {
+			if dryRun {
+				fmt.Printf("[dry-run] cdc: %s (%s shareable)\n", path, formatSize(fileSaved, false))
+			}
+			stats.FilesDeduped++
+			stats.BytesSaved += fileSaved
+		}
+	}
+	return stats
+}
+
+// maxDedupeLen bounds a single range dedup call; btrfs silently truncates
+// longer requests.
+const maxDedupeLen = 16 << 20
+
+// dedupeBatchMax bounds the destinations in a single range dedup call. The
+// kernel rejects requests whose argument does not fit in one 4 KiB page:
+// a 24-byte header plus 32 bytes per destination.
+const dedupeBatchMax = 120
+
+// chunkRun is a contiguous region of a file matching a contiguous region of
+// an earlier file.
+type chunkRun struct {
+	src    string
+	srcOff int64
+	dstOff int64
+	length int64
+}
+
+// dedupeRun block-aligns a matching run and dedups it against its source in
+// pieces of at most maxDedupeLen, returning the bytes shared (or shareable in
+// dry-run mode).
+func dedupeRun(run chunkRun, dst string, blockSize int64, dryRun bool, stats *DedupStats) int64 {
+	srcOff, dstOff, length, ok := alignedRange(run.srcOff, run.dstOff, run.length, blockSize)
+	if !ok {
+		return 0
+	}
+	if dryRun {
+		return length
+	}
+	var saved int64
+	for done := int64(0); done < length; {
+		n := min(length-done, maxDedupeLen)
+		deduped, err := dedupeRange(run.src, srcOff+done, dst, dstOff+done, n)
+		if err != nil {
+			slog.Debug("range dedup failed", "src", run.src, "dst", dst, "offset", dstOff+done, "length", n, "error", err)
+			stats.Errors++
+			return saved
+		}
+		saved += deduped
+		done += n
+	}
+	return saved
+}
+
+// runCDC walks root for the files walk selects and deduplicates matching
+// chunks across them, showing progress on stderr.
+func runCDC(root string, walk WalkOptions, p CDCParams, dryRun bool) (*DedupStats, error) {
+	var paths []string
+	err := walkRandom(root, walk, nil, func(path string, _ int64) {
+		paths = append(paths, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	finishLine(fmt.Sprintf("  Found %s files for chunking", formatCount(int64(len(paths)))))
+
+	start := time.Now()
+	tick := newProgressTicker(progressEvery)
+	stats := ProcessCDC(paths, p, fsBlockSize(root), dryRun, func(current int) {
+		if tick.Due() || current == len(paths) {
+			eta := formatETA(time.Since(start), int64(current), int64(len(paths)))
+			printProgressBar("  Chunking:", int64(current), int64(len(paths)), eta)
+		}
+	})
+	tick.Stop()
+	finishLine(fmt.Sprintf("  Chunked %s files", formatCount(int64(len(paths)))))
+	return stats, nil
+}
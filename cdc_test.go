@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand/v2"
+	"os"
+	"testing"
+	"time"
+)
+
+var testCDCParams = CDCParams{Min: 2048, Avg: 8192, Max: 32768}
+
+func randomData(seed uint64, n int) []byte {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	return data
+}
+
+func TestCDCParamsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       CDCParams
+		wantErr bool
+	}{
+		{"valid", CDCParams{Min: 16384, Avg: 65536, Max: 262144}, false},
+		{"min below window", CDCParams{Min: 16, Avg: 64, Max: 128}, true},
+		{"avg below min", CDCParams{Min: 8192, Avg: 4096, Max: 65536}, true},
+		{"max below avg", CDCParams{Min: 1024, Avg: 8192, Max: 4096}, true},
+		{"avg not power of two", CDCParams{Min: 1024, Avg: 5000, Max: 65536}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	data := randomData(1, 1<<20)
+	chunks, err := chunkReader(bytes.NewReader(data), testCDCParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("covers input contiguously", func(t *testing.T) {
+		var off int64
+		for i, c := range chunks {
+			if c.Offset != off {
+				t.Fatalf("chunk %d offset = %d, want %d", i, c.Offset, off)
+			}
+			if c.Sum != sha256.Sum256(data[c.Offset:c.Offset+c.Length]) {
+				t.Fatalf("chunk %d checksum mismatch", i)
+			}
+			off += c.Length
+		}
+		if off != int64(len(data)) {
+			t.Errorf("chunks cover %d bytes, want %d", off, len(data))
+		}
+	})
+
+	t.Run("respects size limits", func(t *testing.T) {
+		for i, c := range chunks {
+			last := i == len(chunks)-1
+			if c.Length > int64(testCDCParams.Max) || (!last && c.Length < int64(testCDCParams.Min)) {
+				t.Errorf("chunk %d length %d outside [%d, %d]", i, c.Length, testCDCParams.Min, testCDCParams.Max)
+			}
+		}
+	})
+
+	t.Run("average near target", func(t *testing.T) {
+		avg := len(data) / len(chunks)
+		if avg < testCDCParams.Avg/2 || avg > testCDCParams.Avg*3 {
+			t.Errorf("average chunk size %d far from target %d", avg, testCDCParams.Avg)
+		}
+	})
+
+	t.Run("empty input", func(t *testing.T) {
+		got, err := chunkReader(bytes.NewReader(nil), testCDCParams)
+		if err != nil || len(got) != 0 {
+			t.Errorf("empty input: got %d chunks, err %v", len(got), err)
+		}
+	})
+}
+
+func TestChunkReaderShiftedContent(t *testing.T) {
+	base := randomData(2, 1<<20)
+	for _, shift := range []int{1, 17, 4096} {
+		// Insert shift bytes near the start; everything after moves.
+		shifted := append(append(append([]byte{}, base[:1000]...), randomData(3, shift)...), base[1000:]...)
+
+		a, err := chunkReader(bytes.NewReader(base), testCDCParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := chunkReader(bytes.NewReader(shifted), testCDCParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[[sha256.Size]byte]bool)
+		for _, c := range a {
+			seen[c.Sum] = true
+		}
+		shared := 0
+		for _, c := range b {
+			if seen[c.Sum] {
+				shared++
+			}
+		}
+		// Only the chunk(s) around the insertion should change.
+		if shared < len(a)-3 {
+			t.Errorf("shift %d: only %d of %d chunks survived the insertion", shift, shared, len(a))
+		}
+	}
+}
+
+func TestAlignedRange(t *testing.T) {
+	tests := []struct {
+		name                    string
+		srcOff, dstOff, length  int64
+		wantSrc, wantDst, wantN int64
+		wantOK                  bool
+	}{
+		{"already aligned", 4096, 8192, 8192, 4096, 8192, 8192, true},
+		{"shrinks both ends", 4000, 8096, 10000, 4096, 8192, 8192, true},
+		{"incongruent offsets", 0, 1, 100000, 0, 0, 0, false},
+		{"too short after alignment", 100, 100, 4000, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, d, n, ok := alignedRange(tt.srcOff, tt.dstOff, tt.length, 4096)
+			if ok != tt.wantOK || s != tt.wantSrc || d != tt.wantDst || n != tt.wantN {
+				t.Errorf("alignedRange = (%d, %d, %d, %v), want (%d, %d, %d, %v)",
+					s, d, n, ok, tt.wantSrc, tt.wantDst, tt.wantN, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestProcessCDCDryRun(t *testing.T) {
+	discardStdout(t)
+
+	base := randomData(4, 1<<20)
+	dir := t.TempDir()
+	orig := createTempFile(t, dir, "v1.bak", base)
+
+	t.Run("block-aligned insertion is shareable", func(t *testing.T) {
+		shifted := append(append(append([]byte{}, base[:8192]...), randomData(5, 4096)...), base[8192:]...)
+		v2 := createTempFile(t, dir, "v2.bak", shifted)
+		stats := ProcessCDC([]string{orig, v2}, testCDCParams, 4096, true, nil)
+		if stats.FilesDeduped != 1 {
+			t.Errorf("FilesDeduped = %d, want 1", stats.FilesDeduped)
+		}
+		if stats.BytesSaved < int64(len(base))*3/4 {
+			t.Errorf("BytesSaved = %d, want most of %d", stats.BytesSaved, len(base))
+		}
+	})
+
+	t.Run("odd insertion cannot be block-aligned", func(t *testing.T) {
+		shifted := append(append(append([]byte{}, base[:8192]...), 0x42), base[8192:]...)
+		v3 := createTempFile(t, dir, "v3.bak", shifted)
+		stats := ProcessCDC([]string{orig, v3}, testCDCParams, 4096, true, nil)
+		// Only chunks before the insertion keep their alignment.
+		if stats.BytesSaved > 16384 {
+			t.Errorf("BytesSaved = %d, expected only the unshifted prefix", stats.BytesSaved)
+		}
+	})
+
+	t.Run("unrelated files", func(t *testing.T) {
+		other := createTempFile(t, dir, "other.bak", randomData(6, 1<<20))
+		stats := ProcessCDC([]string{orig, other}, testCDCParams, 4096, true, nil)
+		if stats.FilesDeduped != 0 || stats.BytesSaved != 0 {
+			t.Errorf("unrelated files should share nothing, got %+v", stats)
+		}
+	})
+
+	t.Run("chunking keeps access times", func(t *testing.T) {
+		p := createTempFile(t, dir, "atime.bak", base)
+		// Old enough that even relatime would update it on a read.
+		atime := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(p, atime, atime.Add(-24*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if at, err := fileAtime(p); err != nil || !at.Equal(atime) {
+			t.Skipf("atime not available: %v", err)
+		}
+		if _, err := chunkFile(p, testCDCParams); err != nil {
+			t.Fatal(err)
+		}
+		if at, _ := fileAtime(p); !at.Equal(atime) {
+			t.Errorf("chunkFile changed atime to %v", at)
+		}
+	})
+
+	t.Run("missing file counts error", func(t *testing.T) {
+		stats := ProcessCDC([]string{orig, "/nonexistent"}, testCDCParams, 4096, true, nil)
+		if stats.Errors != 1 {
+			t.Errorf("Errors = %d, want 1", stats.Errors)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// parseChangedSince parses a --changed-since marker: an RFC 3339 time, a
+// local "2006-01-02 15:04:05" or "2006-01-02", or a duration such as 36h
+// meaning that long before now.
+func parseChangedSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("negative duration %q", s)
+		}
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time (RFC 3339, %q or %q) or a duration", s, time.DateTime, time.DateOnly)
+}
+
+// splitByMtime reorders paths so files last modified before since come
+// first, keeping walk order otherwise, and returns the set of those older
+// files. Files that cannot be stat'ed count as changed.
+func splitByMtime(paths []string, since time.Time) ([]string, map[string]bool) {
+	older := make(map[string]bool)
+	for _, p := range paths {
+		if info, err := os.Lstat(p); err == nil && info.ModTime().Before(since) {
+			older[p] = true
+		}
+	}
+	return olderFirst(paths, older), older
+}
+
+// olderFirst returns a copy of paths with those in older first, keeping
+// walk order otherwise.
+func olderFirst(paths []string, older map[string]bool) []string {
+	sorted := slices.Clone(paths)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		switch {
+		case older[a] == older[b]:
+			return 0
+		case older[a]:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return sorted
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseChangedSince(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"24h", now.Add(-24 * time.Hour)},
+		{"2024-06-01T08:30:00Z", time.Date(2024, 6, 1, 8, 30, 0, 0, time.UTC)},
+		{"2024-06-01", time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-06-01 08:30:00", time.Date(2024, 6, 1, 8, 30, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		got, err := parseChangedSince(tt.in, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseChangedSince(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "yesterday", "-1h", "2024-13-01"} {
+		if _, err := parseChangedSince(bad, now); err == nil {
+			t.Errorf("parseChangedSince(%q): expected error", bad)
+		}
+	}
+}
+
+func TestProcessSizeGroupChangedSince(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("content shared across runs")
+	marker := time.Now().Add(-time.Hour)
+	age := func(path string, d time.Duration) {
+		mt := marker.Add(d)
+		if err := os.Chtimes(path, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Walk order puts the changed file first; the old ones must still be
+	// the refs and stay untouched.
+	changed := createTempFile(t, dir, "changed", content)
+	old1 := createTempFile(t, dir, "old1", content)
+	old2 := createTempFile(t, dir, "old2", content)
+	age(changed, time.Minute)
+	age(old1, -time.Minute)
+	age(old2, -2*time.Minute)
+	before1, _ := os.Stat(old1)
+	before2, _ := os.Stat(old2)
+
+	opts := DedupOptions{Hardlink: true, ChangedSince: marker}
+	stats := ProcessSizeGroup([]string{changed, old1, old2}, int64(len(content)), opts, nil)
+	if stats.FilesDeduped != 1 || stats.Errors != 0 {
+		t.Fatalf("got %d deduped, %d errors; want 1, 0", stats.FilesDeduped, stats.Errors)
+	}
+	after1, _ := os.Stat(old1)
+	after2, _ := os.Stat(old2)
+	infoChanged, _ := os.Stat(changed)
+	if !os.SameFile(before1, after1) || !os.SameFile(before2, after2) {
+		t.Error("an unchanged file was replaced")
+	}
+	if !os.SameFile(infoChanged, after1) {
+		t.Error("changed file was not linked to the first old ref")
+	}
+
+	// Only old files: nothing to do, nothing read.
+	stats = ProcessSizeGroup([]string{old1, old2}, int64(len(content)), opts, nil)
+	if stats.FilesScanned != 0 || stats.FilesDeduped != 0 {
+		t.Errorf("group without changed files: scanned %d, deduped %d; want 0, 0", stats.FilesScanned, stats.FilesDeduped)
+	}
+}
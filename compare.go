@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// parallelCompareMin is the number of refs a file must still be compared
+// against before DedupOptions.CompareWorkers spreads the comparisons out.
+// Below it, starting goroutines costs more than most groups gain.
+const parallelCompareMin = 32
+
+// compareResult is the outcome of comparing a file with one ref.
+type compareResult struct {
+	done  bool // false if the comparison was not needed
+	equal bool
+	err   error
+}
+
+// refComparisons holds the results of compareRefs for refs[base:]. A nil
+// *refComparisons holds none.
+type refComparisons struct {
+	base    int
+	results []compareResult
+}
+
+// get returns the result for refs[i], if it was computed.
+func (c *refComparisons) get(i int) (compareResult, bool) {
+	if c == nil || i < c.base || i-c.base >= len(c.results) {
+		return compareResult{}, false
+	}
+	r := c.results[i-c.base]
+	return r, r.done
+}
+
+// compareRefs compares path with refs[base:] on up to workers goroutines,
+// each comparison bounded by timeout. Refs are handed out in order, and
+// none after the first equal one is compared: the caller stops at a match
+// unless deduping against it fails, and then compares the rest itself.
+//
+// The refs are a snapshot: ProcessSizeGroup only adds refs and rewrites
+// ref paths between files, never while compareRefs runs.
+func compareRefs(refs []*fileRef, base int, path string, workers int, timeout time.Duration) *refComparisons {
+	refs = refs[base:]
+	c := &refComparisons{base: base, results: make([]compareResult, len(refs))}
+	var next atomic.Int64
+	var firstMatch atomic.Int64
+	firstMatch.Store(int64(len(refs)))
+	var wg sync.WaitGroup
+	for range min(workers, len(refs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(len(refs)) || i > firstMatch.Load() {
+					return
+				}
+				ref := refs[i]
+				equal, err := withTimeout(timeout, func() (bool, error) { return filesEqual(ref.path, path) })
+				c.results[i] = compareResult{done: true, equal: equal, err: err}
+				if equal && err == nil {
+					for {
+						m := firstMatch.Load()
+						if i >= m || firstMatch.CompareAndSwap(m, i) {
+							break
+						}
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return c
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCompareRefs(t *testing.T) {
+	dir := t.TempDir()
+	var refs []*fileRef
+	for i := range 40 {
+		content := fmt.Sprintf("content %02d", i)
+		if i == 35 {
+			content = "content 20" // a second match, never reached
+		}
+		refs = append(refs, &fileRef{path: createTempFile(t, dir, fmt.Sprintf("ref%02d", i), []byte(content))})
+	}
+	path := createTempFile(t, dir, "file", []byte("content 20"))
+
+	c := compareRefs(refs, 4, path, 8, 0)
+	for i := range 4 {
+		if _, ok := c.get(i); ok {
+			t.Errorf("ref %d before base was compared", i)
+		}
+	}
+	for i := 4; i < 20; i++ {
+		if r, ok := c.get(i); !ok || r.equal || r.err != nil {
+			t.Errorf("ref %d: %+v, %v; want compared and different", i, r, ok)
+		}
+	}
+	if r, ok := c.get(20); !ok || !r.equal || r.err != nil {
+		t.Errorf("ref 20: %+v, %v; want compared and equal", r, ok)
+	}
+	if _, ok := c.get(40); ok {
+		t.Error("result beyond the refs")
+	}
+
+	var none *refComparisons
+	if _, ok := none.get(0); ok {
+		t.Error("nil comparisons returned a result")
+	}
+}
+
+func TestProcessSizeGroupCompareWorkers(t *testing.T) {
+	discardStdout(t)
+
+	// Many distinct contents, then one copy of each of a few of them, so
+	// later files face a long ref list.
+	dir := t.TempDir()
+	var paths []string
+	for i := range 2 * parallelCompareMin {
+		paths = append(paths, createTempFile(t, dir, fmt.Sprintf("u%02d", i), []byte(fmt.Sprintf("distinct %03d", i))))
+	}
+	for _, i := range []int{0, 7, 2*parallelCompareMin - 1} {
+		paths = append(paths, createTempFile(t, dir, fmt.Sprintf("d%02d", i), []byte(fmt.Sprintf("distinct %03d", i))))
+	}
+
+	want := ProcessSizeGroup(paths, 12, DedupOptions{DryRun: true}, nil)
+	got := ProcessSizeGroup(paths, 12, DedupOptions{DryRun: true, CompareWorkers: 8}, nil)
+	if got.FilesDeduped != 3 || got.UniqueContents != want.UniqueContents || got.FilesDeduped != want.FilesDeduped {
+		t.Errorf("with workers: %d deduped, %d unique; sequential: %d, %d; want 3 deduped",
+			got.FilesDeduped, got.UniqueContents, want.FilesDeduped, want.UniqueContents)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// applyConfig reads a key=value config file and applies each entry to the
+// matching flag in fs. Keys are flag names (underscores may be used in place
+// of dashes), and the special key "root" sets the directory to process.
+// Flags already set on the command line take precedence over the file.
+// Blank lines and lines starting with '#' are ignored; values may be quoted.
+// Repeating a key applies each value in turn.
+func applyConfig(fs *flag.FlagSet, path string) (root string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		explicit[fl.Name] = true
+	})
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return "", fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		value = unquote(strings.TrimSpace(value))
+		if key == "" {
+			return "", fmt.Errorf("%s:%d: missing key", path, lineNum)
+		}
+
+		if key == "root" {
+			root = value
+			continue
+		}
+		if key == "config" {
+			return "", fmt.Errorf("%s:%d: config files cannot include other config files", path, lineNum)
+		}
+		if fs.Lookup(key) == nil {
+			return "", fmt.Errorf("%s:%d: unknown key %q", path, lineNum, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return "", fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, lineNum, value, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return root, nil
+}
+
+// unquote strips one pair of matching single or double quotes.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFlags returns a flag set with a few representative flag types.
+func newTestFlags() (*flag.FlagSet, *int64, *int, *bool, *time.Duration) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	minSize := fs.Int64("min-size", 524288, "")
+	top := fs.Int("top", 10_000, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	maxTime := fs.Duration("max-time", 0, "")
+	fs.String("config", "", "")
+	return fs, minSize, top, dryRun, maxTime
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	return createTempFile(t, t.TempDir(), "fastdedup.conf", []byte(content))
+}
+
+func TestApplyConfig(t *testing.T) {
+	t.Run("sets values", func(t *testing.T) {
+		fs, minSize, top, dryRun, maxTime := newTestFlags()
+		if err := fs.Parse(nil); err != nil {
+			t.Fatal(err)
+		}
+		cfg := writeConfig(t, `# nightly job
+root = "/srv/backups"
+min_size = 1048576
+top=500
+
+dry-run = true
+max-time = '2h'
+`)
+		root, err := applyConfig(fs, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != "/srv/backups" {
+			t.Errorf("root = %q, want /srv/backups", root)
+		}
+		if *minSize != 1048576 || *top != 500 || !*dryRun || *maxTime != 2*time.Hour {
+			t.Errorf("got min-size=%d top=%d dry-run=%v max-time=%v", *minSize, *top, *dryRun, *maxTime)
+		}
+	})
+
+	t.Run("command line overrides file", func(t *testing.T) {
+		fs, minSize, top, _, _ := newTestFlags()
+		if err := fs.Parse([]string{"-top", "42"}); err != nil {
+			t.Fatal(err)
+		}
+		cfg := writeConfig(t, "top = 500\nmin-size = 0\n")
+		if _, err := applyConfig(fs, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if *top != 42 {
+			t.Errorf("top = %d, want command-line value 42", *top)
+		}
+		if *minSize != 0 {
+			t.Errorf("min-size = %d, want file value 0", *minSize)
+		}
+	})
+
+	t.Run("no root key", func(t *testing.T) {
+		fs, _, _, _, _ := newTestFlags()
+		root, err := applyConfig(fs, writeConfig(t, "top = 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != "" {
+			t.Errorf("root = %q, want empty", root)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		fs, _, _, _, _ := newTestFlags()
+		if _, err := applyConfig(fs, filepath.Join(t.TempDir(), "nope.conf")); err == nil {
+			t.Error("expected error for missing file")
+		}
+	})
+}
+
+func TestApplyConfigMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown key", "colour = blue\n", `:1: unknown key "colour"`},
+		{"missing equals", "# ok\ntop 500\n", ":2: expected key = value"},
+		{"missing key", "= 5\n", ":1: missing key"},
+		{"int type mismatch", "top = lots\n", `:1: invalid value "lots" for top`},
+		{"bool type mismatch", "dry-run = perhaps\n", `invalid value "perhaps" for dry-run`},
+		{"duration type mismatch", "max-time = 2 hours\n", "for max-time"},
+		{"nested config", "config = other.conf\n", "cannot include"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, _, _, _, _ := newTestFlags()
+			_, err := applyConfig(fs, writeConfig(t, tt.content))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %q should contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// LiveStats holds progress counters that are safe to read while a run is in
+// progress. All fields are updated atomically so the debug endpoint can poll
+// them from another goroutine.
+type LiveStats struct {
+	phase          atomic.Value // string
+	FilesScanned   atomic.Int64
+	FilesProcessed atomic.Int64
+	GroupsDone     atomic.Int64
+	GroupsTotal    atomic.Int64
+	BytesSaved     atomic.Int64
+	FilesDeduped   atomic.Int64
+	AlreadyDeduped atomic.Int64
+	Errors         atomic.Int64
+
+	// I/O profile, counted where the calls are made: FIEMAP and FICLONE
+	// ioctls, content bytes compared by filesEqual, and files opened to
+	// read extents, compare content or clone.
+	FIEMAPCalls   atomic.Int64
+	FICLONECalls  atomic.Int64
+	BytesCompared atomic.Int64
+	FilesOpened   atomic.Int64
+}
+
+// live is the process-wide progress state published by the debug endpoint.
+var live = &LiveStats{}
+
+// liveSnapshot is a point-in-time copy of LiveStats for JSON encoding.
+type liveSnapshot struct {
+	Phase          string `json:"phase"`
+	FilesScanned   int64  `json:"files_scanned"`
+	FilesProcessed int64  `json:"files_processed"`
+	GroupsDone     int64  `json:"groups_done"`
+	GroupsTotal    int64  `json:"groups_total"`
+	BytesSaved     int64  `json:"bytes_saved"`
+	FilesDeduped   int64  `json:"files_deduped"`
+	AlreadyDeduped int64  `json:"already_deduped"`
+	Errors         int64  `json:"errors"`
+	FIEMAPCalls    int64  `json:"fiemap_calls"`
+	FICLONECalls   int64  `json:"ficlone_calls"`
+	BytesCompared  int64  `json:"bytes_compared"`
+	FilesOpened    int64  `json:"files_opened"`
+}
+
+// SetPhase records the current phase of the run (e.g. "scan", "dedup", "done").
+func (l *LiveStats) SetPhase(phase string) {
+	l.phase.Store(phase)
+}
+
+// AddGroup accumulates the results of one processed size group.
+func (l *LiveStats) AddGroup(stats *DedupStats) {
+	l.GroupsDone.Add(1)
+	l.BytesSaved.Add(stats.BytesSaved)
+	l.FilesDeduped.Add(stats.FilesDeduped)
+	l.AlreadyDeduped.Add(stats.AlreadyDeduped)
+	l.Errors.Add(stats.Errors)
+}
+
+// Snapshot returns a consistent-enough copy of the counters for reporting.
+func (l *LiveStats) Snapshot() liveSnapshot {
+	phase, _ := l.phase.Load().(string)
+	return liveSnapshot{
+		Phase:          phase,
+		FilesScanned:   l.FilesScanned.Load(),
+		FilesProcessed: l.FilesProcessed.Load(),
+		GroupsDone:     l.GroupsDone.Load(),
+		GroupsTotal:    l.GroupsTotal.Load(),
+		BytesSaved:     l.BytesSaved.Load(),
+		FilesDeduped:   l.FilesDeduped.Load(),
+		AlreadyDeduped: l.AlreadyDeduped.Load(),
+		Errors:         l.Errors.Load(),
+		FIEMAPCalls:    l.FIEMAPCalls.Load(),
+		FICLONECalls:   l.FICLONECalls.Load(),
+		BytesCompared:  l.BytesCompared.Load(),
+		FilesOpened:    l.FilesOpened.Load(),
+	}
+}
+
+var publishOnce sync.Once
+
+// startDebugServer serves /debug/vars (expvar) and /stats (JSON snapshot of
+// the live counters) on addr. It returns the bound listener address, which
+// is useful when addr uses port 0.
+func startDebugServer(addr string) (string, error) {
+	publishOnce.Do(func() {
+		expvar.Publish("fastdedup", expvar.Func(func() any {
+			return live.Snapshot()
+		}))
+	})
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		//goland:noinspection GoUnhandledErrorResult
+		json.NewEncoder(w).Encode(live.Snapshot())
+	})
+
+	//goland:noinspection GoUnhandledErrorResult
+	go http.Serve(ln, mux)
+	return ln.Addr().String(), nil
+}
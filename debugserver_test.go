@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestLiveStatsAddGroup(t *testing.T) {
+	l := &LiveStats{}
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.AddGroup(&DedupStats{BytesSaved: 10, FilesDeduped: 2, AlreadyDeduped: 1, Errors: 1})
+		}()
+	}
+	wg.Wait()
+
+	s := l.Snapshot()
+	if s.GroupsDone != 50 || s.BytesSaved != 500 || s.FilesDeduped != 100 || s.AlreadyDeduped != 50 || s.Errors != 50 {
+		t.Errorf("unexpected snapshot after concurrent updates: %+v", s)
+	}
+}
+
+func TestDebugServer(t *testing.T) {
+	addr, err := startDebugServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a run in progress.
+	live.SetPhase("dedup")
+	live.FilesScanned.Store(1000)
+	live.GroupsTotal.Store(5)
+	live.AddGroup(&DedupStats{BytesSaved: 4096, FilesDeduped: 3})
+	t.Cleanup(func() { live = &LiveStats{} })
+
+	t.Run("stats endpoint", func(t *testing.T) {
+		resp, err := http.Get("http://" + addr + "/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		var s liveSnapshot
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Phase != "dedup" || s.FilesScanned != 1000 || s.GroupsTotal != 5 ||
+			s.GroupsDone != 1 || s.BytesSaved != 4096 || s.FilesDeduped != 3 {
+			t.Errorf("unexpected stats: %+v", s)
+		}
+	})
+
+	t.Run("expvar endpoint", func(t *testing.T) {
+		resp, err := http.Get("http://" + addr + "/debug/vars")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var vars map[string]json.RawMessage
+		if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+			t.Fatal(err)
+		}
+		var s liveSnapshot
+		if err := json.Unmarshal(vars["fastdedup"], &s); err != nil {
+			t.Fatalf("fastdedup var missing or invalid: %v", err)
+		}
+		if s.FilesDeduped != 3 {
+			t.Errorf("expvar files_deduped = %d, want 3", s.FilesDeduped)
+		}
+	})
+
+	t.Run("address in use", func(t *testing.T) {
+		if _, err := startDebugServer(addr); err == nil {
+			t.Error("expected error binding an address already in use")
+		}
+	})
+}
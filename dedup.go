@@ -2,59 +2,560 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 // Extent represents a contiguous physical region of a file on disk.
+// Physical offsets are only meaningful within one filesystem, so Device
+// records the st_dev of the file the extent was read from.
 type Extent struct {
-	Logical  uint64
-	Physical uint64
-	Length   uint64
-	Flags    uint32
+	Logical  uint64 `json:"logical"`
+	Physical uint64 `json:"physical"`
+	Length   uint64 `json:"length"`
+	Flags    uint32 `json:"flags"`
+	Device   uint64 `json:"device"`
 }
 
-// SameExtents reports whether two extent lists have identical physical mappings.
+// FIEMAP extent flags (linux/fiemap.h) as reported in Extent.Flags.
+const (
+	extentFlagUnknown   = 0x00000002 // location not known yet
+	extentFlagDelalloc  = 0x00000004 // delayed allocation, no blocks assigned yet
+	extentFlagEncoded   = 0x00000008 // data is compressed or otherwise encoded
+	extentFlagUnwritten = 0x00000800 // preallocated, reads as zeros
+	extentFlagShared    = 0x00002000 // space is shared with other files
+)
+
+// StorageInfo is how a file is laid out on disk, as returned by
+// FileStorageInfo.
+type StorageInfo struct {
+	Inode     uint64 `json:"inode"`
+	Nlink     uint64 `json:"nlink"`
+	Extents   int    `json:"extents"`
+	Allocated int64  `json:"allocated_bytes"` // total length of the extents
+	Shared    bool   `json:"shared"`          // any extent is shared with another file
+	SharedLen int64  `json:"shared_bytes"`    // length of the shared extents
+	Unwritten int64  `json:"unwritten_bytes"` // length of preallocated, unwritten extents
+}
+
+// compressedExtentMax is the largest extent btrfs writes for compressed data.
+const compressedExtentMax = 128 * 1024
+
+// uncompressedExtentMax is the largest extent btrfs writes for uncompressed data.
+const uncompressedExtentMax = 128 * 1024 * 1024
+
+// hasEncodedExtent reports whether any extent holds compressed or otherwise
+// encoded data.
+func hasEncodedExtent(extents []Extent) bool {
+	for _, e := range extents {
+		if e.Flags&extentFlagEncoded != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fragmentationRatio returns how many times more extents a file of the given
+// size has than the fewest it could be stored in: 1 for a contiguous file,
+// higher the more fragmented it is. Compressed data is measured against
+// compressedExtentMax, since btrfs never writes larger compressed extents.
+// An empty extent list (inline or sparse data) has ratio 0.
+func fragmentationRatio(extents []Extent, size int64) float64 {
+	if len(extents) == 0 {
+		return 0
+	}
+	extentMax := int64(uncompressedExtentMax)
+	if hasEncodedExtent(extents) {
+		extentMax = compressedExtentMax
+	}
+	fewest := max((size+extentMax-1)/extentMax, 1)
+	return float64(len(extents)) / float64(fewest)
+}
+
+// sharedFraction returns the fraction of a file's extent bytes flagged
+// FIEMAP_EXTENT_SHARED, or 0 for an empty extent list.
+func sharedFraction(extents []Extent) float64 {
+	shared, exclusive := sharedBytes(extents)
+	if shared+exclusive == 0 {
+		return 0
+	}
+	return float64(shared) / float64(shared+exclusive)
+}
+
+// sharedBytes splits the length of a file's extents into the bytes flagged
+// FIEMAP_EXTENT_SHARED, whose storage other files (or snapshots) also
+// reference, and the bytes only this file's inode owns.
+func sharedBytes(extents []Extent) (shared, exclusive uint64) {
+	for _, e := range extents {
+		if e.Flags&extentFlagShared != 0 {
+			shared += e.Length
+		} else {
+			exclusive += e.Length
+		}
+	}
+	return shared, exclusive
+}
+
+// preserveSharedMin is the sharedFraction above which DedupOptions.PreserveShared
+// leaves a file alone.
+const preserveSharedMin = 0.5
+
+// allShared reports whether every extent of a non-empty extent list is
+// flagged FIEMAP_EXTENT_SHARED.
+func allShared(extents []Extent) bool {
+	for _, e := range extents {
+		if e.Flags&extentFlagShared == 0 {
+			return false
+		}
+	}
+	return len(extents) > 0
+}
+
+// needsRefDefrag reports whether a file's extent map looks like compressed
+// data that is more fragmented than compression alone explains: more than
+// twice as many extents as its size needs at 128 KiB each.
+func needsRefDefrag(extents []Extent, size int64) bool {
+	return hasEncodedExtent(extents) && fragmentationRatio(extents, size) > 2
+}
+
+// verifySharedExtents checks that every extent of both files carries
+// FIEMAP_EXTENT_SHARED. After a successful reflink the filesystem must
+// account the blocks to both files, so an extent that is not flagged shared
+// means the clone did not take even if the physical offsets match.
+func verifySharedExtents(src, dst []Extent) error {
+	for _, side := range []struct {
+		name    string
+		extents []Extent
+	}{{"source", src}, {"destination", dst}} {
+		for _, e := range side.extents {
+			if e.Flags&extentFlagShared == 0 {
+				return fmt.Errorf("%s extent at offset %d not marked shared after reflink", side.name, e.Logical)
+			}
+		}
+	}
+	return nil
+}
+
+// SameExtents reports whether two extent lists have identical physical
+// mappings on the same device. btrfs gives every subvolume its own st_dev,
+// so reflinks across subvolumes are not recognized here and fall back to
+// content comparison.
 func SameExtents(a, b []Extent) bool {
 	if len(a) != len(b) {
 		return false
 	}
 	for i := range a {
-		if a[i].Physical != b[i].Physical || a[i].Length != b[i].Length {
+		if !sameMapping(a[i], b[i]) {
 			return false
 		}
 	}
 	return true
 }
 
+// sameMapping reports whether two extents map the same physical range on
+// the same device in the same state. An unwritten (preallocated) extent
+// reads as zeros whatever its blocks hold, so it only matches another
+// unwritten one: btrfs can map the same blocks as unwritten in one file
+// and written in another, and those files differ.
+func sameMapping(a, b Extent) bool {
+	return a.Device == b.Device && a.Physical == b.Physical && a.Length == b.Length &&
+		a.Flags&extentFlagUnwritten == b.Flags&extentFlagUnwritten
+}
+
 // DedupStats tracks deduplication results.
+// JSON field names match the slog keys and /stats output.
 type DedupStats struct {
-	BytesSaved     int64
-	FilesDeduped   int64
-	AlreadyDeduped int64
-	Errors         int64
-	ErrorDetails   []DedupError
+	BytesSaved     int64        `json:"bytes_saved"`
+	FilesDeduped   int64        `json:"files_deduped"`
+	AlreadyDeduped int64        `json:"already_deduped"`
+	Errors         int64        `json:"errors"`
+	ErrorDetails   []DedupError `json:"error_details,omitempty"`
+
+	// PermissionDenied counts files skipped because they could not be read.
+	PermissionDenied int64 `json:"permission_denied"`
+	// NoCOW counts files skipped because they have the NOCOW attribute and
+	// cannot be reflinked.
+	NoCOW int64 `json:"nocow_skipped"`
+	// Unfragmented counts files left alone because their fragmentation
+	// ratio was below DedupOptions.MinFragmentation.
+	Unfragmented int64 `json:"unfragmented_skipped"`
+	// TimedOut counts files skipped because reading their extents or
+	// content took longer than DedupOptions.FileTimeout.
+	TimedOut int64 `json:"timed_out"`
+	// ReadErrors lists files whose content failed to read partway through
+	// a comparison (EIO and the like), which usually means failing media.
+	// They are skipped, and a ref that fails is not compared again.
+	ReadErrors []string `json:"read_errors,omitempty"`
+	// SharedSkipped counts files left alone because DedupOptions.PreserveShared
+	// was set and most of their extents were already shared.
+	SharedSkipped int64 `json:"shared_skipped"`
+	// FullyShared counts files skipped without any comparison because
+	// DedupOptions.SkipShared was set and all their extents were shared.
+	FullyShared int64 `json:"fully_shared_skipped"`
+	// HookSkipped counts files left alone because the pre-dedup hook
+	// (DedupOptions.Hooks) failed for them.
+	HookSkipped int64 `json:"hook_skipped"`
+	// Protected counts files left alone because DedupOptions.SkipProtected
+	// was set and they had other hard links or the immutable or
+	// append-only attribute. They can still be refs.
+	Protected int64 `json:"protected_skipped"`
+	// ChangedSkipped counts files left alone because DedupOptions.Recheck
+	// found them or their ref changed between comparison and replacement.
+	ChangedSkipped int64 `json:"changed_skipped"`
+	// FilesScanned and BytesScanned cover every file the group examined,
+	// whatever became of it; they are the base for DedupRatio.
+	FilesScanned int64 `json:"files_scanned"`
+	BytesScanned int64 `json:"bytes_scanned"`
+	// UniqueContents counts scanned files whose content matched no earlier
+	// file. Skipped files are not counted, since their content is unknown.
+	UniqueContents int64 `json:"unique_contents"`
+	// Fatal is set when processing stopped early: at the first permission
+	// error because DedupOptions.PermissionFatal was set, or with
+	// errTooManyErrors once Errors exceeded DedupOptions.MaxErrors.
+	Fatal error `json:"-"`
+}
+
+// String summarizes the stats on one line with human-readable sizes.
+func (s *DedupStats) String() string {
+	return fmt.Sprintf("%s deduped, %s saved, %s already, %s errors",
+		formatCount(s.FilesDeduped), formatSize(s.BytesSaved, false),
+		formatCount(s.AlreadyDeduped), formatCount(s.Errors))
+}
+
+// DedupRatio returns BytesSaved as a fraction of BytesScanned, or 0 when
+// nothing was scanned.
+func (s *DedupStats) DedupRatio() float64 {
+	if s.BytesScanned == 0 {
+		return 0
+	}
+	return float64(s.BytesSaved) / float64(s.BytesScanned)
+}
+
+// UniqueRatio returns UniqueContents as a fraction of FilesScanned, or 0
+// when nothing was scanned. 1 means every file was distinct.
+func (s *DedupStats) UniqueRatio() float64 {
+	if s.FilesScanned == 0 {
+		return 0
+	}
+	return float64(s.UniqueContents) / float64(s.FilesScanned)
+}
+
+// ConvergedRatio returns the fraction of duplicates found that already
+// shared storage with their reference, or 0 when there were none. Near 1,
+// earlier runs left little to do and this one mostly confirmed their work.
+func (s *DedupStats) ConvergedRatio() float64 {
+	dups := s.AlreadyDeduped + s.FilesDeduped
+	if dups == 0 {
+		return 0
+	}
+	return float64(s.AlreadyDeduped) / float64(dups)
+}
+
+// convergedHintMin is the ConvergedRatio from which the summary suggests
+// running less often.
+const convergedHintMin = 0.95
+
+// DedupOptions controls how ProcessSizeGroup handles the files it compares.
+type DedupOptions struct {
+	DryRun       bool         // report what would be deduped without making changes
+	RawSizes     bool         // print raw byte counts instead of human-readable sizes
+	Hardlink     bool         // replace duplicates with hard links instead of reflinks
+	FixPerms     bool         // temporarily make read-only directories writable
+	DefragRefs   bool         // defragment fragmented compressed references before reflinking (btrfs)
+	VerifyShared bool         // also require FIEMAP_EXTENT_SHARED on both files after reflinking
+	Log          *DedupLog    // per-file dedup log; nil logs nothing
+	Script       *DedupScript // with DryRun, script of equivalent cp --reflink commands; nil writes nothing
+
+	PermissionFatal bool   // stop at the first unreadable file instead of skipping it
+	RefStrategy     string // which copy becomes the reference: refFirst (default), refAtime or refInode
+	MaxErrors       int64  // stop once Errors exceeds this; 0 means unlimited
+
+	// MinFragmentation, if positive, leaves files whose fragmentationRatio
+	// is below it in place; they can still be the reference of their group.
+	MinFragmentation float64
+
+	// FragPrefix, if positive, estimates the fragmentation of files larger
+	// than it from the extents of their first FragPrefix bytes, so files
+	// the estimate leaves below MinFragmentation are skipped without
+	// mapping them whole. Files that pass are still mapped in full.
+	FragPrefix int64
+
+	// NameKey, if set, further splits a size group: files are only compared
+	// with files that have the same key (see nameKeyFunc).
+	NameKey func(path string) string
+
+	// MatchMagic further splits a size group by the first magicLen bytes
+	// of each file, so files are only compared with files of the same type
+	// signature. Identical files always share them: this cannot change
+	// what is deduped, only skip comparing files that cannot match.
+	MatchMagic bool
+
+	// PreferHardlink hard-links duplicates whose mode, owner, and mtime
+	// match the reference instead of reflinking them, saving the inode too.
+	PreferHardlink bool
+
+	// Events, if set, receives a dedup or error event per file acted on.
+	// When it writes to stdout, dry-run lines are not printed there.
+	Events *EventLog
+
+	// Manifest, if set, supplies canonical copies by content hash; files of
+	// a size it lists are hashed and deduped against their canonical copy.
+	Manifest *Manifest
+
+	// PreserveShared leaves files alone when most of their extents are
+	// already shared, typically with read-only snapshots: replacing them
+	// would unshare the snapshot copies and grow the snapshots. Such files
+	// still serve as refs for others. Needs FIEMAP.
+	PreserveShared bool
+
+	// SkipShared skips files whose extents are all shared before comparing
+	// them with anything: such files are almost always deduped or
+	// snapshotted already. They do not become refs, except the first file
+	// of a group, which is kept so that new copies still find one. Files
+	// with more than maxRefExtents extents are never skipped. Needs FIEMAP.
+	SkipShared bool
+
+	// BatchDedupe shares reflink duplicates with their ref in place by
+	// range dedup (FIDEDUPERANGE), queuing them and deduping up to
+	// dedupeBatchMax files per call when the group ends or a queue fills.
+	// The kernel verifies the content, and dst keeps its inode and metadata.
+	BatchDedupe bool
+
+	// Inflight, if set, is shared by concurrently processed groups to bound
+	// how many files are being replaced at once.
+	Inflight *InflightLimiter
+
+	// FileTimeout, if positive, abandons a FIEMAP call or content
+	// comparison that takes longer, skipping the file (see withTimeout).
+	FileTimeout time.Duration
+
+	// Groups, if set, receives each content group found: its reference and
+	// every path with that content, including ones already sharing storage.
+	Groups *GroupsManifest
+
+	// Hooks, if set, run before and after each file is replaced; a failed
+	// pre-hook skips the file.
+	Hooks *DedupHooks
+
+	// ChangedSince, if set, restricts replacement to files modified at or
+	// after it. Older files are only refs for the changed ones, and a group
+	// without changed files is skipped.
+	ChangedSince time.Time
+	// NormalizePaths makes the shortest of several paths to one ref's
+	// storage, which becomes the ref's path, be chosen by character count
+	// ignoring combining marks (see shorterPath), so NFC and NFD spellings
+	// of a name weigh the same and the choice does not depend on walk order.
+	NormalizePaths bool
+	// Processed, if set, holds files done by an earlier run. Like files
+	// unchanged since ChangedSince, they are only refs for the others, and
+	// a group made of them alone is skipped.
+	Processed *ProcessedSet
+	// CompareWorkers, above 1, compares a file against the refs of a group
+	// with many distinct contents on that many goroutines.
+	CompareWorkers int
+	// SkipProtected leaves files that have other hard links, which a
+	// replacement would split from them, or the immutable or append-only
+	// attribute alone. They can still be refs.
+	SkipProtected bool
+	// Recheck stats each file and its ref before comparing them and again
+	// before replacing the file, and skips it if either changed in between.
+	// It turns off parallel comparison, so each ref is stat'ed right
+	// before it is compared.
+	Recheck bool
+	// Txn, if set, stages each replacement instead of making it; see
+	// Transaction. Its files count as deduped once staged.
+	Txn *Transaction
+}
+
+// Reference strategies for DedupOptions.RefStrategy.
+const (
+	refFirst = "first"        // first file in walk order
+	refAtime = "atime"        // most recently accessed copy
+	refInode = "lowest-inode" // lowest inode number, usually the oldest file
+)
+
+// sortByAtime returns a copy of paths ordered newest access time first, so
+// the first file of each content group (its reference) is the hottest copy.
+// Files whose atime cannot be read sort last in their original order.
+func sortByAtime(paths []string) []string {
+	atimes := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		if at, err := fileAtime(p); err == nil {
+			atimes[p] = at
+		}
+	}
+	sorted := slices.Clone(paths)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		return atimes[b].Compare(atimes[a])
+	})
+	return sorted
+}
+
+// sortByInode returns a copy of paths ordered lowest inode number first.
+// Filesystems hand out inode numbers in increasing order, so the reference
+// is usually the original the other copies were made from, which snapshots
+// are most likely to share. Files that cannot be stat'ed sort last in
+// their original order.
+func sortByInode(paths []string) []string {
+	inodes := make(map[string]uint64, len(paths))
+	for _, p := range paths {
+		if ino, err := fileInode(p); err == nil {
+			inodes[p] = ino.ino
+		}
+	}
+	sorted := slices.Clone(paths)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		ia, okA := inodes[a]
+		ib, okB := inodes[b]
+		switch {
+		case okA != okB:
+			if okA {
+				return -1
+			}
+			return 1
+		case ia < ib:
+			return -1
+		case ia > ib:
+			return 1
+		}
+		return 0
+	})
+	return sorted
+}
+
+// inodeKey identifies a file independent of the path used to reach it.
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// maxRefExtents is the most extents kept in memory per file. Refs of
+// heavily fragmented files keep none and are compared by streaming both
+// extent maps from disk (extentsEqual).
+var maxRefExtents = 1 << 16
+
+// refKey partitions the refs of a size group: files are only compared with
+// refs on the same filesystem and, with DedupOptions.NameKey and
+// MatchMagic, with the same name key and leading bytes.
+type refKey struct {
+	fs    fsID
+	name  string
+	magic string
+}
+
+// magicLen is how many leading bytes of each file DedupOptions.MatchMagic
+// compares: enough for the signatures of common file formats.
+const magicLen = 16
+
+// fileMagic returns the first magicLen bytes of path, or fewer for short
+// files. Unreadable files get "", and fail later when compared.
+func fileMagic(path string) string {
+	f, err := openNoATime(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, magicLen)
+	n, _ := io.ReadFull(f, buf)
+	return string(buf[:n])
 }
 
 // fileRef is a reference file representing a unique content group within a size class.
 type fileRef struct {
-	path    string
-	extents []Extent
+	path      string
+	extents   []Extent
+	defragged bool // defragmentation already attempted (DefragRefs)
+	// manyExtents is set instead of extents for files with more than
+	// maxRefExtents; they are compared with extentsEqual.
+	manyExtents bool
+	ino         inodeKey // device and inode of path, if hasIno
+	hasIno      bool
+	group       *contentGroup // paths sharing this content, with DedupOptions.Groups
+	readFailed  bool          // reading its content failed; see DedupStats.ReadErrors
+}
+
+// shorterPath reports whether a should replace b as the path of a ref.
+// Normally that is when it has fewer bytes, so ties keep the path seen
+// first. With normalize, lengths are counted in characters other than
+// nonspacing combining marks, which NFD spells separately after their base
+// letter, so "é" counts once in either normalization form; ties go to
+// fewer bytes (NFC), then to the smaller string, making the order total.
+// Without Unicode tables, decompositions that yield no combining marks,
+// such as Hangul syllables, still count differently.
+func shorterPath(a, b string, normalize bool) bool {
+	if !normalize {
+		return len(a) < len(b)
+	}
+	if ca, cb := visibleLen(a), visibleLen(b); ca != cb {
+		return ca < cb
+	}
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// visibleLen counts the runes of s that are not nonspacing marks.
+func visibleLen(s string) int {
+	n := 0
+	for _, r := range s {
+		if !unicode.Is(unicode.Mn, r) {
+			n++
+		}
+	}
+	return n
+}
+
+// nameKeyFunc returns a NameKey that derives a file's key from its base name.
+// With an empty pattern the key is the base name itself. Otherwise pattern is
+// matched against the base name and the key is its first capture group (or
+// the whole match without groups), so e.g. `^(.*)\.\d+$` lets rotated
+// "index.db.1" and "index.db.2" pair up; names that do not match keep their
+// base name as the key.
+func nameKeyFunc(pattern string) (func(path string) string, error) {
+	if pattern == "" {
+		return filepath.Base, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(path string) string {
+		name := filepath.Base(path)
+		m := re.FindStringSubmatch(name)
+		switch {
+		case m == nil:
+			return name
+		case len(m) > 1:
+			return m[1]
+		default:
+			return m[0]
+		}
+	}, nil
 }
 
 // CollectFiles walks the tree once and returns file paths grouped by target size.
 // Paths are stored compactly with interned directory strings via the provided DirIntern.
 // If pool is nil, a temporary pool is created (no cross-call sharing).
 // The optional onMatch callback is called for each file matching a target size.
-func CollectFiles(root string, targetSet map[int64]struct{}, includeSnapshots bool, minSize int64, pool *DirIntern, onMatch func()) (map[int64][]CompactPath, error) {
+func CollectFiles(root string, targetSet map[int64]struct{}, walk WalkOptions, pool *DirIntern, onMatch func()) (map[int64][]CompactPath, error) {
 	if pool == nil {
 		pool = NewDirIntern()
 	}
 	result := make(map[int64][]CompactPath)
-	err := walkRandom(root, includeSnapshots, minSize, func(path string, size int64) {
+	err := walkRandom(root, walk, nil, func(path string, size int64) {
 		if _, ok := targetSet[size]; ok {
 			dir, name := filepath.Dir(path), filepath.Base(path)
 			iDir, _ := pool.Intern(dir)
@@ -74,117 +575,606 @@ func CollectFiles(root string, targetSet map[int64]struct{}, includeSnapshots bo
 // content group). When content matches but the dedup operation fails (e.g.
 // permissions, cross-device), the file is tried against remaining refs. If all
 // matching refs fail, the file is added as an alternative ref so future files
-// can dedup against it instead.
-func ProcessSizeGroup(paths []string, size int64, dryRun bool, verbose bool, rawSizes bool, hardlink bool, fixPerms bool, onProgress func(current int)) *DedupStats {
+// can dedup against it instead. The first file of each content group becomes
+// its reference, so opts.RefStrategy picks which copy is kept by reordering
+// paths.
+func ProcessSizeGroup(paths []string, size int64, opts DedupOptions, onProgress func(current int)) *DedupStats {
 	stats := &DedupStats{}
-	var refs []*fileRef
+	mode := "reflink"
+	if opts.Hardlink {
+		mode = "hardlink"
+	}
+	switch opts.RefStrategy {
+	case refAtime:
+		paths = sortByAtime(paths)
+	case refInode:
+		paths = sortByInode(paths)
+	}
+	// Unchanged files go first so they are refs before any changed file
+	// is compared.
+	var older map[string]bool
+	if !opts.ChangedSince.IsZero() {
+		paths, older = splitByMtime(paths, opts.ChangedSince)
+	}
+	if opts.Processed != nil {
+		paths, older = opts.Processed.split(paths, older)
+	}
+	if older != nil && len(older) == len(paths) {
+		return stats
+	}
+	// Refs are kept per filesystem and name key; without opts.NameKey
+	// every file on a filesystem shares the "" key. A tree spanning several
+	// filesystems is deduped within each, never across them.
+	refsByKey := make(map[refKey][]*fileRef)
+	// Hard-link farms reach one inode through many paths. refInodes maps
+	// the inode of each ref so further links to it are recognized with a
+	// map lookup, and matchedInodes maps inodes already found identical to
+	// a ref so their remaining links skip FIEMAP and content comparison.
+	refInodes := make(map[inodeKey]*fileRef)
+	matchedInodes := make(map[inodeKey]*fileRef)
+	// manifestRefs holds the refs created for opts.Manifest canonical paths.
+	manifestRefs := make(map[string]*fileRef)
+	// hotRefs holds the ref each key's last duplicate matched. Groups are
+	// often dominated by one content, so it is tried first instead of
+	// comparing against every rarer content created before it.
+	hotRefs := make(map[refKey]*fileRef)
+
+	// Content groups are only tracked for opts.Groups and written when the
+	// group is done, including after an early return.
+	var groups []*contentGroup
+	newGroup := func(ref *fileRef) {
+		if opts.Groups == nil {
+			return
+		}
+		ref.group = &contentGroup{primary: ref, paths: []string{ref.path}}
+		groups = append(groups, ref.group)
+	}
+	join := func(ref *fileRef, path string) {
+		if ref.group != nil {
+			ref.group.paths = append(ref.group.paths, path)
+		}
+	}
+	defer func() {
+		for _, g := range groups {
+			opts.Groups.Record(size, g.primary.path, g.paths)
+		}
+	}()
+
+	overErrorLimit := func() bool {
+		if opts.MaxErrors > 0 && stats.Errors > opts.MaxErrors {
+			stats.Fatal = fmt.Errorf("%w: more than %d", errTooManyErrors, opts.MaxErrors)
+			return true
+		}
+		return false
+	}
+
+	// With opts.BatchDedupe, reflink duplicates are queued per ref and
+	// shared with it by range dedup, many per call. Unlike an immediate
+	// dedup, a failed one is not retried against another ref.
+	pending := make(map[*fileRef][]string)
+	var pendingRefs []*fileRef
+	flushBatch := func(ref *fileRef) {
+		dsts := pending[ref]
+		if len(dsts) == 0 {
+			return
+		}
+		delete(pending, ref)
+		opts.Inflight.Acquire()
+		errs := dedupeRangeBatch(ref.path, dsts, size)
+		opts.Inflight.Release()
+		for i, err := range errs {
+			dst := dsts[i]
+			if err != nil {
+				slog.Debug("batched dedup failed", "src", ref.path, "dst", dst, "error", err)
+				stats.Errors++
+				opts.Events.Emit(eventError, map[string]any{"path": dst, "ref": ref.path, "size": size, "mode": mode, "error": err.Error()})
+				stats.ErrorDetails = append(stats.ErrorDetails, DedupError{
+					Size:    size,
+					Mode:    mode,
+					Err:     err.Error(),
+					SrcPath: ref.path,
+					DstPath: dst,
+				})
+				continue
+			}
+			opts.Log.Record(dst, ref.path)
+			slog.Debug("deduped", "file", dst, "ref", ref.path, "size", size)
+			opts.Events.Emit(eventDedup, map[string]any{"path": dst, "ref": ref.path, "size": size, "mode": mode, "dry_run": false})
+			opts.Hooks.Post(ref.path, dst, size)
+			stats.BytesSaved += size
+			stats.FilesDeduped++
+		}
+	}
+	// Registered after the groups writer, so it runs first.
+	defer func() {
+		for _, ref := range pendingRefs {
+			flushBatch(ref)
+		}
+		if stats.Fatal == nil {
+			overErrorLimit()
+		}
+	}()
 
 	for i, path := range paths {
 		if onProgress != nil {
 			onProgress(i + 1)
 		}
+		stats.FilesScanned++
+		stats.BytesScanned += size
+		ino, inoErr := fileInode(path)
+		hasIno := inoErr == nil
 
-		extents, err := getExtents(path)
-		if err != nil {
-			slog.Debug("cannot get extents (will use content comparison)", "path", path, "error", err)
+		var key refKey
+		if hasIno {
+			// Hard links cannot even cross btrfs subvolumes.
+			if opts.Hardlink {
+				key.fs = fsID{dev: ino.dev}
+			} else {
+				key.fs = filesystemOf(path, ino.dev)
+			}
+		}
+		if opts.NameKey != nil {
+			key.name = opts.NameKey(path)
+		}
+		if opts.MatchMagic {
+			key.magic = fileMagic(path)
+		}
+		refs := refsByKey[key]
+		tr := newFileTrace(path, size, len(refs))
+		if hot := hotRefs[key]; hot != nil {
+			refs = refsWithFirst(refs, hot)
+			tr.step("last matched ref %s first", hot.path)
+		}
+
+		// Canonical copies from opts.Manifest are refs without having to be
+		// discovered; a file whose hash is listed tries its canonical first.
+		if opts.Manifest.HasSize(size) {
+			canon := path
+			if !opts.Manifest.IsCanonical(path) {
+				sum, err := hashFile(path)
+				if _, denied := permissionDenied(err); denied {
+					tr.end("unreadable: skipped")
+					if stats.skipUnreadable(path, err, opts) {
+						return stats
+					}
+					continue
+				}
+				canon = ""
+				if err != nil {
+					slog.Debug("cannot hash file for manifest lookup", "path", path, "error", err)
+				} else {
+					canon, _ = opts.Manifest.Lookup(sum, size)
+				}
+			}
+			if canon != "" {
+				ref := manifestRefs[canon]
+				if ref == nil {
+					ref = &fileRef{path: canon}
+					var err error
+					ref.extents, err = fileExtentsMax(canon, maxRefExtents)
+					ref.manyExtents = errors.Is(err, errTooManyExtents)
+					if k, err := fileInode(canon); err == nil {
+						ref.ino, ref.hasIno = k, true
+						refInodes[k] = ref
+					}
+					manifestRefs[canon] = ref
+					newGroup(ref)
+				}
+				if !slices.Contains(refsByKey[key], ref) {
+					refsByKey[key] = append([]*fileRef{ref}, refsByKey[key]...)
+				}
+				if canon == path {
+					tr.end("canonical copy in the manifest: kept as ref")
+					stats.UniqueContents++
+					continue
+				}
+				refs = refsWithFirst(refsByKey[key], ref)
+				tr.step("manifest lists %s as canonical", canon)
+			}
+		}
+
+		if hasIno {
+			if ref, ok := refInodes[ino]; ok {
+				if shorterPath(path, ref.path, opts.NormalizePaths) {
+					ref.path = path
+				}
+				join(ref, path)
+				tr.end("hard link of ref %s: already deduped", ref.path)
+				stats.AlreadyDeduped++
+				continue
+			}
+		}
+		// addRef makes path a ref. same is a ref it matched but could not
+		// be deduped against, or nil for new content.
+		var manyExtents bool
+		addRef := func(extents []Extent, same *fileRef) {
+			ref := &fileRef{path: path, extents: extents, manyExtents: manyExtents, ino: ino, hasIno: hasIno}
+			refsByKey[key] = append(refsByKey[key], ref)
+			if hasIno {
+				refInodes[ino] = ref
+			}
+			if same != nil && same.group != nil {
+				ref.group = same.group
+				join(ref, path)
+			} else {
+				newGroup(ref)
+			}
+		}
+
+		// An inode already matched to one of this key's refs needs no
+		// extents or comparison; try that ref first.
+		var knownRef *fileRef
+		if hasIno {
+			if ref, ok := matchedInodes[ino]; ok && slices.Contains(refs, ref) {
+				knownRef = ref
+				refs = refsWithFirst(refs, ref)
+				tr.step("another link matched ref %s", ref.path)
+			}
+		}
+
+		if opts.MinFragmentation > 0 && opts.FragPrefix > 0 && size > opts.FragPrefix &&
+			knownRef == nil && !older[path] && len(refs) > 0 {
+			if prefix, err := fileExtentsPrefix(path, opts.FragPrefix); err == nil && len(prefix) > 0 {
+				if ratio := fragmentationRatio(prefix, opts.FragPrefix); ratio < opts.MinFragmentation {
+					slog.Debug("skipping file below estimated fragmentation threshold", "path", path, "ratio", ratio)
+					tr.end("estimated fragmentation ratio %.1f below --min-fragmentation: skipped", ratio)
+					stats.Unfragmented++
+					continue
+				}
+			}
+		}
+
+		var extents []Extent
+		if knownRef == nil {
+			var err error
+			extents, err = withTimeout(opts.FileTimeout, func() ([]Extent, error) { return fileExtentsMax(path, maxRefExtents) })
+			if errors.Is(err, errTooManyExtents) {
+				manyExtents, err = true, nil
+				tr.step("over %d extents", maxRefExtents)
+			}
+			if err != nil {
+				if errors.Is(err, errFileTimeout) {
+					slog.Debug("skipping file: reading extents timed out", "path", path, "error", err)
+					tr.end("reading extents timed out: skipped")
+					stats.TimedOut++
+					continue
+				}
+				if _, denied := permissionDenied(err); denied {
+					tr.end("unreadable: skipped")
+					if stats.skipUnreadable(path, err, opts) {
+						return stats
+					}
+					continue
+				}
+				slog.Debug("cannot get extents (will use content comparison)", "path", path, "error", err)
+				tr.step("no extents (%v)", err)
+			}
+		}
+
+		if !opts.Hardlink && isNoCOW(path) {
+			slog.Debug("skipping nocow file, cannot reflink", "path", path)
+			tr.end("nocow: skipped")
+			stats.NoCOW++
+			continue
+		}
+
+		if older[path] {
+			if opts.Processed.Has(path) {
+				tr.end("in --processed-set: kept as ref")
+			} else {
+				tr.end("not changed since --changed-since: kept as ref")
+			}
+			addRef(extents, nil)
+			continue
 		}
 
 		// First file — establish as reference.
 		if len(refs) == 0 {
-			refs = append(refs, &fileRef{path: path, extents: extents})
+			tr.end("first file: kept as ref")
+			addRef(extents, nil)
+			stats.UniqueContents++
 			continue
 		}
 
+		if opts.SkipProtected {
+			if why := protectedReason(path); why != "" {
+				slog.Debug("skipping protected file", "path", path, "reason", why)
+				tr.end("%s: kept as ref", why)
+				stats.Protected++
+				addRef(extents, nil)
+				continue
+			}
+		}
+
+		if opts.MinFragmentation > 0 && extents != nil {
+			if ratio := fragmentationRatio(extents, size); ratio < opts.MinFragmentation {
+				slog.Debug("skipping file below fragmentation threshold", "path", path, "ratio", ratio)
+				tr.end("fragmentation ratio %.1f below --min-fragmentation: skipped", ratio)
+				stats.Unfragmented++
+				continue
+			}
+		}
+
+		if opts.SkipShared && allShared(extents) {
+			slog.Debug("skipping file whose extents are all shared", "path", path)
+			tr.end("all extents shared: skipped")
+			stats.FullyShared++
+			continue
+		}
+
+		keepShared := opts.PreserveShared && sharedFraction(extents) > preserveSharedMin
+
 		deduped := false
-		contentMatch := false
+		unreadable := false
+		vetoed := false // by the pre-dedup hook
+		var contentMatch *fileRef
 		dedupErrors := 0
 		var firstDedupErr error
 		var firstRefPath string
-		for _, ref := range refs {
-			// Same inode (hard link) — already sharing storage.
-			if same, _ := sameInode(ref.path, path); same {
-				if len(path) < len(ref.path) {
-					ref.path = path
-					ref.extents = extents
+		var firstMode string
+		var compared *refComparisons
+		changed := false // between comparison and replacement, with Recheck
+		var pathBefore os.FileInfo
+		if opts.Recheck {
+			pathBefore, _ = os.Lstat(path)
+		}
+		for ri, ref := range refs {
+			tr.step("checked ref %s", ref.path)
+			// Same inode (hard link) — already sharing storage. When both
+			// inodes are known, refInodes has already ruled this out.
+			if !hasIno || !ref.hasIno {
+				if same, _ := sameInode(ref.path, path); same {
+					if shorterPath(path, ref.path, opts.NormalizePaths) {
+						ref.path = path
+						ref.extents, ref.manyExtents = extents, manyExtents
+					}
+					join(ref, path)
+					tr.end("same inode: already deduped")
+					stats.AlreadyDeduped++
+					hotRefs[key] = ref
+					deduped = true
+					break
 				}
-				stats.AlreadyDeduped++
-				deduped = true
-				break
 			}
+			tr.step("not same inode")
 
 			// Same extents (existing reflink) — already sharing storage.
-			// Only check when both sides have valid extents.
-			if extents != nil && ref.extents != nil && SameExtents(ref.extents, extents) {
-				if len(path) < len(ref.path) {
+			// Only check when both sides have valid extents. Files with
+			// too many extents to keep are compared on disk.
+			sameExtents := extents != nil && ref.extents != nil && SameExtents(ref.extents, extents)
+			if manyExtents && ref.manyExtents {
+				sameExtents, _ = fileExtentsEqual(ref.path, path)
+			}
+			if sameExtents {
+				if shorterPath(path, ref.path, opts.NormalizePaths) {
 					ref.path = path
-					ref.extents = extents
+					ref.extents, ref.manyExtents = extents, manyExtents
+					ref.ino, ref.hasIno = ino, hasIno
 				}
+				if hasIno {
+					refInodes[ino] = ref
+				}
+				join(ref, path)
+				tr.end("same extents: already deduped")
 				stats.AlreadyDeduped++
+				hotRefs[key] = ref
 				deduped = true
 				break
 			}
+			if extents == nil && !manyExtents || ref.extents == nil && !ref.manyExtents {
+				tr.step("extents unknown")
+			} else {
+				tr.step("extents differ")
+			}
+
+			// A file kept for its sharing is never replaced, so its content
+			// need not be compared.
+			if keepShared {
+				continue
+			}
+
+			if ref.readFailed {
+				tr.step("ref unreadable")
+				continue
+			}
 
 			// Compare file content byte-by-byte.
-			equal, err := filesEqual(ref.path, path)
+			var refBefore os.FileInfo
+			if opts.Recheck {
+				refBefore, _ = os.Lstat(ref.path)
+			}
+			equal := ref == knownRef
+			var err error
+			if !equal {
+				if compared == nil && !opts.Recheck && opts.CompareWorkers > 1 && len(refs)-ri >= parallelCompareMin {
+					compared = compareRefs(refs, ri, path, opts.CompareWorkers, opts.FileTimeout)
+				}
+				if r, ok := compared.get(ri); ok {
+					equal, err = r.equal, r.err
+				} else {
+					equal, err = withTimeout(opts.FileTimeout, func() (bool, error) { return filesEqual(ref.path, path) })
+				}
+			}
+			if errors.Is(err, errFileTimeout) {
+				// Either file may be the slow one; skip this one rather
+				// than risk stalling on every later file too.
+				slog.Debug("skipping file: content comparison timed out", "a", ref.path, "b", path, "error", err)
+				tr.end("content comparison timed out: skipped")
+				stats.TimedOut++
+				unreadable = true
+				break
+			}
 			if err != nil {
+				if denied, ok := permissionDenied(err); ok && denied == path {
+					tr.end("unreadable: skipped")
+					if stats.skipUnreadable(path, err, opts) {
+						return stats
+					}
+					unreadable = true
+					break
+				}
+				// A read failing midway points at the media; skip the
+				// file that failed, and never read a failed ref again.
+				if bad, ok := readFailed(err); ok {
+					slog.Warn("read error, possible bad media", "path", bad, "error", err)
+					stats.ReadErrors = append(stats.ReadErrors, bad)
+					if bad == path {
+						tr.end("read error: skipped")
+						unreadable = true
+						break
+					}
+					ref.readFailed = true
+					tr.step("ref read error")
+					continue
+				}
 				slog.Debug("content comparison failed", "a", ref.path, "b", path, "error", err)
+				tr.step("comparison failed (%v)", err)
 				continue
 			}
 			if !equal {
+				tr.step("content differs")
 				continue
 			}
+			tr.step("content equal")
 
 			// Identical content found.
-			contentMatch = true
+			if contentMatch == nil {
+				contentMatch = ref
+			}
+			hotRefs[key] = ref
+			fileMode := mode
+			if fileMode != "hardlink" && opts.PreferHardlink && ref.ino.dev == ino.dev && sameMetadata(ref.path, path) {
+				// Nothing distinguishes the two inodes, so one can go.
+				fileMode = "hardlink"
+				tr.step("same metadata: hard link")
+			}
 
-			if dryRun {
-				fmt.Printf("[dry-run] dedup: %s -> %s (%s)\n", path, ref.path, formatSize(size, rawSizes))
+			if opts.DryRun {
+				if !opts.Events.toStdout() {
+					fmt.Printf("[dry-run] dedup: %s -> %s (%s)\n", path, ref.path, formatSize(size, opts.RawSizes))
+				}
+				opts.Events.Emit(eventDedup, map[string]any{"path": path, "ref": ref.path, "size": size, "mode": fileMode, "dry_run": true})
+				opts.Script.Record(path, ref.path)
+				tr.end("would dedup (dry run)")
+				join(ref, path)
 				stats.BytesSaved += size
 				stats.FilesDeduped++
 				deduped = true
+				if hasIno {
+					matchedInodes[ino] = ref
+				}
+				break
+			}
+
+			if opts.Recheck && !(unchangedSince(path, pathBefore) && unchangedSince(ref.path, refBefore)) {
+				slog.Debug("skipping file: it or its ref changed since they were compared", "path", path, "ref", ref.path)
+				tr.end("changed since compared with %s: skipped", ref.path)
+				stats.ChangedSkipped++
+				changed = true
+				break
+			}
+
+			if opts.DefragRefs && fileMode != "hardlink" && !ref.defragged && needsRefDefrag(ref.extents, size) {
+				ref.defragged = true
+				if err := defragFile(ref.path); err != nil {
+					slog.Debug("reference defragment failed", "path", ref.path, "error", err)
+				} else if ext, err := fileExtents(ref.path); err == nil {
+					slog.Debug("defragmented reference", "path", ref.path, "before", len(ref.extents), "after", len(ext))
+					ref.extents = ext
+				}
+			}
+
+			if err := opts.Hooks.Pre(ref.path, path, size); err != nil {
+				slog.Debug("pre-hook failed, skipping file", "src", ref.path, "dst", path, "error", err)
+				tr.end("pre-hook failed: skipped")
+				stats.HookSkipped++
+				join(ref, path)
+				vetoed = true
 				break
 			}
 
+			if opts.BatchDedupe && fileMode != "hardlink" {
+				if len(pending[ref]) == 0 {
+					pendingRefs = append(pendingRefs, ref)
+				}
+				pending[ref] = append(pending[ref], path)
+				tr.end("queued for batch dedup")
+				join(ref, path)
+				deduped = true
+				if hasIno {
+					matchedInodes[ino] = ref
+				}
+				if len(pending[ref]) == dedupeBatchMax {
+					flushBatch(ref)
+					if overErrorLimit() {
+						return stats
+					}
+				}
+				break
+			}
+
+			// The rest of a dedup's bookkeeping waits for the commit of a
+			// transactional run.
+			record := func() {
+				opts.Log.Record(path, ref.path)
+				slog.Debug("deduped", "file", path, "ref", ref.path, "size", size)
+				opts.Events.Emit(eventDedup, map[string]any{"path": path, "ref": ref.path, "size": size, "mode": fileMode, "dry_run": false})
+				opts.Hooks.Post(ref.path, path, size)
+			}
 			var dedupErr error
-			if hardlink {
-				dedupErr = hardlinkFile(ref.path, path, fixPerms)
+			opts.Inflight.Acquire()
+			if opts.Txn != nil {
+				dedupErr = opts.Txn.Stage(ref.path, path, ref.extents, size, fileMode == "hardlink", opts.VerifyShared, record)
+			} else if fileMode == "hardlink" {
+				dedupErr = hardlinkFile(ref.path, path, opts.FixPerms)
 			} else {
-				dedupErr = dedupFile(ref.path, path, fixPerms)
+				dedupErr = dedupFile(ref.path, path, ref.extents, opts.FixPerms, opts.VerifyShared)
 			}
+			opts.Inflight.Release()
 			if dedupErr != nil {
 				if firstDedupErr == nil {
 					firstDedupErr = dedupErr
 					firstRefPath = ref.path
+					firstMode = fileMode
 				}
 				slog.Debug("dedup failed, trying next ref", "src", ref.path, "dst", path, "error", dedupErr)
+				tr.step("dedup failed (%v)", dedupErr)
 				dedupErrors++
 				continue // try next ref — another ref with same content may work
 			}
 
-			if verbose {
-				fmt.Fprintf(os.Stderr, "    %s -> %s\n", path, ref.path)
+			if opts.Txn == nil {
+				record()
+				tr.end("deduped")
+			} else {
+				tr.end("staged for commit")
 			}
-			slog.Debug("deduped", "file", path, "ref", ref.path, "size", size)
+			join(ref, path)
 			stats.BytesSaved += size
 			stats.FilesDeduped++
 			deduped = true
+			// Other links to path's original inode hold the same content.
+			if hasIno {
+				matchedInodes[ino] = ref
+			}
 			break
 		}
 
-		if !deduped {
-			if contentMatch {
+		if !deduped && !unreadable && !vetoed && !changed {
+			if keepShared {
+				slog.Debug("skipping file whose extents are mostly shared", "path", path, "shared", sharedFraction(extents))
+				tr.end("mostly shared: skipped")
+				stats.SharedSkipped++
+			} else if contentMatch != nil {
 				// Content matched a ref but all dedup attempts failed.
 				// Add this file as an alternative ref — it may succeed as
 				// source where the original ref could not.
 				stats.Errors++
 				if firstDedupErr != nil {
-					mode := "reflink"
-					if hardlink {
-						mode = "hardlink"
-					}
+					opts.Events.Emit(eventError, map[string]any{"path": path, "ref": firstRefPath, "size": size, "mode": firstMode, "error": firstDedupErr.Error()})
 					stats.ErrorDetails = append(stats.ErrorDetails, DedupError{
 						Size:    size,
-						Mode:    mode,
+						Mode:    firstMode,
 						Err:     firstDedupErr.Error(),
 						SrcPath: firstRefPath,
 						DstPath: path,
@@ -192,59 +1182,275 @@ func ProcessSizeGroup(paths []string, size int64, dryRun bool, verbose bool, raw
 				}
 				slog.Debug("all dedup attempts failed for content match, adding as alternative ref",
 					"path", path, "attempts", dedupErrors)
+				tr.end("every dedup failed: kept as alternative ref")
+				if overErrorLimit() {
+					return stats
+				}
+			} else {
+				tr.end("unique content: kept as ref")
+				stats.UniqueContents++
 			}
-			refs = append(refs, &fileRef{path: path, extents: extents})
+			addRef(extents, contentMatch)
 		}
 	}
 
 	return stats
 }
 
+// refsWithFirst returns refs with ref moved to the front, leaving refs itself
+// untouched. ref is added if refs does not hold it.
+func refsWithFirst(refs []*fileRef, ref *fileRef) []*fileRef {
+	if len(refs) > 0 && refs[0] == ref {
+		return refs
+	}
+	return append([]*fileRef{ref}, slices.DeleteFunc(slices.Clone(refs), func(r *fileRef) bool { return r == ref })...)
+}
+
+// permissionDenied reports whether err is a permission error, and if so
+// which path could not be opened.
+func permissionDenied(err error) (string, bool) {
+	var pathErr *fs.PathError
+	if errors.Is(err, fs.ErrPermission) && errors.As(err, &pathErr) {
+		return pathErr.Path, true
+	}
+	return "", false
+}
+
+// readFailed reports whether err is a read failing partway through a file,
+// as opposed to failing to open or stat it, and which file it was. On a
+// healthy system such errors (EIO above all) mean bad media.
+func readFailed(err error) (string, bool) {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && pathErr.Op == "read" {
+		return pathErr.Path, true
+	}
+	return "", false
+}
+
+// sameMetadata reports whether a and b have the same mode, owner, and
+// modification time, so hard-linking them loses no metadata. Files whose
+// owner cannot be determined are never considered the same.
+func sameMetadata(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	uidA, gidA, okA := fileOwner(infoA)
+	uidB, gidB, okB := fileOwner(infoB)
+	return okA && okB && uidA == uidB && gidA == gidB &&
+		infoA.Mode() == infoB.Mode() && infoA.ModTime().Equal(infoB.ModTime())
+}
+
+// skipUnreadable records path as skipped for lack of read permission. It
+// returns true when the group must stop because opts.PermissionFatal is set.
+func (s *DedupStats) skipUnreadable(path string, err error, opts DedupOptions) bool {
+	s.PermissionDenied++
+	if opts.PermissionFatal {
+		s.Fatal = err
+		return true
+	}
+	slog.Debug("skipping unreadable file", "path", path, "error", err)
+	return false
+}
+
+// errSizeMismatch is returned by filesEqual when the two files no longer
+// have the same size.
+var errSizeMismatch = errors.New("file sizes differ")
+
+// mmapCompare makes filesEqual compare mapped files (see mmapEqual) instead
+// of reading them, which saves copying page-cache data on hot files. It is
+// set once at startup by --mmap-compare.
+var mmapCompare bool
+
+// errFileTimeout is returned by withTimeout when an operation outlives
+// DedupOptions.FileTimeout.
+var errFileTimeout = errors.New("file operation timed out")
+
+// withTimeout runs op and returns its result, or errFileTimeout once d has
+// passed. FIEMAP ioctls and reads cannot be interrupted, so a timed-out op
+// is left running in its goroutine; on a truly stuck disk that goroutine and
+// its open files leak, which beats stalling the run. d <= 0 runs op inline.
+func withTimeout[T any](d time.Duration, op func() (T, error)) (T, error) {
+	if d <= 0 {
+		return op()
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := op()
+		done <- result{v, err}
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-timer.C:
+		var zero T
+		return zero, fmt.Errorf("%w after %s", errFileTimeout, d)
+	}
+}
+
+// errTooManyErrors is wrapped in DedupStats.Fatal when a group stops because
+// DedupOptions.MaxErrors was exceeded.
+var errTooManyErrors = errors.New("too many errors")
+
 // filesEqual reports whether two files have identical content.
-// Both files are assumed to have the same size.
+//
+// Callers only compare files from the same size group: pass 2 groups files by
+// their size at walk time, so a file that grew or shrank since pass 1 lands in
+// a different bucket and is never compared across sizes. A file can still
+// change size between the walk and this comparison, so the invariant is
+// checked here on the open descriptors and violations are reported as
+// errSizeMismatch rather than silently treated as "not equal".
 func filesEqual(pathA, pathB string) (bool, error) {
-	fa, err := os.Open(pathA)
+	fa, err := openNoATime(pathA)
 	if err != nil {
 		return false, err
 	}
 	//goland:noinspection GoUnhandledErrorResult
 	defer fa.Close()
 
-	fb, err := os.Open(pathB)
+	fb, err := openNoATime(pathB)
 	if err != nil {
 		return false, err
 	}
 	//goland:noinspection GoUnhandledErrorResult
 	defer fb.Close()
 
-	const chunkSize = 256 * 1024
-	bufA := make([]byte, chunkSize)
-	bufB := make([]byte, chunkSize)
+	infoA, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	infoB, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, fmt.Errorf("%w: %s is %d bytes, %s is %d bytes",
+			errSizeMismatch, pathA, infoA.Size(), pathB, infoB.Size())
+	}
+
+	if hddCompare {
+		return hddEqual(fa, fb, infoA.Size())
+	}
+	if mmapCompare {
+		equal, err := mmapEqual(fa, fb, infoA.Size())
+		if err == nil || errors.Is(err, errSizeMismatch) {
+			return equal, err
+		}
+		slog.Debug("mmap comparison failed, reading instead", "a", pathA, "b", pathB, "error", err)
+	}
+	return readEqual(fa, fb, infoA.Size())
+}
+
+// readEqual compares fa and fb, both size bytes when opened, by reading
+// them in parallel. A file that grows or shrinks meanwhile is reported as
+// errSizeMismatch; a change in content only makes the files differ.
+func readEqual(fa, fb *os.File, size int64) (bool, error) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	chunksA, freeA := readChunks(fa, ioBufSize, done, &wg)
+	chunksB, freeB := readChunks(fb, ioBufSize, done, &wg)
+	// Stop the readers before the deferred Close calls run.
+	defer wg.Wait()
+	defer close(done)
 
 	for {
-		nA, errA := io.ReadFull(fa, bufA)
-		nB, errB := io.ReadFull(fb, bufB)
+		a := <-chunksA
+		b := <-chunksB
 
-		if nA != nB || !bytes.Equal(bufA[:nA], bufB[:nB]) {
+		// A failed read cuts its chunk short; report it rather than the
+		// mismatch it causes.
+		if a.err != nil && !isEOF(a.err) {
+			return false, a.err
+		}
+		if b.err != nil && !isEOF(b.err) {
+			return false, b.err
+		}
+		live.BytesCompared.Add(int64(min(a.n, b.n)))
+		// Chunks of different lengths or ends at different offsets mean a
+		// size changed, unless the content differs anyway.
+		if a.n != b.n || !bytes.Equal(a.buf[:a.n], b.buf[:b.n]) {
+			if err := checkUnchangedSize(size, fa, fb); err != nil {
+				return false, err
+			}
 			return false, nil
 		}
 
-		eofA := isEOF(errA)
-		eofB := isEOF(errB)
+		eofA := isEOF(a.err)
+		eofB := isEOF(b.err)
 
-		if eofA && eofB {
-			return true, nil
-		}
-		if eofA != eofB {
-			return false, nil
+		if eofA || eofB {
+			if err := checkUnchangedSize(size, fa, fb); err != nil {
+				return false, err
+			}
+			return eofA && eofB, nil
 		}
-		if errA != nil {
-			return false, errA
+
+		freeA <- a.buf
+		freeB <- b.buf
+	}
+}
+
+// readChunk is one filled buffer from readChunks.
+type readChunk struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// readChunks reads f sequentially in a background goroutine using two
+// alternating buffers, so the caller can compare chunk N while chunk N+1 is
+// being read. Buffers must be handed back on the returned free channel once
+// the caller is done with them. The reader stops after delivering the first
+// chunk with a non-nil error (including EOF), or when done is closed.
+func readChunks(f *os.File, chunkSize int, done <-chan struct{}, wg *sync.WaitGroup) (<-chan readChunk, chan<- []byte) {
+	chunks := make(chan readChunk, 2)
+	free := make(chan []byte, 2)
+	free <- make([]byte, chunkSize)
+	free <- make([]byte, chunkSize)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			n, err := io.ReadFull(f, buf)
+			select {
+			case chunks <- readChunk{buf: buf, n: n, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
 		}
-		if errB != nil {
-			return false, errB
+	}()
+	return chunks, free
+}
+
+// checkUnchangedSize returns errSizeMismatch if any of files is no longer
+// size bytes long. Files that cannot be stat'ed are not reported.
+func checkUnchangedSize(size int64, files ...*os.File) error {
+	for _, f := range files {
+		if info, err := f.Stat(); err == nil && info.Size() != size {
+			return fmt.Errorf("%w: %s changed to %d bytes while compared", errSizeMismatch, f.Name(), info.Size())
 		}
 	}
+	return nil
 }
 
 func isEOF(err error) bool {
@@ -254,14 +1460,14 @@ func isEOF(err error) bool {
 // hardlinkFile replaces dst with a hard link to src.
 // On failure, the original file is restored from a temporary backup.
 func hardlinkFile(src, dst string, fixPerms bool) error {
-	tmpPath := dst + ".dedup-tmp"
+	tmpPath := dst + tmpSuffix
 
 	// Step 1: move dst out of the way, temporarily fixing directory permissions if needed.
-	renameErr := os.Rename(dst, tmpPath)
+	renameErr := guard.rename(dst, tmpPath)
 	var restoreDir func()
 	if renameErr != nil && fixPerms {
 		if restore, chErr := addDirWrite(filepath.Dir(dst)); chErr == nil {
-			if os.Rename(dst, tmpPath) == nil {
+			if guard.rename(dst, tmpPath) == nil {
 				renameErr = nil
 				restoreDir = restore
 				slog.Debug("temporarily added write permission to directory", "dir", filepath.Dir(dst))
@@ -279,12 +1485,12 @@ func hardlinkFile(src, dst string, fixPerms bool) error {
 
 	//goland:noinspection GoUnhandledErrorResult
 	rollback := func() {
-		os.Remove(dst)
-		os.Rename(tmpPath, dst)
+		guard.remove(dst)
+		guard.rename(tmpPath, dst)
 	}
 
 	// Step 2: create hard link from src to dst.
-	if err := os.Link(src, dst); err != nil {
+	if err := guard.link(src, dst); err != nil {
 		rollback()
 		return fmt.Errorf("hard link: %w", err)
 	}
@@ -297,16 +1503,19 @@ func hardlinkFile(src, dst string, fixPerms bool) error {
 
 	// Step 4: success — remove the backup.
 	//goland:noinspection GoUnhandledErrorResult
-	os.Remove(tmpPath)
+	guard.remove(tmpPath)
 	return nil
 }
 
 // dedupFile replaces dst with a reflink copy of src, preserving dst's metadata.
-// On failure, the original file is restored from a temporary backup.
+// The copy is built and verified at a temporary path next to dst and then
+// swapped into place with a single atomic exchange, so dst always exists and
+// always has valid content. The exchange leaves the original at the temporary
+// path; if it changed while the copy was being built, the swap is undone.
 // If the directory is write-protected, it falls back to an in-place reflink
 // with a backup in the system temp directory.
-func dedupFile(src, dst string, fixPerms bool) error {
-	tmpPath := dst + ".dedup-tmp"
+func dedupFile(src, dst string, srcExtents []Extent, fixPerms, verifyShared bool) error {
+	tmpPath := dst + tmpSuffix
 
 	// Capture dst metadata before touching anything.
 	dstInfo, err := os.Lstat(dst)
@@ -314,62 +1523,126 @@ func dedupFile(src, dst string, fixPerms bool) error {
 		return fmt.Errorf("stat dst: %w", err)
 	}
 
-	// Step 1: move dst out of the way, temporarily fixing directory permissions if needed.
-	renameErr := os.Rename(dst, tmpPath)
-	var restoreDir func()
-	if renameErr != nil && fixPerms {
+	// Step 1: create a reflink copy of src next to dst, temporarily fixing
+	// directory permissions if needed.
+	cloneErr := reflinkCopy(src, tmpPath, dstInfo.Mode())
+	if cloneErr != nil && fixPerms && errors.Is(cloneErr, fs.ErrPermission) {
 		if restore, chErr := addDirWrite(filepath.Dir(dst)); chErr == nil {
-			if os.Rename(dst, tmpPath) == nil {
-				renameErr = nil
-				restoreDir = restore
+			if cloneErr = reflinkCopy(src, tmpPath, dstInfo.Mode()); cloneErr == nil {
 				slog.Debug("temporarily added write permission to directory", "dir", filepath.Dir(dst))
+				defer restore()
 			} else {
 				restore()
 			}
 		}
 	}
-	if renameErr != nil {
-		// Directory may be write-protected; fall back to in-place reflink.
-		slog.Debug("rename failed, trying in-place reflink", "dst", dst, "error", renameErr)
-		return dedupFileInPlace(src, dst, dstInfo, fixPerms)
-	}
-	if restoreDir != nil {
-		defer restoreDir()
+	if cloneErr != nil {
+		//goland:noinspection GoUnhandledErrorResult
+		guard.remove(tmpPath)
+		if errors.Is(cloneErr, fs.ErrPermission) {
+			// Directory may be write-protected; fall back to in-place reflink.
+			slog.Debug("cannot create temp file, trying in-place reflink", "dst", dst, "error", cloneErr)
+			return dedupFileInPlace(src, dst, srcExtents, dstInfo, fixPerms, verifyShared)
+		}
+		return fmt.Errorf("reflink copy: %w", cloneErr)
 	}
 
 	//goland:noinspection GoUnhandledErrorResult
-	rollback := func() {
-		os.Remove(dst)
-		os.Rename(tmpPath, dst)
+	cleanup := func() { guard.remove(tmpPath) }
+
+	// Steps 2 and 3: verify the copy and give it dst's metadata.
+	if err := finishCopy(src, tmpPath, srcExtents, dstInfo, verifyShared); err != nil {
+		cleanup()
+		return err
 	}
 
-	// Step 2: create reflink copy of src at dst.
-	if err := reflinkCopy(src, dst, dstInfo.Mode()); err != nil {
-		rollback()
-		return fmt.Errorf("reflink copy: %w", err)
+	// Step 4: atomically swap the copy into place. Filesystems without
+	// RENAME_EXCHANGE fall back to rename (see replaceByRename).
+	if noRenameExchange.Load() {
+		return replaceByRename(tmpPath, dst, dstInfo)
+	}
+	if err := renameExchange(tmpPath, dst); err != nil {
+		if !renameExchangeUnsupported(err) {
+			cleanup()
+			return fmt.Errorf("swap into dst: %w", err)
+		}
+		slog.Debug("rename exchange unsupported, replacing with rename", "dst", dst, "error", err)
+		noRenameExchange.Store(true)
+		return replaceByRename(tmpPath, dst, dstInfo)
 	}
 
-	// Step 3: verify the new file shares extents with src (when FIEMAP is available).
-	if err := verifyReflink(src, dst); err != nil {
-		rollback()
-		return err
+	// Step 5: the original now sits at tmpPath. If it was written to while
+	// the copy was built, swap it back rather than lose the write.
+	if !unchangedSince(tmpPath, dstInfo) {
+		if err := renameExchange(tmpPath, dst); err != nil {
+			return fmt.Errorf("dst changed during dedup and could not be restored (original kept at %s): %w", tmpPath, err)
+		}
+		cleanup()
+		return fmt.Errorf("dst changed during dedup")
 	}
 
-	// Step 4: restore original file metadata on the new file.
-	if err := restoreMetadata(dst, dstInfo); err != nil {
-		slog.Debug("metadata restoration partial", "path", dst, "error", err)
+	// Step 6: success — remove the original.
+	cleanup()
+	return nil
+}
+
+// noRenameExchange is set the first time renameat2 reports RENAME_EXCHANGE
+// unsupported, so later replacements go straight to replaceByRename.
+var noRenameExchange atomic.Bool
+
+// renameExchangeUnsupported reports whether err means the kernel or
+// filesystem does not implement RENAME_EXCHANGE, as opposed to failing for
+// this file (dst deleted, permissions).
+func renameExchangeUnsupported(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// replaceByRename renames the verified copy at tmpPath over dst, for
+// filesystems without RENAME_EXCHANGE. Rename never leaves dst absent, but
+// the original is gone once it returns, so dst is checked first: if it was
+// deleted, replaced or written to since dstInfo was taken, the copy is
+// removed and dst left alone. A write landing between the check and the
+// rename is still lost.
+func replaceByRename(tmpPath, dst string, dstInfo os.FileInfo) error {
+	if !unchangedSince(dst, dstInfo) {
+		//goland:noinspection GoUnhandledErrorResult
+		guard.remove(tmpPath)
+		return fmt.Errorf("dst changed during dedup")
+	}
+	if err := guard.rename(tmpPath, dst); err != nil {
+		//goland:noinspection GoUnhandledErrorResult
+		guard.remove(tmpPath)
+		return fmt.Errorf("replace dst: %w", err)
 	}
+	return nil
+}
 
-	// Step 5: success — remove the backup.
-	//goland:noinspection GoUnhandledErrorResult
-	os.Remove(tmpPath)
+// finishCopy prepares the reflink copy of src at tmpPath to replace the
+// file described by dstInfo: it verifies the copy shares extents with src
+// (when FIEMAP is available), then gives it dst's metadata before it
+// becomes visible.
+func finishCopy(src, tmpPath string, srcExtents []Extent, dstInfo os.FileInfo, verifyShared bool) error {
+	if err := verifyReflink(src, tmpPath, srcExtents, verifyShared); err != nil {
+		return err
+	}
+	if err := restoreMetadata(tmpPath, dstInfo); err != nil {
+		slog.Debug("metadata restoration partial", "path", tmpPath, "error", err)
+	}
 	return nil
 }
 
+// unchangedSince reports whether path is still the file described by info,
+// with the same size and modification time.
+func unchangedSince(path string, info os.FileInfo) bool {
+	cur, err := os.Lstat(path)
+	return err == nil && os.SameFile(cur, info) &&
+		cur.Size() == info.Size() && cur.ModTime().Equal(info.ModTime())
+}
+
 // dedupFileInPlace performs a reflink by truncating and cloning into the existing
 // dst inode, avoiding any directory entry changes. A content backup is kept in
 // the system temp directory for rollback on failure.
-func dedupFileInPlace(src, dst string, dstInfo os.FileInfo, fixPerms bool) error {
+func dedupFileInPlace(src, dst string, srcExtents []Extent, dstInfo os.FileInfo, fixPerms, verifyShared bool) error {
 	// Back up dst content to a temp file.
 	backupPath, err := backupToTemp(dst)
 	if err != nil {
@@ -381,10 +1654,10 @@ func dedupFileInPlace(src, dst string, dstInfo os.FileInfo, fixPerms bool) error
 	// If the file is read-only and --fix-perms is set, temporarily make it writable.
 	origMode := dstInfo.Mode().Perm()
 	if fixPerms && origMode&0200 == 0 {
-		if err := os.Chmod(dst, origMode|0200); err != nil {
+		if err := guard.chmod(dst, origMode|0200); err != nil {
 			slog.Debug("cannot chmod file writable", "path", dst, "error", err)
 		} else {
-			defer os.Chmod(dst, origMode)
+			defer guard.chmod(dst, origMode)
 		}
 	}
 
@@ -395,7 +1668,7 @@ func dedupFileInPlace(src, dst string, dstInfo os.FileInfo, fixPerms bool) error
 	}
 
 	// Verify.
-	if err := verifyReflink(src, dst); err != nil {
+	if err := verifyReflink(src, dst, srcExtents, verifyShared); err != nil {
 		restoreFromTemp(backupPath, dst)
 		return err
 	}
@@ -408,17 +1681,48 @@ func dedupFileInPlace(src, dst string, dstInfo os.FileInfo, fixPerms bool) error
 	return nil
 }
 
+// trustReflink makes verifyReflink accept every clone the kernel reported
+// as successful without reading either file again. It is set once at
+// startup by --no-verify-reflink.
+var trustReflink bool
+
 // verifyReflink checks that src and dst share the same data after a reflink.
-func verifyReflink(src, dst string) error {
-	srcExtents, errSrc := getExtents(src)
-	dstExtents, errDst := getExtents(dst)
-	if errSrc == nil && errDst == nil {
+// srcExtents, if not nil, are src's extents as read before the clone; a
+// dst matching them needs no second FIEMAP of src, so a ref cloned to every
+// member of its group is read once. With verifyShared, both files' extents
+// must also be flagged shared, and a missing FIEMAP is an error rather than
+// a fallback to content comparison.
+func verifyReflink(src, dst string, srcExtents []Extent, verifyShared bool) error {
+	if trustReflink && !verifyShared {
+		return nil
+	}
+	// A mismatch is checked again against src as it is now, in case its
+	// extents moved since they were read (e.g. by a balance).
+	if srcExtents != nil && !verifyShared {
+		if dstExtents, err := fileExtentsMax(dst, len(srcExtents)); err == nil && SameExtents(srcExtents, dstExtents) {
+			return nil
+		}
+	}
+	errMismatch := fmt.Errorf("extents mismatch after reflink (filesystem may not support reflinks)")
+	if verifyShared {
+		srcExtents, errSrc := fileExtents(src)
+		dstExtents, errDst := fileExtents(dst)
+		if errSrc != nil || errDst != nil {
+			return fmt.Errorf("cannot verify shared extents: %w", errors.Join(errSrc, errDst))
+		}
 		if !SameExtents(srcExtents, dstExtents) {
-			return fmt.Errorf("extents mismatch after reflink (filesystem may not support reflinks)")
+			return errMismatch
+		}
+		return verifySharedExtents(srcExtents, dstExtents)
+	}
+	if same, err := fileExtentsEqual(src, dst); err == nil {
+		if !same {
+			return errMismatch
 		}
 		return nil
 	}
-	// FIEMAP not available (e.g. ZFS) — verify content instead.
+	// FIEMAP not available (e.g. ZFS, or detected unsupported at startup) —
+	// re-read both files and verify content instead.
 	equal, err := filesEqual(src, dst)
 	if err != nil {
 		return fmt.Errorf("verify content after reflink: %w", err)
@@ -444,7 +1748,7 @@ func backupToTemp(path string) (string, error) {
 	}
 	tmpPath := tmp.Name()
 
-	if _, err := io.Copy(tmp, src); err != nil {
+	if _, err := copySparse(tmp, src); err != nil {
 		tmp.Close()
 		os.Remove(tmpPath)
 		return "", err
@@ -466,13 +1770,16 @@ func restoreFromTemp(backupPath, dst string) {
 	}
 	defer src.Close()
 
+	if guard.check("open", dst) != nil {
+		return
+	}
 	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
 	if err != nil {
 		return
 	}
 	defer dstFile.Close()
 
-	io.Copy(dstFile, src)
+	copySparse(dstFile, src)
 }
 
 // addDirWrite temporarily adds owner-write permission to a directory.
@@ -487,11 +1794,11 @@ func addDirWrite(dir string) (restore func(), err error) {
 		// Already writable — nothing to do.
 		return func() {}, nil
 	}
-	if err := os.Chmod(dir, origMode|0200); err != nil {
+	if err := guard.chmod(dir, origMode|0200); err != nil {
 		return nil, err
 	}
 	return func() {
 		//goland:noinspection GoUnhandledErrorResult
-		os.Chmod(dir, origMode)
+		guard.chmod(dir, origMode)
 	}, nil
 }
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestSameExtents(t *testing.T) {
@@ -23,10 +34,18 @@ func TestSameExtents(t *testing.T) {
 		{"different length", []Extent{{Physical: 1, Length: 2}}, []Extent{{Physical: 1, Length: 9}}, false},
 		{"logical ignored", []Extent{{Logical: 0, Physical: 1, Length: 2}}, []Extent{{Logical: 99, Physical: 1, Length: 2}}, true},
 		{"flags ignored", []Extent{{Physical: 1, Length: 2, Flags: 0}}, []Extent{{Physical: 1, Length: 2, Flags: 1}}, true},
+		{"same device", []Extent{{Physical: 1, Length: 2, Device: 7}}, []Extent{{Physical: 1, Length: 2, Device: 7}}, true},
+		{"different device", []Extent{{Physical: 1, Length: 2, Device: 7}}, []Extent{{Physical: 1, Length: 2, Device: 8}}, false},
 		{"multiple matching", []Extent{{Physical: 1, Length: 2}, {Physical: 3, Length: 4}, {Physical: 5, Length: 6}},
 			[]Extent{{Physical: 1, Length: 2}, {Physical: 3, Length: 4}, {Physical: 5, Length: 6}}, true},
 		{"last differs", []Extent{{Physical: 1, Length: 2}, {Physical: 3, Length: 4}},
 			[]Extent{{Physical: 1, Length: 2}, {Physical: 3, Length: 99}}, false},
+		{"both unwritten", []Extent{{Physical: 1, Length: 2, Flags: extentFlagUnwritten}},
+			[]Extent{{Physical: 1, Length: 2, Flags: extentFlagUnwritten | extentFlagShared}}, true},
+		{"unwritten vs written", []Extent{{Physical: 1, Length: 2}, {Physical: 3, Length: 4, Flags: extentFlagUnwritten}},
+			[]Extent{{Physical: 1, Length: 2}, {Physical: 3, Length: 4}}, false},
+		{"unwritten different length", []Extent{{Physical: 1, Length: 2, Flags: extentFlagUnwritten}},
+			[]Extent{{Physical: 1, Length: 4, Flags: extentFlagUnwritten}}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -38,6 +57,98 @@ func TestSameExtents(t *testing.T) {
 	}
 }
 
+func TestFilesEqualMmap(t *testing.T) {
+	defer func(orig bool) { mmapCompare = orig }(mmapCompare)
+	mmapCompare = true
+
+	dir := t.TempDir()
+	base := randomData(7, 3*os.Getpagesize()+100)
+	flip := func(i int) []byte {
+		c := bytes.Clone(base)
+		c[i] ^= 0xff
+		return c
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"identical", base, true},
+		{"first byte", flip(0), false},
+		{"second page", flip(os.Getpagesize() + 1), false},
+		{"last byte", flip(len(base) - 1), false},
+	}
+	a := createTempFile(t, dir, "a", base)
+	for _, tt := range tests {
+		b := createTempFile(t, dir, tt.name, tt.b)
+		if eq, err := filesEqual(a, b); err != nil || eq != tt.want {
+			t.Errorf("%s: filesEqual = %v, %v; want %v", tt.name, eq, err, tt.want)
+		}
+	}
+
+	e1 := createTempFile(t, dir, "empty1", nil)
+	e2 := createTempFile(t, dir, "empty2", nil)
+	if eq, err := filesEqual(e1, e2); err != nil || !eq {
+		t.Errorf("empty files: filesEqual = %v, %v; want true", eq, err)
+	}
+}
+
+func TestFilesEqualHDD(t *testing.T) {
+	defer func(orig bool, window int64) { hddCompare, hddWindow = orig, window }(hddCompare, hddWindow)
+	hddCompare = true
+	hddWindow = 4096 // several windows per file, the last one partial
+
+	dir := t.TempDir()
+	base := randomData(11, 3*4096+100)
+	flip := func(i int) []byte {
+		c := bytes.Clone(base)
+		c[i] ^= 0xff
+		return c
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"identical", base, true},
+		{"first byte", flip(0), false},
+		{"second window", flip(4096 + 1), false},
+		{"last byte", flip(len(base) - 1), false},
+	}
+	a := createTempFile(t, dir, "a", base)
+	for _, tt := range tests {
+		b := createTempFile(t, dir, tt.name, tt.b)
+		if eq, err := filesEqual(a, b); err != nil || eq != tt.want {
+			t.Errorf("%s: filesEqual = %v, %v; want %v", tt.name, eq, err, tt.want)
+		}
+	}
+
+	e1 := createTempFile(t, dir, "empty1", nil)
+	e2 := createTempFile(t, dir, "empty2", nil)
+	if eq, err := filesEqual(e1, e2); err != nil || !eq {
+		t.Errorf("empty files: filesEqual = %v, %v; want true", eq, err)
+	}
+
+	short := createTempFile(t, dir, "short", base[:len(base)-1])
+	if eq, err := filesEqual(a, short); !errors.Is(err, errSizeMismatch) {
+		t.Errorf("different sizes: filesEqual = %v, %v; want errSizeMismatch", eq, err)
+	}
+	// A file shorter than the size being compared was truncated meanwhile.
+	fa, err := os.Open(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fa.Close()
+	fb, err := os.Open(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	if eq, err := hddEqual(fa, fb, int64(len(base))); !errors.Is(err, errSizeMismatch) {
+		t.Errorf("truncated: hddEqual = %v, %v; want errSizeMismatch", eq, err)
+	}
+}
+
 func TestIsEOF(t *testing.T) {
 	tests := []struct {
 		name string
@@ -67,6 +178,22 @@ func createTempFile(t *testing.T, dir string, name string, content []byte) strin
 	return p
 }
 
+// discardStdout redirects stdout to /dev/null for the rest of the test or
+// benchmark, hiding the per-file progress and dry-run lines.
+func discardStdout(tb testing.TB) {
+	tb.Helper()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = devNull
+	tb.Cleanup(func() {
+		os.Stdout = orig
+		devNull.Close()
+	})
+}
+
 func TestFilesEqual(t *testing.T) {
 	t.Run("identical", func(t *testing.T) {
 		dir := t.TempDir()
@@ -161,6 +288,102 @@ func TestFilesEqual(t *testing.T) {
 		}
 	})
 
+	t.Run("multi-chunk files differ in middle chunk", func(t *testing.T) {
+		dir := t.TempDir()
+		data := make([]byte, 1024*1024)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		a := createTempFile(t, dir, "a", data)
+		data[len(data)/2] ^= 0xFF
+		b := createTempFile(t, dir, "b", data)
+		eq, err := filesEqual(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eq {
+			t.Error("files differing in a middle chunk should not be equal")
+		}
+	})
+
+	t.Run("different sizes", func(t *testing.T) {
+		dir := t.TempDir()
+		a := createTempFile(t, dir, "a", []byte("hello"))
+		b := createTempFile(t, dir, "b", []byte("hello, appended"))
+		eq, err := filesEqual(a, b)
+		if !errors.Is(err, errSizeMismatch) {
+			t.Errorf("expected errSizeMismatch, got %v", err)
+		}
+		if eq {
+			t.Error("files of different sizes should not be equal")
+		}
+	})
+
+	t.Run("prefix of longer file", func(t *testing.T) {
+		// A file that grew by appending shares its whole content with the
+		// shorter copy; without the size check this must still not match.
+		dir := t.TempDir()
+		data := make([]byte, 300*1024)
+		a := createTempFile(t, dir, "a", data)
+		b := createTempFile(t, dir, "b", append(data, 0))
+		if _, err := filesEqual(a, b); !errors.Is(err, errSizeMismatch) {
+			t.Errorf("expected errSizeMismatch, got %v", err)
+		}
+	})
+
+	t.Run("grows while compared", func(t *testing.T) {
+		dir := t.TempDir()
+		data := randomData(3, 3*ioBufSize+100)
+		a := createTempFile(t, dir, "a", data)
+		b := createTempFile(t, dir, "b", data)
+		fa, err := os.Open(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fa.Close()
+		fb, err := os.Open(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fb.Close()
+		// Both were len(data) bytes when opened; b then grows by the same
+		// bytes a ends with, so only the size gives it away.
+		w, err := os.OpenFile(b, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data[len(data)-10:]); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if eq, err := readEqual(fa, fb, int64(len(data))); !errors.Is(err, errSizeMismatch) {
+			t.Errorf("readEqual = %v, %v; want errSizeMismatch", eq, err)
+		}
+	})
+
+	t.Run("shrinks while compared", func(t *testing.T) {
+		dir := t.TempDir()
+		data := randomData(4, 3*ioBufSize+100)
+		a := createTempFile(t, dir, "a", data)
+		b := createTempFile(t, dir, "b", data)
+		fa, err := os.Open(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fa.Close()
+		fb, err := os.Open(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fb.Close()
+		if err := os.Truncate(b, int64(ioBufSize)); err != nil {
+			t.Fatal(err)
+		}
+		if eq, err := readEqual(fa, fb, int64(len(data))); !errors.Is(err, errSizeMismatch) {
+			t.Errorf("readEqual = %v, %v; want errSizeMismatch", eq, err)
+		}
+	})
+
 	t.Run("same file path", func(t *testing.T) {
 		dir := t.TempDir()
 		a := createTempFile(t, dir, "a", []byte("test content"))
@@ -178,7 +401,7 @@ func TestProcessSizeGroupDryRun(t *testing.T) {
 	t.Run("single file", func(t *testing.T) {
 		dir := t.TempDir()
 		a := createTempFile(t, dir, "a", []byte("data"))
-		stats := ProcessSizeGroup([]string{a}, 4, true, false, false, false, false, nil)
+		stats := ProcessSizeGroup([]string{a}, 4, DedupOptions{DryRun: true}, nil)
 		if stats.FilesDeduped != 0 || stats.BytesSaved != 0 || stats.Errors != 0 {
 			t.Errorf("single file should have no action, got %+v", stats)
 		}
@@ -189,7 +412,7 @@ func TestProcessSizeGroupDryRun(t *testing.T) {
 		content := []byte("duplicate content here")
 		a := createTempFile(t, dir, "a", content)
 		b := createTempFile(t, dir, "b", content)
-		stats := ProcessSizeGroup([]string{a, b}, int64(len(content)), true, false, false, false, false, nil)
+		stats := ProcessSizeGroup([]string{a, b}, int64(len(content)), DedupOptions{DryRun: true}, nil)
 		if stats.FilesDeduped != 1 {
 			t.Errorf("FilesDeduped = %d, want 1", stats.FilesDeduped)
 		}
@@ -204,7 +427,7 @@ func TestProcessSizeGroupDryRun(t *testing.T) {
 		a := createTempFile(t, dir, "a", content)
 		b := createTempFile(t, dir, "b", content)
 		c := createTempFile(t, dir, "c", content)
-		stats := ProcessSizeGroup([]string{a, b, c}, int64(len(content)), true, false, false, false, false, nil)
+		stats := ProcessSizeGroup([]string{a, b, c}, int64(len(content)), DedupOptions{DryRun: true}, nil)
 		if stats.FilesDeduped != 2 {
 			t.Errorf("FilesDeduped = %d, want 2", stats.FilesDeduped)
 		}
@@ -214,7 +437,7 @@ func TestProcessSizeGroupDryRun(t *testing.T) {
 		dir := t.TempDir()
 		a := createTempFile(t, dir, "a", []byte("aaaaa"))
 		b := createTempFile(t, dir, "b", []byte("bbbbb"))
-		stats := ProcessSizeGroup([]string{a, b}, 5, true, false, false, false, false, nil)
+		stats := ProcessSizeGroup([]string{a, b}, 5, DedupOptions{DryRun: true}, nil)
 		if stats.FilesDeduped != 0 {
 			t.Errorf("different files should not be deduped, got %d", stats.FilesDeduped)
 		}
@@ -225,14 +448,14 @@ func TestProcessSizeGroupDryRun(t *testing.T) {
 		a := createTempFile(t, dir, "a", []byte("same!"))
 		b := createTempFile(t, dir, "b", []byte("same!"))
 		c := createTempFile(t, dir, "c", []byte("diff!"))
-		stats := ProcessSizeGroup([]string{a, b, c}, 5, true, false, false, false, false, nil)
+		stats := ProcessSizeGroup([]string{a, b, c}, 5, DedupOptions{DryRun: true}, nil)
 		if stats.FilesDeduped != 1 {
 			t.Errorf("FilesDeduped = %d, want 1", stats.FilesDeduped)
 		}
 	})
 
 	t.Run("empty paths", func(t *testing.T) {
-		stats := ProcessSizeGroup([]string{}, 0, true, false, false, false, false, nil)
+		stats := ProcessSizeGroup([]string{}, 0, DedupOptions{DryRun: true}, nil)
 		if stats.FilesDeduped != 0 || stats.Errors != 0 {
 			t.Errorf("empty paths should have no action, got %+v", stats)
 		}
@@ -246,7 +469,7 @@ func TestProcessSizeGroupDryRun(t *testing.T) {
 		c := createTempFile(t, dir, "c", content)
 
 		var calls []int
-		ProcessSizeGroup([]string{a, b, c}, int64(len(content)), true, false, false, false, false, func(current int) {
+		ProcessSizeGroup([]string{a, b, c}, int64(len(content)), DedupOptions{DryRun: true}, func(current int) {
 			calls = append(calls, current)
 		})
 		if len(calls) != 3 {
@@ -264,13 +487,44 @@ func TestProcessSizeGroupDryRun(t *testing.T) {
 		content := []byte("content")
 		a := createTempFile(t, dir, "a", content)
 		b := createTempFile(t, dir, "b", content)
-		stats := ProcessSizeGroup([]string{a, b}, int64(len(content)), true, false, false, false, false, nil)
+		stats := ProcessSizeGroup([]string{a, b}, int64(len(content)), DedupOptions{DryRun: true}, nil)
 		if len(stats.ErrorDetails) != 0 {
 			t.Errorf("dry-run should have no error details, got %d", len(stats.ErrorDetails))
 		}
 	})
 }
 
+func TestDedupRatio(t *testing.T) {
+	// Two contents in a group of five 1000-byte files: three copies of one
+	// and two of the other, so three files can go.
+	dir := t.TempDir()
+	a := bytes.Repeat([]byte("a"), 1000)
+	b := bytes.Repeat([]byte("b"), 1000)
+	paths := []string{
+		createTempFile(t, dir, "a1", a),
+		createTempFile(t, dir, "b1", b),
+		createTempFile(t, dir, "a2", a),
+		createTempFile(t, dir, "b2", b),
+		createTempFile(t, dir, "a3", a),
+	}
+	stats := ProcessSizeGroup(paths, 1000, DedupOptions{DryRun: true}, nil)
+	if stats.FilesScanned != 5 || stats.BytesScanned != 5000 || stats.UniqueContents != 2 {
+		t.Fatalf("FilesScanned, BytesScanned, UniqueContents = %d, %d, %d; want 5, 5000, 2",
+			stats.FilesScanned, stats.BytesScanned, stats.UniqueContents)
+	}
+	if got := stats.DedupRatio(); got != 0.6 {
+		t.Errorf("DedupRatio = %v, want 0.6", got)
+	}
+	if got := stats.UniqueRatio(); got != 0.4 {
+		t.Errorf("UniqueRatio = %v, want 0.4", got)
+	}
+
+	var empty DedupStats
+	if empty.DedupRatio() != 0 || empty.UniqueRatio() != 0 {
+		t.Errorf("empty stats ratios = %v, %v; want 0, 0", empty.DedupRatio(), empty.UniqueRatio())
+	}
+}
+
 func TestAddDirWrite(t *testing.T) {
 	t.Run("already writable", func(t *testing.T) {
 		dir := t.TempDir()
@@ -359,3 +613,1001 @@ func TestRestoreFromTemp(t *testing.T) {
 		restoreFromTemp("/nonexistent", dst) // should not panic
 	})
 }
+
+func TestFragmentationRatio(t *testing.T) {
+	extents := func(n int, flags uint32) []Extent {
+		ext := make([]Extent, n)
+		for i := range ext {
+			ext[i] = Extent{Length: 4096, Flags: flags}
+		}
+		return ext
+	}
+	const mib = 1 << 20
+
+	tests := []struct {
+		name    string
+		extents []Extent
+		size    int64
+		want    float64
+	}{
+		{"no extents", nil, mib, 0},
+		{"contiguous", extents(1, 0), mib, 1},
+		{"fragmented", extents(50, 0), mib, 50},
+		{"large file at extent limit", extents(3, 0), 300 * mib, 1},
+		{"large file fragmented", extents(30, 0), 300 * mib, 10},
+		{"compressed at natural count", extents(8, extentFlagEncoded), mib, 1},
+		{"compressed fragmented", extents(32, extentFlagEncoded), mib, 4},
+		{"mixed counts as compressed", append(extents(4, extentFlagEncoded), extents(4, 0)...), mib, 1},
+	}
+	for _, tt := range tests {
+		if got := fragmentationRatio(tt.extents, tt.size); got != tt.want {
+			t.Errorf("%s: fragmentationRatio = %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProcessSizeGroupMinFragmentation(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	content := randomData(5, 256*1024)
+	paths := []string{
+		createTempFile(t, dir, "a", content),
+		createTempFile(t, dir, "b", content),
+	}
+	extents, err := fileExtents(paths[1])
+	if err != nil || len(extents) == 0 {
+		t.Skipf("FIEMAP unavailable here: %v", err)
+	}
+	ratio := fragmentationRatio(extents, int64(len(content)))
+
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, MinFragmentation: ratio + 1}, nil)
+	if stats.Unfragmented != 1 || stats.FilesDeduped != 0 {
+		t.Errorf("above file's ratio: Unfragmented = %d, FilesDeduped = %d; want 1, 0", stats.Unfragmented, stats.FilesDeduped)
+	}
+	stats = ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, MinFragmentation: ratio}, nil)
+	if stats.Unfragmented != 0 || stats.FilesDeduped != 1 {
+		t.Errorf("at file's ratio: Unfragmented = %d, FilesDeduped = %d; want 0, 1", stats.Unfragmented, stats.FilesDeduped)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	t.Run("fast op", func(t *testing.T) {
+		v, err := withTimeout(time.Second, func() (int, error) { return 42, nil })
+		if v != 42 || err != nil {
+			t.Errorf("withTimeout = %d, %v; want 42, nil", v, err)
+		}
+	})
+
+	t.Run("op error", func(t *testing.T) {
+		want := errors.New("boom")
+		if _, err := withTimeout(time.Second, func() (int, error) { return 0, want }); err != want {
+			t.Errorf("err = %v, want %v", err, want)
+		}
+	})
+
+	t.Run("slow op", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		start := time.Now()
+		v, err := withTimeout(20*time.Millisecond, func() (int, error) {
+			<-release // a stuck syscall
+			return 42, nil
+		})
+		if !errors.Is(err, errFileTimeout) || v != 0 {
+			t.Errorf("withTimeout = %d, %v; want 0, errFileTimeout", v, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("returned after %s, want about 20ms", elapsed)
+		}
+	})
+
+	t.Run("no timeout runs inline", func(t *testing.T) {
+		ran := false
+		if _, err := withTimeout(0, func() (bool, error) { ran = true; return true, nil }); err != nil || !ran {
+			t.Errorf("ran = %v, err = %v; want true, nil", ran, err)
+		}
+	})
+}
+
+func TestSharedFraction(t *testing.T) {
+	tests := []struct {
+		name    string
+		extents []Extent
+		want    float64
+		all     bool
+	}{
+		{"no extents", nil, 0, false},
+		{"unshared", []Extent{{Length: 4096}}, 0, false},
+		{"all shared", []Extent{{Length: 4096, Flags: extentFlagShared}, {Length: 8192, Flags: extentFlagShared | extentFlagEncoded}}, 1, true},
+		{"weighted by length", []Extent{{Length: 3072, Flags: extentFlagShared}, {Length: 1024}}, 0.75, false},
+	}
+	for _, tt := range tests {
+		if got := sharedFraction(tt.extents); got != tt.want {
+			t.Errorf("%s: sharedFraction = %g, want %g", tt.name, got, tt.want)
+		}
+		if got := allShared(tt.extents); got != tt.all {
+			t.Errorf("%s: allShared = %v, want %v", tt.name, got, tt.all)
+		}
+	}
+}
+
+func TestProcessSizeGroupSkipProtected(t *testing.T) {
+	discardStdout(t)
+
+	// linked has a second link outside the group; replacing it would
+	// split the two.
+	dir := t.TempDir()
+	content := randomData(9, 64*1024)
+	ref := createTempFile(t, dir, "ref", content)
+	linked := createTempFile(t, dir, "linked", content)
+	if err := os.Link(linked, filepath.Join(t.TempDir(), "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{ref, linked}
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, SkipProtected: true}, nil)
+	if stats.Protected != 1 || stats.FilesDeduped != 0 {
+		t.Errorf("Protected = %d, FilesDeduped = %d; want 1, 0", stats.Protected, stats.FilesDeduped)
+	}
+	// As the first file, a protected file is still the ref.
+	stats = ProcessSizeGroup([]string{linked, ref}, int64(len(content)), DedupOptions{DryRun: true, SkipProtected: true}, nil)
+	if stats.Protected != 0 || stats.FilesDeduped != 1 {
+		t.Errorf("protected ref: Protected = %d, FilesDeduped = %d; want 0, 1", stats.Protected, stats.FilesDeduped)
+	}
+}
+
+func TestProcessSizeGroupPreserveShared(t *testing.T) {
+	discardStdout(t)
+
+	// snap shares its extents with live, as a snapshot would; dup is an
+	// unrelated copy. Deduping live against dup would unshare snap.
+	dir := t.TempDir()
+	content := randomData(6, 256*1024)
+	dup := createTempFile(t, dir, "dup", content)
+	live := createTempFile(t, dir, "live", content)
+	if err := reflinkCopy(live, filepath.Join(dir, "snap"), 0644); err != nil {
+		t.Skipf("reflinks unavailable here: %v", err)
+	}
+	extents, err := fileExtents(live)
+	if err != nil || sharedFraction(extents) <= preserveSharedMin {
+		t.Skipf("FIEMAP does not report shared extents here: %v", err)
+	}
+
+	paths := []string{dup, live}
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, PreserveShared: true}, nil)
+	if stats.SharedSkipped != 1 || stats.FilesDeduped != 0 {
+		t.Errorf("SharedSkipped = %d, FilesDeduped = %d; want 1, 0", stats.SharedSkipped, stats.FilesDeduped)
+	}
+	stats = ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true}, nil)
+	if stats.SharedSkipped != 0 || stats.FilesDeduped != 1 {
+		t.Errorf("without PreserveShared: SharedSkipped = %d, FilesDeduped = %d; want 0, 1", stats.SharedSkipped, stats.FilesDeduped)
+	}
+}
+
+func TestProcessSizeGroupSkipShared(t *testing.T) {
+	discardStdout(t)
+
+	// ref is an unshared copy. full shares all its extents with a
+	// snapshot-like clone; partial shares all but its rewritten first block.
+	dir := t.TempDir()
+	content := randomData(7, 256*1024)
+	ref := createTempFile(t, dir, "ref", content)
+	full := createTempFile(t, dir, "full", content)
+	partial := createTempFile(t, dir, "partial", content)
+	for _, p := range []string{full, partial} {
+		if err := reflinkCopy(p, p+".snap", 0644); err != nil {
+			t.Skipf("reflinks unavailable here: %v", err)
+		}
+	}
+	f, err := os.OpenFile(partial, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(content[:4096], 0)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullExt, err1 := fileExtents(full)
+	partialExt, err2 := fileExtents(partial)
+	if err1 != nil || err2 != nil || !allShared(fullExt) || allShared(partialExt) || sharedFraction(partialExt) == 0 {
+		t.Skipf("FIEMAP does not report shared extents here: %v, %v", err1, err2)
+	}
+
+	paths := []string{ref, full, partial}
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, SkipShared: true}, nil)
+	if stats.FullyShared != 1 || stats.FilesDeduped != 1 {
+		t.Errorf("FullyShared = %d, FilesDeduped = %d; want 1, 1", stats.FullyShared, stats.FilesDeduped)
+	}
+	stats = ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true}, nil)
+	if stats.FullyShared != 0 || stats.FilesDeduped != 2 {
+		t.Errorf("without SkipShared: FullyShared = %d, FilesDeduped = %d; want 0, 2", stats.FullyShared, stats.FilesDeduped)
+	}
+}
+
+func TestNeedsRefDefrag(t *testing.T) {
+	compressed := func(n int) []Extent {
+		ext := make([]Extent, n)
+		for i := range ext {
+			ext[i] = Extent{Length: 4096, Flags: extentFlagEncoded}
+		}
+		return ext
+	}
+	plain := make([]Extent, 100)
+
+	tests := []struct {
+		name    string
+		extents []Extent
+		size    int64
+		want    bool
+	}{
+		{"no extents", nil, 1 << 20, false},
+		{"uncompressed fragmented", plain, 1 << 20, false},
+		{"compressed at natural extent count", compressed(8), 1 << 20, false},
+		{"compressed at twice natural count", compressed(16), 1 << 20, false},
+		{"compressed heavily fragmented", compressed(17), 1 << 20, true},
+		{"small compressed file", compressed(3), 4096, true},
+		{"small compressed single extent", compressed(1), 4096, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := needsRefDefrag(tt.extents, tt.size); got != tt.want {
+				t.Errorf("needsRefDefrag(%d extents, %d) = %v, want %v", len(tt.extents), tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	err := fmt.Errorf("compare: %w", &fs.PathError{Op: "open", Path: "/x/y", Err: syscall.EACCES})
+	if path, ok := permissionDenied(err); !ok || path != "/x/y" {
+		t.Errorf("permissionDenied(EACCES) = %q, %v, want /x/y, true", path, ok)
+	}
+	if _, ok := permissionDenied(&fs.PathError{Op: "open", Path: "/x/y", Err: syscall.ENOENT}); ok {
+		t.Error("ENOENT should not count as permission denied")
+	}
+}
+
+func TestProcessSizeGroupUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files without read permission")
+	}
+	discardStdout(t)
+
+	setup := func(t *testing.T) []string {
+		dir := t.TempDir()
+		content := []byte("duplicate content")
+		a := createTempFile(t, dir, "a", content)
+		b := createTempFile(t, dir, "b", content)
+		c := createTempFile(t, dir, "c", content)
+		if err := os.Chmod(b, 0); err != nil {
+			t.Fatal(err)
+		}
+		return []string{a, b, c}
+	}
+
+	t.Run("skipped and counted", func(t *testing.T) {
+		paths := setup(t)
+		stats := ProcessSizeGroup(paths, 17, DedupOptions{DryRun: true}, nil)
+		if stats.PermissionDenied != 1 {
+			t.Errorf("PermissionDenied = %d, want 1", stats.PermissionDenied)
+		}
+		if stats.FilesDeduped != 1 || stats.Errors != 0 || stats.Fatal != nil {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("fatal stops at first unreadable file", func(t *testing.T) {
+		paths := setup(t)
+		stats := ProcessSizeGroup(paths, 17, DedupOptions{DryRun: true, PermissionFatal: true}, nil)
+		if !errors.Is(stats.Fatal, fs.ErrPermission) {
+			t.Errorf("Fatal = %v, want permission error", stats.Fatal)
+		}
+		if stats.FilesDeduped != 0 {
+			t.Errorf("FilesDeduped = %d, want 0 after stopping", stats.FilesDeduped)
+		}
+	})
+}
+
+func TestProcessSizeGroupReadError(t *testing.T) {
+	discardStdout(t)
+
+	// A directory opens like a file but fails every read (EISDIR),
+	// standing in for a file on bad media.
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad")
+	if err := os.Mkdir(bad, 0755); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(bad)
+	if err != nil || info.Size() == 0 {
+		t.Skip("directories have no size here")
+	}
+	content := randomData(3, int(info.Size()))
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+
+	_, err = filesEqual(a, bad)
+	if got, ok := readFailed(err); !ok || got != bad {
+		t.Fatalf("readFailed(%v) = %q, %v; want %s", err, got, ok, bad)
+	}
+	if _, ok := readFailed(&fs.PathError{Op: "open", Path: a, Err: fs.ErrPermission}); ok {
+		t.Error("an open error counts as a read error")
+	}
+
+	t.Run("failing file", func(t *testing.T) {
+		stats := ProcessSizeGroup([]string{a, bad, b}, info.Size(), DedupOptions{DryRun: true}, nil)
+		if !reflect.DeepEqual(stats.ReadErrors, []string{bad}) || stats.FilesDeduped != 1 {
+			t.Errorf("read errors %v, %d deduped; want [%s] and b deduped", stats.ReadErrors, stats.FilesDeduped, bad)
+		}
+	})
+
+	t.Run("failing ref", func(t *testing.T) {
+		// a cannot match the broken ref, so b dedups against a instead;
+		// the broken ref is only read once.
+		stats := ProcessSizeGroup([]string{bad, a, b}, info.Size(), DedupOptions{DryRun: true}, nil)
+		if !reflect.DeepEqual(stats.ReadErrors, []string{bad}) || stats.FilesDeduped != 1 {
+			t.Errorf("read errors %v, %d deduped; want [%s] and b deduped", stats.ReadErrors, stats.FilesDeduped, bad)
+		}
+	})
+}
+
+func TestJSONFieldNames(t *testing.T) {
+	t.Run("DedupStats", func(t *testing.T) {
+		in := DedupStats{
+			BytesSaved: 4096, FilesDeduped: 2, AlreadyDeduped: 1, Errors: 1, PermissionDenied: 3, NoCOW: 4, Unfragmented: 5, SharedSkipped: 7, FullyShared: 10, HookSkipped: 9, TimedOut: 8,
+			Protected: 11, ChangedSkipped: 12,
+			ReadErrors:   []string{"/c"},
+			FilesScanned: 6, BytesScanned: 24576, UniqueContents: 3,
+			ErrorDetails: []DedupError{{Size: 4096, Mode: "reflink", Err: "EXDEV", SrcPath: "/a", DstPath: "/b"}},
+			Fatal:        errors.New("not serialized"),
+		}
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"bytes_saved":4096,"files_deduped":2,"already_deduped":1,"errors":1,` +
+			`"error_details":[{"size":4096,"mode":"reflink","error":"EXDEV","src_path":"/a","dst_path":"/b"}],` +
+			`"permission_denied":3,"nocow_skipped":4,"unfragmented_skipped":5,"timed_out":8,"read_errors":["/c"],"shared_skipped":7,"fully_shared_skipped":10,"hook_skipped":9,` +
+			`"protected_skipped":11,"changed_skipped":12,"files_scanned":6,"bytes_scanned":24576,"unique_contents":3}`
+		if string(data) != want {
+			t.Errorf("Marshal =\n%s\nwant\n%s", data, want)
+		}
+		var out DedupStats
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		in.Fatal = nil
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("round trip = %+v, want %+v", out, in)
+		}
+	})
+
+	t.Run("SizeEntry", func(t *testing.T) {
+		in := SizeEntry{Size: 1000, Count: 3}
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"size":1000,"count":3,"savings":2000}`; string(data) != want {
+			t.Errorf("Marshal = %s, want %s", data, want)
+		}
+		var out SizeEntry
+		if err := json.Unmarshal(data, &out); err != nil || out != in {
+			t.Errorf("round trip = %+v, %v, want %+v", out, err, in)
+		}
+	})
+
+	t.Run("Extent", func(t *testing.T) {
+		in := Extent{Logical: 0, Physical: 8192, Length: 4096, Flags: extentFlagEncoded, Device: 42}
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"logical":0,"physical":8192,"length":4096,"flags":8,"device":42}`; string(data) != want {
+			t.Errorf("Marshal = %s, want %s", data, want)
+		}
+		var out Extent
+		if err := json.Unmarshal(data, &out); err != nil || out != in {
+			t.Errorf("round trip = %+v, %v, want %+v", out, err, in)
+		}
+	})
+}
+
+func TestDedupStatsString(t *testing.T) {
+	s := &DedupStats{BytesSaved: 1048576, FilesDeduped: 1200, AlreadyDeduped: 3}
+	if got, want := s.String(), "1,200 deduped, 1.0 MiB saved, 3 already, 0 errors"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestVerifySharedExtents(t *testing.T) {
+	shared := []Extent{
+		{Logical: 0, Physical: 1 << 20, Length: 65536, Flags: extentFlagShared},
+		{Logical: 65536, Physical: 2 << 20, Length: 4096, Flags: extentFlagShared | extentFlagEncoded | 0x1},
+	}
+	unshared := []Extent{
+		{Logical: 0, Physical: 1 << 20, Length: 65536, Flags: extentFlagShared},
+		{Logical: 65536, Physical: 2 << 20, Length: 4096, Flags: 0x1},
+	}
+
+	tests := []struct {
+		name     string
+		src, dst []Extent
+		wantErr  string
+	}{
+		{"both shared", shared, shared, ""},
+		{"no extents", nil, nil, ""},
+		{"source not shared", unshared, shared, "source extent at offset 65536"},
+		{"destination not shared", shared, unshared, "destination extent at offset 65536"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySharedExtents(tt.src, tt.dst)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Matching physical offsets alone pass SameExtents but not the shared check.
+	if !SameExtents(shared, unshared) {
+		t.Fatal("fixtures should have identical physical layout")
+	}
+}
+
+func TestProcessSizeGroupByName(t *testing.T) {
+	discardStdout(t)
+
+	root := t.TempDir()
+	for _, d := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := []byte("same size, same content")
+	aIndex := createTempFile(t, filepath.Join(root, "a"), "index.db", content)
+	aOther := createTempFile(t, filepath.Join(root, "a"), "other.db", content)
+	bIndex := createTempFile(t, filepath.Join(root, "b"), "index.db", content)
+	size := int64(len(content))
+
+	t.Run("same name dedups", func(t *testing.T) {
+		keyFn, _ := nameKeyFunc("")
+		stats := ProcessSizeGroup([]string{aIndex, bIndex}, size, DedupOptions{DryRun: true, NameKey: keyFn}, nil)
+		if stats.FilesDeduped != 1 {
+			t.Errorf("FilesDeduped = %d, want 1", stats.FilesDeduped)
+		}
+	})
+
+	t.Run("different name is not a candidate", func(t *testing.T) {
+		keyFn, _ := nameKeyFunc("")
+		stats := ProcessSizeGroup([]string{aIndex, aOther}, size, DedupOptions{DryRun: true, NameKey: keyFn}, nil)
+		if stats.FilesDeduped != 0 {
+			t.Errorf("FilesDeduped = %d, want 0", stats.FilesDeduped)
+		}
+		// Without grouping the same pair dedups.
+		stats = ProcessSizeGroup([]string{aIndex, aOther}, size, DedupOptions{DryRun: true}, nil)
+		if stats.FilesDeduped != 1 {
+			t.Errorf("ungrouped FilesDeduped = %d, want 1", stats.FilesDeduped)
+		}
+	})
+
+	t.Run("mixed group dedups only matching names", func(t *testing.T) {
+		keyFn, _ := nameKeyFunc("")
+		stats := ProcessSizeGroup([]string{aIndex, aOther, bIndex}, size, DedupOptions{DryRun: true, NameKey: keyFn}, nil)
+		if stats.FilesDeduped != 1 {
+			t.Errorf("FilesDeduped = %d, want 1 (b/index.db only)", stats.FilesDeduped)
+		}
+	})
+}
+
+func TestProcessSizeGroupMatchMagic(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	png := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), randomData(1, 4096)...)
+	jpeg := append([]byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00"), randomData(2, 4096)...)
+	a := createTempFile(t, dir, "a.png", png)
+	b := createTempFile(t, dir, "b.png", png)
+	c := createTempFile(t, dir, "c.jpg", jpeg)
+	if fileMagic(a) != fileMagic(b) || fileMagic(a) == fileMagic(c) || len(fileMagic(a)) != magicLen {
+		t.Fatalf("magic a=%q b=%q c=%q", fileMagic(a), fileMagic(b), fileMagic(c))
+	}
+	if short := createTempFile(t, dir, "short", []byte("GIF8")); fileMagic(short) != "GIF8" {
+		t.Errorf("short file magic = %q, want GIF8", fileMagic(short))
+	}
+
+	var buf bytes.Buffer
+	origLog := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: levelTrace})))
+	defer slog.SetDefault(origLog)
+
+	stats := ProcessSizeGroup([]string{a, c, b}, int64(len(png)), DedupOptions{DryRun: true, MatchMagic: true}, nil)
+	if stats.FilesDeduped != 1 {
+		t.Errorf("FilesDeduped = %d, want 1 (b.png)", stats.FilesDeduped)
+	}
+	// The JPEG is not grouped with the PNG before it.
+	if !strings.Contains(buf.String(), "path="+c+` trace="size 4112, refs: 0 `) {
+		t.Errorf("c.jpg was compared with other types:\n%s", buf.String())
+	}
+}
+
+func TestShorterPathNormalized(t *testing.T) {
+	nfc, nfd := "/d/caf\u00e9/x", "/d/cafe\u0301/x"
+	if shorterPath(nfd, nfc, true) || !shorterPath(nfc, nfd, true) {
+		t.Error("NFC spelling does not win over NFD")
+	}
+	// "é" is one character in both forms, so shorter than "ab" either way,
+	// and byte length alone would order them differently.
+	for _, e := range []string{"\u00e9", "e\u0301"} {
+		p, q := "/d/"+e+"/x", "/d/ab/x"
+		if !shorterPath(p, q, true) || shorterPath(q, p, true) {
+			t.Errorf("%q should be shorter than %q", p, q)
+		}
+	}
+	if !shorterPath("/d/ab/x", "/d/e\u0301/x", false) {
+		t.Error("without normalization, bytes decide")
+	}
+	if shorterPath("/a/x", "/a/x", true) {
+		t.Error("a path is not shorter than itself")
+	}
+}
+
+// TestProcessSizeGroupNormalizePaths checks the ref of hard links whose
+// names differ in normalization is the same in either walk order.
+func TestProcessSizeGroupNormalizePaths(t *testing.T) {
+	for _, e := range []string{"\u00e9", "e\u0301"} {
+		dir := t.TempDir()
+		for _, d := range []string{"ab", e} {
+			if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		content := []byte("linked twice")
+		plain := createTempFile(t, filepath.Join(dir, "ab"), "x", content)
+		accented := filepath.Join(dir, e, "x")
+		if err := os.Link(plain, accented); err != nil {
+			t.Fatal(err)
+		}
+		for _, order := range [][]string{{plain, accented}, {accented, plain}} {
+			var buf bytes.Buffer
+			opts := DedupOptions{DryRun: true, NormalizePaths: true, Groups: NewGroupsManifest(&buf)}
+			ProcessSizeGroup(order, int64(len(content)), opts, nil)
+			var rec groupRecord
+			if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Ref != accented {
+				t.Errorf("%q first: ref = %q, want %q", order[0], rec.Ref, accented)
+			}
+		}
+	}
+}
+
+func TestNameKeyFunc(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    string
+	}{
+		{"", "/snap/1/index.db", "index.db"},
+		{`^(.*)\.\d+$`, "/var/log/app.log.1", "app.log"},
+		{`^(.*)\.\d+$`, "/var/log/app.log", "app.log"},
+		{`^[a-z]+`, "/x/abc123", "abc"},
+	}
+	for _, tt := range tests {
+		keyFn, err := nameKeyFunc(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keyFn(tt.path); got != tt.want {
+			t.Errorf("nameKeyFunc(%q)(%q) = %q, want %q", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+	if _, err := nameKeyFunc("("); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestProcessSizeGroupRefAtime(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("identical content")
+	now := time.Now()
+	var paths []string
+	for i, age := range []time.Duration{3 * time.Hour, time.Minute, 2 * time.Hour} {
+		p := createTempFile(t, dir, fmt.Sprintf("f%d", i), content)
+		if err := os.Chtimes(p, now.Add(-age), now.Add(-24*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	if at, err := fileAtime(paths[1]); err != nil || !at.Equal(now.Add(-time.Minute)) {
+		t.Skipf("atime not available: %v", err)
+	}
+
+	sorted := sortByAtime(paths)
+	if want := []string{paths[1], paths[2], paths[0]}; !reflect.DeepEqual(sorted, want) {
+		t.Errorf("sortByAtime = %v, want %v", sorted, want)
+	}
+	if paths[0] != filepath.Join(dir, "f0") {
+		t.Error("sortByAtime modified its input")
+	}
+
+	// Comparing files must not bump their access times.
+	if _, err := filesEqual(paths[0], paths[2]); err != nil {
+		t.Fatal(err)
+	}
+	if at, _ := fileAtime(paths[0]); !at.Equal(now.Add(-3 * time.Hour)) {
+		t.Errorf("filesEqual changed atime to %v", at)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	origStdout := os.Stdout
+	os.Stdout = out
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, RefStrategy: refAtime}, nil)
+	os.Stdout = origStdout
+	out.Close()
+
+	if stats.FilesDeduped != 2 {
+		t.Fatalf("FilesDeduped = %d, want 2", stats.FilesDeduped)
+	}
+	report, _ := os.ReadFile(out.Name())
+	for _, p := range []string{paths[0], paths[2]} {
+		if want := p + " -> " + paths[1]; !strings.Contains(string(report), want) {
+			t.Errorf("expected %q in dry-run output:\n%s", want, report)
+		}
+	}
+}
+
+func TestProcessSizeGroupRefLowestInode(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("identical content")
+	var paths []string
+	for i := range 3 {
+		paths = append(paths, createTempFile(t, dir, fmt.Sprintf("f%d", i), content))
+	}
+	// Walk order rarely matches inode order; put the lowest inode last.
+	inodes := make(map[string]uint64)
+	for _, p := range paths {
+		ino, err := fileInode(p)
+		if err != nil {
+			t.Skipf("inode numbers not available: %v", err)
+		}
+		inodes[p] = ino.ino
+	}
+	slices.SortFunc(paths, func(a, b string) int { return cmp.Compare(inodes[b], inodes[a]) })
+	lowest := paths[2]
+	missing := filepath.Join(dir, "missing")
+
+	sorted := sortByInode(append([]string{missing}, paths...))
+	if want := []string{paths[2], paths[1], paths[0], missing}; !reflect.DeepEqual(sorted, want) {
+		t.Errorf("sortByInode = %v, want %v", sorted, want)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	origStdout := os.Stdout
+	os.Stdout = out
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, RefStrategy: refInode}, nil)
+	os.Stdout = origStdout
+	out.Close()
+
+	if stats.FilesDeduped != 2 {
+		t.Fatalf("FilesDeduped = %d, want 2", stats.FilesDeduped)
+	}
+	report, _ := os.ReadFile(out.Name())
+	for _, p := range paths[:2] {
+		if want := p + " -> " + lowest; !strings.Contains(string(report), want) {
+			t.Errorf("expected %q in dry-run output:\n%s", want, report)
+		}
+	}
+}
+
+func TestProcessSizeGroupHardLinkFarm(t *testing.T) {
+	discardStdout(t)
+
+	// Two inodes with identical content, three links each.
+	farm := func(t *testing.T) []string {
+		dir := t.TempDir()
+		content := []byte("hard link farm content")
+		var paths []string
+		for _, inode := range []string{"a", "b"} {
+			first := createTempFile(t, dir, inode+"0", content)
+			paths = append(paths, first)
+			for i := 1; i < 3; i++ {
+				link := filepath.Join(dir, fmt.Sprintf("%s%d", inode, i))
+				if err := os.Link(first, link); err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, link)
+			}
+		}
+		return paths
+	}
+	size := int64(len("hard link farm content"))
+
+	t.Run("dry run", func(t *testing.T) {
+		stats := ProcessSizeGroup(farm(t), size, DedupOptions{DryRun: true}, nil)
+		if stats.AlreadyDeduped != 2 {
+			t.Errorf("AlreadyDeduped = %d, want 2", stats.AlreadyDeduped)
+		}
+		if stats.FilesDeduped != 3 {
+			t.Errorf("FilesDeduped = %d, want 3", stats.FilesDeduped)
+		}
+	})
+
+	t.Run("hardlink", func(t *testing.T) {
+		paths := farm(t)
+		stats := ProcessSizeGroup(paths, size, DedupOptions{Hardlink: true}, nil)
+		if stats.Errors != 0 {
+			t.Fatalf("Errors = %d: %v", stats.Errors, stats.ErrorDetails)
+		}
+		want, err := os.Stat(paths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range paths[1:] {
+			got, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(got, want) {
+				t.Errorf("%s not linked to %s", p, paths[0])
+			}
+		}
+	})
+}
+
+func TestProcessSizeGroupMaxErrors(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	content := []byte("identical content that cannot be reflinked")
+	probe := createTempFile(t, dir, "probe", content)
+	if err := reflinkCopy(probe, filepath.Join(dir, "probe.clone"), 0644); err == nil {
+		t.Skip("temp dir supports reflinks; cannot inject dedup failures")
+	}
+
+	var paths []string
+	for i := range 6 {
+		paths = append(paths, createTempFile(t, dir, fmt.Sprintf("f%d", i), content))
+	}
+	size := int64(len(content))
+
+	// Every duplicate fails to reflink, so each one is an error.
+	stats := ProcessSizeGroup(paths, size, DedupOptions{}, nil)
+	if stats.Errors != 5 || stats.Fatal != nil {
+		t.Fatalf("unlimited: Errors = %d, Fatal = %v; want 5, nil", stats.Errors, stats.Fatal)
+	}
+
+	stats = ProcessSizeGroup(paths, size, DedupOptions{MaxErrors: 2}, nil)
+	if stats.Errors != 3 {
+		t.Errorf("Errors = %d, want 3 (stop just past the limit)", stats.Errors)
+	}
+	if !errors.Is(stats.Fatal, errTooManyErrors) {
+		t.Errorf("Fatal = %v, want errTooManyErrors", stats.Fatal)
+	}
+	if len(stats.ErrorDetails) != 3 {
+		t.Errorf("ErrorDetails = %d entries, want 3", len(stats.ErrorDetails))
+	}
+}
+
+func TestProcessSizeGroupPreferHardlink(t *testing.T) {
+	discardStdout(t)
+
+	content := []byte("prefer hard links when identical")
+	size := int64(len(content))
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	setup := func(t *testing.T) (ref, same, differs string) {
+		dir := t.TempDir()
+		ref = createTempFile(t, dir, "ref", content)
+		same = createTempFile(t, dir, "same", content)
+		differs = createTempFile(t, dir, "differs", content)
+		for _, p := range []string{ref, same, differs} {
+			if err := os.Chtimes(p, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chmod(differs, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return ref, same, differs
+	}
+
+	t.Run("mode per file", func(t *testing.T) {
+		ref, same, differs := setup(t)
+		if !sameMetadata(ref, same) {
+			t.Skip("file ownership is not available on this platform")
+		}
+		if sameMetadata(ref, differs) {
+			t.Fatal("files with different modes reported as the same")
+		}
+		var buf bytes.Buffer
+		opts := DedupOptions{DryRun: true, PreferHardlink: true, Events: NewEventLog(&buf)}
+		ProcessSizeGroup([]string{ref, same, differs}, size, opts, nil)
+
+		modes := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var ev struct{ Path, Mode string }
+			if err := json.Unmarshal([]byte(line), &ev); err != nil {
+				t.Fatal(err)
+			}
+			modes[ev.Path] = ev.Mode
+		}
+		if modes[same] != "hardlink" || modes[differs] != "reflink" {
+			t.Errorf("modes = %v, want same: hardlink, differs: reflink", modes)
+		}
+	})
+
+	t.Run("identical metadata is hard-linked", func(t *testing.T) {
+		ref, same, _ := setup(t)
+		if !sameMetadata(ref, same) {
+			t.Skip("file ownership is not available on this platform")
+		}
+		stats := ProcessSizeGroup([]string{ref, same}, size, DedupOptions{PreferHardlink: true}, nil)
+		if stats.FilesDeduped != 1 || stats.Errors != 0 {
+			t.Fatalf("FilesDeduped = %d, Errors = %d; want 1, 0", stats.FilesDeduped, stats.Errors)
+		}
+		ri, _ := os.Stat(ref)
+		si, _ := os.Stat(same)
+		if !os.SameFile(ri, si) {
+			t.Error("identical files were not hard-linked")
+		}
+	})
+
+	t.Run("differing metadata keeps its inode", func(t *testing.T) {
+		ref, _, differs := setup(t)
+		before, _ := os.Stat(differs)
+		ProcessSizeGroup([]string{ref, differs}, size, DedupOptions{PreferHardlink: true}, nil)
+		ri, _ := os.Stat(ref)
+		di, err := os.Stat(differs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(ri, di) {
+			t.Error("file with different mode was hard-linked")
+		}
+		if di.Mode() != before.Mode() {
+			t.Errorf("mode = %v, want %v", di.Mode(), before.Mode())
+		}
+	})
+}
+
+func TestProcessSizeGroupBatchDedupe(t *testing.T) {
+	// More duplicates than fit in one call, so the queue is flushed once
+	// when full and once when the group ends.
+	dir := t.TempDir()
+	content := randomData(7, 8192)
+	n := dedupeBatchMax + 30
+	paths := make([]string, n)
+	inodes := make([]os.FileInfo, n)
+	for i := range paths {
+		paths[i] = createTempFile(t, dir, fmt.Sprintf("f%03d", i), content)
+		inodes[i], _ = os.Stat(paths[i])
+	}
+	supported := reflinkCopy(paths[0], filepath.Join(t.TempDir(), "probe"), 0644) == nil
+
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{BatchDedupe: true}, nil)
+
+	dups := int64(n - 1)
+	if supported {
+		if stats.FilesDeduped != dups || stats.Errors != 0 {
+			t.Errorf("FilesDeduped = %d, Errors = %d; want %d, 0", stats.FilesDeduped, stats.Errors, dups)
+		}
+	} else {
+		// Every queued file reaches the kernel and fails there.
+		if stats.FilesDeduped != 0 || stats.Errors != dups || int64(len(stats.ErrorDetails)) != dups {
+			t.Errorf("FilesDeduped = %d, Errors = %d, ErrorDetails = %d; want 0, %d, %d",
+				stats.FilesDeduped, stats.Errors, len(stats.ErrorDetails), dups, dups)
+		}
+		for _, d := range stats.ErrorDetails {
+			if d.SrcPath != paths[0] {
+				t.Errorf("error for %s has ref %s, want %s", d.DstPath, d.SrcPath, paths[0])
+				break
+			}
+		}
+	}
+
+	// Range dedup works in place: same inodes, same content.
+	for i, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil || !os.SameFile(info, inodes[i]) {
+			t.Fatalf("%s: inode changed or file gone (%v)", p, err)
+		}
+		if data, _ := os.ReadFile(p); !bytes.Equal(data, content) {
+			t.Fatalf("%s: content changed", p)
+		}
+	}
+}
+
+func TestProcessSizeGroupHotRef(t *testing.T) {
+	dir := t.TempDir()
+	// The common content's ref comes after rarer ones, and the hot ref
+	// changes when a rare duplicate turns up.
+	var paths []string
+	for _, f := range []struct{ name, content string }{
+		{"u0", "unique content 0"},
+		{"u1", "unique content 1"},
+		{"c0", "common content 0"},
+		{"c1", "common content 0"},
+		{"y0", "second content 0"},
+		{"c2", "common content 0"},
+		{"y1", "second content 0"},
+		{"c3", "common content 0"},
+	} {
+		paths = append(paths, createTempFile(t, dir, f.name, []byte(f.content)))
+	}
+	stats := ProcessSizeGroup(paths, 16, DedupOptions{Hardlink: true}, nil)
+	if stats.Errors != 0 {
+		t.Fatalf("Errors = %d: %v", stats.Errors, stats.ErrorDetails)
+	}
+	if stats.FilesDeduped != 4 || stats.UniqueContents != 4 {
+		t.Errorf("FilesDeduped = %d, UniqueContents = %d; want 4, 4", stats.FilesDeduped, stats.UniqueContents)
+	}
+	linked := func(a, b string) bool {
+		ia, errA := os.Stat(filepath.Join(dir, a))
+		ib, errB := os.Stat(filepath.Join(dir, b))
+		return errA == nil && errB == nil && os.SameFile(ia, ib)
+	}
+	for _, name := range []string{"c1", "c2", "c3"} {
+		if !linked("c0", name) {
+			t.Errorf("%s not linked to c0", name)
+		}
+	}
+	if !linked("y0", "y1") {
+		t.Error("y1 not linked to y0")
+	}
+	if linked("u0", "u1") || linked("u0", "c0") {
+		t.Error("distinct contents were linked")
+	}
+}
+
+func TestConvergedRatio(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("converging content")
+	size := int64(len(content))
+	var paths []string
+	for i := range 4 {
+		paths = append(paths, createTempFile(t, dir, fmt.Sprintf("a%d", i), content))
+	}
+
+	// First run: every duplicate is new.
+	stats := ProcessSizeGroup(paths, size, DedupOptions{Hardlink: true}, nil)
+	if stats.FilesDeduped != 3 || stats.ConvergedRatio() != 0 {
+		t.Fatalf("first run: %d deduped, converged %v; want 3, 0", stats.FilesDeduped, stats.ConvergedRatio())
+	}
+
+	// Second run after one more copy appeared: three of four duplicates
+	// were done already.
+	paths = append(paths, createTempFile(t, dir, "a4", content))
+	stats = ProcessSizeGroup(paths, size, DedupOptions{Hardlink: true}, nil)
+	if stats.AlreadyDeduped != 3 || stats.FilesDeduped != 1 {
+		t.Fatalf("second run: %d already, %d deduped; want 3, 1", stats.AlreadyDeduped, stats.FilesDeduped)
+	}
+	if got := stats.ConvergedRatio(); got != 0.75 {
+		t.Errorf("ConvergedRatio = %v, want 0.75", got)
+	}
+
+	// Third run: nothing left to do.
+	stats = ProcessSizeGroup(paths, size, DedupOptions{Hardlink: true}, nil)
+	if got := stats.ConvergedRatio(); got != 1 {
+		t.Errorf("ConvergedRatio = %v, want 1", got)
+	}
+
+	var empty DedupStats
+	if empty.ConvergedRatio() != 0 {
+		t.Errorf("empty ConvergedRatio = %v, want 0", empty.ConvergedRatio())
+	}
+}
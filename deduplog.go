@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Per-file dedup logging modes for --log-dedups.
+const (
+	logDedupsNone   = "none"
+	logDedupsSample = "sample"
+	logDedupsAll    = "all"
+)
+
+// DedupLog prints a "dst -> ref" line for deduped files according to a
+// logging mode. In sample mode only one in every N dedups is printed, which
+// keeps bulk runs from spending their time writing log lines.
+// A nil *DedupLog logs nothing.
+type DedupLog struct {
+	mode  string
+	every int64
+	count atomic.Int64
+	out   io.Writer
+}
+
+// NewDedupLog creates a dedup logger writing to stderr. every is the sample
+// interval and is only used in sample mode.
+func NewDedupLog(mode string, every int64) (*DedupLog, error) {
+	switch mode {
+	case logDedupsNone, logDedupsAll:
+	case logDedupsSample:
+		if every < 1 {
+			return nil, fmt.Errorf("sample interval must be at least 1, got %d", every)
+		}
+	default:
+		return nil, fmt.Errorf("invalid log mode %q (want %s, %s, or %s)", mode, logDedupsNone, logDedupsSample, logDedupsAll)
+	}
+	return &DedupLog{mode: mode, every: every, out: os.Stderr}, nil
+}
+
+// Record notes one successful dedup and prints it if the mode selects it.
+func (l *DedupLog) Record(path, ref string) {
+	if l == nil || l.mode == logDedupsNone {
+		return
+	}
+	n := l.count.Add(1)
+	if l.mode == logDedupsSample && (n-1)%l.every != 0 {
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	fmt.Fprintf(l.out, "    %s -> %s\n", path, ref)
+}
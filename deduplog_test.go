@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewDedupLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		every   int64
+		wantErr bool
+	}{
+		{"none", logDedupsNone, 0, false},
+		{"all", logDedupsAll, 0, false},
+		{"sample", logDedupsSample, 100, false},
+		{"sample zero interval", logDedupsSample, 0, true},
+		{"unknown mode", "some", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDedupLog(tt.mode, tt.every)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewDedupLog(%q, %d) error = %v, wantErr %v", tt.mode, tt.every, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDedupLogRecord(t *testing.T) {
+	record := func(mode string, every int64, n int) []string {
+		l, err := NewDedupLog(mode, every)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		l.out = &buf
+		for range n {
+			l.Record("/a/dup", "/a/ref")
+		}
+		return strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	}
+
+	t.Run("all", func(t *testing.T) {
+		if lines := record(logDedupsAll, 0, 25); len(lines) != 25 {
+			t.Errorf("logged %d lines, want 25", len(lines))
+		}
+	})
+
+	t.Run("sample rate", func(t *testing.T) {
+		lines := record(logDedupsSample, 10, 1000)
+		if len(lines) != 100 {
+			t.Errorf("logged %d lines, want 100 (1 in 10)", len(lines))
+		}
+		if lines[0] != "    /a/dup -> /a/ref" {
+			t.Errorf("unexpected line format: %q", lines[0])
+		}
+	})
+
+	t.Run("sample logs first dedup", func(t *testing.T) {
+		if lines := record(logDedupsSample, 1000, 1); len(lines) != 1 || lines[0] == "" {
+			t.Errorf("first dedup should be logged, got %q", lines)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		if lines := record(logDedupsNone, 0, 50); len(lines) != 1 || lines[0] != "" {
+			t.Errorf("none mode should log nothing, got %d lines", len(lines))
+		}
+	})
+
+	t.Run("nil logger", func(t *testing.T) {
+		var l *DedupLog
+		l.Record("/a", "/b") // should not panic
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// dedupOnlyFunc returns whether a path matches any of the --dedup-only
+// glob patterns. A pattern without a slash is matched against the base
+// name; one with slashes against as many trailing path components, so
+// "wp-admin/*.php" matches /home/site1/www/wp-admin/index.php.
+func dedupOnlyFunc(patterns []string) (func(path string) bool, error) {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, err
+		}
+	}
+	return func(path string) bool {
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, trailingComponents(path, strings.Count(p, "/")+1)); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// trailingComponents returns the last n slash-separated components of path.
+func trailingComponents(path string, n int) string {
+	i := len(path)
+	for ; n > 0 && i > 0; n-- {
+		i = strings.LastIndexByte(path[:i], '/')
+	}
+	return path[i+1:]
+}
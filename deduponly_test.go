@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDedupOnlyFunc(t *testing.T) {
+	match, err := dedupOnlyFunc([]string{"*.css", "wp-admin/*.php"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/home/a/www/style.css", true},
+		{"style.css", true},
+		{"/home/a/www/wp-admin/index.php", true},
+		{"wp-admin/index.php", true},
+		{"/home/a/www/index.php", false},
+		{"/home/a/wp-admin/inc/index.php", false},
+		{"/home/a/my-wp-admin/index.php", false},
+		{"/home/a/notes.txt", false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.path); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if _, err := dedupOnlyFunc([]string{"["}); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestDedupOnlyPass2(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("same bytes")
+	var matching, others []string
+	for _, site := range []string{"a", "b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, site, "wp-admin"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		matching = append(matching, createTempFile(t, filepath.Join(root, site, "wp-admin"), "load.php", content))
+		others = append(others, createTempFile(t, filepath.Join(root, site), "upload.txt", content))
+	}
+	match, err := dedupOnlyFunc([]string{"wp-admin/*.php"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walk := WalkOptions{ShouldProcess: func(path string, _ os.FileInfo) bool { return match(path) }}
+
+	collected, err := CollectFiles(root, map[int64]struct{}{int64(len(content)): {}}, walk, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, cp := range collected[int64(len(content))] {
+		paths = append(paths, cp.String())
+	}
+	slices.Sort(paths)
+	if !slices.Equal(paths, matching) {
+		t.Fatalf("collected %v, want %v", paths, matching)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	origStdout := os.Stdout
+	os.Stdout = out
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true}, nil)
+	os.Stdout = origStdout
+	out.Close()
+
+	if stats.FilesDeduped != 2 {
+		t.Errorf("FilesDeduped = %d, want 2", stats.FilesDeduped)
+	}
+	report, _ := os.ReadFile(out.Name())
+	for _, p := range others {
+		if strings.Contains(string(report), p) {
+			t.Errorf("non-matching %s in dry-run output:\n%s", p, report)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Output formats for --output.
+const (
+	outputText  = "text"
+	outputJSONL = "jsonl"
+)
+
+// Event names written by EventLog.
+const (
+	eventPassStart = "pass_start"
+	eventPassEnd   = "pass_end"
+	eventDedup     = "dedup"
+	eventError     = "error"
+	eventProgress  = "progress"
+	eventRunEnd    = "run_end"
+)
+
+// EventLog writes run events as JSON lines for log aggregation. Every line
+// is one object with "ts" (RFC 3339, UTC) and "event" first, followed by the
+// event's own fields. It is safe for concurrent use. A nil *EventLog writes
+// nothing.
+type EventLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+	err error
+}
+
+// NewEventLog creates an event log writing to w.
+func NewEventLog(w io.Writer) *EventLog {
+	return &EventLog{w: w, now: time.Now}
+}
+
+// Emit writes one event. fields must not contain "ts" or "event". Write
+// errors are kept and reported by Err; later events are dropped.
+func (l *EventLog) Emit(event string, fields map[string]any) {
+	if l == nil {
+		return
+	}
+	head, _ := json.Marshal(struct {
+		TS    string `json:"ts"`
+		Event string `json:"event"`
+	}{l.now().UTC().Format(time.RFC3339Nano), event})
+	line := head
+	if len(fields) > 0 {
+		rest, err := json.Marshal(fields)
+		if err != nil {
+			l.setErr(err)
+			return
+		}
+		// Splice the sorted fields in after ts and event.
+		line = append(bytes.TrimSuffix(head, []byte("}")), ',')
+		line = append(line, rest[1:]...)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return
+	}
+	_, l.err = l.w.Write(line)
+}
+
+func (l *EventLog) setErr(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+// Err returns the first error encountered while writing events.
+func (l *EventLog) Err() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// toStdout reports whether events go to standard output, which then carries
+// nothing else.
+func (l *EventLog) toStdout() bool {
+	return l != nil && l.w == os.Stdout
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventLogEmit(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewEventLog(&buf)
+	l.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("X", 3600)) }
+
+	l.Emit(eventPassStart, map[string]any{"pass": 1, "root": "/data"})
+	l.Emit(eventPassEnd, nil)
+
+	want := `{"ts":"2024-05-01T11:00:00Z","event":"pass_start","pass":1,"root":"/data"}` + "\n" +
+		`{"ts":"2024-05-01T11:00:00Z","event":"pass_end"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	var nilLog *EventLog
+	nilLog.Emit(eventDedup, map[string]any{"path": "x"})
+	if nilLog.Err() != nil {
+		t.Error("nil EventLog should report no error")
+	}
+}
+
+type failWriter struct{ n int }
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	w.n++
+	return 0, errors.New("disk full")
+}
+
+func TestEventLogWriteError(t *testing.T) {
+	w := &failWriter{}
+	l := NewEventLog(w)
+	l.Emit(eventProgress, nil)
+	l.Emit(eventProgress, nil)
+	if l.Err() == nil {
+		t.Fatal("expected write error")
+	}
+	if w.n != 1 {
+		t.Errorf("writes after error = %d, want 1", w.n)
+	}
+}
+
+func TestProcessSizeGroupEvents(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	content := []byte("event stream content")
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+	c := createTempFile(t, dir, "c", content)
+
+	var buf bytes.Buffer
+	events := NewEventLog(&buf)
+	stats := ProcessSizeGroup([]string{a, b, c}, int64(len(content)), DedupOptions{DryRun: true, Events: events}, nil)
+	if stats.FilesDeduped != 2 {
+		t.Fatalf("FilesDeduped = %d, want 2", stats.FilesDeduped)
+	}
+
+	var got []string
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var ev map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("line %q is not JSON: %v", sc.Text(), err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, ev["ts"].(string)); err != nil {
+			t.Errorf("bad ts in %q: %v", sc.Text(), err)
+		}
+		if ev["event"] != eventDedup || ev["ref"] != a || ev["dry_run"] != true {
+			t.Errorf("unexpected event %q", sc.Text())
+		}
+		got = append(got, ev["path"].(string))
+	}
+	if len(got) != 2 || got[0] != b || got[1] != c {
+		t.Errorf("dedup events for %v, want [%s %s]", got, b, c)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// dirList is a repeatable string flag.
+type dirList []string
+
+func (l *dirList) String() string { return strings.Join(*l, ",") }
+
+func (l *dirList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// ExcludeDirs is a set of directories whose subtrees are never visited.
+// Paths are stored in the form walks produce under root, so a directory is
+// pruned with one map lookup before it is read. A nil *ExcludeDirs excludes
+// nothing.
+type ExcludeDirs struct {
+	dirs map[string]struct{}
+}
+
+// NewExcludeDirs normalizes dirs for a walk of root, which must be absolute
+// and clean. Relative dirs are resolved against root and symlinks are
+// resolved where the directory exists, as they are for root. It returns nil
+// if dirs is empty.
+func NewExcludeDirs(root string, dirs []string) *ExcludeDirs {
+	if len(dirs) == 0 {
+		return nil
+	}
+	e := &ExcludeDirs{dirs: make(map[string]struct{}, len(dirs))}
+	for _, d := range dirs {
+		if !filepath.IsAbs(d) {
+			d = filepath.Join(root, d)
+		}
+		d = filepath.Clean(d)
+		if canonical, err := filepath.EvalSymlinks(d); err == nil {
+			d = canonical
+		}
+		// An exclude at or above root covers the whole walk.
+		if rel, err := filepath.Rel(d, root); err == nil && !isDotDot(rel) {
+			d = root
+		}
+		e.dirs[d] = struct{}{}
+	}
+	return e
+}
+
+// Has reports whether dir is itself excluded. Walks check each directory
+// before descending, so nothing below an excluded one is ever reached.
+func (e *ExcludeDirs) Has(dir string) bool {
+	if e == nil {
+		return false
+	}
+	_, ok := e.dirs[dir]
+	return ok
+}
+
+// Covers reports whether path is at or under an excluded directory, for
+// paths that do not come from a walk.
+func (e *ExcludeDirs) Covers(path string) bool {
+	if e == nil {
+		return false
+	}
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if e.Has(p) {
+			return true
+		}
+		if parent := filepath.Dir(p); parent == p {
+			return false
+		}
+	}
+}
+
+// isDotDot reports whether the relative path rel leaves its base directory.
+func isDotDot(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewExcludeDirs(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NewExcludeDirs(root, nil) != nil {
+		t.Error("no dirs should give a nil set")
+	}
+	e := NewExcludeDirs(root, []string{"live/", "./a/../b", filepath.Join(root, "abs") + "/"})
+	for _, dir := range []string{"live", "b", "abs"} {
+		if !e.Has(filepath.Join(root, dir)) {
+			t.Errorf("%s not excluded", dir)
+		}
+	}
+	if e.Has(filepath.Join(root, "a")) || e.Has(root) {
+		t.Error("unexpected directory excluded")
+	}
+
+	// Excluding root or one of its parents excludes everything.
+	for _, d := range []string{".", filepath.Dir(root)} {
+		if !NewExcludeDirs(root, []string{d}).Has(root) {
+			t.Errorf("exclude %q does not cover root", d)
+		}
+	}
+	if NewExcludeDirs(root, []string{root + "-other"}).Has(root) {
+		t.Error("a sibling with root as a string prefix covers root")
+	}
+
+	var nilSet *ExcludeDirs
+	if nilSet.Has(root) || nilSet.Covers(root) {
+		t.Error("nil set excludes")
+	}
+}
+
+func TestExcludeDirsCovers(t *testing.T) {
+	e := NewExcludeDirs("/data", []string{"live"})
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/data/live", true},
+		{"/data/live/x", true},
+		{"/data/live/deep/er/x", true},
+		{"/data/live2/x", false},
+		{"/data/x", false},
+		{"/data", false},
+	}
+	for _, tt := range tests {
+		if got := e.Covers(tt.path); got != tt.want {
+			t.Errorf("Covers(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWalkExcludeUnder(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"keep", "live/x", "live/deep/er/y", "live2/z", "other/nested/skip/w", "other/nested/kept"} {
+		p := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := WalkOptions{Exclude: NewExcludeDirs(root, []string{"live", filepath.Join(root, "other/nested/skip")})}
+
+	var got []string
+	count, _, err := WalkSizes(root, NewSizeMap(100), walk, nil, nil, nil, time.Time{}, func(path string, _ int64) {
+		rel, _ := filepath.Rel(root, path)
+		got = append(got, rel)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(got)
+	want := []string{"keep", "live2/z", "other/nested/kept"}
+	if count != 3 || !slices.Equal(got, want) {
+		t.Errorf("walked %d files %v, want %v", count, got, want)
+	}
+	if n := CountFiles(root, walk); n != 3 {
+		t.Errorf("CountFiles = %d, want 3", n)
+	}
+	if indexedUnder(root, filepath.Join(root, "live/deep/er/y"), walk) {
+		t.Error("index entry under an excluded directory accepted")
+	}
+
+	walk.Exclude = NewExcludeDirs(root, []string{"."})
+	if count, _, _ := WalkSizes(root, NewSizeMap(100), walk, nil, nil, nil, time.Time{}, nil); count != 0 {
+		t.Errorf("excluded root walked %d files, want 0", count)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+// Exit codes. Without --detailed-exit-codes a run exits exitOK, or
+// exitError on a fatal error or when any file failed.
+const (
+	exitOK      = 0 // ran cleanly; with --detailed-exit-codes, nothing to dedup
+	exitError   = 1 // fatal error: bad flags, unreadable root, aborted run
+	exitChanged = 2 // --detailed-exit-codes: ran cleanly and deduped files
+	exitPartial = 3 // --detailed-exit-codes: ran to the end, but some files failed
+)
+
+// exitCode derives the exit code of a completed run from its counts of
+// deduped and failed files. In a dry run, deduped files are the ones that
+// would have been.
+func exitCode(deduped, errs int64, detailed bool) int {
+	switch {
+	case !detailed && errs > 0:
+		return exitError
+	case !detailed:
+		return exitOK
+	case errs > 0:
+		return exitPartial
+	case deduped > 0:
+		return exitChanged
+	default:
+		return exitOK
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name          string
+		deduped, errs int64
+		detailed      bool
+		want          int
+	}{
+		{"clean", 5, 0, false, exitOK},
+		{"nothing to do", 0, 0, false, exitOK},
+		{"errors", 5, 2, false, exitError},
+		{"detailed changed", 5, 0, true, exitChanged},
+		{"detailed nothing to do", 0, 0, true, exitOK},
+		{"detailed partial", 5, 2, true, exitPartial},
+		{"detailed only errors", 0, 2, true, exitPartial},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.deduped, tt.errs, tt.detailed); got != tt.want {
+			t.Errorf("%s: exitCode(%d, %d, %v) = %d, want %d", tt.name, tt.deduped, tt.errs, tt.detailed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Verdicts returned by explainFile, one per way a file can leave the
+// decision path in ProcessSizeGroup.
+const (
+	explainMissing      = "missing"
+	explainNotRegular   = "not-regular"
+	explainTooSmall     = "too-small"
+	explainOutsideRoot  = "outside-root"
+	explainNoSameSize   = "no-same-size"
+	explainNoCOW        = "nocow"
+	explainUnfragmented = "unfragmented"
+	explainShared       = "shared"
+	explainAlready      = "already-deduped"
+	explainDuplicate    = "duplicate"
+	explainUnique       = "unique"
+)
+
+// explainFile traces the checks a run over root would apply to path and
+// writes one line per step to w, ending with the outcome. It returns the
+// verdict. The walk and comparisons are the ones a run makes, so the
+// answer reflects the tree as it is now: a file whose size changed since a
+// run started is explained at its new size.
+func explainFile(w io.Writer, root, path string, walk WalkOptions, opts DedupOptions) string {
+	say := func(format string, args ...any) {
+		//goland:noinspection GoUnhandledErrorResult
+		fmt.Fprintf(w, "  "+format+"\n", args...)
+	}
+	fmt.Fprintf(w, "Explaining %s\n", path)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		say("cannot stat: %v", err)
+		return explainMissing
+	}
+	if !info.Mode().IsRegular() {
+		say("not a regular file (%s); only regular files are deduped", info.Mode().Type())
+		return explainNotRegular
+	}
+	size := info.Size()
+	say("regular file, %s (%d bytes)", formatSize(size, false), size)
+	if size == 0 || size < walk.MinSize {
+		say("smaller than --min-size %d; not scanned", max(walk.MinSize, 1))
+		return explainTooSmall
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		say("outside %s; not scanned", root)
+		return explainOutsideRoot
+	}
+
+	// Pass 1 and 2 in one walk: the files a run would group with path.
+	var others []string
+	var magic string
+	if opts.MatchMagic {
+		magic = fileMagic(path)
+	}
+	_ = walkRandom(root, walk, nil, func(p string, s int64) {
+		if s != size || p == path {
+			return
+		}
+		if opts.NameKey != nil && opts.NameKey(p) != opts.NameKey(path) {
+			return
+		}
+		if opts.MatchMagic && fileMagic(p) != magic {
+			return
+		}
+		others = append(others, p)
+	})
+	if len(others) == 0 {
+		say("no other file of %d bytes under %s; nothing to compare with", size, root)
+		return explainNoSameSize
+	}
+	say("%s other files of the same size", formatCount(int64(len(others))))
+
+	if !opts.Hardlink && isNoCOW(path) {
+		say("has the nocow attribute and cannot be reflinked (chattr -C or use --hardlink)")
+		return explainNoCOW
+	}
+
+	extents, err := fileExtents(path)
+	if err != nil {
+		say("cannot read extents (%v); comparing content only", err)
+	} else {
+		say("extents: %s, fragmentation ratio %.1f, %.0f%% shared",
+			formatCount(int64(len(extents))), fragmentationRatio(extents, size), 100*sharedFraction(extents))
+		if opts.MinFragmentation > 0 && fragmentationRatio(extents, size) < opts.MinFragmentation {
+			say("below --min-fragmentation %g; left alone", opts.MinFragmentation)
+			return explainUnfragmented
+		}
+		if opts.PreserveShared && sharedFraction(extents) > preserveSharedMin {
+			say("mostly shared already; left alone by --preserve-shared")
+			return explainShared
+		}
+		if opts.SkipShared && allShared(extents) {
+			say("all extents shared already; left alone by --skip-shared")
+			return explainShared
+		}
+	}
+
+	// Sharing storage with any file settles it, whichever order a run
+	// would visit them in.
+	for _, other := range others {
+		if otherInfo, err := os.Lstat(other); err == nil && os.SameFile(otherInfo, info) {
+			say("already a hard link of %s", other)
+			return explainAlready
+		}
+		if extents != nil {
+			if otherExt, err := fileExtents(other); err == nil && SameExtents(otherExt, extents) {
+				say("already shares all extents with %s", other)
+				return explainAlready
+			}
+		}
+	}
+
+	mode := "reflink"
+	if opts.Hardlink {
+		mode = "hard link"
+	}
+	var differ, failed int
+	for _, other := range others {
+		equal, err := filesEqual(other, path)
+		if err != nil {
+			say("cannot compare with %s: %v", other, err)
+			failed++
+			continue
+		}
+		if equal {
+			say("identical to %s; one of the two would be replaced by a %s of the other", other, mode)
+			return explainDuplicate
+		}
+		differ++
+	}
+	say("content differs from all %s same-size files", formatCount(int64(differ)))
+	if failed > 0 {
+		say("%s comparisons failed; see above", formatCount(int64(failed)))
+	}
+	return explainUnique
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExplainFile(t *testing.T) {
+	root := t.TempDir()
+	a := createTempFile(t, root, "a", []byte("same"))
+	b := createTempFile(t, root, "b", []byte("same"))
+	c := createTempFile(t, root, "c", []byte("diff"))
+	lonely := createTempFile(t, root, "lonely", []byte("only file of this size"))
+	link := filepath.Join(root, "link")
+	if err := os.Link(c, link); err != nil {
+		t.Fatal(err)
+	}
+	sym := filepath.Join(root, "sym")
+	if err := os.Symlink(a, sym); err != nil {
+		t.Fatal(err)
+	}
+	outside := createTempFile(t, t.TempDir(), "outside", []byte("same"))
+
+	tests := []struct {
+		name    string
+		path    string
+		minSize int64
+		want    string
+	}{
+		{"duplicate", b, 0, explainDuplicate},
+		{"hard link", link, 0, explainAlready},
+		{"no same size", lonely, 0, explainNoSameSize},
+		{"below min size", a, 1024, explainTooSmall},
+		{"symlink", sym, 0, explainNotRegular},
+		{"missing", filepath.Join(root, "missing"), 0, explainMissing},
+		{"outside root", outside, 0, explainOutsideRoot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if got := explainFile(&out, root, tt.path, WalkOptions{MinSize: tt.minSize}, DedupOptions{}); got != tt.want {
+				t.Errorf("verdict = %q, want %q; output:\n%s", got, tt.want, out.String())
+			}
+			if !strings.HasPrefix(out.String(), "Explaining "+tt.path+"\n") {
+				t.Errorf("output does not start with the path:\n%s", out.String())
+			}
+		})
+	}
+
+	t.Run("unique", func(t *testing.T) {
+		// c's only same-size, differing neighbors are a and b once its
+		// hard link is gone.
+		if err := os.Remove(link); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if got := explainFile(&out, root, c, WalkOptions{}, DedupOptions{}); got != explainUnique {
+			t.Errorf("verdict = %q, want %q; output:\n%s", got, explainUnique, out.String())
+		}
+		if !strings.Contains(out.String(), "differs from all 2 same-size files") {
+			t.Errorf("output does not report 2 differing files:\n%s", out.String())
+		}
+	})
+}
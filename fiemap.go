@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"syscall"
+)
+
+// errNoFIEMAP is returned by fileExtents when FIEMAP was found to be
+// unsupported at startup.
+var errNoFIEMAP = errors.New("FIEMAP not supported on this filesystem")
+
+// fiemapSupported records whether the filesystem being processed answers
+// FIEMAP. It is set once at startup by configureFIEMAP; when false, extent
+// lookups are skipped and reflinks are verified by content comparison.
+var fiemapSupported = true
+
+// errDelalloc is returned by getExtents for a file whose extents still
+// have no physical location after syncing it.
+var errDelalloc = errors.New("extents still delayed-allocated after sync")
+
+// errTooManyExtents is returned by fileExtentsMax for a file with more
+// extents than asked for.
+var errTooManyExtents = errors.New("too many extents")
+
+// FIEMAP sync modes for --fiemap-sync.
+const (
+	fiemapSyncAlways   = "always"   // every query flushes the file first
+	fiemapSyncDelalloc = "delalloc" // flush only files reporting delalloc
+)
+
+// fiemapTargetedSync, set once at startup by --fiemap-sync delalloc, makes
+// getExtents query without FIEMAP_FLAG_SYNC and fsync only files whose
+// extents come back delayed-allocated, then query them again. Most files
+// were flushed long ago, so this saves a sync per file on busy trees.
+var fiemapTargetedSync bool
+
+// hasDelalloc reports whether any extent has no physical location yet.
+// Such offsets are placeholders: two files would appear to share them.
+func hasDelalloc(extents []Extent) bool {
+	for _, e := range extents {
+		if e.Flags&(extentFlagDelalloc|extentFlagUnknown) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fiemapUnsupported reports whether err means the filesystem or kernel does
+// not implement FIEMAP at all, as opposed to failing for one file.
+func fiemapUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTTY) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// configureFIEMAP probes FIEMAP on the first regular file under root and sets
+// fiemapSupported. Directories are not probed because some filesystems (btrfs)
+// only implement FIEMAP for files. If no file can be probed, FIEMAP is
+// assumed to work and per-file fallbacks still apply.
+func configureFIEMAP(root string) {
+	var probe string
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			probe = path
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if probe == "" {
+		return
+	}
+	if _, err := getExtents(probe); err != nil && fiemapUnsupported(err) {
+		fiemapSupported = false
+		slog.Debug("FIEMAP unsupported, verifying reflinks by content", "probe", probe, "error", err)
+	}
+}
+
+// fileExtents returns the extents of path, or errNoFIEMAP without touching
+// the file when FIEMAP is known to be unsupported.
+func fileExtents(path string) ([]Extent, error) {
+	if !fiemapSupported {
+		return nil, errNoFIEMAP
+	}
+	return getExtents(path)
+}
+
+// fileExtentsMax is fileExtents, failing with errTooManyExtents for files
+// with more than max extents.
+func fileExtentsMax(path string, max int) ([]Extent, error) {
+	if !fiemapSupported {
+		return nil, errNoFIEMAP
+	}
+	return getExtentsMax(path, max)
+}
+
+// fileExtentsPrefix is fileExtents limited to the extents overlapping the
+// first length bytes, for estimates only.
+func fileExtentsPrefix(path string, length int64) ([]Extent, error) {
+	if !fiemapSupported {
+		return nil, errNoFIEMAP
+	}
+	return getExtentsPrefix(path, uint64(length))
+}
+
+// fileExtentsEqual is extentsEqual, or errNoFIEMAP without touching the
+// files when FIEMAP is known to be unsupported.
+func fileExtentsEqual(a, b string) (bool, error) {
+	if !fiemapSupported {
+		return false, errNoFIEMAP
+	}
+	return extentsEqual(a, b)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFiemapUnsupported(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("FIEMAP ioctl on /x: %w", syscall.ENOTTY), true},
+		{fmt.Errorf("FIEMAP ioctl on /x: %w", syscall.EOPNOTSUPP), true},
+		{fmt.Errorf("FIEMAP ioctl on /x: %w", syscall.EIO), false},
+		{syscall.EACCES, false},
+	}
+	for _, tt := range tests {
+		if got := fiemapUnsupported(tt.err); got != tt.want {
+			t.Errorf("fiemapUnsupported(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestHasDelalloc(t *testing.T) {
+	tests := []struct {
+		name    string
+		extents []Extent
+		want    bool
+	}{
+		{"none", nil, false},
+		{"allocated", []Extent{{Physical: 4096, Length: 4096}, {Physical: 8192, Length: 4096, Flags: extentFlagShared}}, false},
+		{"delalloc", []Extent{{Physical: 4096, Length: 4096}, {Length: 4096, Flags: extentFlagDelalloc | extentFlagUnknown}}, true},
+		{"unknown", []Extent{{Length: 4096, Flags: extentFlagUnknown}}, true},
+	}
+	for _, tt := range tests {
+		if got := hasDelalloc(tt.extents); got != tt.want {
+			t.Errorf("%s: hasDelalloc = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigureFIEMAP(t *testing.T) {
+	defer func(orig bool) { fiemapSupported = orig }(fiemapSupported)
+
+	dir := t.TempDir()
+	createTempFile(t, dir, "probe", []byte("data"))
+	configureFIEMAP(dir)
+	_, err := getExtents(dir + "/probe")
+	if want := err == nil || !fiemapUnsupported(err); fiemapSupported != want {
+		t.Errorf("fiemapSupported = %v, want %v (probe error %v)", fiemapSupported, want, err)
+	}
+
+	fiemapSupported = true
+	configureFIEMAP(t.TempDir())
+	if !fiemapSupported {
+		t.Error("empty tree should leave FIEMAP assumed supported")
+	}
+}
+
+// TestNoFIEMAPVerification simulates a filesystem that clones but has no
+// FIEMAP: verification must fall back to comparing content.
+func TestNoFIEMAPVerification(t *testing.T) {
+	defer func(orig bool) { fiemapSupported = orig }(fiemapSupported)
+	fiemapSupported = false
+
+	dir := t.TempDir()
+	src := createTempFile(t, dir, "src", []byte("cloned content"))
+	same := createTempFile(t, dir, "same", []byte("cloned content"))
+	diff := createTempFile(t, dir, "diff", []byte("corrupt conten"))
+
+	if _, err := fileExtents(src); !errors.Is(err, errNoFIEMAP) {
+		t.Errorf("fileExtents error = %v, want errNoFIEMAP", err)
+	}
+	if err := verifyReflink(src, same, nil, false); err != nil {
+		t.Errorf("identical content should verify without FIEMAP: %v", err)
+	}
+	if err := verifyReflink(src, diff, nil, false); err == nil || !strings.Contains(err.Error(), "content mismatch") {
+		t.Errorf("differing content error = %v, want content mismatch", err)
+	}
+	if err := verifyReflink(src, same, nil, true); err == nil {
+		t.Error("--verify-shared cannot succeed without FIEMAP")
+	}
+
+	stats := ProcessSizeGroup([]string{src, same}, 14, DedupOptions{DryRun: true}, nil)
+	if stats.FilesDeduped != 1 {
+		t.Errorf("FilesDeduped = %d, want 1 via content comparison", stats.FilesDeduped)
+	}
+}
+
+// TestVerifyReflinkTrusted checks that --no-verify-reflink skips reading
+// either file, unless --verify-shared asks for the check explicitly.
+func TestVerifyReflinkTrusted(t *testing.T) {
+	defer func(orig bool) { trustReflink = orig }(trustReflink)
+	trustReflink = true
+
+	dir := t.TempDir()
+	src := createTempFile(t, dir, "src", []byte("cloned content"))
+	missing := filepath.Join(dir, "missing")
+
+	if err := verifyReflink(src, missing, nil, false); err != nil {
+		t.Errorf("trusted reflink was verified: %v", err)
+	}
+	if err := verifyReflink(src, missing, nil, true); err == nil {
+		t.Error("--verify-shared was skipped")
+	}
+}
+
+// TestVerifyReflinkCachedExtents checks that a clone matching the ref's
+// cached extents is verified without reading the ref again, and that a
+// mismatch with stale cached extents is rechecked against the ref itself.
+func TestVerifyReflinkCachedExtents(t *testing.T) {
+	dir := t.TempDir()
+	src := createTempFile(t, dir, "src", randomData(10, 64*1024))
+	srcExtents, err := fileExtents(src)
+	if err != nil || len(srcExtents) == 0 {
+		t.Skipf("FIEMAP unavailable here: %v", err)
+	}
+	// A hard link stands in for a clone: it has exactly src's extents.
+	clone := filepath.Join(dir, "clone")
+	if err := os.Link(src, clone); err != nil {
+		t.Fatal(err)
+	}
+	// With src gone, only the cached extents can verify the clone.
+	if err := os.Rename(src, src+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyReflink(src, clone, srcExtents, false); err != nil {
+		t.Errorf("clone matching the cached extents: %v", err)
+	}
+	if err := verifyReflink(src, clone, nil, false); err == nil {
+		t.Error("without cached extents, the missing src was not read")
+	}
+
+	// Stale cached extents fall back to comparing with src as it is now.
+	if err := os.Rename(src+".moved", src); err != nil {
+		t.Fatal(err)
+	}
+	stale := []Extent{{Logical: 0, Physical: 1 << 40, Length: srcExtents[0].Length}}
+	if err := verifyReflink(src, clone, stale, false); err != nil {
+		t.Errorf("stale cached extents were not rechecked: %v", err)
+	}
+}
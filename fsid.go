@@ -0,0 +1,30 @@
+package main
+
+import "sync"
+
+// fsID identifies the filesystem a file is on: files can only share data
+// with files of the same fsID. It is the btrfs filesystem UUID, which
+// every subvolume shares although each has its own st_dev, or else the
+// device number.
+type fsID struct {
+	dev  uint64
+	uuid [16]byte
+}
+
+// fsIDs caches the fsID of each device number seen, so each filesystem is
+// probed once per run.
+var fsIDs sync.Map // uint64 -> fsID
+
+// filesystemOf returns the fsID of path, whose st_dev is dev. It is a
+// variable so tests can place files on simulated filesystems.
+var filesystemOf = func(path string, dev uint64) fsID {
+	if id, ok := fsIDs.Load(dev); ok {
+		return id.(fsID)
+	}
+	id := fsID{dev: dev}
+	if uuid, err := btrfsFSID(path); err == nil && uuid != nil {
+		id = fsID{uuid: *uuid}
+	}
+	fsIDs.Store(dev, id)
+	return id
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestProcessSizeGroupPerFilesystem places identical files on two
+// simulated filesystems: each must be deduped within its own, with no
+// attempt across them.
+func TestProcessSizeGroupPerFilesystem(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	content := []byte("same content on two filesystems")
+	var paths []string
+	for _, fs := range []string{"fs1", "fs2"} {
+		if err := os.Mkdir(filepath.Join(dir, fs), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b"} {
+			paths = append(paths, createTempFile(t, filepath.Join(dir, fs), name, content))
+		}
+	}
+	// Interleave so each file's predecessor is on the other filesystem.
+	paths = []string{paths[0], paths[2], paths[1], paths[3]}
+
+	defer func(orig func(string, uint64) fsID) { filesystemOf = orig }(filesystemOf)
+	filesystemOf = func(path string, _ uint64) fsID {
+		if strings.Contains(path, "/fs1/") {
+			return fsID{dev: 1}
+		}
+		return fsID{dev: 2}
+	}
+
+	var script bytes.Buffer
+	s, err := NewDedupScript(&script, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, Script: s}, nil)
+	if stats.FilesDeduped != 2 || stats.UniqueContents != 2 {
+		t.Errorf("got %d deduped, %d unique; want 2, 2 (one per filesystem)", stats.FilesDeduped, stats.UniqueContents)
+	}
+	for _, line := range strings.Split(script.String(), "\n") {
+		if !strings.HasPrefix(line, "cp ") {
+			continue
+		}
+		if strings.Contains(line, "/fs1/") == strings.Contains(line, "/fs2/") {
+			t.Errorf("dedup across filesystems: %s", line)
+		}
+	}
+}
+
+// TestProcessSizeGroupPerDevice is TestProcessSizeGroupPerFilesystem on
+// two real devices, where the test environment has a second one.
+func TestProcessSizeGroupPerDevice(t *testing.T) {
+	discardStdout(t)
+
+	dirs := []string{t.TempDir()}
+	other, err := os.MkdirTemp("/dev/shm", "fastdedup")
+	if err != nil {
+		t.Skipf("no second device: %v", err)
+	}
+	defer os.RemoveAll(other)
+	dirs = append(dirs, other)
+	if fileDevice(dirs[0]) == fileDevice(dirs[1]) {
+		t.Skip("/dev/shm is on the same device as the temporary directory")
+	}
+
+	content := []byte("same content on two devices")
+	var paths []string
+	for _, name := range []string{"a", "b"} {
+		for _, dir := range dirs {
+			paths = append(paths, createTempFile(t, dir, name, content))
+		}
+	}
+	var groups bytes.Buffer
+	g := NewGroupsManifest(&groups)
+	stats := ProcessSizeGroup(paths, int64(len(content)), DedupOptions{DryRun: true, Groups: g}, nil)
+	if stats.FilesDeduped != 2 || stats.UniqueContents != 2 {
+		t.Errorf("got %d deduped, %d unique; want 2, 2 (one per device)", stats.FilesDeduped, stats.UniqueContents)
+	}
+	// Each device's copy is deduped against the ref on its own device.
+	for _, line := range strings.Split(strings.TrimSpace(groups.String()), "\n") {
+		var rec groupRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range rec.Paths {
+			if filepath.Dir(p) != filepath.Dir(rec.Ref) {
+				t.Errorf("%s grouped with %s on another device", p, rec.Ref)
+			}
+		}
+	}
+}
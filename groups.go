@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// contentGroup collects the paths ProcessSizeGroup found to share one
+// content, for DedupOptions.Groups. Alternative refs added after a failed
+// dedup join the group of the ref they matched.
+type contentGroup struct {
+	primary *fileRef // first ref of the content; its path is the reference
+	paths   []string
+}
+
+// groupRecord is one line of a --groups-manifest file.
+type groupRecord struct {
+	Size  int64    `json:"size"`
+	Ref   string   `json:"ref"`
+	Paths []string `json:"paths"`
+}
+
+// GroupsManifest writes every content group with more than one path as a
+// JSON line, whether its members were deduped now, earlier, or not at all.
+// A nil *GroupsManifest writes nothing.
+type GroupsManifest struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	n   int64
+	err error
+}
+
+// NewGroupsManifest returns a GroupsManifest writing to w.
+func NewGroupsManifest(w io.Writer) *GroupsManifest {
+	return &GroupsManifest{enc: json.NewEncoder(w)}
+}
+
+// Record writes the group of paths of the given size whose reference is
+// ref. Groups of a single path are skipped. Write errors are kept and
+// reported by Err.
+func (g *GroupsManifest) Record(size int64, ref string, paths []string) {
+	if g == nil || len(paths) < 2 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil {
+		return
+	}
+	g.err = g.enc.Encode(groupRecord{Size: size, Ref: ref, Paths: paths})
+	g.n++
+}
+
+// Err returns the first write error, if any, and the number of groups
+// written.
+func (g *GroupsManifest) Err() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.n, g.err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGroupsManifest(t *testing.T) {
+	dir := t.TempDir()
+	a := createTempFile(t, dir, "a", []byte("same"))
+	b := createTempFile(t, dir, "b", []byte("same"))
+	c := createTempFile(t, dir, "c", []byte("diff"))
+	d := filepath.Join(dir, "d")
+	if err := os.Link(a, d); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	g := NewGroupsManifest(&buf)
+	ProcessSizeGroup([]string{a, b, c, d}, 4, DedupOptions{DryRun: true, Groups: g}, nil)
+	if n, err := g.Err(); err != nil || n != 1 {
+		t.Fatalf("Err() = %d, %v; want 1 group", n, err)
+	}
+
+	var got groupRecord
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("%q: %v", buf.String(), err)
+	}
+	want := groupRecord{Size: 4, Ref: a, Paths: []string{a, b, d}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("group = %+v, want %+v", got, want)
+	}
+}
+
+func TestGroupsManifestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	g := NewGroupsManifest(&buf)
+	g.Record(10, "/a", []string{"/a"})
+	g.Record(10, "/b", []string{"/b", "/c"})
+	want := `{"size":10,"ref":"/b","paths":["/b","/c"]}` + "\n"
+	if buf.String() != want {
+		t.Errorf("output = %q, want %q (single-path groups skipped)", buf.String(), want)
+	}
+
+	var nilGroups *GroupsManifest
+	nilGroups.Record(10, "/a", []string{"/a", "/b"})
+}
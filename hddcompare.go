@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// hddCompare makes filesEqual read each file a whole window at a time (see
+// hddEqual) instead of both files in parallel, trading memory for fewer
+// seeks on spinning disks. It is set once at startup by --hdd-mode.
+var hddCompare bool
+
+// hddBuffers recycles hddWindow-sized buffers across comparisons.
+var hddBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, hddWindow)
+	return &buf
+}}
+
+// hddEqual compares the first size bytes of fa and fb by reading a window
+// of fa, then the same window of fb, so the disk head moves between files
+// once per window rather than once per buffer. Each window is announced
+// with fadvise so it is fetched in large requests. A file that is shorter
+// than size, or changed size while compared, is reported as
+// errSizeMismatch.
+func hddEqual(fa, fb *os.File, size int64) (bool, error) {
+	n := min(hddWindow, size)
+	get := func() *[]byte {
+		buf := hddBuffers.Get().(*[]byte)
+		if int64(cap(*buf)) < n { // pooled before hddWindow grew
+			*buf = make([]byte, hddWindow)
+		}
+		return buf
+	}
+	pa, pb := get(), get()
+	defer hddBuffers.Put(pa)
+	defer hddBuffers.Put(pb)
+	bufA, bufB := (*pa)[:n], (*pb)[:n]
+	read := func(f *os.File, buf []byte, off int64) error {
+		adviseWillNeed(f, off, int64(len(buf)))
+		if _, err := io.ReadFull(f, buf); err != nil {
+			if isEOF(err) {
+				return fmt.Errorf("%w: %s truncated while compared", errSizeMismatch, f.Name())
+			}
+			return err
+		}
+		return nil
+	}
+	for off := int64(0); off < size; off += n {
+		w := min(n, size-off)
+		if err := read(fa, bufA[:w], off); err != nil {
+			return false, err
+		}
+		if err := read(fb, bufB[:w], off); err != nil {
+			return false, err
+		}
+		live.BytesCompared.Add(w)
+		if !bytes.Equal(bufA[:w], bufB[:w]) {
+			return false, nil
+		}
+	}
+
+	if err := checkUnchangedSize(size, fa, fb); err != nil {
+		return false, err
+	}
+	return true, nil
+}
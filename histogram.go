@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// histogramBounds are the upper bounds (exclusive) of the size histogram
+// buckets; the last bucket holds everything from the final bound upwards.
+var histogramBounds = [...]int64{1 << 10, 4 << 10, 64 << 10, 1 << 20, 16 << 20, 256 << 20, 1 << 30}
+
+// histogramLabels names the buckets delimited by histogramBounds.
+var histogramLabels = [len(histogramBounds) + 1]string{
+	"< 1K", "1K-4K", "4K-64K", "64K-1M", "1M-16M", "16M-256M", "256M-1G", ">= 1G",
+}
+
+// SizeHistogram counts files and bytes in log-scale size buckets. Unlike
+// SizeMap it is fixed-size, so it covers every walked file even after the
+// SizeMap has evicted entries.
+type SizeHistogram struct {
+	Counts [len(histogramBounds) + 1]int64
+	Bytes  [len(histogramBounds) + 1]int64
+}
+
+// histogramBucket returns the bucket index for a file of the given size.
+func histogramBucket(size int64) int {
+	for i, bound := range histogramBounds {
+		if size < bound {
+			return i
+		}
+	}
+	return len(histogramBounds)
+}
+
+// Add records one file of the given size.
+func (h *SizeHistogram) Add(size int64) {
+	i := histogramBucket(size)
+	h.Counts[i]++
+	h.Bytes[i] += size
+}
+
+// Write prints the non-empty buckets with their file counts, total bytes,
+// and share of the total bytes.
+func (h *SizeHistogram) Write(w io.Writer, rawSizes bool) {
+	var total int64
+	for _, b := range h.Bytes {
+		total += b
+	}
+	fmt.Fprintf(w, "\nFile size histogram:\n")
+	fmt.Fprintf(w, "  %-10s  %10s  %10s  %6s\n", "Size", "Files", "Bytes", "Share")
+	for i, count := range h.Counts {
+		if count == 0 {
+			continue
+		}
+		share := 0.0
+		if total > 0 {
+			share = float64(h.Bytes[i]) * 100 / float64(total)
+		}
+		fmt.Fprintf(w, "  %-10s  %10s  %10s  %5.1f%%\n",
+			histogramLabels[i], formatCount(count), formatSize(h.Bytes[i], rawSizes), share)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramBucket(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, 0},
+		{1023, 0},
+		{1024, 1},
+		{4095, 1},
+		{4096, 2},
+		{65536, 3},
+		{1 << 20, 4},
+		{16 << 20, 5},
+		{256 << 20, 6},
+		{1<<30 - 1, 6},
+		{1 << 30, 7},
+		{1 << 40, 7},
+	}
+	for _, tt := range tests {
+		if got := histogramBucket(tt.size); got != tt.want {
+			t.Errorf("histogramBucket(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	var h SizeHistogram
+	for _, size := range []int64{100, 200, 2048, 1 << 20, 3 << 20, 2 << 30} {
+		h.Add(size)
+	}
+	if h.Counts[0] != 2 || h.Bytes[0] != 300 {
+		t.Errorf("< 1K bucket = %d files, %d bytes, want 2, 300", h.Counts[0], h.Bytes[0])
+	}
+	if h.Counts[4] != 2 || h.Bytes[4] != 4<<20 {
+		t.Errorf("1M-16M bucket = %d files, %d bytes, want 2, %d", h.Counts[4], h.Bytes[4], 4<<20)
+	}
+	if h.Counts[7] != 1 {
+		t.Errorf(">= 1G bucket = %d files, want 1", h.Counts[7])
+	}
+
+	var out bytes.Buffer
+	h.Write(&out, true)
+	report := out.String()
+	for _, want := range []string{"< 1K", "1K-4K", "1M-16M", ">= 1G", "4194304"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("histogram missing %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "4K-64K") {
+		t.Errorf("empty bucket should be omitted:\n%s", report)
+	}
+}
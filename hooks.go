@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// DedupHooks runs site commands around each file replaced: pre before it
+// is touched, post after it was deduped. Commands run through /bin/sh -c
+// with the ref, the file being replaced and the size as $1, $2 and $3,
+// and as FASTDEDUP_SRC, FASTDEDUP_DST and FASTDEDUP_SIZE in the
+// environment, FASTDEDUP_HOOK being "pre" or "post". Their output goes to
+// stderr, so it never mixes with --output jsonl. A nil *DedupHooks runs
+// nothing. Hooks are not run in dry-run mode.
+type DedupHooks struct {
+	pre, post string
+}
+
+// NewDedupHooks returns hooks running the given commands, or nil if both
+// are empty.
+func NewDedupHooks(pre, post string) *DedupHooks {
+	if pre == "" && post == "" {
+		return nil
+	}
+	return &DedupHooks{pre: pre, post: post}
+}
+
+// Pre runs the pre-dedup command for replacing dst with src. An error,
+// including a nonzero exit, means dst must be left alone.
+func (h *DedupHooks) Pre(src, dst string, size int64) error {
+	if h == nil || h.pre == "" {
+		return nil
+	}
+	return runHook(h.pre, "pre", src, dst, size)
+}
+
+// Post runs the post-dedup command after dst was deduped against src.
+// The dedup is done either way, so a failure is only logged.
+func (h *DedupHooks) Post(src, dst string, size int64) {
+	if h == nil || h.post == "" {
+		return
+	}
+	if err := runHook(h.post, "post", src, dst, size); err != nil {
+		slog.Warn("post-hook failed", "src", src, "dst", dst, "error", err)
+	}
+}
+
+func runHook(command, stage, src, dst string, size int64) error {
+	sizeArg := strconv.FormatInt(size, 10)
+	cmd := exec.Command("/bin/sh", "-c", command, "fastdedup", src, dst, sizeArg)
+	cmd.Env = append(os.Environ(),
+		"FASTDEDUP_HOOK="+stage,
+		"FASTDEDUP_SRC="+src,
+		"FASTDEDUP_DST="+dst,
+		"FASTDEDUP_SIZE="+sizeArg,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDedupHooks(t *testing.T) {
+	var h *DedupHooks
+	if err := h.Pre("a", "b", 1); err != nil {
+		t.Errorf("nil hooks: Pre = %v", err)
+	}
+	h.Post("a", "b", 1)
+	if NewDedupHooks("", "") != nil {
+		t.Error("NewDedupHooks with no commands should be nil")
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	h = NewDedupHooks(
+		`echo "$FASTDEDUP_HOOK $1 $2 $3" >> `+out,
+		`echo "$FASTDEDUP_HOOK $FASTDEDUP_SRC $FASTDEDUP_DST $FASTDEDUP_SIZE" >> `+out+`; exit 1`,
+	)
+	if err := h.Pre("/ref", "/dst", 42); err != nil {
+		t.Fatalf("Pre: %v", err)
+	}
+	h.Post("/ref", "/dst", 42) // fails, only warns
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "pre /ref /dst 42\npost /ref /dst 42\n"; got != want {
+		t.Errorf("hook output = %q, want %q", got, want)
+	}
+
+	if err := NewDedupHooks("exit 3", "").Pre("/ref", "/dst", 42); err == nil {
+		t.Error("Pre with failing command: expected error")
+	}
+}
+
+func TestProcessSizeGroupHooks(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("identical content for hooks")
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+	c := createTempFile(t, dir, "c", content)
+	log := filepath.Join(t.TempDir(), "log")
+
+	// Veto c; let b through.
+	pre := `echo "pre $2" >> ` + log + `; case "$2" in */c) exit 1;; esac`
+	post := `echo "post $2" >> ` + log
+	stats := ProcessSizeGroup([]string{a, b, c}, int64(len(content)), DedupOptions{
+		Hardlink: true,
+		Hooks:    NewDedupHooks(pre, post),
+	}, nil)
+
+	if stats.FilesDeduped != 1 || stats.HookSkipped != 1 || stats.Errors != 0 {
+		t.Errorf("got %d deduped, %d hook-skipped, %d errors; want 1, 1, 0",
+			stats.FilesDeduped, stats.HookSkipped, stats.Errors)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{"pre " + b, "post " + b, "pre " + c}, "\n") + "\n"
+	if string(data) != want {
+		t.Errorf("hook log =\n%s\nwant\n%s", data, want)
+	}
+
+	infoA, _ := os.Stat(a)
+	infoB, _ := os.Stat(b)
+	infoC, _ := os.Stat(c)
+	if !os.SameFile(infoA, infoB) {
+		t.Error("b was not linked to a")
+	}
+	if os.SameFile(infoA, infoC) {
+		t.Error("c was linked despite the failed pre-hook")
+	}
+}
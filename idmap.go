@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// idRange maps count ids starting at from onto ids starting at to.
+type idRange struct {
+	to, from, count uint32
+}
+
+// ownerPolicy decides what ownership a replaced file gets. The zero value
+// preserves the original uid and gid unchanged.
+type ownerPolicy struct {
+	skip bool      // leave ownership to whoever created the file
+	uids []idRange // applied to the original uid; unmatched ids pass through
+	gids []idRange
+}
+
+// restoreOwner is the ownerPolicy used by restoreMetadata. It is set once at
+// startup from --preserve-owner, --map-uid and --map-gid and read-only
+// afterwards.
+var restoreOwner ownerPolicy
+
+// parseIDMap parses a comma-separated list of HOSTLOW:CONTLOW:COUNT ranges.
+// Ids in [CONTLOW, CONTLOW+COUNT) are mapped to HOSTLOW plus the same
+// offset, as for a container whose ids are shifted on the host.
+func parseIDMap(s string) ([]idRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ranges []idRange
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%q: want HOSTLOW:CONTLOW:COUNT", part)
+		}
+		var vals [3]uint32
+		for i, f := range fields {
+			v, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", part, err)
+			}
+			vals[i] = uint32(v)
+		}
+		r := idRange{to: vals[0], from: vals[1], count: vals[2]}
+		if r.count == 0 {
+			return nil, fmt.Errorf("%q: count must be positive", part)
+		}
+		if uint64(r.from)+uint64(r.count) > 1<<32 || uint64(r.to)+uint64(r.count) > 1<<32 {
+			return nil, fmt.Errorf("%q: range exceeds 32-bit ids", part)
+		}
+		for _, prev := range ranges {
+			if r.from < prev.from+prev.count && prev.from < r.from+r.count {
+				return nil, fmt.Errorf("%q overlaps another range", part)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// mapID returns id translated by the first range containing it, or id
+// itself if no range does.
+func mapID(ranges []idRange, id uint32) uint32 {
+	for _, r := range ranges {
+		if id >= r.from && id-r.from < r.count {
+			return r.to + (id - r.from)
+		}
+	}
+	return id
+}
+
+// owner returns the uid and gid to give a file whose original owner was
+// uid:gid, and false if ownership should not be set at all.
+func (p ownerPolicy) owner(uid, gid uint32) (uint32, uint32, bool) {
+	if p.skip {
+		return 0, 0, false
+	}
+	return mapID(p.uids, uid), mapID(p.gids, gid), true
+}
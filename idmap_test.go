@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIDMap(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []idRange
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"100000:0:65536", []idRange{{to: 100000, from: 0, count: 65536}}, false},
+		{"1000:0:1,2000:1:10", []idRange{{to: 1000, from: 0, count: 1}, {to: 2000, from: 1, count: 10}}, false},
+		{"1:2", nil, true},
+		{"a:0:1", nil, true},
+		{"1:0:0", nil, true},
+		{"1:0:-1", nil, true},
+		{"0:4294967295:2", nil, true},
+		{"1000:0:10,2000:5:10", nil, true}, // overlapping container ranges
+	}
+	for _, tt := range tests {
+		got, err := parseIDMap(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseIDMap(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIDMap(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOwnerPolicy(t *testing.T) {
+	ranges, err := parseIDMap("100000:0:65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ownerPolicy{uids: ranges, gids: ranges}
+	for _, tt := range []struct{ in, want uint32 }{
+		{0, 100000},
+		{1000, 101000},
+		{65535, 165535},
+		{65536, 65536}, // outside the range: unchanged
+	} {
+		if uid, gid, ok := p.owner(tt.in, tt.in); !ok || uid != tt.want || gid != tt.want {
+			t.Errorf("owner(%d) = %d, %d, %v; want %d", tt.in, uid, gid, ok, tt.want)
+		}
+	}
+
+	if uid, gid, ok := (ownerPolicy{}).owner(42, 43); !ok || uid != 42 || gid != 43 {
+		t.Errorf("zero policy owner = %d, %d, %v; want 42, 43, true", uid, gid, ok)
+	}
+	if _, _, ok := (ownerPolicy{skip: true}).owner(42, 43); ok {
+		t.Error("skip policy should not set ownership")
+	}
+}
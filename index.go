@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IndexSizes records in sm the size of each file listed in an index read
+// from r, in place of walking the tree in pass 1. Each line holds a path
+// and a size in bytes separated by whitespace, as written by
+// `find DIR -type f -printf '%p\t%s\n'`; the path ends at the last space
+// or tab. Relative paths are taken relative to root. Empty lines are
+// ignored, and so are paths outside root and files walk would skip. The
+// index is trusted: nothing is stat'ed, so walk.ShouldProcess sees only
+// the name and size, and files that have since changed only show up in
+// pass 2. The optional onFile callback is called for every file recorded.
+func IndexSizes(r io.Reader, root string, sm *SizeMap, walk WalkOptions, onFile func(path string, size int64)) (int64, error) {
+	var count int64
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndexAny(line, " \t")
+		if i <= 0 {
+			return count, fmt.Errorf("line %d: want PATH SIZE", lineNo)
+		}
+		size, err := strconv.ParseInt(line[i+1:], 10, 64)
+		if err != nil || size < 0 {
+			return count, fmt.Errorf("line %d: invalid size %q", lineNo, line[i+1:])
+		}
+		path := strings.TrimRight(line[:i], " \t")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		path = filepath.Clean(path)
+		if !indexedUnder(root, path, walk) || !walk.accepts(path, indexedFile{path, size}) {
+			continue
+		}
+		sm.Add(size)
+		count++
+		if onFile != nil {
+			onFile(path, size)
+		}
+	}
+	return count, sc.Err()
+}
+
+// indexedUnder reports whether path lies under root and would be reached
+// by walkRandom there.
+func indexedUnder(root, path string, walk WalkOptions) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || isDotDot(rel) || walk.Exclude.Covers(path) {
+		return false
+	}
+	if walk.IncludeSnapshots {
+		return true
+	}
+	for _, dir := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if dir == ".snapshots" {
+			return false
+		}
+	}
+	return true
+}
+
+// indexedFile is the os.FileInfo of an index entry: a regular file of the
+// listed size, with nothing else known.
+type indexedFile struct {
+	path string
+	size int64
+}
+
+func (f indexedFile) Name() string       { return filepath.Base(f.path) }
+func (f indexedFile) Size() int64        { return f.size }
+func (f indexedFile) Mode() os.FileMode  { return 0 }
+func (f indexedFile) ModTime() time.Time { return time.Time{} }
+func (f indexedFile) IsDir() bool        { return false }
+func (f indexedFile) Sys() any           { return nil }
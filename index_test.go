@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIndexSizes(t *testing.T) {
+	index := strings.Join([]string{
+		"/data/a.bin\t4096",
+		"/data/dir with spaces/b.bin 4096",
+		"c.bin\t4096",
+		"",
+		"/data/small\t10",
+		"/data/empty\t0",
+		"/other/d.bin\t4096",
+		"/data/.snapshots/1/a.bin\t4096",
+		"/data/e.bin\t8192\r",
+	}, "\n")
+
+	sm := NewSizeMap(100)
+	var paths []string
+	n, err := IndexSizes(strings.NewReader(index), "/data", sm, WalkOptions{MinSize: 100}, func(path string, _ int64) {
+		paths = append(paths, path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/data/a.bin", "/data/dir with spaces/b.bin", "/data/c.bin", "/data/e.bin"}
+	if n != int64(len(want)) || strings.Join(paths, "|") != strings.Join(want, "|") {
+		t.Errorf("got %d files %q, want %q", n, paths, want)
+	}
+	top := sm.TopN(10)
+	if len(top) != 1 || top[0].Size != 4096 || top[0].Count != 3 {
+		t.Errorf("TopN = %+v, want 3 files of 4096 bytes", top)
+	}
+
+	sm = NewSizeMap(100)
+	if n, err := IndexSizes(strings.NewReader(index), "/data", sm, WalkOptions{IncludeSnapshots: true, MinSize: 100}, nil); err != nil || n != 5 {
+		t.Errorf("with snapshots: got %d, %v; want 5", n, err)
+	}
+
+	// Entries go through ShouldProcess like walked files, with their size.
+	var asked []string
+	walk := WalkOptions{MinSize: 100, ShouldProcess: func(path string, info os.FileInfo) bool {
+		asked = append(asked, fmt.Sprintf("%s:%d", info.Name(), info.Size()))
+		return path != "/data/c.bin"
+	}}
+	if n, err := IndexSizes(strings.NewReader(index), "/data", NewSizeMap(100), walk, nil); err != nil || n != 3 {
+		t.Errorf("with ShouldProcess: got %d, %v; want 3", n, err)
+	}
+	if want := "a.bin:4096|b.bin:4096|c.bin:4096|e.bin:8192"; strings.Join(asked, "|") != want {
+		t.Errorf("ShouldProcess asked about %q, want %q", asked, want)
+	}
+
+	for _, bad := range []string{"/data/a.bin", "/data/a.bin\tbig", "/data/a.bin -1"} {
+		if _, err := IndexSizes(strings.NewReader(bad), "/data", NewSizeMap(100), WalkOptions{MinSize: 1}, nil); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "sync/atomic"
+
+// InflightLimiter bounds how many file replacements run at once across
+// concurrently processed groups, and with them the temporary files that
+// exist at the same time. A nil *InflightLimiter imposes no limit.
+type InflightLimiter struct {
+	sem  chan struct{}
+	cur  atomic.Int64
+	peak atomic.Int64
+}
+
+// NewInflightLimiter returns a limiter admitting n replacements at a time,
+// or nil (no limit) when n is not positive.
+func NewInflightLimiter(n int) *InflightLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &InflightLimiter{sem: make(chan struct{}, n)}
+}
+
+// Acquire blocks until a replacement may start.
+func (l *InflightLimiter) Acquire() {
+	if l == nil {
+		return
+	}
+	l.sem <- struct{}{}
+	cur := l.cur.Add(1)
+	for {
+		peak := l.peak.Load()
+		if cur <= peak || l.peak.CompareAndSwap(peak, cur) {
+			return
+		}
+	}
+}
+
+// Release marks a replacement started by Acquire as finished.
+func (l *InflightLimiter) Release() {
+	if l == nil {
+		return
+	}
+	l.cur.Add(-1)
+	<-l.sem
+}
+
+// Peak returns the most replacements that were in flight at once.
+func (l *InflightLimiter) Peak() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.peak.Load()
+}
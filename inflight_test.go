@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInflightLimiter(t *testing.T) {
+	const limit, workers = 3, 20
+	l := NewInflightLimiter(limit)
+	var cur, over atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				l.Acquire()
+				if cur.Add(1) > limit {
+					over.Add(1)
+				}
+				time.Sleep(time.Millisecond)
+				cur.Add(-1)
+				l.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	if over.Load() != 0 {
+		t.Errorf("more than %d replacements in flight %d times", limit, over.Load())
+	}
+	if p := l.Peak(); p < 1 || p > limit {
+		t.Errorf("Peak = %d, want 1..%d", p, limit)
+	}
+}
+
+func TestInflightLimiterUnlimited(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		l := NewInflightLimiter(n)
+		if l != nil {
+			t.Errorf("NewInflightLimiter(%d) = %v, want nil", n, l)
+		}
+		// A nil limiter never blocks.
+		l.Acquire()
+		l.Acquire()
+		l.Release()
+		l.Release()
+		if l.Peak() != 0 {
+			t.Errorf("nil Peak = %d, want 0", l.Peak())
+		}
+	}
+}
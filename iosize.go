@@ -0,0 +1,50 @@
+package main
+
+const (
+	// defaultIOBufSize is the read buffer size for comparisons and copies
+	// when neither --io-buffer nor the filesystem asks for a larger one.
+	defaultIOBufSize = 256 * 1024
+	// maxDetectedIOBufSize caps a buffer size taken from the filesystem.
+	maxDetectedIOBufSize = 8 << 20
+	// defaultHDDWindow is how much of each file --hdd-mode reads in one go.
+	defaultHDDWindow = 32 << 20
+	// hddBudget bounds the memory of all concurrent --hdd-mode comparisons,
+	// each of which holds a window of both files.
+	hddBudget = 128 << 20
+)
+
+// Buffer sizes, set once at startup by configureIOBuffers and read-only
+// afterwards.
+var (
+	// ioBufSize is the buffer size for file comparison and copies.
+	ioBufSize = defaultIOBufSize
+	// hddWindow is how much of each file hddEqual reads in one go. Files
+	// up to this size are read whole, one after the other.
+	hddWindow int64 = defaultHDDWindow
+)
+
+// configureIOBuffers sets the read buffer size from --io-buffer, if
+// positive, or else from detected, the preferred IO size the root's
+// filesystem reports (see preferredIOSize). A detected size is clamped to
+// between defaultIOBufSize and maxDetectedIOBufSize, so the page size most
+// local filesystems report keeps the default. It then sizes the --hdd-mode
+// window so that compares comparisons running at once stay within
+// hddBudget, and within a quarter of maxMem if that is set. The window
+// never drops below the read buffer size.
+func configureIOBuffers(ioBuffer, detected int64, compares int, maxMem int64) {
+	if ioBuffer > 0 {
+		ioBufSize = int(ioBuffer)
+	} else {
+		ioBufSize = int(min(max(detected, defaultIOBufSize), maxDetectedIOBufSize))
+	}
+	budget := int64(hddBudget)
+	if maxMem > 0 {
+		budget = min(budget, maxMem/4)
+	}
+	hddWindow = max(min(defaultHDDWindow, budget/int64(2*max(compares, 1))), int64(ioBufSize))
+}
+
+// ioBuffer returns a new buffer of the configured IO size.
+func ioBuffer() []byte {
+	return make([]byte, ioBufSize)
+}
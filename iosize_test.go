@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestConfigureIOBuffers(t *testing.T) {
+	defer func(buf int, window int64) { ioBufSize, hddWindow = buf, window }(ioBufSize, hddWindow)
+	tests := []struct {
+		name     string
+		ioBuffer int64
+		detected int64
+		want     int
+	}{
+		{"nothing detected", 0, 0, defaultIOBufSize},
+		{"page size keeps the default", 0, 4096, defaultIOBufSize},
+		{"detected size is used", 0, 1 << 20, 1 << 20},
+		{"detected size is capped", 0, 64 << 20, maxDetectedIOBufSize},
+		{"override wins", 8192, 1 << 20, 8192},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureIOBuffers(tt.ioBuffer, tt.detected, 1, 0)
+			if ioBufSize != tt.want {
+				t.Errorf("ioBufSize = %d, want %d", ioBufSize, tt.want)
+			}
+			if len(ioBuffer()) != ioBufSize {
+				t.Errorf("ioBuffer() length %d, want %d", len(ioBuffer()), ioBufSize)
+			}
+		})
+	}
+
+	// filesEqual must compare correctly across several buffers.
+	configureIOBuffers(8192, 0, 1, 0)
+	dir := t.TempDir()
+	a := createTempFile(t, dir, "a", randomData(7, 3*8192+100))
+	b := createTempFile(t, dir, "b", randomData(7, 3*8192+100))
+	if eq, err := filesEqual(a, b); err != nil || !eq {
+		t.Errorf("filesEqual with small buffer = %v, %v", eq, err)
+	}
+}
+
+func TestConfigureHDDWindow(t *testing.T) {
+	defer func(buf int, window int64) { ioBufSize, hddWindow = buf, window }(ioBufSize, hddWindow)
+	tests := []struct {
+		name     string
+		compares int
+		maxMem   int64
+		want     int64
+	}{
+		{"one comparison", 1, 0, defaultHDDWindow},
+		{"unset workers", 0, 0, defaultHDDWindow},
+		{"eight workers share the budget", 8, 0, hddBudget / 16},
+		{"max-mem lowers the budget", 1, 64 << 20, 8 << 20},
+		{"never below the read buffer", 1000, 0, defaultIOBufSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureIOBuffers(0, 0, tt.compares, tt.maxMem)
+			if hddWindow != tt.want {
+				t.Errorf("hddWindow = %d, want %d", hddWindow, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+// FileLimit caps how many files one pass handles, for cautious first runs
+// (--limit-files). A nil *FileLimit imposes no limit. It is used from the
+// goroutine driving the pass and is not safe for concurrent use.
+type FileLimit struct {
+	max, used int64
+}
+
+// NewFileLimit returns a limit of n files, or nil (no limit) when n is not
+// positive.
+func NewFileLimit(n int64) *FileLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &FileLimit{max: n}
+}
+
+// Take counts one file, reporting false if the limit was already reached.
+func (l *FileLimit) Take() bool {
+	if l == nil {
+		return true
+	}
+	if l.used >= l.max {
+		return false
+	}
+	l.used++
+	return true
+}
+
+// Trim counts as many of paths as the limit still allows and returns them.
+func (l *FileLimit) Trim(paths []string) []string {
+	if l == nil {
+		return paths
+	}
+	n := min(int64(len(paths)), l.max-l.used)
+	l.used += n
+	return paths[:n]
+}
+
+// Reached reports whether no more files may be taken.
+func (l *FileLimit) Reached() bool {
+	return l != nil && l.used >= l.max
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFileLimit(t *testing.T) {
+	var unlimited *FileLimit
+	if !unlimited.Take() || unlimited.Reached() || len(unlimited.Trim(make([]string, 5))) != 5 {
+		t.Error("nil *FileLimit should not limit")
+	}
+	if NewFileLimit(0) != nil {
+		t.Error("NewFileLimit(0) should be nil")
+	}
+
+	l := NewFileLimit(5)
+	if !l.Take() || !l.Take() {
+		t.Fatal("Take under the limit failed")
+	}
+	if got := l.Trim([]string{"a", "b", "c", "d"}); len(got) != 3 {
+		t.Errorf("Trim = %q, want 3 paths", got)
+	}
+	if !l.Reached() || l.Take() || len(l.Trim([]string{"e"})) != 0 {
+		t.Error("limit of 5 not enforced")
+	}
+}
+
+func TestWalkSizesLimit(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 20 {
+		createTempFile(t, dir, fmt.Sprintf("f%02d", i), []byte(fmt.Sprintf("file %d", i)))
+	}
+
+	sm := NewSizeMap(100)
+	var seen int
+	count, _, err := WalkSizes(dir, sm, WalkOptions{}, nil, nil, NewFileLimit(7), time.Time{}, func(string, int64) { seen++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 7 || seen != 7 {
+		t.Errorf("walked %d files, callback saw %d; want 7", count, seen)
+	}
+
+	count, _, _ = WalkSizes(dir, NewSizeMap(100), WalkOptions{}, nil, nil, nil, time.Time{}, nil)
+	if count != 20 {
+		t.Errorf("unlimited walk found %d files, want 20", count)
+	}
+}
@@ -3,16 +3,28 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
+// lockPollInterval is how often acquireLockFile retries a held lock while
+// waiting for it.
+const lockPollInterval = 100 * time.Millisecond
+
 // acquireLock takes a non-blocking exclusive flock on a per-root lock file.
 // Returns the open file (caller must defer releaseLock) or an error if locked.
 func acquireLock(root string) (*os.File, error) {
+	return acquireLockFile(defaultLockPath(root), 0)
+}
+
+// defaultLockPath returns the per-root lock file under the user's cache
+// directory, creating its directory.
+func defaultLockPath(root string) string {
 	dir, err := os.UserCacheDir()
 	if err != nil {
 		// Fall back to /tmp if no cache dir.
@@ -23,17 +35,29 @@ func acquireLock(root string) (*os.File, error) {
 
 	h := fnv.New64a()
 	h.Write([]byte(root))
-	lockPath := filepath.Join(lockDir, fmt.Sprintf("%016x.lock", h.Sum64()))
+	return filepath.Join(lockDir, fmt.Sprintf("%016x.lock", h.Sum64()))
+}
 
+// acquireLockFile takes an exclusive flock on lockPath, creating it. While
+// another process holds it, it retries for up to wait before failing with
+// syscall.EWOULDBLOCK; a wait of 0 fails at once.
+func acquireLockFile(lockPath string, wait time.Duration) (*os.File, error) {
 	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
-	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
-		f.Close()
-		return nil, err
+	deadline := time.Now().Add(wait)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) || !time.Now().Before(deadline) {
+			f.Close()
+			return nil, err
+		}
+		time.Sleep(min(lockPollInterval, time.Until(deadline)))
 	}
-	return f, nil
 }
 
 // releaseLock releases the flock and closes the file.
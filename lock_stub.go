@@ -2,7 +2,10 @@
 
 package main
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 // acquireLock is a no-op on non-Unix platforms.
 // Actual dedup operations will fail with platform-specific errors.
@@ -10,5 +13,15 @@ func acquireLock(_ string) (*os.File, error) {
 	return nil, nil
 }
 
+// defaultLockPath has no lock file to name on non-Unix platforms.
+func defaultLockPath(_ string) string {
+	return ""
+}
+
+// acquireLockFile is a no-op on non-Unix platforms.
+func acquireLockFile(_ string, _ time.Duration) (*os.File, error) {
+	return nil, nil
+}
+
 // releaseLock is a no-op on non-Unix platforms.
 func releaseLock(_ *os.File) {}
@@ -3,7 +3,11 @@
 package main
 
 import (
+	"errors"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestAcquireLock(t *testing.T) {
@@ -91,3 +95,38 @@ func TestAcquireLock(t *testing.T) {
 		}
 	})
 }
+
+func TestAcquireLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	f1, err := acquireLockFile(path, 0)
+	if err != nil {
+		t.Fatalf("first acquireLockFile failed: %v", err)
+	}
+
+	t.Run("second is blocked while the first holds it", func(t *testing.T) {
+		start := time.Now()
+		f2, err := acquireLockFile(path, 150*time.Millisecond)
+		if err == nil {
+			releaseLock(f2)
+			t.Fatal("second acquireLockFile succeeded while the lock was held")
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			t.Errorf("error = %v, want EWOULDBLOCK", err)
+		}
+		if waited := time.Since(start); waited < 150*time.Millisecond {
+			t.Errorf("gave up after %v, want the full wait", waited)
+		}
+	})
+
+	t.Run("waiting acquires once the first releases it", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			releaseLock(f1)
+		}()
+		f2, err := acquireLockFile(path, 5*time.Second)
+		if err != nil {
+			t.Fatalf("acquireLockFile after release failed: %v", err)
+		}
+		releaseLock(f2)
+	})
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -14,26 +20,115 @@ var version = "dev"
 
 func main() {
 	var (
-		maxSizes     = flag.Int("max-sizes", 1_000_000, "maximum unique file sizes to track in pass 1")
-		topN         = flag.Int("top", 10_000, "number of most impactful file sizes to dedup in pass 2")
-		minSize      = flag.Int64("min-size", 524288, "minimum file size to process in bytes")
-		maxTime      = flag.String("max-time", "", "stop gracefully after duration (e.g. 30m, 2h, 1h30m)")
-		dryRun       = flag.Bool("dry-run", false, "report what would be deduped without making changes")
-		verbose      = flag.Bool("v", false, "show file paths of deduped files and detailed diagnostics")
-		quiet        = flag.Bool("q", false, "quiet mode — only print final summary (for cronjobs)")
-		batch        = flag.Bool("batch", false, "collect all target files in one pass (faster, uses more memory)")
-		lowMemory    = flag.Bool("low-memory", false, "scan separately for each file size (lowest memory, slower)")
-		memBudgetMB  = flag.Int64("mem-budget", 256, "memory budget in MiB for path cache in default mode")
-		noCache      = flag.Bool("no-cache", false, "ignore saved state — reprocess all file sizes even if unchanged since last run")
-		hardlink     = flag.Bool("hardlink", false, "use hard links instead of reflinks (works on any filesystem, but linked files share all changes)")
-		fixPerms     = flag.Bool("fix-perms", false, "temporarily add write permission to read-only directories during dedup, then restore")
-		rawSizes     = flag.Bool("raw-sizes", false, "show raw byte counts instead of human-readable")
-		snapshots    = flag.Bool("snapshots", false, "include .snapshots directories (skipped by default)")
-		scrub        = flag.Bool("scrub", false, "run btrfs scrub after dedup completes (requires root, btrfs only)")
-		defrag       = flag.Bool("defrag", false, "run btrfs defragment after dedup/scrub (requires root, btrfs only)")
-		showVersion  = flag.Bool("version", false, "print version and exit")
+		maxSizes    = flag.Int("max-sizes", 1_000_000, "maximum unique file sizes to track in pass 1")
+		smCache     = flag.String("sizemap-cache", "", "save pass 1 size counts to FILE every minute and add them back on the next start, so an interrupted scan is not lost; removed once pass 1 completes")
+		topN        = flag.Int("top", 10_000, "number of most impactful file sizes to dedup in pass 2")
+		minImpact   = flag.String("min-impact", "", "only dedup file sizes whose potential savings reach this many bytes (e.g. 1G); without an explicit --top, every such size is a target")
+		minSize     = flag.Int64("min-size", 524288, "minimum file size to process in bytes")
+		progEvery   = flag.String("progress-every", progressEvery.String(), "how often to redraw progress output (e.g. 1s)")
+		fileTimeout = flag.String("file-timeout", "", "skip a file when reading its extents or comparing its content takes longer than this (e.g. 30s); stuck reads are abandoned")
+		maxTime     = flag.String("max-time", "", "stop gracefully after duration (e.g. 30m, 2h, 1h30m)")
+		survTimeout = flag.String("survey-timeout", "", "end pass 1 after duration (e.g. 20m) and pick targets from the sizes recorded so far")
+		dryRun      = flag.Bool("dry-run", false, "report what would be deduped without making changes")
+		similarImg  = flag.Bool("similar-images", false, "read-only: report clusters of JPEG, PNG and GIF images that look alike by perceptual hash without being byte-equal, for manual review, instead of deduping")
+		simDist     = flag.Int("similar-distance", defaultSimilarDistance, "with --similar-images, the most bits of 64 in which two image hashes may differ for the images to count as similar")
+		sharedRpt   = flag.Bool("shared-bytes-report", false, "read-only: list for each file how many of its bytes are shared with other files and how many it owns alone, with totals, instead of deduping")
+		topology    = flag.Bool("topology", false, "read-only: report for each group of identical files how they share storage (copies, hard links, reflinks) instead of deduping")
+		noModify    = flag.Bool("no-modify", false, "implies --dry-run, and also refuses every write to scanned files where it happens; exits nonzero if one was attempted")
+		verbose     = flag.Bool("v", false, "show file paths of deduped files and detailed diagnostics")
+		trace       = flag.Bool("vv", false, "like -v, and also log each file's decision path: the refs it was checked against and why it was or was not deduped")
+		quiet       = flag.Bool("q", false, "quiet mode — only print final summary (for cronjobs)")
+		batch       = flag.Bool("batch", false, "collect all target files in one pass (faster, uses more memory)")
+		lowMemory   = flag.Bool("low-memory", false, "scan separately for each file size (lowest memory, slower)")
+		maxMem      = flag.Int64("max-mem", 0, "soft memory limit in bytes; near it, pass 1 tracks fewer sizes instead of growing (0 = no limit)")
+		memBudgetMB = flag.Int64("mem-budget", 256, "memory budget in MiB for path cache in default mode")
+		noCache     = flag.Bool("no-cache", false, "ignore saved state — reprocess all file sizes even if unchanged since last run")
+		hardlink    = flag.Bool("hardlink", false, "use hard links instead of reflinks (works on any filesystem, but linked files share all changes)")
+		preferLink  = flag.Bool("prefer-hardlink-when-identical", false, "hard-link duplicates whose mode, owner, and mtime match the reference instead of reflinking them (they then share all changes)")
+		keepOwner   = flag.Bool("preserve-owner", true, "give replaced files their original owner and group (false leaves them owned by the user running fastdedup)")
+		mapUID      = flag.String("map-uid", "", "remap original owners when restoring them: comma-separated HOSTLOW:CONTLOW:COUNT ranges")
+		mapGID      = flag.String("map-gid", "", "like --map-uid, for groups")
+		fixPerms    = flag.Bool("fix-perms", false, "temporarily add write permission to read-only directories during dedup, then restore")
+		keepShared  = flag.Bool("preserve-shared", false, "leave files alone when most of their extents are already shared (e.g. with btrfs snapshots), so snapshots stay small")
+		skipShared  = flag.Bool("skip-shared", false, "skip files whose extents are all already shared before comparing them with anything (cuts pass 2 work on volumes with much sharing)")
+		minFrag     = flag.Float64("min-fragmentation", 0, "only replace files with at least this many times more extents than their size needs (1 = contiguous; 0 = no filter)")
+		fragPrefix  = flag.String("frag-prefix", "", "with --min-fragmentation, estimate the fragmentation of larger files from the extents of their first SIZE bytes (e.g. 64M) and skip those below it without mapping them whole")
+		transaction = flag.Bool("transactional", false, "build and verify every replacement during the run, then swap them all into place at the end, or none if anything failed")
+		verifyBatch = flag.Bool("verify-batch", false, "with --transactional, re-check every replacement once all are swapped in (shared storage and content, rereading every file) and roll them all back if any diverged")
+		batchDedupe = flag.Bool("batch-dedupe", false, "share duplicates in place with range dedup (FIDEDUPERANGE), many files per call, instead of swapping in a reflink copy of each")
+		defragRefs  = flag.Bool("defrag-refs", false, "defragment heavily fragmented compressed reference files before reflinking (btrfs only)")
+		tmpSuf      = flag.String("tmp-suffix", tmpSuffix, "suffix of the temporary file built next to each file being replaced")
+		cleanTmps   = flag.Bool("clean-tmps", false, "first restore or remove temporary files (--tmp-suffix) left under the directory by an interrupted run")
+		ioBufBytes  = flag.Int64("io-buffer", 0, "read buffer size in bytes for comparing and copying files (default: the filesystem's preferred IO size, 256 KiB to 8 MiB)")
+		rawSizes    = flag.Bool("raw-sizes", false, "show raw byte counts instead of human-readable")
+		snapshots   = flag.Bool("snapshots", false, "include .snapshots directories (skipped by default)")
+		scrub       = flag.Bool("scrub", false, "run btrfs scrub after dedup completes (requires root, btrfs only)")
+		defrag      = flag.Bool("defrag", false, "run btrfs defragment after dedup/scrub (requires root, btrfs only)")
+		interactive = flag.Bool("interactive", false, "show the plan and ask for confirmation before modifying files")
+		noTTYAction = flag.String("interactive-no-tty", noTTYAbort, "with --interactive and no terminal on stdin: abort or proceed")
+		logDedups   = flag.String("log-dedups", "", "per-file dedup lines: none, sample, or all (default: all with -v, none otherwise)")
+		logEvery    = flag.Int64("log-dedups-every", 1000, "with --log-dedups=sample, print one in every N dedups")
+		debugAddr   = flag.String("debug-addr", "", "serve live progress at /stats and /debug/vars on this address (e.g. localhost:6060)")
+		metricsFile = flag.String("metrics-file", "", "write Prometheus textfile metrics to this path at the end of the run")
+		cdc         = flag.Bool("cdc", false, "dedup matching content-defined chunks across files instead of whole identical files")
+		cdcMin      = flag.Int("cdc-min", 16384, "with --cdc, minimum chunk size in bytes")
+		cdcAvg      = flag.Int("cdc-avg", 65536, "with --cdc, target average chunk size in bytes (power of two)")
+		cdcMax      = flag.Int("cdc-max", 262144, "with --cdc, maximum chunk size in bytes")
+		maxErrors   = flag.Int64("max-errors", 0, "abort the run once more than N files have failed to dedup (0 = unlimited)")
+		permFatal   = flag.Bool("skip-errors-fatal", false, "abort on the first file that cannot be read (permission denied) instead of skipping it")
+		growth      = flag.Float64("project-growth", 0, "with --survey-only, also project the potential savings if the data grows by FACTOR (e.g. 2) with the same duplicate distribution")
+		surveyOnly  = flag.Bool("survey-only", false, "run pass 1 only and report duplicate size collisions, without reading file contents")
+		maxInflight = flag.Int("max-inflight", 0, "with --per-device-workers, replace at most N files at once across all workers, bounding temporary files (0 = no limit)")
+		perDevice   = flag.Int("per-device-workers", 0, "deduplicate up to N size groups concurrently per device (0 = one group at a time)")
+		cmpWorkers  = flag.Int("compare-workers", 0, "compare each file against a group's references on up to N goroutines once it has many distinct contents (0 = sequential)")
+		skipProt    = flag.Bool("skip-protected", false, "leave files alone that have other hard links or the immutable or append-only attribute (they can still be refs)")
+		recheck     = flag.Bool("recheck", false, "stat each file and its ref before comparing them and again before replacing the file, and skip it if either changed")
+		paranoid    = flag.Bool("paranoid", false, "turn on every safety check: --verify-shared, --recheck, --skip-protected, --transactional and --verify-batch (the last two only in modes that can stage replacements)")
+		verifyShare = flag.Bool("verify-shared", false, "after each reflink, require both files' extents to be flagged shared by FIEMAP (fails without FIEMAP)")
+		noVerifyRef = flag.Bool("no-verify-reflink", false, "trust a successful FICLONE and skip reading both files' extents afterwards (faster; only for filesystems known to reflink reliably)")
+		histogram   = flag.Bool("histogram", false, "print a histogram of scanned file sizes after pass 1")
+		treeStats   = flag.Bool("report-tree-stats", false, "after pass 1, report the deepest directory and the directory with the most entries")
+		groupByName = flag.Bool("group-by-name", false, "only dedup files that also share the same base name")
+		normPaths   = flag.Bool("normalize-paths", false, "when several paths reach a ref's storage, choose the shortest by characters, counting NFC and NFD spellings alike, with a deterministic tie-break")
+		matchMagic  = flag.Bool("match-magic", false, "only compare files whose first 16 bytes (their type signature) match")
+		nameKey     = flag.String("name-key", "", "with --group-by-name, regex applied to base names; the first capture group (or whole match) is the grouping key")
+		samplePct   = flag.Float64("sample-percent", 0, "estimate dedupable space from a random P% of files, then exit without deduping")
+		preHook     = flag.String("pre-hook", "", "shell command run before each file is replaced, with ref, file and size as $1 $2 $3; a nonzero exit skips the file")
+		postHook    = flag.String("post-hook", "", "shell command run after each file is deduped, with ref, file and size as $1 $2 $3; failures only warn")
+		estTotal    = flag.Bool("estimate-total", false, "count files in a quick pre-scan of directories, so pass 1 can show a percentage and ETA")
+		mmapCmp     = flag.Bool("mmap-compare", false, "compare file contents through memory mappings instead of reads; faster for files already in the page cache")
+		hddMode     = flag.Bool("hdd-mode", false, "compare files by reading up to 32 MiB of one, then the same range of the other, instead of both in parallel; far fewer seeks on spinning disks, using up to 128 MiB of buffers across all workers")
+		fiemapSync  = flag.String("fiemap-sync", fiemapSyncAlways, "when FIEMAP flushes files first: always, or delalloc to fsync only files whose extents are still delayed-allocated")
+		procSet     = flag.String("processed-set", "", "append the files of each size group finished without errors to FILE, and treat files listed there as done: only refs for the others (lets a long job run in chunks)")
+		changedSnc  = flag.String("changed-since", "", "only replace files modified since TIME (RFC 3339, 2006-01-02, or a duration like 24h ago); older files are only refs")
+		changedFile = flag.String("changed-since-file", "", "like --changed-since, using the modification time of FILE as the marker (e.g. touched after each run)")
+		limitFiles  = flag.Int64("limit-files", 0, "stop each pass after N files: pass 1 records at most N files, pass 2 compares at most N (0 = no limit)")
+		indexFile   = flag.String("index", "", "read pass 1 file sizes from FILE (one PATH SIZE per line) instead of walking the tree")
+		refStrategy = flag.String("ref-strategy", refFirst, "which copy is kept as the reference: first (walk order), atime (most recently accessed) or lowest-inode (usually the original)")
+		outputFmt   = flag.String("output", outputText, "output format: text, or jsonl to stream run events to stdout as JSON lines")
+		eventsFile  = flag.String("events-file", "", "append run events as JSON lines to this file")
+		baseline    = flag.String("compare-baseline", "", "at the end, print how the run's totals changed from the last run_end event in this file (e.g. a previous --events-file)")
+		explain     = flag.String("explain", "", "trace why this file would or would not be deduped by a run over the directory, then exit without changing anything")
+		pairsFile   = flag.String("pairs-file", "", "dedup exactly the PATH,REF pairs listed in this CSV file, each only if both files are identical, then exit")
+		relink      = flag.Bool("hardlinks-to-reflinks", false, "replace every hard link beyond the first of each file with an independent copy that reflinks the same data (own inode and metadata, shared blocks), then exit")
+		undo        = flag.String("undo", "", "undo the dedups recorded in this --events-file: rewrite each deduped file as an independent copy, then exit")
+		groupsFile  = flag.String("groups-manifest", "", "write every group of identical files found (reference and all paths) to this file as JSON lines")
+		manifest    = flag.String("manifest", "", "sha256sum-format file of canonical copies; files whose hash is listed are deduped against them")
+		emitScript  = flag.String("emit-script", "", "with --dry-run, also write the dedups found as a shell script of cp --reflink commands to this file")
+		configFile  = flag.String("config", "", "read flags from a key=value config file (command-line flags take precedence)")
+		detailedEC  = flag.Bool("detailed-exit-codes", false, "exit 0 when there was nothing to dedup, 2 after deduping files, 3 when some files failed (1 stays fatal errors)")
+		showVersion = flag.Bool("version", false, "print version and exit")
+		lockPath    = flag.String("lock-file", "", "take the lock against concurrent runs on this file instead of the per-root one under the user cache directory")
+		lockWait    = flag.String("lock-wait", "", "if another instance holds the lock, wait up to this long for it (e.g. 10m) instead of exiting at once")
+		noLock      = flag.Bool("no-lock", false, "do not take the lock against concurrent runs (only when something else keeps runs apart)")
+		selftest    = flag.Bool("selftest", false, "dedup two identical temporary files under the directory, check they share extents, match and kept their metadata, print PASS or FAIL and exit")
 	)
 
+	var excludeUnder dirList
+	flag.Var(&excludeUnder, "exclude-under", "never visit DIR or anything under it; relative paths are taken from the root directory (repeatable)")
+	var dedupOnly dirList
+	flag.Var(&dedupOnly, "dedup-only", "only dedup files matching this glob, as references and as copies; matched against the base name, or trailing path components if it has slashes (e.g. 'wp-admin/*.php') (repeatable)")
+
 	//goland:noinspection GoUnhandledErrorResult
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [directory]\n\n", os.Args[0])
@@ -47,8 +142,29 @@ func main() {
 		fmt.Printf("fastdedup %s\n", version)
 		return
 	}
+	// --selftest reports an unsupported platform as its own failure.
+	if !platformSupported() && !*selftest {
+		fmt.Fprintf(os.Stderr, "error: fastdedup requires Linux with btrfs or XFS (reflink support); %s is not supported\n", runtime.GOOS)
+		os.Exit(1)
+	}
 
 	root := "."
+	if *configFile != "" {
+		cfgRoot, err := applyConfig(flag.CommandLine, *configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --config: %v\n", err)
+			os.Exit(1)
+		}
+		if cfgRoot != "" {
+			root = cfgRoot
+		}
+	}
+	if *paranoid {
+		if err := applyParanoid(flag.CommandLine); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	if flag.NArg() > 0 {
 		root = flag.Arg(0)
 	}
@@ -60,65 +176,825 @@ func main() {
 	if canonical, err := filepath.EvalSymlinks(root); err == nil {
 		root = canonical
 	}
+	if err := checkRoot(root); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	walkOpts := WalkOptions{IncludeSnapshots: *snapshots, MinSize: *minSize, Exclude: NewExcludeDirs(root, excludeUnder)}
 
 	// Set log level and quiet mode.
 	level := slog.LevelWarn
+	if *trace {
+		*verbose = true
+	}
 	if *verbose {
 		level = slog.LevelDebug
 	}
+	if *trace {
+		level = levelTrace
+	}
 	if *quiet {
 		level = slog.LevelError
 		quietMode = true
 	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level, ReplaceAttr: replaceTraceLevel})))
+
+	if *selftest {
+		if !runSelftest(os.Stdout, root) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Per-file dedup lines follow -v unless --log-dedups is given.
+	logMode := *logDedups
+	if logMode == "" {
+		logMode = logDedupsNone
+		if *verbose {
+			logMode = logDedupsAll
+		}
+	}
+	dedupLog, err := NewDedupLog(logMode, *logEvery)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: --log-dedups: %v\n", err)
+		os.Exit(1)
+	}
+	var changedSince time.Time
+	switch {
+	case *changedSnc != "" && *changedFile != "":
+		fmt.Fprintf(os.Stderr, "error: --changed-since and --changed-since-file cannot be combined\n")
+		os.Exit(1)
+	case *changedSnc != "":
+		changedSince, err = parseChangedSince(*changedSnc, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: invalid --changed-since: %v\n", err)
+			os.Exit(1)
+		}
+	case *changedFile != "":
+		info, err := os.Stat(*changedFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --changed-since-file: %v\n", err)
+			os.Exit(1)
+		}
+		changedSince = info.ModTime()
+	}
+
+	if *noModify {
+		*dryRun = true
+		guard.on.Store(true)
+	}
+	if *relink && (*hardlink || *preferLink || *undo != "" || *pairsFile != "" || *topology || *explain != "" || *sharedRpt || *cdc || *surveyOnly || *samplePct > 0 || *transaction || *batchDedupe) {
+		fmt.Fprintf(os.Stderr, "error: --hardlinks-to-reflinks cannot be combined with --hardlink, --prefer-hardlink-when-identical, --undo, --pairs-file, --topology, --explain, --shared-bytes-report, --cdc, --survey-only, --sample-percent, --transactional, or --batch-dedupe\n")
+		os.Exit(1)
+	}
+	if *similarImg && (*sharedRpt || *topology || *explain != "" || *pairsFile != "" || *undo != "" || *relink || *cdc || *surveyOnly || *samplePct > 0) {
+		fmt.Fprintf(os.Stderr, "error: --similar-images cannot be combined with --shared-bytes-report, --topology, --explain, --pairs-file, --undo, --hardlinks-to-reflinks, --cdc, --survey-only, or --sample-percent\n")
+		os.Exit(1)
+	}
+	if *simDist < 0 || *simDist > maxSimilarDistance {
+		fmt.Fprintf(os.Stderr, "error: invalid --similar-distance %d (want 0 to %d)\n", *simDist, maxSimilarDistance)
+		os.Exit(1)
+	}
+	if *sharedRpt && (*topology || *explain != "" || *pairsFile != "" || *undo != "" || *cdc || *surveyOnly || *samplePct > 0) {
+		fmt.Fprintf(os.Stderr, "error: --shared-bytes-report cannot be combined with --topology, --explain, --pairs-file, --undo, --cdc, --survey-only, or --sample-percent\n")
+		os.Exit(1)
+	}
+	if *topology && (*cdc || *surveyOnly || *samplePct > 0) {
+		fmt.Fprintf(os.Stderr, "error: --topology cannot be combined with --cdc, --survey-only, or --sample-percent\n")
+		os.Exit(1)
+	}
+	var txn *Transaction
+	if *transaction {
+		if *dryRun || *topology || *batchDedupe || *fixPerms || *cdc {
+			fmt.Fprintf(os.Stderr, "error: --transactional cannot be combined with --dry-run, --no-modify, --topology, --batch-dedupe, --fix-perms, or --cdc\n")
+			os.Exit(1)
+		}
+		txn = NewTransaction()
+		txn.Verify = *verifyBatch
+	} else if *verifyBatch {
+		fmt.Fprintf(os.Stderr, "error: --verify-batch requires --transactional\n")
+		os.Exit(1)
+	}
+	// Topology only reads; as a dry run, nothing is cached or maintained.
+	var topo *TopologyReport
+	if *topology {
+		*dryRun = true
+		topo = NewTopologyReport(os.Stdout, *rawSizes)
+	}
+	dedupOpts := DedupOptions{
+		DryRun:     *dryRun,
+		RawSizes:   *rawSizes,
+		Hardlink:   *hardlink,
+		FixPerms:   *fixPerms,
+		DefragRefs: *defragRefs,
+		Log:        dedupLog,
+
+		VerifyShared:    *verifyShare,
+		PreserveShared:  *keepShared,
+		SkipShared:      *skipShared,
+		BatchDedupe:     *batchDedupe,
+		Inflight:        NewInflightLimiter(*maxInflight),
+		Hooks:           NewDedupHooks(*preHook, *postHook),
+		ChangedSince:    changedSince,
+		CompareWorkers:  *cmpWorkers,
+		Txn:             txn,
+		PermissionFatal: *permFatal,
+		SkipProtected:   *skipProt,
+		Recheck:         *recheck,
+		RefStrategy:     *refStrategy,
+		MaxErrors:       *maxErrors,
+		PreferHardlink:  *preferLink,
+		MatchMagic:      *matchMagic,
+		NormalizePaths:  *normPaths,
+
+		MinFragmentation: *minFrag,
+	}
+
+	if *groupByName {
+		keyFn, err := nameKeyFunc(*nameKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: invalid --name-key: %v\n", err)
+			os.Exit(1)
+		}
+		dedupOpts.NameKey = keyFn
+	} else if *nameKey != "" {
+		fmt.Fprintf(os.Stderr, "error: --name-key requires --group-by-name\n")
+		os.Exit(1)
+	}
+
+	var dedupOnlyFn func(path string) bool
+	if len(dedupOnly) > 0 {
+		if dedupOnlyFn, err = dedupOnlyFunc(dedupOnly); err != nil {
+			fmt.Fprintf(os.Stderr, "error: invalid --dedup-only: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *procSet != "" {
+		if *dryRun || *transaction || *cdc {
+			fmt.Fprintf(os.Stderr, "error: --processed-set cannot be combined with --dry-run, --no-modify, --topology, --transactional, or --cdc\n")
+			os.Exit(1)
+		}
+		dedupOpts.Processed, err = LoadProcessedSet(*procSet)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --processed-set: %v\n", err)
+			os.Exit(1)
+		}
+		if n := dedupOpts.Processed.Len(); n > 0 && !*quiet {
+			fmt.Fprintf(os.Stderr, "  %s files done in %s are only refs\n", formatCount(int64(n)), *procSet)
+		}
+	}
+
+	var scriptFile *os.File
+	if *emitScript != "" {
+		if !*dryRun {
+			fmt.Fprintf(os.Stderr, "error: --emit-script requires --dry-run\n")
+			os.Exit(1)
+		}
+		f, err := os.OpenFile(*emitScript, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		if err == nil {
+			dedupOpts.Script, err = NewDedupScript(f, root)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --emit-script: %v\n", err)
+			os.Exit(1)
+		}
+		scriptFile = f
+	}
+
+	var eventsOut *os.File
+	switch *outputFmt {
+	case outputText:
+		if *eventsFile != "" {
+			f, err := os.OpenFile(*eventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: --events-file: %v\n", err)
+				os.Exit(1)
+			}
+			eventsOut = f
+			dedupOpts.Events = NewEventLog(f)
+		}
+	case outputJSONL:
+		if *eventsFile != "" {
+			fmt.Fprintf(os.Stderr, "error: --output %s writes events to stdout and cannot be combined with --events-file\n", outputJSONL)
+			os.Exit(1)
+		}
+		if *cdc || *surveyOnly || *samplePct > 0 {
+			fmt.Fprintf(os.Stderr, "error: --output %s cannot be combined with --cdc, --survey-only, or --sample-percent\n", outputJSONL)
+			os.Exit(1)
+		}
+		dedupOpts.Events = NewEventLog(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "error: invalid --output %q (want %s or %s)\n", *outputFmt, outputText, outputJSONL)
+		os.Exit(1)
+	}
+	events := dedupOpts.Events
+
+	var groupsOut *os.File
+	if *groupsFile != "" {
+		if *cdc || *surveyOnly || *samplePct > 0 {
+			fmt.Fprintf(os.Stderr, "error: --groups-manifest cannot be combined with --cdc, --survey-only, or --sample-percent\n")
+			os.Exit(1)
+		}
+		f, err := os.OpenFile(*groupsFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --groups-manifest: %v\n", err)
+			os.Exit(1)
+		}
+		groupsOut = f
+		dedupOpts.Groups = NewGroupsManifest(f)
+	}
+
+	if *pairsFile != "" && (*undo != "" || *cdc || *surveyOnly || *samplePct > 0 || *topology || *explain != "" || *transaction || *batchDedupe || *baseline != "") {
+		fmt.Fprintf(os.Stderr, "error: --pairs-file cannot be combined with --undo, --cdc, --survey-only, --sample-percent, --topology, --explain, --transactional, --batch-dedupe, or --compare-baseline\n")
+		os.Exit(1)
+	}
+	var base *runSummary
+	if *baseline != "" {
+		if *undo != "" || *cdc || *surveyOnly || *samplePct > 0 || *topology || *explain != "" {
+			fmt.Fprintf(os.Stderr, "error: --compare-baseline cannot be combined with --undo, --cdc, --survey-only, --sample-percent, --topology, or --explain\n")
+			os.Exit(1)
+		}
+		b, err := loadBaseline(*baseline)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --compare-baseline: %s: %v\n", *baseline, err)
+			os.Exit(1)
+		}
+		if b.Root != root {
+			fmt.Fprintf(os.Stderr, "warning: --compare-baseline: baseline run was over %s, not %s\n", b.Root, root)
+		}
+		base = b
+	}
+
+	if *manifest != "" {
+		m, err := LoadManifest(*manifest, root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --manifest: %v\n", err)
+			os.Exit(1)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Loaded %s manifest entries", formatCount(int64(m.Len())))
+			if m.Missing > 0 {
+				fmt.Fprintf(os.Stderr, " (%s missing files skipped)", formatCount(m.Missing))
+			}
+			fmt.Fprintln(os.Stderr)
+		}
+		dedupOpts.Manifest = m
+	}
 
 	// Parse --max-time deadline.
 	var deadline time.Time
 	if *maxTime != "" {
 		d, err := time.ParseDuration(*maxTime)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: invalid --max-time %q: %v\n", *maxTime, err)
+			fmt.Fprintf(os.Stderr, "error: invalid --max-time %q: %v\n", *maxTime, err)
+			os.Exit(1)
+		}
+		deadline = time.Now().Add(d)
+	}
+
+	var lockWaitDur time.Duration
+	if *lockWait != "" {
+		lockWaitDur, err = time.ParseDuration(*lockWait)
+		if err != nil || lockWaitDur < 0 {
+			fmt.Fprintf(os.Stderr, "error: invalid --lock-wait %q\n", *lockWait)
+			os.Exit(1)
+		}
+	}
+	if *noLock && (*lockPath != "" || *lockWait != "") {
+		fmt.Fprintf(os.Stderr, "error: --no-lock cannot be combined with --lock-file or --lock-wait\n")
+		os.Exit(1)
+	}
+
+	// --min-impact selects sizes by savings; --top still caps them if given.
+	var minImpactBytes int64
+	topLimit := *topN
+	if *minImpact != "" {
+		minImpactBytes, err = parseSize(*minImpact)
+		if err != nil || minImpactBytes == 0 {
+			fmt.Fprintf(os.Stderr, "error: invalid --min-impact %q\n", *minImpact)
+			os.Exit(1)
+		}
+		topSet := false
+		flag.Visit(func(f *flag.Flag) { topSet = topSet || f.Name == "top" })
+		if !topSet {
+			topLimit = math.MaxInt
+		}
+	}
+
+	if d, err := time.ParseDuration(*progEvery); err != nil || d <= 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --progress-every %q: want a positive duration such as 500ms or 5s\n", *progEvery)
+		os.Exit(1)
+	} else {
+		progressEvery = d
+	}
+
+	if *fileTimeout != "" {
+		d, err := time.ParseDuration(*fileTimeout)
+		if err != nil || d <= 0 {
+			fmt.Fprintf(os.Stderr, "error: invalid --file-timeout %q: want a positive duration such as 30s\n", *fileTimeout)
+			os.Exit(1)
+		}
+		dedupOpts.FileTimeout = d
+	}
+
+	var surveyLimit time.Duration
+	if *survTimeout != "" {
+		surveyLimit, err = time.ParseDuration(*survTimeout)
+		if err != nil || surveyLimit <= 0 {
+			fmt.Fprintf(os.Stderr, "error: invalid --survey-timeout %q: want a positive duration such as 20m\n", *survTimeout)
+			os.Exit(1)
+		}
+	}
+
+	if *noTTYAction != noTTYAbort && *noTTYAction != noTTYProceed {
+		fmt.Fprintf(os.Stderr, "error: invalid --interactive-no-tty %q (want %s or %s)\n", *noTTYAction, noTTYAbort, noTTYProceed)
+		os.Exit(1)
+	}
+
+	if *ioBufBytes < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --io-buffer %d\n", *ioBufBytes)
+		os.Exit(1)
+	}
+	if err := validTmpSuffix(*tmpSuf); err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid --tmp-suffix: %v\n", err)
+		os.Exit(1)
+	}
+	tmpSuffix = *tmpSuf
+	uids, err := parseIDMap(*mapUID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid --map-uid: %v\n", err)
+		os.Exit(1)
+	}
+	gids, err := parseIDMap(*mapGID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid --map-gid: %v\n", err)
+		os.Exit(1)
+	}
+	if !*keepOwner && (uids != nil || gids != nil) {
+		fmt.Fprintf(os.Stderr, "error: --map-uid and --map-gid cannot be combined with --preserve-owner=false\n")
+		os.Exit(1)
+	}
+	restoreOwner = ownerPolicy{skip: !*keepOwner, uids: uids, gids: gids}
+
+	configureIOBuffers(*ioBufBytes, preferredIOSize(root), max(*perDevice, 1)*max(*cmpWorkers, 1), *maxMem)
+	if *fiemapSync != fiemapSyncAlways && *fiemapSync != fiemapSyncDelalloc {
+		fmt.Fprintf(os.Stderr, "error: invalid --fiemap-sync %q (want %s or %s)\n", *fiemapSync, fiemapSyncAlways, fiemapSyncDelalloc)
+		os.Exit(1)
+	}
+	fiemapTargetedSync = *fiemapSync == fiemapSyncDelalloc
+	if *hddMode && *mmapCmp {
+		fmt.Fprintf(os.Stderr, "error: --hdd-mode cannot be combined with --mmap-compare\n")
+		os.Exit(1)
+	}
+	mmapCompare = *mmapCmp
+	hddCompare = *hddMode
+	trustReflink = *noVerifyRef
+	configureFIEMAP(root)
+	if w := checkMetadataSpace(root); w != "" {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+
+	cdcParams := CDCParams{Min: *cdcMin, Avg: *cdcAvg, Max: *cdcMax}
+	if *cdc {
+		if err := cdcParams.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --cdc: %v\n", err)
+			os.Exit(1)
+		}
+		if *hardlink {
+			fmt.Fprintf(os.Stderr, "error: --cdc cannot be combined with --hardlink\n")
+			os.Exit(1)
+		}
+		if *preferLink {
+			fmt.Fprintf(os.Stderr, "error: --cdc cannot be combined with --prefer-hardlink-when-identical\n")
+			os.Exit(1)
+		}
+		if *manifest != "" {
+			fmt.Fprintf(os.Stderr, "error: --cdc cannot be combined with --manifest\n")
+			os.Exit(1)
+		}
+	}
+
+	if *batchDedupe && (*hardlink || *verifyShare || *cdc) {
+		fmt.Fprintf(os.Stderr, "error: --batch-dedupe cannot be combined with --hardlink, --verify-shared, or --cdc\n")
+		os.Exit(1)
+	}
+	if !changedSince.IsZero() && *cdc {
+		fmt.Fprintf(os.Stderr, "error: --changed-since cannot be combined with --cdc\n")
+		os.Exit(1)
+	}
+	if (*preHook != "" || *postHook != "") && *cdc {
+		fmt.Fprintf(os.Stderr, "error: --pre-hook and --post-hook cannot be combined with --cdc\n")
+		os.Exit(1)
+	}
+
+	if *noVerifyRef && *verifyShare {
+		fmt.Fprintf(os.Stderr, "error: --no-verify-reflink cannot be combined with --verify-shared\n")
+		os.Exit(1)
+	}
+	if *verifyShare && *hardlink {
+		fmt.Fprintf(os.Stderr, "error: --verify-shared applies to reflinks and cannot be combined with --hardlink\n")
+		os.Exit(1)
+	}
+
+	if *refStrategy != refFirst && *refStrategy != refAtime && *refStrategy != refInode {
+		fmt.Fprintf(os.Stderr, "error: invalid --ref-strategy %q (want %s, %s or %s)\n", *refStrategy, refFirst, refAtime, refInode)
+		os.Exit(1)
+	}
+
+	if *samplePct < 0 || *samplePct > 100 {
+		fmt.Fprintf(os.Stderr, "error: --sample-percent must be between 0 and 100, got %g\n", *samplePct)
+		os.Exit(1)
+	}
+	if *growth != 0 && (!*surveyOnly || *growth < 1) {
+		fmt.Fprintf(os.Stderr, "error: --project-growth needs --survey-only and a factor of at least 1, got %g\n", *growth)
+		os.Exit(1)
+	}
+	if *limitFiles < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --limit-files %d\n", *limitFiles)
+		os.Exit(1)
+	}
+	if *smCache != "" && (*samplePct > 0 || *indexFile != "" || *cdc) {
+		fmt.Fprintf(os.Stderr, "error: --sizemap-cache cannot be combined with --sample-percent, --index, or --cdc\n")
+		os.Exit(1)
+	}
+	if *treeStats && (*samplePct > 0 || *indexFile != "" || *cdc) {
+		fmt.Fprintf(os.Stderr, "error: --report-tree-stats needs the pass 1 walk and cannot be combined with --sample-percent, --index, or --cdc\n")
+		os.Exit(1)
+	}
+	if *limitFiles > 0 && (*samplePct > 0 || *indexFile != "" || *cdc) {
+		fmt.Fprintf(os.Stderr, "error: --limit-files cannot be combined with --sample-percent, --index, or --cdc\n")
+		os.Exit(1)
+	}
+	if *survTimeout != "" && (*samplePct > 0 || *indexFile != "" || *cdc) {
+		fmt.Fprintf(os.Stderr, "error: --survey-timeout cannot be combined with --sample-percent, --index, or --cdc\n")
+		os.Exit(1)
+	}
+	if *indexFile != "" && *samplePct > 0 {
+		fmt.Fprintf(os.Stderr, "error: --index cannot be combined with --sample-percent\n")
+		os.Exit(1)
+	}
+
+	if *minFrag < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --min-fragmentation %g\n", *minFrag)
+		os.Exit(1)
+	}
+	if *fragPrefix != "" {
+		dedupOpts.FragPrefix, err = parseSize(*fragPrefix)
+		if err != nil || dedupOpts.FragPrefix == 0 {
+			fmt.Fprintf(os.Stderr, "error: invalid --frag-prefix %q\n", *fragPrefix)
+			os.Exit(1)
+		}
+		if *minFrag == 0 {
+			fmt.Fprintf(os.Stderr, "error: --frag-prefix requires --min-fragmentation\n")
+			os.Exit(1)
+		}
+	}
+	if *maxMem < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --max-mem %d\n", *maxMem)
+		os.Exit(1)
+	}
+	if *maxErrors < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --max-errors %d\n", *maxErrors)
+		os.Exit(1)
+	}
+	if *perDevice < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --per-device-workers %d\n", *perDevice)
+		os.Exit(1)
+	}
+	if *cmpWorkers < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --compare-workers %d\n", *cmpWorkers)
+		os.Exit(1)
+	}
+	if *maxInflight < 0 {
+		fmt.Fprintf(os.Stderr, "error: invalid --max-inflight %d\n", *maxInflight)
+		os.Exit(1)
+	}
+	if *perDevice > 0 && *fixPerms {
+		// Concurrent groups could restore each other's directory permissions.
+		fmt.Fprintf(os.Stderr, "error: --per-device-workers cannot be combined with --fix-perms\n")
+		os.Exit(1)
+	}
+
+	// Validate --scrub / --defrag requirements early.
+	if *scrub || *defrag {
+		if os.Geteuid() != 0 {
+			fmt.Fprintf(os.Stderr, "error: --scrub and --defrag require root permissions\n")
+			os.Exit(1)
+		}
+		if !isBtrfs(root) {
+			fmt.Fprintf(os.Stderr, "error: --scrub and --defrag require a btrfs filesystem (detected non-btrfs at %s)\n", root)
+			os.Exit(1)
+		}
+	}
+
+	// Start the optional live-stats endpoint.
+	if *debugAddr != "" {
+		addr, err := startDebugServer(*debugAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --debug-addr: %v\n", err)
+			os.Exit(1)
+		}
+		slog.Debug("serving live stats", "addr", addr)
+	}
+
+	if *defragRefs && !isBtrfs(root) {
+		fmt.Fprintf(os.Stderr, "error: --defrag-refs requires a btrfs filesystem (detected non-btrfs at %s)\n", root)
+		os.Exit(1)
+	}
+
+	// Explain only reads, so it needs no lock.
+	if *explain != "" {
+		path, err := filepath.Abs(*explain)
+		if err == nil {
+			// Resolve the directory but not the file, so a symlink is
+			// explained as one.
+			if dir, derr := filepath.EvalSymlinks(filepath.Dir(path)); derr == nil {
+				path = filepath.Join(dir, filepath.Base(path))
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --explain: %v\n", err)
+			os.Exit(1)
+		}
+		verdict := explainFile(os.Stdout, root, path, walkOpts, dedupOpts)
+		slog.Debug("explained", "path", path, "verdict", verdict)
+		return
+	}
+
+	// So does the shared bytes report.
+	if *sharedRpt {
+		if !fiemapSupported {
+			fmt.Fprintf(os.Stderr, "error: --shared-bytes-report needs FIEMAP, which %s does not support\n", root)
+			os.Exit(1)
+		}
+		report := NewSharedBytesReport(os.Stdout, *rawSizes)
+		var addErr error
+		err := walkRandom(root, walkOpts, nil, func(path string, _ int64) {
+			if addErr == nil {
+				addErr = report.Add(path)
+			}
+		})
+		if err == nil {
+			err = addErr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --shared-bytes-report: %v\n", err)
+			os.Exit(1)
+		}
+		report.WriteSummary(os.Stderr)
+		return
+	}
+
+	// The similar images report only reads too.
+	if *similarImg {
+		report := &SimilarImagesReport{}
+		if err := walkRandom(root, walkOpts, nil, func(path string, _ int64) { report.Add(path) }); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --similar-images: %v\n", err)
+			os.Exit(1)
+		}
+		report.WriteSummary(os.Stderr, report.Write(os.Stdout, *simDist))
+		return
+	}
+
+	startTime := time.Now()
+
+	if *hardlink && !*dryRun {
+		fmt.Fprintf(os.Stderr, "WARNING: --hardlink mode creates hard links instead of reflinks.\n")
+		fmt.Fprintf(os.Stderr, "  Hard-linked files share the same inode — editing one file changes ALL copies.\n")
+		fmt.Fprintf(os.Stderr, "  Metadata (permissions, timestamps) is also shared. Use with caution.\n\n")
+	} else if *preferLink && !*dryRun {
+		fmt.Fprintf(os.Stderr, "WARNING: --prefer-hardlink-when-identical hard-links duplicates with identical metadata.\n")
+		fmt.Fprintf(os.Stderr, "  Hard-linked files share the same inode — editing one file changes ALL copies.\n\n")
+	}
+
+	fmtSize := func(b int64) string {
+		return formatSize(b, *rawSizes)
+	}
+	// printBaseline reports the run's change from --compare-baseline.
+	printBaseline := func(stats *DedupStats) {
+		if base == nil {
+			return
+		}
+		d := compareBaseline(&base.DedupStats, stats)
+		if *quiet {
+			fmt.Fprintf(os.Stderr, "fastdedup: %s: %s\n", root, d.Line(*rawSizes))
+		} else {
+			d.Write(os.Stderr, base, *rawSizes)
+		}
+	}
+
+	// Acquire per-root lock to prevent concurrent runs.
+	if !*noLock {
+		path := *lockPath
+		if path == "" {
+			path = defaultLockPath(root)
+		}
+		lockFile, lockErr := acquireLockFile(path, 0)
+		if errors.Is(lockErr, syscall.EWOULDBLOCK) && lockWaitDur > 0 {
+			if !*quiet {
+				fmt.Fprintf(os.Stderr, "Waiting up to %s for another fastdedup instance on %s to finish\n", lockWaitDur, root)
+			}
+			lockFile, lockErr = acquireLockFile(path, lockWaitDur)
+		}
+		if errors.Is(lockErr, syscall.EWOULDBLOCK) {
+			fmt.Fprintf(os.Stderr, "error: another fastdedup instance is already running on %s\n", root)
+			os.Exit(1)
+		}
+		if lockErr != nil {
+			fmt.Fprintf(os.Stderr, "error: lock file: %v\n", lockErr)
+			os.Exit(1)
+		}
+		defer releaseLock(lockFile)
+	}
+
+	// Clean up after interrupted runs before anything else touches the tree.
+	if *cleanTmps {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Checking %s for stale *%s files\n", root, tmpSuffix)
+		}
+		stats, err := cleanStaleTmps(root, tmpSuffix, walkOpts, *dryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --clean-tmps: %v\n", err)
 			os.Exit(1)
 		}
-		deadline = time.Now().Add(d)
+		if !*quiet || len(stats.Kept) > 0 {
+			fmt.Fprintf(os.Stderr, "  %s restored, %s removed, %s kept\n",
+				formatCount(stats.Restored), formatCount(stats.Removed), formatCount(int64(len(stats.Kept))))
+		}
+		for _, path := range stats.Kept {
+			fmt.Fprintf(os.Stderr, "  kept %s: does not match %s; compare them and remove one by hand\n",
+				path, strings.TrimSuffix(path, tmpSuffix))
+		}
 	}
 
-	// Validate --scrub / --defrag requirements early.
-	if *scrub || *defrag {
-		if os.Geteuid() != 0 {
-			fmt.Fprintf(os.Stderr, "error: --scrub and --defrag require root permissions\n")
+	// Undo replaces both passes: the files come from the recorded events.
+	if *undo != "" {
+		f, err := os.Open(*undo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --undo: %v\n", err)
 			os.Exit(1)
 		}
-		if !isBtrfs(root) {
-			fmt.Fprintf(os.Stderr, "error: --scrub and --defrag require a btrfs filesystem (detected non-btrfs at %s)\n", root)
+		entries, err := readUndoEntries(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --undo: %s: %v\n", *undo, err)
 			os.Exit(1)
 		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Undoing %s recorded dedups from %s\n", formatCount(int64(len(entries))), *undo)
+		}
+		tick := newProgressTicker(progressEvery)
+		stats := runUndo(entries, *dryRun, func(current int) {
+			if tick.Due() || current == len(entries) {
+				printProgressBar("  Undoing:", int64(current), int64(len(entries)), "")
+			}
+		})
+		tick.Stop()
+		finishLine(fmt.Sprintf("  Restored %s independent copies", formatCount(stats.Restored)))
+		elapsed := time.Since(startTime).Truncate(time.Millisecond)
+		if *quiet {
+			if stats.Restored > 0 || stats.Errors > 0 {
+				fmt.Fprintf(os.Stderr, "fastdedup: %s: %s restored, %s missing, %s errors (%s)\n",
+					*undo, formatCount(stats.Restored), formatCount(stats.Missing), formatCount(stats.Errors), elapsed)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "\nDone in %s!\n", elapsed)
+			fmt.Fprintf(os.Stderr, "  Files restored:   %s\n", formatCount(stats.Restored))
+			fmt.Fprintf(os.Stderr, "  Missing:          %s\n", formatCount(stats.Missing))
+			fmt.Fprintf(os.Stderr, "  Errors:           %s\n", formatCount(stats.Errors))
+		}
+		if code := exitCode(stats.Restored, stats.Errors, *detailedEC); code != exitOK {
+			os.Exit(code)
+		}
+		return
 	}
 
-	startTime := time.Now()
-
-	if *hardlink && !*dryRun {
-		fmt.Fprintf(os.Stderr, "WARNING: --hardlink mode creates hard links instead of reflinks.\n")
-		fmt.Fprintf(os.Stderr, "  Hard-linked files share the same inode — editing one file changes ALL copies.\n")
-		fmt.Fprintf(os.Stderr, "  Metadata (permissions, timestamps) is also shared. Use with caution.\n\n")
+	// Converting hard links replaces both passes: the groups are inodes.
+	if *relink {
+		groups, err := collectHardlinks(root, walkOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --hardlinks-to-reflinks: %v\n", err)
+			os.Exit(1)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Converting %s hard-linked files to reflinks\n", formatCount(int64(len(groups))))
+		}
+		tick := newProgressTicker(progressEvery)
+		stats := runRelink(groups, dedupOpts, func(current int) {
+			if tick.Due() || current == len(groups) {
+				printProgressBar("  Converting:", int64(current), int64(len(groups)), "")
+			}
+		})
+		tick.Stop()
+		finishLine(fmt.Sprintf("  Replaced %s hard links with reflinks", formatCount(stats.Converted)))
+		elapsed := time.Since(startTime).Truncate(time.Millisecond)
+		if *quiet {
+			if stats.Converted > 0 || stats.Errors > 0 {
+				fmt.Fprintf(os.Stderr, "fastdedup: %s: %s hard links converted, %s errors (%s)\n",
+					root, formatCount(stats.Converted), formatCount(stats.Errors), elapsed)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "\nDone in %s!\n", elapsed)
+			fmt.Fprintf(os.Stderr, "  Hard-linked files: %s\n", formatCount(stats.Groups))
+			fmt.Fprintf(os.Stderr, "  Links converted:   %s\n", formatCount(stats.Converted))
+			fmt.Fprintf(os.Stderr, "  Errors:            %s\n", formatCount(stats.Errors))
+		}
+		if code := exitCode(stats.Converted, stats.Errors, *detailedEC); code != exitOK {
+			os.Exit(code)
+		}
+		return
 	}
 
-	fmtSize := func(b int64) string {
-		return formatSize(b, *rawSizes)
+	// A pairs file replaces both passes: the files and their refs are given.
+	if *pairsFile != "" {
+		f, err := os.Open(*pairsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --pairs-file: %v\n", err)
+			os.Exit(1)
+		}
+		pairs, err := readPairs(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --pairs-file: %s: %v\n", *pairsFile, err)
+			os.Exit(1)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Deduping %s pairs from %s\n", formatCount(int64(len(pairs))), *pairsFile)
+		}
+		tick := newProgressTicker(progressEvery)
+		stats := runPairs(pairs, dedupOpts, func(current int) {
+			if tick.Due() || current == len(pairs) {
+				printProgressBar("  Pairs:", int64(current), int64(len(pairs)), "")
+			}
+		})
+		tick.Stop()
+		finishLine(fmt.Sprintf("  Deduped %s pairs", formatCount(stats.FilesDeduped)))
+		if err := events.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to write events: %v\n", err)
+		}
+		if eventsOut != nil {
+			if err := eventsOut.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: --events-file: %v\n", err)
+			}
+		}
+		elapsed := time.Since(startTime).Truncate(time.Millisecond)
+		if *quiet {
+			if stats.FilesDeduped > 0 || stats.Errors > 0 {
+				fmt.Fprintf(os.Stderr, "fastdedup: %s: %s\n", *pairsFile, stats)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "\nDone in %s!\n", elapsed)
+			fmt.Fprintf(os.Stderr, "  Files deduped:    %s\n", formatCount(stats.FilesDeduped))
+			fmt.Fprintf(os.Stderr, "  Space saved:      %s\n", fmtSize(stats.BytesSaved))
+			fmt.Fprintf(os.Stderr, "  Already deduped:  %s\n", formatCount(stats.AlreadyDeduped))
+			fmt.Fprintf(os.Stderr, "  Errors:           %s\n", formatCount(stats.Errors))
+			for _, e := range stats.ErrorDetails {
+				fmt.Fprintf(os.Stderr, "    %s -> %s: %s\n", e.DstPath, e.SrcPath, e.Err)
+			}
+		}
+		if code := exitCode(stats.FilesDeduped, stats.Errors, *detailedEC); code != exitOK {
+			os.Exit(code)
+		}
+		return
 	}
 
-	// Acquire per-root lock to prevent concurrent runs.
-	lockFile, lockErr := acquireLock(root)
-	if lockErr != nil {
-		fmt.Fprintf(os.Stderr, "error: another fastdedup instance is already running on %s\n", root)
-		os.Exit(1)
+	// Content-defined chunking replaces both passes: chunks are matched
+	// across all files regardless of size.
+	if *cdc {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Content-defined chunking in %s\n", root)
+		}
+		stats, err := runCDC(root, walkOpts, cdcParams, *dryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nerror: cdc failed: %v\n", err)
+			os.Exit(1)
+		}
+		elapsed := time.Since(startTime).Truncate(time.Millisecond)
+		if *quiet {
+			if stats.FilesDeduped > 0 || stats.Errors > 0 {
+				fmt.Fprintf(os.Stderr, "fastdedup: %s: %s chunk-deduped, %s saved, %s errors (%s)\n",
+					root, formatCount(stats.FilesDeduped), fmtSize(stats.BytesSaved),
+					formatCount(stats.Errors), elapsed)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "\nDone in %s!\n", elapsed)
+			fmt.Fprintf(os.Stderr, "  Files deduped:    %s\n", formatCount(stats.FilesDeduped))
+			fmt.Fprintf(os.Stderr, "  Space saved:      %s\n", fmtSize(stats.BytesSaved))
+			fmt.Fprintf(os.Stderr, "  Errors:           %s\n", formatCount(stats.Errors))
+		}
+		if code := exitCode(stats.FilesDeduped, stats.Errors, *detailedEC); code != exitOK {
+			os.Exit(code)
+		}
+		return
 	}
-	defer releaseLock(lockFile)
 
 	// Load dedup cache.
 	var cacheFile string
 	var cached map[int64]uint64
-	if !*noCache && os.Getenv("FASTDEDUP_NO_CACHE") == "" {
+	// With --dedup-only, a size without matching duplicates may still have
+	// others, so nothing is cached.
+	if !*noCache && os.Getenv("FASTDEDUP_NO_CACHE") == "" && dedupOnlyFn == nil {
 		if cf, err := cachePath(root); err == nil {
 			cacheFile = cf
 			cached = loadCache(cf)
@@ -126,10 +1002,38 @@ func main() {
 	}
 
 	// === Pass 1: Survey file sizes ===
+	live.SetPhase("scan")
+	events.Emit(eventPassStart, map[string]any{"pass": 1, "root": root})
 	if !*quiet {
-		fmt.Fprintf(os.Stderr, "Pass 1: Scanning file sizes in %s\n", root)
+		if *indexFile != "" {
+			fmt.Fprintf(os.Stderr, "Pass 1: Reading file sizes under %s from %s\n", root, *indexFile)
+		} else {
+			fmt.Fprintf(os.Stderr, "Pass 1: Scanning file sizes in %s\n", root)
+		}
 	}
 	sm := NewSizeMap(*maxSizes)
+	var memMon *memMonitor
+	if *maxMem > 0 {
+		// The walk shrinks the size map itself when the monitor flags
+		// pressure, trading the least impactful sizes for staying alive.
+		memMon = startMemMonitor(*maxMem, 250*time.Millisecond)
+		sm.SetPressure(memMon.Pressure)
+	}
+	// Counts saved by an interrupted pass 1 are added to this one's.
+	var smSaveTick *progressTicker
+	if *smCache != "" {
+		counts, err := loadSizeCounts(*smCache)
+		switch {
+		case err == nil:
+			sm.Merge(counts)
+			if !*quiet {
+				fmt.Fprintf(os.Stderr, "  Resuming with %s sizes saved in %s\n", formatCount(int64(len(counts))), *smCache)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			fmt.Fprintf(os.Stderr, "warning: --sizemap-cache: %v; starting from empty counts\n", err)
+		}
+		smSaveTick = newProgressTicker(sizeCountsSaveEvery)
+	}
 	var filenameHashes map[int64]uint64
 	if cacheFile != "" {
 		filenameHashes = make(map[int64]uint64)
@@ -147,57 +1051,200 @@ func main() {
 	if estimatedFiles == 0 && isMountPoint(root) {
 		estimatedFiles = fsFileEstimate(root)
 	}
+	if *estTotal && *indexFile == "" {
+		printStatus("  Counting files...")
+		countStart := time.Now()
+		estimatedFiles = CountFiles(root, walkOpts)
+		slog.Debug("pre-scan counted files", "files", estimatedFiles, "duration", time.Since(countStart))
+	}
 	var estimatedBytes int64
 	if estimatedFiles == 0 {
 		estimatedBytes = fsUsedBytes(root)
 	}
 
+	var sizeHist SizeHistogram
 	var scanCount int64
 	var scanBytes int64
 	scanStart := time.Now()
-	lastUpdate := scanStart
-	fileCount, err := WalkSizes(root, sm, *snapshots, *minSize, func(path string, size int64) {
+	scanTick := newProgressTicker(progressEvery)
+	// Canonical manifest copies outside root count toward their size group
+	// once the size is seen, so a single scanned copy still becomes a target.
+	manifestSizes := make(map[int64]bool)
+	onScan := func(path string, size int64) {
+		if n := dedupOpts.Manifest.External(size); n > 0 && !manifestSizes[size] {
+			manifestSizes[size] = true
+			for range n {
+				sm.Add(size)
+			}
+		}
 		if filenameHashes != nil {
 			filenameHashes[size] += hashFilename(filepath.Base(path))
 		}
+		sizeHist.Add(size)
 		scanCount++
 		scanBytes += size
-		if scanCount%100 == 0 {
-			now := time.Now()
-			if now.Sub(lastUpdate) >= 200*time.Millisecond {
-				lastUpdate = now
-				elapsed := now.Sub(scanStart)
-				rate := int64(float64(scanCount) / elapsed.Seconds())
-				if estimatedFiles > 0 {
-					eta := formatETA(elapsed, scanCount, estimatedFiles)
-					suffix := fmt.Sprintf("%s/s %s", formatCount(rate), eta)
-					printProgressBar("  Scanning:", scanCount, estimatedFiles, suffix)
-				} else if estimatedBytes > 0 {
-					eta := formatETA(elapsed, scanBytes, estimatedBytes)
-					suffix := fmt.Sprintf("%s / %s %s", formatSize(scanBytes, false), formatSize(estimatedBytes, false), eta)
-					printProgressBar("  Scanning:", scanBytes, estimatedBytes, suffix)
-				} else {
-					printStatus(fmt.Sprintf("  Scanned: %s (%s/s)", formatCount(scanCount), formatCount(rate)))
-				}
+		live.FilesScanned.Add(1)
+		if smSaveTick != nil && smSaveTick.Due() {
+			if err := saveSizeCounts(*smCache, sm); err != nil {
+				slog.Debug("cannot save size counts", "path", *smCache, "error", err)
+			}
+		}
+		if scanTick.Due() {
+			elapsed := time.Since(scanStart)
+			rate := int64(float64(scanCount) / elapsed.Seconds())
+			if estimatedFiles > 0 {
+				eta := formatETA(elapsed, scanCount, estimatedFiles)
+				suffix := fmt.Sprintf("%s/s %s", formatCount(rate), eta)
+				printProgressBar("  Scanning:", scanCount, estimatedFiles, suffix)
+			} else if estimatedBytes > 0 {
+				eta := formatETA(elapsed, scanBytes, estimatedBytes)
+				suffix := fmt.Sprintf("%s / %s %s", formatSize(scanBytes, false), formatSize(estimatedBytes, false), eta)
+				printProgressBar("  Scanning:", scanBytes, estimatedBytes, suffix)
+			} else {
+				printStatus(fmt.Sprintf("  Scanned: %s (%s/s)", formatCount(scanCount), formatCount(rate)))
 			}
 		}
-	})
+	}
+	var fileCount, sampledCount int64
+	totalStats := &DedupStats{}
+	// Every run from here on writes metrics, whether it finishes, returns
+	// early with nothing to do, or fails, so an exporter never keeps serving
+	// the previous run's values. Early returns are covered by the deferred
+	// write; exits, which skip deferred calls, go through exit.
+	metricsWritten := false
+	writeRunMetrics := func(elapsed time.Duration) {
+		if *metricsFile == "" || metricsWritten {
+			return
+		}
+		metricsWritten = true
+		if err := writeMetrics(*metricsFile, root, totalStats, fileCount, elapsed); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to write metrics file: %v\n", err)
+		}
+	}
+	defer func() { writeRunMetrics(time.Since(startTime).Truncate(time.Millisecond)) }()
+	exit := func(code int) {
+		writeRunMetrics(time.Since(startTime).Truncate(time.Millisecond))
+		os.Exit(code)
+	}
+	var special SpecialFiles
+	var tree TreeStats
+	var surveyCut bool // pass 1 stopped at --survey-timeout
+	if *indexFile != "" {
+		var f *os.File
+		if f, err = os.Open(*indexFile); err == nil {
+			fileCount, err = IndexSizes(f, root, sm, walkOpts, onScan)
+			f.Close()
+		}
+		if err != nil {
+			err = fmt.Errorf("--index: %w", err)
+		}
+	} else if *samplePct > 0 {
+		smp := newSampler(*samplePct, uint64(time.Now().UnixNano()))
+		fileCount, sampledCount, err = SampleSizes(root, sm, walkOpts, &special, smp, onScan)
+	} else {
+		var surveyEnd time.Time
+		if surveyLimit > 0 {
+			surveyEnd = scanStart.Add(surveyLimit)
+		}
+		fileCount, surveyCut, err = WalkSizes(root, sm, walkOpts, &special, &tree, NewFileLimit(*limitFiles), surveyEnd, onScan)
+	}
+	scanTick.Stop()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\nerror: pass 1 failed: %v\n", err)
-		os.Exit(1)
+		exit(1)
+	}
+	// A complete pass 1 leaves nothing to resume; one cut short by
+	// --survey-timeout saves its counts for the next run.
+	if smSaveTick != nil {
+		smSaveTick.Stop()
+		if surveyCut {
+			err = saveSizeCounts(*smCache, sm)
+		} else if err = os.Remove(*smCache); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: --sizemap-cache: %v\n", err)
+		}
 	}
 	finishLine(fmt.Sprintf("  Scanned %s files, %s unique sizes",
 		formatCount(fileCount), formatCount(int64(sm.Len()))))
+	if *limitFiles > 0 && fileCount >= *limitFiles {
+		finishLine(fmt.Sprintf("  Stopped at --limit-files %s; the rest of the tree was not scanned", formatCount(*limitFiles)))
+	}
+	if surveyCut {
+		finishLine(fmt.Sprintf("  Stopped at --survey-timeout %s; targets are chosen from the files scanned so far", *survTimeout))
+	}
+	memMon.Stop()
+	evictions := sm.Evictions()
+	if evictions.Duplicated > 0 {
+		finishLine(fmt.Sprintf("  Evicted %s sizes from the size map, %s with duplicates (about %s potential savings lost); a higher --max-sizes keeps them",
+			formatCount(evictions.Sizes), formatCount(evictions.Duplicated), fmtSize(evictions.Savings)))
+	} else if evictions.Sizes > 0 {
+		finishLine(fmt.Sprintf("  Evicted %s sizes from the size map, none with duplicates", formatCount(evictions.Sizes)))
+	}
+	// Sizes dropped near --max-mem are reported apart: a higher --max-sizes
+	// would not have kept them.
+	shrunk := sm.ShrinkEvictions()
+	if shrunk.Duplicated > 0 {
+		finishLine(fmt.Sprintf("  Near --max-mem: capped tracked sizes at %s and dropped %s sizes, %s with duplicates (about %s potential savings lost); a higher --max-mem keeps them",
+			formatCount(int64(sm.MaxSize())), formatCount(shrunk.Sizes), formatCount(shrunk.Duplicated), fmtSize(shrunk.Savings)))
+	} else if sm.Shrinks() > 0 {
+		finishLine(fmt.Sprintf("  Near --max-mem: capped tracked sizes at %s and dropped %s sizes, none with duplicates",
+			formatCount(int64(sm.MaxSize())), formatCount(shrunk.Sizes)))
+	}
+	pass1End := map[string]any{"pass": 1, "files": fileCount, "sizes": sm.Len(),
+		"duration_ms": time.Since(scanStart).Milliseconds()}
+	if tree.Dirs > 0 {
+		pass1End["dirs"], pass1End["max_depth"], pass1End["max_dir_entries"] = tree.Dirs, tree.MaxDepth, tree.MaxEntries
+	}
+	if surveyCut {
+		pass1End["survey_timeout"] = true
+	}
+	if evictions.Sizes > 0 {
+		pass1End["evicted_sizes"], pass1End["evicted_duplicated"], pass1End["evicted_savings"] =
+			evictions.Sizes, evictions.Duplicated, evictions.Savings
+	}
+	if shrunk.Sizes > 0 {
+		pass1End["shrunk_sizes"], pass1End["shrunk_duplicated"], pass1End["shrunk_savings"] =
+			shrunk.Sizes, shrunk.Duplicated, shrunk.Savings
+	}
+	events.Emit(eventPassEnd, pass1End)
+
+	if *histogram {
+		sizeHist.Write(os.Stderr, *rawSizes)
+	}
+	if *treeStats && tree.Dirs > 0 {
+		fmt.Fprintf(os.Stderr, "\nTree: %s directories\n", formatCount(tree.Dirs))
+		fmt.Fprintf(os.Stderr, "  Deepest:          %d levels below the root (%s)\n", tree.MaxDepth, tree.DeepestDir)
+		fmt.Fprintf(os.Stderr, "  Widest:           %s entries (%s)\n", formatCount(int64(tree.MaxEntries)), tree.WidestDir)
+	}
 
 	// Save scan metadata for future progress estimation.
 	if mFile != "" {
 		_ = saveMeta(mFile, &ScanMeta{FileCount: fileCount})
 	}
 
+	// Sampling only supports an estimate; nothing is deduped.
+	if *samplePct > 0 {
+		writeSampleEstimate(os.Stdout, sm.TopN(sm.Len()), fileCount, sampledCount, *samplePct, *rawSizes)
+		return
+	}
+
+	// Survey mode stops after pass 1; the cache does not apply since nothing
+	// is deduped.
+	if *surveyOnly {
+		entries := sm.TopN(sm.Len())
+		writeSurvey(os.Stdout, entries, *topN, fileCount, *rawSizes)
+		if *growth > 0 && len(entries) > 0 {
+			projectGrowth(entries, *growth).Write(os.Stdout, *rawSizes)
+		}
+		return
+	}
+
 	// Select top N most impactful sizes, excluding cached (unchanged) groups.
 	// Cached sizes are filtered before applying the -top limit so that
 	// subsequent runs still process the requested number of entries.
-	allCandidates := sm.TopN(sm.Len())
+	allCandidates := sm.TopNMinImpact(sm.Len(), minImpactBytes)
 	var targets []SizeEntry
 	var skippedCached int64
 	for _, t := range allCandidates {
@@ -207,7 +1254,7 @@ func main() {
 				continue
 			}
 		}
-		if len(targets) < *topN {
+		if len(targets) < topLimit {
 			targets = append(targets, t)
 		}
 	}
@@ -220,6 +1267,7 @@ func main() {
 				fmt.Fprintf(os.Stderr, "\nNo duplicate file sizes found.\n")
 			}
 		}
+		printBaseline(&DedupStats{})
 		return
 	}
 
@@ -249,10 +1297,41 @@ func main() {
 			"", "", formatCount(totalTargetFiles), fmtSize(totalTargetSavings))
 	}
 
+	// Ask for confirmation before pass 2 modifies anything.
+	if *interactive && !*dryRun {
+		var planFiles, planSavings int64
+		for _, t := range targets {
+			planFiles += t.Count
+			planSavings += t.Savings()
+		}
+		ok, err := confirmPlan(os.Stdin, os.Stderr, stdinIsTTY, *noTTYAction, len(targets), planFiles, planSavings, *rawSizes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			exit(1)
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Aborted, no changes made.\n")
+			return
+		}
+	}
+
 	// === Pass 2: Deduplicate ===
-	totalStats := &DedupStats{}
+	live.SetPhase("dedup")
+	pass2Walk := walkOpts
+	if dedupOnlyFn != nil {
+		// Pass 1 counted every file, so groups may shrink below two here.
+		pass2Walk.ShouldProcess = func(path string, _ os.FileInfo) bool { return dedupOnlyFn(path) }
+	}
+	if !*dryRun && isBtrfs(root) {
+		// Reflinks and their metadata can fill metadata mid-run.
+		stopSpaceWatch := watchMetadataSpace(root, spaceCheckEvery)
+		defer stopSpaceWatch()
+	}
+	live.GroupsTotal.Store(int64(len(targets)))
 	errorSizes := make(map[int64]bool) // track which size groups had errors
-	dirPool := NewDirIntern()          // shared directory string interner for compact paths
+	// With --transactional, groups are cached only once their dedups commit.
+	txnCached := make(map[int64]uint64)
+	dirPool := NewDirIntern() // shared directory string interner for compact paths
 
 	// Compute expected totals from pass 1 for overall progress.
 	var expectedFiles int64
@@ -262,34 +1341,90 @@ func main() {
 		expectedSavings += t.Savings()
 	}
 
-	var filesProcessed int64 // cumulative files across all groups
-	var noDupGroups int64    // groups where no action was taken
-	var timeLimitHit bool    // set when --max-time deadline is reached
+	events.Emit(eventPassStart, map[string]any{"pass": 2, "groups": len(targets), "files": expectedFiles,
+		"potential_savings": expectedSavings, "dry_run": *dryRun})
+
+	var filesProcessed int64      // cumulative files across all groups
+	var noDupGroups int64         // groups where no action was taken
+	var timeLimitHit bool         // set when --max-time deadline is reached
+	var errorLimitHit atomic.Bool // set once more than --max-errors errors occurred
+	fileLimit := NewFileLimit(*limitFiles)
 	dedupStart := time.Now()
+	dedupTick := newProgressTicker(progressEvery)
 
 	timeExpired := func() bool {
 		return !deadline.IsZero() && time.Now().After(deadline)
 	}
 
-	// processGroup deduplicates one size group and accumulates stats.
-	processGroup := func(idx, total int, size int64, paths []string) {
+	// With --per-device-workers, groups run concurrently on per-device
+	// pools; groupMu serializes the bookkeeping below and the output.
+	var sched *deviceScheduler
+	if *perDevice > 0 {
+		sched = newDeviceScheduler(*perDevice)
+	}
+	var groupMu sync.Mutex
+	procTick := newProgressTicker(processedFlushEvery)
+	defer procTick.Stop()
+
+	// markCached records a size with no duplicates so the next run skips it.
+	markCached := func(size int64) {
+		groupMu.Lock()
+		cached[size] = filenameHashes[size]
+		groupMu.Unlock()
+	}
+
+	// tooFew reports whether n collected files of a size leave nothing to
+	// dedup, counting canonical manifest copies outside root.
+	tooFew := func(size int64, n int) bool {
+		return int64(n)+dedupOpts.Manifest.External(size) < 2
+	}
+
+	// runGroup deduplicates one size group and accumulates stats.
+	runGroup := func(idx, total int, size int64, paths []string) {
+		if topo != nil {
+			topo.Add(topologyOf(paths, size))
+			groupMu.Lock()
+			filesProcessed += int64(len(paths))
+			groupMu.Unlock()
+			return
+		}
 		numWidth := len(fmt.Sprintf("%d", total))
 		prefix := fmt.Sprintf("  [%*d/%d] %10s \u00d7 %-8s",
 			numWidth, idx+1, total,
 			fmtSize(size), formatCount(int64(len(paths))))
 
-		step := max(1, len(paths)/200)
-		groupBase := filesProcessed
-		stats := ProcessSizeGroup(paths, size, *dryRun, *verbose, *rawSizes, *hardlink, *fixPerms, func(current int) {
-			if current%step == 0 || current == len(paths) {
-				overall := groupBase + int64(current)
-				eta := formatETA(time.Since(dedupStart), overall, expectedFiles)
-				overallPct := overall * 100 / expectedFiles
-				suffix := fmt.Sprintf("(%d%%) %s", overallPct, eta)
-				printProgressBar(prefix, int64(current), int64(len(paths)), suffix)
+		// A per-file progress bar only makes sense for one group at a time.
+		var onProgress func(current int)
+		if sched == nil {
+			groupBase := filesProcessed
+			onProgress = func(current int) {
+				if dedupTick.Due() || current == len(paths) {
+					overall := groupBase + int64(current)
+					eta := formatETA(time.Since(dedupStart), overall, expectedFiles)
+					overallPct := overall * 100 / expectedFiles
+					suffix := fmt.Sprintf("(%d%%) %s", overallPct, eta)
+					printProgressBar(prefix, int64(current), int64(len(paths)), suffix)
+				}
 			}
-		})
+		}
+		opts := dedupOpts
+		if *maxErrors > 0 {
+			// The limit is for the whole run; give the group what's left.
+			groupMu.Lock()
+			opts.MaxErrors = *maxErrors - totalStats.Errors
+			groupMu.Unlock()
+		}
+		stats := ProcessSizeGroup(paths, size, opts, onProgress)
+
+		groupMu.Lock()
+		defer groupMu.Unlock()
 		filesProcessed += int64(len(paths))
+		live.FilesProcessed.Add(int64(len(paths)))
+		live.AddGroup(stats)
+		events.Emit(eventProgress, map[string]any{"size": size, "files": len(paths),
+			"groups_done": live.GroupsDone.Load(), "groups_total": len(targets),
+			"files_processed": filesProcessed, "files_total": expectedFiles,
+			"files_deduped": stats.FilesDeduped, "bytes_saved": stats.BytesSaved, "errors": stats.Errors})
 
 		var parts []string
 		if stats.FilesDeduped > 0 {
@@ -304,6 +1439,46 @@ func main() {
 			parts = append(parts, fmt.Sprintf("%s errors",
 				formatCount(stats.Errors)))
 		}
+		if stats.PermissionDenied > 0 {
+			parts = append(parts, fmt.Sprintf("%s unreadable",
+				formatCount(stats.PermissionDenied)))
+		}
+		if stats.NoCOW > 0 {
+			parts = append(parts, fmt.Sprintf("%s nocow",
+				formatCount(stats.NoCOW)))
+		}
+		if stats.Unfragmented > 0 {
+			parts = append(parts, fmt.Sprintf("%s unfragmented",
+				formatCount(stats.Unfragmented)))
+		}
+		if stats.TimedOut > 0 {
+			parts = append(parts, fmt.Sprintf("%s timed out",
+				formatCount(stats.TimedOut)))
+		}
+		if len(stats.ReadErrors) > 0 {
+			parts = append(parts, fmt.Sprintf("%s read errors",
+				formatCount(int64(len(stats.ReadErrors)))))
+		}
+		if stats.SharedSkipped > 0 {
+			parts = append(parts, fmt.Sprintf("%s shared",
+				formatCount(stats.SharedSkipped)))
+		}
+		if stats.FullyShared > 0 {
+			parts = append(parts, fmt.Sprintf("%s all shared",
+				formatCount(stats.FullyShared)))
+		}
+		if stats.HookSkipped > 0 {
+			parts = append(parts, fmt.Sprintf("%s vetoed by hook",
+				formatCount(stats.HookSkipped)))
+		}
+		if stats.Protected > 0 {
+			parts = append(parts, fmt.Sprintf("%s protected",
+				formatCount(stats.Protected)))
+		}
+		if stats.ChangedSkipped > 0 {
+			parts = append(parts, fmt.Sprintf("%s changed",
+				formatCount(stats.ChangedSkipped)))
+		}
 		if len(parts) == 0 {
 			noDupGroups++
 			// Clear progress bar but don't print a line for no-action groups.
@@ -317,12 +1492,45 @@ func main() {
 		totalStats.AlreadyDeduped += stats.AlreadyDeduped
 		totalStats.Errors += stats.Errors
 		totalStats.ErrorDetails = append(totalStats.ErrorDetails, stats.ErrorDetails...)
-		if stats.Errors > 0 {
+		totalStats.PermissionDenied += stats.PermissionDenied
+		totalStats.NoCOW += stats.NoCOW
+		totalStats.Unfragmented += stats.Unfragmented
+		totalStats.SharedSkipped += stats.SharedSkipped
+		totalStats.FullyShared += stats.FullyShared
+		totalStats.HookSkipped += stats.HookSkipped
+		totalStats.Protected += stats.Protected
+		totalStats.ChangedSkipped += stats.ChangedSkipped
+		totalStats.TimedOut += stats.TimedOut
+		totalStats.ReadErrors = append(totalStats.ReadErrors, stats.ReadErrors...)
+		totalStats.FilesScanned += stats.FilesScanned
+		totalStats.BytesScanned += stats.BytesScanned
+		totalStats.UniqueContents += stats.UniqueContents
+		// Groups with unreadable files are not cached, so they are retried
+		// once permissions are fixed.
+		if stats.Errors > 0 || stats.PermissionDenied > 0 || len(stats.ReadErrors) > 0 {
 			errorSizes[size] = true
+		} else if dedupOpts.Processed != nil {
+			dedupOpts.Processed.Add(paths...)
+			if procTick.Due() {
+				if err := dedupOpts.Processed.Flush(); err != nil {
+					slog.Debug("cannot save processed set", "path", *procSet, "error", err)
+				}
+			}
+		}
+		if *maxErrors > 0 && totalStats.Errors > *maxErrors {
+			errorLimitHit.Store(true)
+		}
+		if stats.Fatal != nil && !errors.Is(stats.Fatal, errTooManyErrors) {
+			fmt.Fprintf(os.Stderr, "\nerror: %v (--skip-errors-fatal)\n", stats.Fatal)
+			fmt.Fprintf(os.Stderr, "  Run as root or adjust permissions to process every file.\n")
+			txn.Abort()
+			exit(1)
 		}
 
 		// Incrementally save cache after each completed group so Ctrl+C doesn't lose progress.
-		if cacheFile != "" && !*dryRun && !errorSizes[size] {
+		if cacheFile != "" && !*dryRun && !errorSizes[size] && txn != nil {
+			txnCached[size] = filenameHashes[size]
+		} else if cacheFile != "" && !*dryRun && !errorSizes[size] {
 			cached[size] = filenameHashes[size]
 			if err := saveCache(cacheFile, cached); err != nil {
 				slog.Debug("failed to save cache", "error", err)
@@ -330,6 +1538,43 @@ func main() {
 		}
 	}
 
+	var lateOnce sync.Once
+
+	// processGroup runs a group inline, or queues it on the pool for the
+	// device holding its first file.
+	processGroup := func(idx, total int, size int64, paths []string) {
+		if fileLimit != nil {
+			all := len(paths)
+			if paths = fileLimit.Trim(paths); len(paths) < all {
+				// A partial group says nothing about the rest; don't cache it.
+				groupMu.Lock()
+				errorSizes[size] = true
+				groupMu.Unlock()
+			}
+			if len(paths) < 2 {
+				return
+			}
+		}
+		if sched == nil {
+			runGroup(idx, total, size, paths)
+			return
+		}
+		sched.Submit(fileDevice(paths[0]), func() {
+			if errorLimitHit.Load() {
+				return
+			}
+			if timeExpired() {
+				lateOnce.Do(func() {
+					groupMu.Lock()
+					finishLine("  Time limit reached, skipping queued groups")
+					groupMu.Unlock()
+				})
+				return
+			}
+			runGroup(idx, total, size, paths)
+		})
+	}
+
 	if *batch {
 		// Batch mode: collect all target files in a single pass, then deduplicate.
 		if !*quiet {
@@ -342,21 +1587,18 @@ func main() {
 
 		var collectCount int64
 		collectStart := time.Now()
-		lastCollectUpdate := collectStart
-		collected, err := CollectFiles(root, targetSet, *snapshots, *minSize, dirPool, func() {
+		collectTick := newProgressTicker(progressEvery)
+		collected, err := CollectFiles(root, targetSet, pass2Walk, dirPool, func() {
 			collectCount++
-			if collectCount%100 == 0 {
-				now := time.Now()
-				if now.Sub(lastCollectUpdate) >= 200*time.Millisecond {
-					lastCollectUpdate = now
-					eta := formatETA(now.Sub(collectStart), collectCount, expectedFiles)
-					printProgressBar("  Collecting:", collectCount, expectedFiles, eta)
-				}
+			if collectTick.Due() {
+				eta := formatETA(time.Since(collectStart), collectCount, expectedFiles)
+				printProgressBar("  Collecting:", collectCount, expectedFiles, eta)
 			}
 		})
+		collectTick.Stop()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "\nerror: collection failed: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 
 		type processEntry struct {
@@ -367,12 +1609,12 @@ func main() {
 		var totalFiles int64
 		for _, t := range targets {
 			paths := collected[t.Size]
-			if len(paths) >= 2 {
+			if !tooFew(t.Size, len(paths)) {
 				toProcess = append(toProcess, processEntry{t.Size, paths})
 				totalFiles += int64(len(paths))
 			} else if cacheFile != "" && !*dryRun {
 				// No duplicates for this size — cache to skip on next run.
-				cached[t.Size] = filenameHashes[t.Size]
+				markCached(t.Size)
 			}
 		}
 		finishLine(fmt.Sprintf("  Collected %s files in %s size groups",
@@ -400,6 +1642,9 @@ func main() {
 		}
 
 		for i, entry := range toProcess {
+			if errorLimitHit.Load() || fileLimit.Reached() {
+				break
+			}
 			if timeExpired() {
 				timeLimitHit = true
 				finishLine("  Time limit reached, stopping gracefully")
@@ -419,21 +1664,24 @@ func main() {
 		}
 
 		for i, t := range targets {
+			if errorLimitHit.Load() || fileLimit.Reached() {
+				break
+			}
 			if timeExpired() {
 				timeLimitHit = true
 				finishLine("  Time limit reached, stopping gracefully")
 				break
 			}
 			singleSet := map[int64]struct{}{t.Size: {}}
-			collected, err := CollectFiles(root, singleSet, *snapshots, *minSize, dirPool, nil)
+			collected, err := CollectFiles(root, singleSet, pass2Walk, dirPool, nil)
 			if err != nil {
 				slog.Debug("collection failed", "size", t.Size, "error", err)
 				continue
 			}
 			paths := collected[t.Size]
-			if len(paths) < 2 {
+			if tooFew(t.Size, len(paths)) {
 				if cacheFile != "" && !*dryRun {
-					cached[t.Size] = filenameHashes[t.Size]
+					markCached(t.Size)
 				}
 				continue
 			}
@@ -463,6 +1711,9 @@ func main() {
 		}
 
 		for wave := 1; ; wave++ {
+			if errorLimitHit.Load() || fileLimit.Reached() {
+				break
+			}
 			if timeExpired() {
 				timeLimitHit = true
 				finishLine("  Time limit reached, stopping gracefully")
@@ -492,9 +1743,9 @@ func main() {
 			var totalMem int64
 			var collectCount int64
 			waveStart := time.Now()
-			lastWaveUpdate := waveStart
+			waveTick := newProgressTicker(progressEvery)
 
-			_ = walkRandom(root, *snapshots, *minSize, func(path string, size int64) {
+			_ = walkRandom(root, pass2Walk, nil, func(path string, size int64) {
 				if _, ok := collectSet[size]; !ok {
 					return
 				}
@@ -503,13 +1754,9 @@ func main() {
 				}
 
 				collectCount++
-				if collectCount%100 == 0 {
-					now := time.Now()
-					if now.Sub(lastWaveUpdate) >= 200*time.Millisecond {
-						lastWaveUpdate = now
-						eta := formatETA(now.Sub(waveStart), collectCount, expectedFiles)
-						printProgressBar("  Collecting:", collectCount, expectedFiles, eta)
-					}
+				if waveTick.Due() {
+					eta := formatETA(time.Since(waveStart), collectCount, expectedFiles)
+					printProgressBar("  Collecting:", collectCount, expectedFiles, eta)
 				}
 
 				dir, name := filepath.Dir(path), filepath.Base(path)
@@ -554,6 +1801,7 @@ func main() {
 					}
 				}
 			})
+			waveTick.Stop()
 
 			if len(cache) == 0 {
 				finishLine(fmt.Sprintf("  Wave %d: no groups fit in memory", wave))
@@ -564,6 +1812,9 @@ func main() {
 
 			// Process cached groups in original priority order.
 			for _, t := range targets {
+				if errorLimitHit.Load() || fileLimit.Reached() {
+					break
+				}
 				if timeExpired() {
 					timeLimitHit = true
 					finishLine("  Time limit reached, stopping gracefully")
@@ -575,9 +1826,9 @@ func main() {
 				}
 				delete(cache, t.Size)
 				processed[t.Size] = true
-				if len(g.paths) < 2 {
+				if tooFew(t.Size, len(g.paths)) {
 					if cacheFile != "" && !*dryRun {
-						cached[t.Size] = filenameHashes[t.Size]
+						markCached(t.Size)
 					}
 					groupsDone++
 					continue
@@ -585,7 +1836,7 @@ func main() {
 				processGroup(groupsDone, totalGroups, t.Size, ExpandPaths(g.paths))
 				groupsDone++
 			}
-			if timeLimitHit {
+			if timeLimitHit || errorLimitHit.Load() || fileLimit.Reached() {
 				break
 			}
 
@@ -607,22 +1858,25 @@ func main() {
 			if !oversized[t.Size] {
 				continue
 			}
+			if errorLimitHit.Load() || fileLimit.Reached() {
+				break
+			}
 			if timeLimitHit || timeExpired() {
 				timeLimitHit = true
 				break
 			}
 			slog.Debug("processing oversized group via per-size scan", "size", t.Size)
 			singleSet := map[int64]struct{}{t.Size: {}}
-			c, err := CollectFiles(root, singleSet, *snapshots, *minSize, dirPool, nil)
+			c, err := CollectFiles(root, singleSet, pass2Walk, dirPool, nil)
 			if err != nil {
 				slog.Debug("collection failed", "size", t.Size, "error", err)
 				groupsDone++
 				continue
 			}
 			paths := c[t.Size]
-			if len(paths) < 2 {
+			if tooFew(t.Size, len(paths)) {
 				if cacheFile != "" && !*dryRun {
-					cached[t.Size] = filenameHashes[t.Size]
+					markCached(t.Size)
 				}
 				groupsDone++
 				continue
@@ -632,6 +1886,46 @@ func main() {
 		}
 	}
 
+	if sched != nil {
+		sched.Wait()
+	}
+	if fileLimit.Reached() {
+		finishLine(fmt.Sprintf("  Reached --limit-files %s, stopped early", formatCount(*limitFiles)))
+	}
+	if topo != nil {
+		topo.WriteSummary(os.Stderr)
+		return
+	}
+
+	// Phase 2 of --transactional: swap every staged file in, or none.
+	if txn != nil {
+		files, bytes := txn.Staged()
+		var txnErr error
+		if totalStats.Errors > 0 {
+			txn.Abort()
+			txnErr = fmt.Errorf("%s errors during the run", formatCount(totalStats.Errors))
+		} else if txnErr = txn.Commit(); txnErr != nil {
+			totalStats.Errors++
+		}
+		if txnErr != nil {
+			totalStats.FilesDeduped -= files
+			totalStats.BytesSaved -= bytes
+			fmt.Fprintf(os.Stderr, "\nerror: --transactional: %v; discarded %s staged dedups\n",
+				txnErr, formatCount(files))
+		} else {
+			for size, h := range txnCached {
+				cached[size] = h
+			}
+			if !*quiet {
+				finishLine(fmt.Sprintf("  Committed %s dedups (%s)", formatCount(files), fmtSize(bytes)))
+			}
+		}
+	}
+
+	if err := dedupOpts.Processed.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: --processed-set: %v\n", err)
+	}
+
 	// Save dedup cache (skip on dry-run).
 	// Individual groups are cached incrementally inside processGroup and at
 	// <2-paths skip points above, so this block only prunes stale entries
@@ -650,6 +1944,39 @@ func main() {
 		}
 	}
 
+	live.SetPhase("done")
+	dedupTick.Stop()
+	slog.Debug("pass 2 done", "peak_inflight", dedupOpts.Inflight.Peak())
+	events.Emit(eventPassEnd, map[string]any{"pass": 2, "duration_ms": time.Since(dedupStart).Milliseconds()})
+
+	if scriptFile != nil {
+		n, err := dedupOpts.Script.Err()
+		if cerr := scriptFile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --emit-script: %v\n", err)
+			exit(1)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "\nWrote %s commands to %s\n", formatCount(n), *emitScript)
+		}
+	}
+
+	if groupsOut != nil {
+		n, err := dedupOpts.Groups.Err()
+		if cerr := groupsOut.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --groups-manifest: %v\n", err)
+			exit(1)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "\nWrote %s content groups to %s\n", formatCount(n), *groupsFile)
+		}
+	}
+
 	// Write anonymized error report (unless disabled).
 	if os.Getenv("FASTDEDUP_NO_REPORT_FILE") == "" && len(totalStats.ErrorDetails) > 0 && !*dryRun {
 		if rf, err := reportFilePath(); err == nil {
@@ -659,6 +1986,11 @@ func main() {
 		}
 	}
 
+	if errorLimitHit.Load() {
+		fmt.Fprintf(os.Stderr, "\nerror: aborted after %s errors (--max-errors %d); check the filesystem type and permissions\n",
+			formatCount(totalStats.Errors), *maxErrors)
+	}
+
 	// Final summary.
 	elapsed := time.Since(startTime).Truncate(time.Millisecond)
 	if *quiet {
@@ -674,12 +2006,99 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  Files deduped:    %s\n", formatCount(totalStats.FilesDeduped))
 		fmt.Fprintf(os.Stderr, "  Space saved:      %s\n", fmtSize(totalStats.BytesSaved))
 		fmt.Fprintf(os.Stderr, "  Already deduped:  %s\n", formatCount(totalStats.AlreadyDeduped))
+		if totalStats.FilesScanned > 0 {
+			fmt.Fprintf(os.Stderr, "  Dedup ratio:      %.1f%% of %s in candidate files\n",
+				100*totalStats.DedupRatio(), fmtSize(totalStats.BytesScanned))
+			fmt.Fprintf(os.Stderr, "  Unique contents:  %s of %s files (%.1f%%)\n",
+				formatCount(totalStats.UniqueContents), formatCount(totalStats.FilesScanned), 100*totalStats.UniqueRatio())
+		}
+		if totalStats.AlreadyDeduped+totalStats.FilesDeduped > 0 {
+			fmt.Fprintf(os.Stderr, "  Converged:        %.1f%% of duplicates already deduped\n", 100*totalStats.ConvergedRatio())
+		}
 		if noDupGroups > 0 {
 			fmt.Fprintf(os.Stderr, "  No duplicates:    %s groups\n", formatCount(noDupGroups))
 		}
+		if io := live.Snapshot(); io.FilesOpened > 0 {
+			fmt.Fprintf(os.Stderr, "  I/O:              %s FIEMAP, %s FICLONE, %s opens, %s compared\n",
+				formatCount(io.FIEMAPCalls), formatCount(io.FICLONECalls), formatCount(io.FilesOpened), fmtSize(io.BytesCompared))
+		}
 		fmt.Fprintf(os.Stderr, "  Errors:           %s\n", formatCount(totalStats.Errors))
+		if totalStats.PermissionDenied > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: permission denied (run as root or adjust permissions)\n",
+				formatCount(totalStats.PermissionDenied))
+		}
+		if totalStats.NoCOW > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: nocow, cannot reflink (chattr -C or use --hardlink)\n",
+				formatCount(totalStats.NoCOW))
+		}
+		if totalStats.Unfragmented > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: below --min-fragmentation %g\n",
+				formatCount(totalStats.Unfragmented), *minFrag)
+		}
+		if totalStats.TimedOut > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: timed out (--file-timeout %s); check the storage they are on\n",
+				formatCount(totalStats.TimedOut), dedupOpts.FileTimeout)
+		}
+		if len(totalStats.ReadErrors) > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: read error, possible bad media; check the disk:\n",
+				formatCount(int64(len(totalStats.ReadErrors))))
+			for _, p := range totalStats.ReadErrors {
+				fmt.Fprintf(os.Stderr, "    %s\n", p)
+			}
+		}
+		if totalStats.SharedSkipped > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: extents already shared (--preserve-shared)\n",
+				formatCount(totalStats.SharedSkipped))
+		}
+		if totalStats.FullyShared > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: all extents already shared (--skip-shared)\n",
+				formatCount(totalStats.FullyShared))
+		}
+		if totalStats.HookSkipped > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: --pre-hook failed\n",
+				formatCount(totalStats.HookSkipped))
+		}
+		if totalStats.Protected > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: other hard links, immutable or append-only (--skip-protected)\n",
+				formatCount(totalStats.Protected))
+		}
+		if totalStats.ChangedSkipped > 0 {
+			fmt.Fprintf(os.Stderr, "  %s files skipped: changed after comparison (--recheck)\n",
+				formatCount(totalStats.ChangedSkipped))
+		}
+		if special.Total() > 0 {
+			fmt.Fprintf(os.Stderr, "  %s special files skipped: %s\n",
+				formatCount(special.Total()), special.String())
+		}
+		if r := totalStats.ConvergedRatio(); r >= convergedHintMin {
+			fmt.Fprintf(os.Stderr, "\nVolume %.0f%% converged; consider less frequent runs.\n", 100*r)
+		}
+	}
+	printBaseline(totalStats)
+
+	events.Emit(eventRunEnd, map[string]any{"root": root, "dry_run": *dryRun, "duration_ms": elapsed.Milliseconds(),
+		"files_deduped": totalStats.FilesDeduped, "bytes_saved": totalStats.BytesSaved,
+		"already_deduped": totalStats.AlreadyDeduped, "errors": totalStats.Errors,
+		"permission_denied": totalStats.PermissionDenied, "nocow_skipped": totalStats.NoCOW,
+		"unfragmented_skipped": totalStats.Unfragmented, "shared_skipped": totalStats.SharedSkipped,
+		"fully_shared_skipped": totalStats.FullyShared, "hook_skipped": totalStats.HookSkipped,
+		"protected_skipped": totalStats.Protected, "changed_skipped": totalStats.ChangedSkipped, "timed_out": totalStats.TimedOut, "read_errors": len(totalStats.ReadErrors), "files_scanned": totalStats.FilesScanned,
+		"bytes_scanned": totalStats.BytesScanned, "unique_contents": totalStats.UniqueContents,
+		"converged_ratio": totalStats.ConvergedRatio(), "special_skipped": special.Total(),
+		"fiemap_calls": live.FIEMAPCalls.Load(), "ficlone_calls": live.FICLONECalls.Load(),
+		"files_opened": live.FilesOpened.Load(), "bytes_compared": live.BytesCompared.Load()})
+	if err := events.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to write events: %v\n", err)
+	}
+	if eventsOut != nil {
+		if err := eventsOut.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: --events-file: %v\n", err)
+		}
 	}
 
+	// Write Prometheus textfile metrics.
+	writeRunMetrics(elapsed)
+
 	// Send webhook notifications.
 	if url := os.Getenv("FASTDEDUP_WEBHOOK_UPDATES"); url != "" {
 		notifyUpdate(url, root, totalStats, elapsed, *dryRun)
@@ -695,17 +2114,25 @@ func main() {
 	if *scrub && !*dryRun {
 		if err := runScrub(root); err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 	}
 	if *defrag && !*dryRun {
 		if err := runDefrag(root, fileCount); err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 	}
 
-	if totalStats.Errors > 0 {
-		os.Exit(1)
+	if n := guard.Blocked(); n > 0 {
+		fmt.Fprintf(os.Stderr, "error: --no-modify refused %d writes that a dry run should never attempt; please report this as a bug\n", n)
+		exit(1)
+	}
+	if errorLimitHit.Load() {
+		exit(exitError)
+	}
+	// Read errors fail the run like dedup errors: the disk needs attention.
+	if code := exitCode(totalStats.FilesDeduped, totalStats.Errors+int64(len(totalStats.ReadErrors)), *detailedEC); code != exitOK {
+		exit(code)
 	}
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Manifest maps content hashes to canonical file paths, as kept by a
+// content-addressed store. Files whose SHA-256 is in the manifest are
+// deduped against the canonical copy instead of a reference discovered by
+// scanning. A nil *Manifest is valid and contains nothing.
+type Manifest struct {
+	byHash    map[[sha256.Size]byte]manifestEntry
+	canonical map[string]bool // canonical paths
+	sizes     map[int64]bool  // sizes of canonical files
+	external  map[int64]int64 // canonical files outside the scanned root, per size
+	Missing   int64           // entries dropped because the file is not a readable regular file
+}
+
+type manifestEntry struct {
+	path string
+	size int64
+}
+
+// LoadManifest reads a manifest in sha256sum format: one "<hex sha256>
+// <path>" per line, with an optional '*' before the path. Blank lines and
+// lines starting with '#' are ignored. Relative paths are resolved against
+// the manifest's directory. If a hash is listed more than once, the first
+// path wins. Canonical files outside root are counted separately so pass 1
+// can treat them as members of their size group.
+func LoadManifest(name, root string) (*Manifest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	base, err := filepath.Abs(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		byHash:    make(map[[sha256.Size]byte]manifestEntry),
+		canonical: make(map[string]bool),
+		sizes:     make(map[int64]bool),
+		external:  make(map[int64]int64),
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hexSum, path, ok := strings.Cut(line, " ")
+		path = strings.TrimPrefix(strings.TrimLeft(path, " "), "*")
+		var sum [sha256.Size]byte
+		if n, err := hex.Decode(sum[:], []byte(hexSum)); !ok || path == "" || err != nil || n != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: expected \"<sha256> <path>\"", name, lineNo)
+		}
+		if _, dup := m.byHash[sum]; dup {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(base, path)
+		}
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			slog.Debug("skipping manifest entry", "path", path, "error", err)
+			m.Missing++
+			continue
+		}
+		m.byHash[sum] = manifestEntry{path: path, size: info.Size()}
+		m.canonical[path] = true
+		m.sizes[info.Size()] = true
+		if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			m.external[info.Size()]++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return m, nil
+}
+
+// Len returns the number of usable entries.
+func (m *Manifest) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.byHash)
+}
+
+// HasSize reports whether any canonical file has the given size, i.e.
+// whether files of that size are worth hashing.
+func (m *Manifest) HasSize(size int64) bool {
+	return m != nil && m.sizes[size]
+}
+
+// External returns the number of canonical files of the given size that lie
+// outside the scanned root.
+func (m *Manifest) External(size int64) int64 {
+	if m == nil {
+		return 0
+	}
+	return m.external[size]
+}
+
+// IsCanonical reports whether path is a canonical path in the manifest.
+func (m *Manifest) IsCanonical(path string) bool {
+	return m != nil && m.canonical[path]
+}
+
+// Lookup returns the canonical path for sum, if it is listed with the given size.
+func (m *Manifest) Lookup(sum [sha256.Size]byte, size int64) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	e, ok := m.byHash[sum]
+	if !ok || e.size != size {
+		return "", false
+	}
+	return e.path, true
+}
+
+// hashFile returns the SHA-256 of the content of path.
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := openNoATime(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, f, ioBuffer()); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
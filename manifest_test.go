@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLoadManifest(t *testing.T) {
+	store := t.TempDir()
+	root := t.TempDir()
+	a := []byte("canonical a")
+	b := []byte("canonical bb")
+	createTempFile(t, store, "a", a)
+	bPath := createTempFile(t, root, "b", b)
+
+	manifest := filepath.Join(store, "MANIFEST")
+	content := fmt.Sprintf("# store manifest\n\n%s  a\n%s *%s\n%s  missing\n%s  a-again\n",
+		sha256Hex(a), sha256Hex(b), bPath, sha256Hex([]byte("gone")), sha256Hex(a))
+	if err := os.WriteFile(manifest, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadManifest(manifest, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 2 || m.Missing != 1 {
+		t.Errorf("Len = %d, Missing = %d; want 2, 1", m.Len(), m.Missing)
+	}
+
+	aPath, _ := filepath.EvalSymlinks(filepath.Join(store, "a"))
+	if got, ok := m.Lookup(sha256.Sum256(a), int64(len(a))); !ok || got != aPath {
+		t.Errorf("Lookup(a) = %q, %v; want %q (relative to the manifest)", got, ok, aPath)
+	}
+	if _, ok := m.Lookup(sha256.Sum256(a), int64(len(a))+1); ok {
+		t.Error("Lookup with the wrong size should fail")
+	}
+	if !m.HasSize(int64(len(a))) || m.HasSize(1) {
+		t.Error("HasSize mismatch")
+	}
+	if m.External(int64(len(a))) != 1 || m.External(int64(len(b))) != 0 {
+		t.Errorf("External = %d, %d; want 1 (outside root), 0 (inside root)",
+			m.External(int64(len(a))), m.External(int64(len(b))))
+	}
+
+	var nilManifest *Manifest
+	if nilManifest.Len() != 0 || nilManifest.HasSize(int64(len(a))) || nilManifest.IsCanonical(aPath) {
+		t.Error("nil manifest should be empty")
+	}
+}
+
+func TestLoadManifestMalformed(t *testing.T) {
+	dir := t.TempDir()
+	for _, line := range []string{"nothash path", sha256Hex([]byte("x"))[:10] + "  path", sha256Hex([]byte("x"))} {
+		manifest := filepath.Join(dir, "MANIFEST")
+		if err := os.WriteFile(manifest, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadManifest(manifest, dir); err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Errorf("LoadManifest(%q) error = %v, want line 1 error", line, err)
+		}
+	}
+}
+
+func TestProcessSizeGroupManifest(t *testing.T) {
+	discardStdout(t)
+
+	store := t.TempDir()
+	content := []byte("stored object content")
+	other := []byte("unlisted same-size!!!")
+	canon := createTempFile(t, store, "object", content)
+	manifest := filepath.Join(store, "MANIFEST")
+	if err := os.WriteFile(manifest, []byte(sha256Hex(content)+"  object\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(content))
+
+	setup := func(t *testing.T) ([]string, *Manifest) {
+		root := t.TempDir()
+		copyPath := createTempFile(t, root, "copy", content)
+		otherPath := createTempFile(t, root, "other", other)
+		m, err := LoadManifest(manifest, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{otherPath, copyPath}, m
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		paths, m := setup(t)
+		stats := ProcessSizeGroup(paths, size, DedupOptions{DryRun: true, Manifest: m}, nil)
+		if stats.FilesDeduped != 1 {
+			t.Errorf("FilesDeduped = %d, want 1 (the single copy, against the canonical)", stats.FilesDeduped)
+		}
+		// Without the manifest the two scanned files differ.
+		stats = ProcessSizeGroup(paths, size, DedupOptions{DryRun: true}, nil)
+		if stats.FilesDeduped != 0 {
+			t.Errorf("without manifest FilesDeduped = %d, want 0", stats.FilesDeduped)
+		}
+	})
+
+	t.Run("hardlink to canonical", func(t *testing.T) {
+		paths, m := setup(t)
+		stats := ProcessSizeGroup(paths, size, DedupOptions{Hardlink: true, Manifest: m}, nil)
+		if stats.Errors != 0 || stats.FilesDeduped != 1 {
+			t.Fatalf("Errors = %d, FilesDeduped = %d; want 0, 1", stats.Errors, stats.FilesDeduped)
+		}
+		ci, _ := os.Stat(canon)
+		pi, _ := os.Stat(paths[1])
+		if !os.SameFile(ci, pi) {
+			t.Errorf("%s is not linked to the canonical copy", paths[1])
+		}
+	})
+}
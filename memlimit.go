@@ -0,0 +1,78 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// memHighWater is the fraction of the --max-mem limit at which the monitor
+// reports pressure, leaving headroom for the allocations already under way.
+const memHighWater = 0.9
+
+// memMonitor polls heap usage in the background and raises a flag when it
+// approaches a limit. Consumers poll Pressure from their own goroutine and
+// react there, so no data structure is shared with the monitor. A nil
+// *memMonitor never reports pressure.
+type memMonitor struct {
+	limit    uint64
+	over     atomic.Bool
+	stop     chan struct{}
+	done     chan struct{}
+	readHeap func() uint64
+}
+
+// startMemMonitor sets limit as the Go runtime's soft memory limit, so the
+// garbage collector works harder near it, and starts polling every interval.
+func startMemMonitor(limit int64, interval time.Duration) *memMonitor {
+	debug.SetMemoryLimit(limit)
+	m := &memMonitor{
+		limit:    uint64(limit),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		readHeap: heapInUse,
+	}
+	go m.run(interval)
+	return m
+}
+
+func (m *memMonitor) run(interval time.Duration) {
+	defer close(m.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+			if float64(m.readHeap()) >= memHighWater*float64(m.limit) {
+				m.over.Store(true)
+			}
+		}
+	}
+}
+
+// Pressure reports whether heap usage neared the limit since the last call
+// that returned true. It is cheap enough to call for every file.
+func (m *memMonitor) Pressure() bool {
+	if m == nil || !m.over.Load() {
+		return false
+	}
+	return m.over.CompareAndSwap(true, false)
+}
+
+// Stop ends polling. The soft memory limit stays in place.
+func (m *memMonitor) Stop() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+}
+
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+func TestSizeMapShrinkUnderPressure(t *testing.T) {
+	sm := NewSizeMap(1_000_000)
+	pressure := false
+	sm.SetPressure(func() bool { return pressure })
+
+	for size := int64(1); size <= 10_000; size++ {
+		sm.Add(size)
+		sm.Add(size)
+	}
+	if sm.Len() != 10_000 || sm.Shrinks() != 0 {
+		t.Fatalf("without pressure: Len = %d, Shrinks = %d", sm.Len(), sm.Shrinks())
+	}
+
+	// Constant pressure: the map halves until it reaches the floor, then
+	// stays bounded however many new sizes arrive.
+	pressure = true
+	for size := int64(10_001); size <= 50_000; size++ {
+		sm.Add(size)
+	}
+	if sm.MaxSize() != minShrinkSize {
+		t.Errorf("MaxSize = %d, want %d", sm.MaxSize(), minShrinkSize)
+	}
+	if sm.Len() > minShrinkSize {
+		t.Errorf("Len = %d, want <= %d", sm.Len(), minShrinkSize)
+	}
+	// The most impactful duplicated sizes survive.
+	top := sm.TopN(1)
+	if len(top) != 1 || top[0].Size != 10_000 {
+		t.Errorf("TopN(1) = %v, want size 10000", top)
+	}
+	// Everything dropped is blamed on memory, not on --max-sizes.
+	if ev := sm.Evictions(); ev != (SizeEvictions{}) {
+		t.Errorf("Evictions = %+v, want none", ev)
+	}
+	if ev := sm.ShrinkEvictions(); ev.Sizes != int64(50_000-sm.Len()) || ev.Duplicated == 0 {
+		t.Errorf("ShrinkEvictions = %+v, want %d sizes, some duplicated", ev, 50_000-sm.Len())
+	}
+}
+
+func TestMemMonitor(t *testing.T) {
+	defer debug.SetMemoryLimit(math.MaxInt64)
+
+	var nilMon *memMonitor
+	if nilMon.Pressure() {
+		t.Error("nil monitor reported pressure")
+	}
+	nilMon.Stop()
+
+	// Any heap is above a one-byte limit.
+	m := startMemMonitor(1, time.Millisecond)
+	defer m.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for !m.Pressure() {
+		if time.Now().After(deadline) {
+			t.Fatal("no pressure reported above the limit")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
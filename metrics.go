@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// escapeLabelValue escapes a Prometheus/OpenMetrics label value.
+// Backslash, double-quote, and line feed are the only characters that
+// must be escaped inside a quoted label value.
+func escapeLabelValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// formatMetrics renders run results in the Prometheus text exposition format,
+// suitable for node_exporter's textfile collector.
+func formatMetrics(root string, stats *DedupStats, filesScanned int64, elapsed time.Duration) string {
+	labels := fmt.Sprintf(`{root="%s"}`, escapeLabelValue(root))
+	metrics := []struct {
+		name  string
+		typ   string
+		help  string
+		value string
+	}{
+		{"fastdedup_bytes_saved_total", "counter", "Bytes reclaimed by deduplication in the last run.", fmt.Sprintf("%d", stats.BytesSaved)},
+		{"fastdedup_files_deduped_total", "counter", "Files deduplicated in the last run.", fmt.Sprintf("%d", stats.FilesDeduped)},
+		{"fastdedup_errors_total", "counter", "Dedup errors in the last run.", fmt.Sprintf("%d", stats.Errors)},
+		{"fastdedup_files_scanned_total", "counter", "Files scanned in pass 1 of the last run.", fmt.Sprintf("%d", filesScanned)},
+		{"fastdedup_run_duration_seconds", "gauge", "Wall-clock duration of the last run.", fmt.Sprintf("%.3f", elapsed.Seconds())},
+	}
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.typ)
+		fmt.Fprintf(&b, "%s%s %s\n", m.name, labels, m.value)
+	}
+	return b.String()
+}
+
+// writeMetrics atomically writes run metrics to path. It writes to a
+// temporary file in the same directory first, then renames, so a scraper
+// never observes a partially written file.
+func writeMetrics(path, root string, stats *DedupStats, filesScanned int64, elapsed time.Duration) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".fastdedup-metrics-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.WriteString(formatMetrics(root, stats, filesScanned, elapsed)); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// CreateTemp uses 0600; textfile collectors usually run as another user.
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleLine matches a single exposition-format sample with one label.
+var sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)\{root="((?:[^"\\]|\\.)*)"\} (\S+)$`)
+
+// parseMetrics is a minimal parser for the exposition format, returning
+// sample values keyed by metric name and the unescaped root label.
+func parseMetrics(t *testing.T, text string) (map[string]float64, string) {
+	t.Helper()
+	values := make(map[string]float64)
+	var root string
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("unparseable metrics line: %q", line)
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatalf("bad value in line %q: %v", line, err)
+		}
+		values[m[1]] = v
+		root = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n").Replace(m[2])
+	}
+	return values, root
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain path", "/mnt/data", "/mnt/data"},
+		{"quote", `/mnt/"x"`, `/mnt/\"x\"`},
+		{"backslash", `/mnt/a\b`, `/mnt/a\\b`},
+		{"newline", "/mnt/a\nb", `/mnt/a\nb`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeLabelValue(tt.input); got != tt.want {
+				t.Errorf("escapeLabelValue(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatMetrics(t *testing.T) {
+	stats := &DedupStats{BytesSaved: 1048576, FilesDeduped: 12, Errors: 3}
+	root := "/mnt/we\"ird\\path\n"
+	out := formatMetrics(root, stats, 5000, 1500*time.Millisecond)
+
+	values, gotRoot := parseMetrics(t, out)
+	if gotRoot != root {
+		t.Errorf("root label = %q, want %q", gotRoot, root)
+	}
+	want := map[string]float64{
+		"fastdedup_bytes_saved_total":    1048576,
+		"fastdedup_files_deduped_total":  12,
+		"fastdedup_errors_total":         3,
+		"fastdedup_files_scanned_total":  5000,
+		"fastdedup_run_duration_seconds": 1.5,
+	}
+	for name, v := range want {
+		if got, ok := values[name]; !ok {
+			t.Errorf("missing metric %s", name)
+		} else if got != v {
+			t.Errorf("%s = %v, want %v", name, got, v)
+		}
+	}
+	if !strings.Contains(out, "# TYPE fastdedup_run_duration_seconds gauge") {
+		t.Error("duration should be typed as a gauge")
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	t.Run("writes file", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "fastdedup.prom")
+		if err := writeMetrics(p, "/data", &DedupStats{FilesDeduped: 1}, 10, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, _ := parseMetrics(t, string(data))
+		if values["fastdedup_files_deduped_total"] != 1 {
+			t.Errorf("files deduped = %v, want 1", values["fastdedup_files_deduped_total"])
+		}
+		info, _ := os.Stat(p)
+		if info.Mode().Perm() != 0644 {
+			t.Errorf("perm = %o, want 0644", info.Mode().Perm())
+		}
+	})
+
+	t.Run("no temp files left", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "fastdedup.prom")
+		if err := writeMetrics(p, "/data", &DedupStats{}, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 1 {
+			t.Errorf("expected only the metrics file, got %d entries", len(entries))
+		}
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		err := writeMetrics("/nonexistent/dir/x.prom", "/data", &DedupStats{}, 0, 0)
+		if err == nil {
+			t.Error("expected error for missing directory")
+		}
+	})
+}
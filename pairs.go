@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// dedupPair is one line of a --pairs-file: Path is to share storage with
+// Ref, which is kept as it is.
+type dedupPair struct {
+	Path string
+	Ref  string
+}
+
+// readPairs parses a --pairs-file: CSV records of PATH,REF, with lines
+// starting with # ignored. Paths containing commas or quotes are quoted
+// as CSV requires.
+func readPairs(r io.Reader) ([]dedupPair, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 2
+	var pairs []dedupPair
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return pairs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec[0] == "" || rec[1] == "" {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("line %d: empty path", line)
+		}
+		if rec[0] == rec[1] {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %s is paired with itself", line, rec[0])
+		}
+		pairs = append(pairs, dedupPair{Path: rec[0], Ref: rec[1]})
+	}
+}
+
+// errPairMismatch is returned by dedupPairFiles for files that are not
+// duplicates of each other.
+var errPairMismatch = errors.New("not identical")
+
+// runPairs dedups each listed file against its listed ref, bypassing size
+// grouping and ref discovery. A pair is refused unless both are regular
+// files of the same size and identical content. opts supplies the dedup
+// mode (DryRun, Hardlink, FixPerms, VerifyShared) and the Log, Events and
+// Hooks to report to. The optional onProgress callback is called with the
+// 1-based index of each pair processed.
+func runPairs(pairs []dedupPair, opts DedupOptions, onProgress func(current int)) *DedupStats {
+	stats := &DedupStats{}
+	mode := "reflink"
+	if opts.Hardlink {
+		mode = "hardlink"
+	}
+	for i, p := range pairs {
+		if onProgress != nil {
+			onProgress(i + 1)
+		}
+		size, err := dedupPairFiles(p, mode, opts, stats)
+		if err != nil {
+			slog.Debug("pair not deduped", "path", p.Path, "ref", p.Ref, "error", err)
+			stats.Errors++
+			opts.Events.Emit(eventError, map[string]any{"path": p.Path, "ref": p.Ref, "size": size, "mode": mode, "error": err.Error()})
+			stats.ErrorDetails = append(stats.ErrorDetails, DedupError{
+				Size:    size,
+				Mode:    mode,
+				Err:     err.Error(),
+				SrcPath: p.Ref,
+				DstPath: p.Path,
+			})
+		}
+	}
+	return stats
+}
+
+// dedupPairFiles validates and dedups one pair, counting the outcome in
+// stats unless it fails. It returns the size of the files.
+func dedupPairFiles(p dedupPair, mode string, opts DedupOptions, stats *DedupStats) (int64, error) {
+	info, err := os.Lstat(p.Path)
+	if err != nil {
+		return 0, err
+	}
+	refInfo, err := os.Lstat(p.Ref)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() || !refInfo.Mode().IsRegular() {
+		return 0, fmt.Errorf("%w: not both regular files", errPairMismatch)
+	}
+	size := info.Size()
+	if size != refInfo.Size() {
+		return size, fmt.Errorf("%w: sizes differ (%d and %d bytes)", errPairMismatch, size, refInfo.Size())
+	}
+	stats.FilesScanned++
+	stats.BytesScanned += size
+
+	if os.SameFile(info, refInfo) {
+		stats.AlreadyDeduped++
+		return size, nil
+	}
+	refExtents, err := fileExtents(p.Ref)
+	if err != nil {
+		refExtents = nil
+	} else if extents, err := fileExtents(p.Path); err == nil && SameExtents(refExtents, extents) {
+		stats.AlreadyDeduped++
+		return size, nil
+	}
+	equal, err := filesEqual(p.Ref, p.Path)
+	if err != nil {
+		return size, fmt.Errorf("compare: %w", err)
+	}
+	if !equal {
+		return size, fmt.Errorf("%w: content differs", errPairMismatch)
+	}
+
+	if opts.DryRun {
+		if !opts.Events.toStdout() {
+			fmt.Printf("[dry-run] dedup: %s -> %s (%s)\n", p.Path, p.Ref, formatSize(size, opts.RawSizes))
+		}
+		opts.Events.Emit(eventDedup, map[string]any{"path": p.Path, "ref": p.Ref, "size": size, "mode": mode, "dry_run": true})
+		stats.BytesSaved += size
+		stats.FilesDeduped++
+		return size, nil
+	}
+	if err := opts.Hooks.Pre(p.Ref, p.Path, size); err != nil {
+		slog.Debug("pre-hook failed, skipping file", "src", p.Ref, "dst", p.Path, "error", err)
+		stats.HookSkipped++
+		return size, nil
+	}
+	if opts.Hardlink {
+		err = hardlinkFile(p.Ref, p.Path, opts.FixPerms)
+	} else {
+		err = dedupFile(p.Ref, p.Path, refExtents, opts.FixPerms, opts.VerifyShared)
+	}
+	if err != nil {
+		return size, err
+	}
+	opts.Log.Record(p.Path, p.Ref)
+	opts.Events.Emit(eventDedup, map[string]any{"path": p.Path, "ref": p.Ref, "size": size, "mode": mode, "dry_run": false})
+	opts.Hooks.Post(p.Ref, p.Path, size)
+	stats.BytesSaved += size
+	stats.FilesDeduped++
+	return size, nil
+}
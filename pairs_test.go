@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadPairs(t *testing.T) {
+	in := "# path,ref\n/d/b,/d/a\n\"/d/with,comma\",/d/a\n"
+	pairs, err := readPairs(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dedupPair{{"/d/b", "/d/a"}, {"/d/with,comma", "/d/a"}}
+	if len(pairs) != len(want) || pairs[0] != want[0] || pairs[1] != want[1] {
+		t.Errorf("pairs = %q, want %q", pairs, want)
+	}
+
+	for _, bad := range []string{"/d/a\n", "/d/a,/d/b,/d/c\n", "/d/a,/d/a\n", ",/d/a\n"} {
+		if _, err := readPairs(strings.NewReader(bad)); err == nil {
+			t.Errorf("readPairs(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRunPairs(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	content := randomData(11, 8192)
+	ref := createTempFile(t, dir, "ref", content)
+	dup := createTempFile(t, dir, "dup", content)
+	other := createTempFile(t, dir, "other", randomData(12, 8192))
+	short := createTempFile(t, dir, "short", content[:4096])
+	link := filepath.Join(dir, "link")
+	if err := os.Link(ref, link); err != nil {
+		t.Fatal(err)
+	}
+	pairsFile := createTempFile(t, dir, "pairs.csv", []byte(strings.Join([]string{
+		dup + "," + ref,
+		other + "," + ref,
+		short + "," + ref,
+		link + "," + ref,
+	}, "\n")))
+
+	f, err := os.Open(pairsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := readPairs(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := runPairs(pairs, DedupOptions{DryRun: true}, nil)
+	if stats.FilesDeduped != 1 || stats.AlreadyDeduped != 1 || stats.Errors != 2 {
+		t.Fatalf("dry run: %s; want 1 deduped, 1 already, 2 errors", stats)
+	}
+	for i, wantErr := range []string{"content differs", "sizes differ"} {
+		if d := stats.ErrorDetails[i]; !strings.Contains(d.Err, wantErr) {
+			t.Errorf("error %d = %q, want %q", i, d.Err, wantErr)
+		}
+	}
+	if same, _ := sameInode(ref, dup); same {
+		t.Fatal("dry run changed the tree")
+	}
+
+	// Hard links show the pair being deduped without needing reflinks.
+	stats = runPairs(pairs, DedupOptions{Hardlink: true}, nil)
+	if stats.FilesDeduped != 1 || stats.Errors != 2 {
+		t.Errorf("hardlink run: %s; want 1 deduped, 2 errors", stats)
+	}
+	if same, _ := sameInode(ref, dup); !same {
+		t.Error("dup was not linked to ref")
+	}
+	if got, _ := os.ReadFile(other); string(got) == string(content) {
+		t.Error("a file with different content was replaced")
+	}
+	if _, err := dedupPairFiles(dedupPair{Path: short, Ref: ref}, "hardlink", DedupOptions{}, &DedupStats{}); !errors.Is(err, errPairMismatch) {
+		t.Errorf("size mismatch error = %v, want errPairMismatch", err)
+	}
+}
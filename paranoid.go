@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// paranoidFlags are the flags --paranoid turns on, in the order they are
+// documented. The transactional ones are left off in the modes listed in
+// paranoidNoTransaction.
+var paranoidFlags = []struct {
+	name          string
+	transactional bool
+}{
+	{"verify-shared", false},  // every reflink must show shared extents on both files
+	{"recheck", false},        // skip files that change between comparison and replacement
+	{"skip-protected", false}, // leave hard-linked, immutable and append-only files alone
+	{"transactional", true},   // stage every replacement, swap them in at the end
+	{"verify-batch", true},    // then reread them all, rolling back on any difference
+}
+
+// paranoidNoTransaction are the flags whose modes cannot stage replacements:
+// dry runs change nothing to verify, and the others dedup outside the
+// transaction or refuse --transactional outright.
+var paranoidNoTransaction = []string{
+	"dry-run", "no-modify", "topology", "batch-dedupe", "fix-perms", "cdc",
+	"processed-set", "pairs-file", "hardlinks-to-reflinks",
+}
+
+// paranoidConflicts are settings that weaken a check --paranoid relies on.
+var paranoidConflicts = map[string]string{
+	"no-verify-reflink": "true",
+	"fiemap-sync":       fiemapSyncDelalloc,
+}
+
+// applyParanoid sets the --paranoid flags on fs. Settings that contradict
+// the preset, given on the command line or in a config file, are an error
+// rather than silently overridden.
+func applyParanoid(fs *flag.FlagSet) error {
+	for name, weak := range paranoidConflicts {
+		if fs.Lookup(name).Value.String() != weak {
+			continue
+		}
+		if weak == "true" {
+			return fmt.Errorf("--paranoid cannot be combined with --%s", name)
+		}
+		return fmt.Errorf("--paranoid cannot be combined with --%s %s", name, weak)
+	}
+	noTxn := false
+	for _, name := range paranoidNoTransaction {
+		if f := fs.Lookup(name); f.Value.String() != f.DefValue {
+			noTxn = true
+		}
+	}
+	for _, f := range paranoidFlags {
+		if f.transactional && noTxn {
+			continue
+		}
+		if err := fs.Set(f.name, "true"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
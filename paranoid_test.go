@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+// paranoidFlagSet defines the flags applyParanoid reads and sets, with
+// their defaults in main.
+func paranoidFlagSet(args ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet("fastdedup", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	for _, name := range []string{"verify-shared", "recheck", "skip-protected", "transactional", "verify-batch", "no-verify-reflink",
+		"dry-run", "no-modify", "topology", "batch-dedupe", "fix-perms", "cdc", "hardlinks-to-reflinks"} {
+		fs.Bool(name, false, "")
+	}
+	fs.String("fiemap-sync", fiemapSyncAlways, "")
+	fs.String("processed-set", "", "")
+	fs.String("pairs-file", "", "")
+	fs.Parse(args)
+	return fs
+}
+
+func TestApplyParanoid(t *testing.T) {
+	isSet := func(fs *flag.FlagSet, name string) bool { return fs.Lookup(name).Value.String() == "true" }
+
+	fs := paranoidFlagSet()
+	if err := applyParanoid(fs); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"verify-shared", "recheck", "skip-protected", "transactional", "verify-batch"} {
+		if !isSet(fs, name) {
+			t.Errorf("--%s not set by --paranoid", name)
+		}
+	}
+	if isSet(fs, "no-verify-reflink") || isSet(fs, "dry-run") {
+		t.Error("--paranoid set a flag outside the preset")
+	}
+
+	// Modes that cannot stage replacements get the checks without them,
+	// rather than a --transactional conflict the user never asked for.
+	for _, args := range [][]string{{"-dry-run"}, {"-no-modify"}, {"-topology"}, {"-batch-dedupe"}, {"-fix-perms"}, {"-cdc"},
+		{"-processed-set", "done.txt"}, {"-pairs-file", "pairs.tsv"}, {"-hardlinks-to-reflinks"}} {
+		arg := args[0]
+		fs = paranoidFlagSet(args...)
+		if err := applyParanoid(fs); err != nil {
+			t.Fatal(err)
+		}
+		if !isSet(fs, "verify-shared") || isSet(fs, "transactional") || isSet(fs, "verify-batch") {
+			t.Errorf("with %s: want the checks without the transactional flags", arg)
+		}
+	}
+
+	for _, args := range [][]string{{"-no-verify-reflink"}, {"-fiemap-sync", fiemapSyncDelalloc}} {
+		err := applyParanoid(paranoidFlagSet(args...))
+		if err == nil || !strings.Contains(err.Error(), strings.TrimPrefix(args[0], "-")) {
+			t.Errorf("%v: error = %v, want a conflict naming it", args, err)
+		}
+	}
+}
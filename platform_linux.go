@@ -3,9 +3,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"syscall"
 	"time"
 	"unsafe"
@@ -19,6 +25,12 @@ const (
 	_FIEMAP_EXTENT_LAST = 0x00000001
 	_MAX_FIEMAP_EXTENTS = 512
 	_FICLONE            = 0x40049409
+	_BTRFS_IOC_DEFRAG   = 0x50009402
+	_BTRFS_IOC_SPACE    = 0xC0109414 // BTRFS_IOC_SPACE_INFO
+	_BTRFS_IOC_FS_INFO  = 0x8400941F
+	_FS_NOCOW_FL        = 0x00800000 // chattr +C (linux/fs.h)
+	_FS_IMMUTABLE_FL    = 0x00000010 // chattr +i
+	_FS_APPEND_FL       = 0x00000020 // chattr +a
 )
 
 // Raw kernel structs for FIEMAP ioctl. Field order and sizes must match
@@ -43,62 +55,363 @@ type fiemapReq struct {
 	extents       [_MAX_FIEMAP_EXTENTS]fiemapExtent
 }
 
+// platformSupported reports whether fastdedup can dedup on this platform.
+func platformSupported() bool {
+	return true
+}
+
 // getExtents returns the physical extent map of a file using the FIEMAP ioctl.
+// Files still showing delayed allocation after a sync fail with errDelalloc,
+// since their physical offsets cannot be compared.
 func getExtents(path string) ([]Extent, error) {
+	return getExtentsMax(path, 0)
+}
+
+// getExtentsMax is getExtents, failing with errTooManyExtents once the
+// file has more than max extents. A max of 0 means no limit.
+func getExtentsMax(path string, max int) ([]Extent, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
+	live.FilesOpened.Add(1)
+
+	// Physical offsets are per filesystem; tag each extent with it.
+	dev, err := fileDev(f, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fiemapTargetedSync {
+		all, err := fiemapFile(f, path, dev, _FIEMAP_FLAG_SYNC, max)
+		if err == nil && hasDelalloc(all) {
+			return nil, fmt.Errorf("%s: %w", path, errDelalloc)
+		}
+		return all, err
+	}
+
+	all, err := fiemapFile(f, path, dev, 0, max)
+	if err != nil || !hasDelalloc(all) {
+		return all, err
+	}
+	// fsync works on a read-only descriptor and flushes only this file.
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("fsync %s: %w", path, err)
+	}
+	if all, err = fiemapFile(f, path, dev, 0, max); err == nil && hasDelalloc(all) {
+		return nil, fmt.Errorf("%s: %w", path, errDelalloc)
+	}
+	return all, err
+}
 
+// getExtentsPrefix returns the extents overlapping the first length bytes
+// of a file, so a fragmentation estimate of a huge file costs one or two
+// FIEMAP batches. The last extent may run past length. Delayed allocation
+// is not rejected: the result is only for estimates, never for comparing
+// files.
+func getExtentsPrefix(path string, length uint64) ([]Extent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	live.FilesOpened.Add(1)
+	dev, err := fileDev(f, path)
+	if err != nil {
+		return nil, err
+	}
 	var all []Extent
-	var start uint64
+	c := newFiemapCursor(f, path, dev, _FIEMAP_FLAG_SYNC)
+	c.end = length
+	for {
+		e, ok, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return all, nil
+		}
+		all = append(all, e)
+	}
+}
+
+// fileDev returns the st_dev of the open file f.
+func fileDev(f *os.File, path string) (uint64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &stat); err != nil {
+		return 0, fmt.Errorf("fstat %s: %w", path, err)
+	}
+	return uint64(stat.Dev), nil
+}
 
+// fiemapFile reads every extent of f with the given FIEMAP request flags,
+// or fails with errTooManyExtents after max of them (0 = no limit).
+func fiemapFile(f *os.File, path string, dev uint64, flags uint32, max int) ([]Extent, error) {
+	var all []Extent
+	c := newFiemapCursor(f, path, dev, flags)
 	for {
-		req := fiemapReq{
-			start:       start,
-			length:      ^uint64(0),
-			flags:       _FIEMAP_FLAG_SYNC,
-			extentCount: _MAX_FIEMAP_EXTENTS,
+		e, ok, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return all, nil
 		}
+		if max > 0 && len(all) == max {
+			return nil, fmt.Errorf("%s: %w", path, errTooManyExtents)
+		}
+		all = append(all, e)
+	}
+}
+
+// fiemapCursor reads the extents of a file one FIEMAP batch at a time, so
+// a file with millions of extents can be walked without holding them all.
+type fiemapCursor struct {
+	f     *os.File
+	path  string
+	dev   uint64
+	flags uint32
+	req   fiemapReq
+	i     uint32 // next extent of req to return
+	start uint64 // logical offset of the next batch
+	end   uint64 // logical offset to stop mapping at, 0 for end of file
+	last  bool   // req holds the file's last extents
+}
+
+func newFiemapCursor(f *os.File, path string, dev uint64, flags uint32) *fiemapCursor {
+	return &fiemapCursor{f: f, path: path, dev: dev, flags: flags}
+}
 
+// next returns the next extent, or ok false after the last one.
+func (c *fiemapCursor) next() (e Extent, ok bool, err error) {
+	if c.i == c.req.mappedExtents {
+		if c.last {
+			return Extent{}, false, nil
+		}
+		length := ^uint64(0)
+		if c.end > 0 {
+			length = c.end - c.start
+		}
+		c.req = fiemapReq{
+			start:       c.start,
+			length:      length,
+			flags:       c.flags,
+			extentCount: _MAX_FIEMAP_EXTENTS,
+		}
+		c.i = 0
+		live.FIEMAPCalls.Add(1)
 		_, _, errno := unix.Syscall(
 			unix.SYS_IOCTL,
-			f.Fd(),
+			c.f.Fd(),
 			uintptr(_FS_IOC_FIEMAP),
-			uintptr(unsafe.Pointer(&req)),
+			uintptr(unsafe.Pointer(&c.req)),
 		)
 		if errno != 0 {
-			return nil, fmt.Errorf("FIEMAP ioctl on %s: %w", path, errno)
+			return Extent{}, false, fmt.Errorf("FIEMAP ioctl on %s: %w", c.path, errno)
+		}
+		if c.req.mappedExtents == 0 {
+			c.last = true
+			return Extent{}, false, nil
+		}
+		last := c.req.extents[c.req.mappedExtents-1]
+		c.start = last.logical + last.length
+		c.last = last.flags&_FIEMAP_EXTENT_LAST != 0 || c.end > 0 && c.start >= c.end
+	}
+	fe := c.req.extents[c.i]
+	c.i++
+	return Extent{
+		Logical:  fe.logical,
+		Physical: fe.physical,
+		Length:   fe.length,
+		Flags:    fe.flags,
+		Device:   c.dev,
+	}, true, nil
+}
+
+// extentsEqual reports whether two files have the same extent map, as
+// SameExtents does for full lists. Both maps are read in lockstep one
+// FIEMAP batch at a time, stopping at the first difference, so large
+// fragmented files are neither held in memory nor read to the end when
+// they differ early.
+func extentsEqual(pathA, pathB string) (bool, error) {
+	fa, err := os.Open(pathA)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(pathB)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	live.FilesOpened.Add(2)
+	devA, err := fileDev(fa, pathA)
+	if err != nil {
+		return false, err
+	}
+	devB, err := fileDev(fb, pathB)
+	if err != nil {
+		return false, err
+	}
+	if devA != devB {
+		return false, nil
+	}
+
+	var flags uint32
+	if !fiemapTargetedSync {
+		flags = _FIEMAP_FLAG_SYNC
+	}
+	synced := !fiemapTargetedSync
+	for {
+		equal, err := extentsEqualOnce(fa, pathA, fb, pathB, devA, flags)
+		if !errors.Is(err, errDelalloc) || synced {
+			return equal, err
+		}
+		// --fiemap-sync delalloc: flush both files once and start over.
+		synced = true
+		if err := fa.Sync(); err != nil {
+			return false, fmt.Errorf("fsync %s: %w", pathA, err)
+		}
+		if err := fb.Sync(); err != nil {
+			return false, fmt.Errorf("fsync %s: %w", pathB, err)
 		}
+	}
+}
 
-		if req.mappedExtents == 0 {
-			break
+// extentsEqualOnce compares the extent maps of fa and fb in one pass.
+func extentsEqualOnce(fa *os.File, pathA string, fb *os.File, pathB string, dev uint64, flags uint32) (bool, error) {
+	ca := newFiemapCursor(fa, pathA, dev, flags)
+	cb := newFiemapCursor(fb, pathB, dev, flags)
+	for {
+		a, okA, err := ca.next()
+		if err != nil {
+			return false, err
+		}
+		b, okB, err := cb.next()
+		if err != nil {
+			return false, err
+		}
+		if !okA || !okB {
+			return okA == okB, nil
+		}
+		if hasDelalloc([]Extent{a}) {
+			return false, fmt.Errorf("%s: %w", pathA, errDelalloc)
+		}
+		if hasDelalloc([]Extent{b}) {
+			return false, fmt.Errorf("%s: %w", pathB, errDelalloc)
 		}
+		if !sameMapping(a, b) {
+			return false, nil
+		}
+	}
+}
 
-		for i := uint32(0); i < req.mappedExtents; i++ {
-			e := req.extents[i]
-			all = append(all, Extent{
-				Logical:  e.logical,
-				Physical: e.physical,
-				Length:   e.length,
-				Flags:    e.flags,
-			})
+// copySparse copies src into dst, which must be empty, reading and writing
+// only src's data regions: holes are skipped and stay holes in dst, so a
+// sparse file does not grow. Data is always written, never cloned, so dst
+// gets blocks of its own. Filesystems without SEEK_DATA support report the
+// whole file as data and get a plain copy.
+func copySparse(dst, src *os.File) (int64, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	fd := int(src.Fd())
+	buf := ioBuffer()
+	var written int64
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // only a hole remains
+		}
+		if err != nil {
+			return written, fmt.Errorf("seek data: %w", err)
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return written, fmt.Errorf("seek hole: %w", err)
 		}
+		hole = min(hole, size)
+		// Section and offset wrappers also keep io.CopyBuffer from using
+		// copy_file_range, which may share extents again.
+		n, err := io.CopyBuffer(io.NewOffsetWriter(dst, data), io.NewSectionReader(src, data, hole-data), buf)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		off = hole
+	}
+	// A trailing hole is only recorded by the file size.
+	return written, dst.Truncate(size)
+}
 
-		last := req.extents[req.mappedExtents-1]
-		if last.flags&_FIEMAP_EXTENT_LAST != 0 {
-			break
+// mmapWindow is how much of each file mmapEqual maps at a time, bounding
+// the address space used for huge files. It must be a multiple of the page
+// size.
+var mmapWindow int64 = 64 << 20
+
+// mmapEqual compares the first size bytes of fa and fb through read-only
+// mappings, one window at a time. A file truncated while mapped faults on
+// access; the fault is recovered and reported as errSizeMismatch, as is a
+// size change found afterwards. Other errors mean mapping failed and the
+// caller should read the files instead.
+func mmapEqual(fa, fb *os.File, size int64) (equal bool, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, fault := r.(interface{ Addr() uintptr }); !fault {
+				panic(r)
+			}
+			equal, err = false, fmt.Errorf("%w: truncated while mapped", errSizeMismatch)
+		}
+	}()
+
+	window := func(off int64, n int) (bool, error) {
+		a, err := unix.Mmap(int(fa.Fd()), off, n, unix.PROT_READ, unix.MAP_SHARED)
+		if err != nil {
+			return false, fmt.Errorf("mmap %s: %w", fa.Name(), err)
+		}
+		//goland:noinspection GoUnhandledErrorResult
+		defer unix.Munmap(a)
+		b, err := unix.Mmap(int(fb.Fd()), off, n, unix.PROT_READ, unix.MAP_SHARED)
+		if err != nil {
+			return false, fmt.Errorf("mmap %s: %w", fb.Name(), err)
+		}
+		//goland:noinspection GoUnhandledErrorResult
+		defer unix.Munmap(b)
+		_ = unix.Madvise(a, unix.MADV_SEQUENTIAL)
+		_ = unix.Madvise(b, unix.MADV_SEQUENTIAL)
+		live.BytesCompared.Add(int64(n))
+		return bytes.Equal(a, b), nil
+	}
+	for off := int64(0); off < size; off += mmapWindow {
+		same, err := window(off, int(min(mmapWindow, size-off)))
+		if err != nil || !same {
+			return false, err
 		}
-		start = last.logical + last.length
 	}
 
-	return all, nil
+	if err := checkUnchangedSize(size, fa, fb); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// adviseWillNeed asks the kernel to start reading n bytes of f at off, so
+// the range is fetched in large requests. It is only a hint; errors are
+// ignored.
+func adviseWillNeed(f *os.File, off, n int64) {
+	_ = unix.Fadvise(int(f.Fd()), off, n, unix.FADV_WILLNEED)
 }
 
 // reflinkCopy creates a reflink (CoW) copy of src at dst. The new file shares
 // the same physical data blocks as src. Only works on btrfs/XFS with reflink.
 func reflinkCopy(src, dst string, perm os.FileMode) error {
+	if err := guard.check("reflink", dst); err != nil {
+		return err
+	}
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("open source: %w", err)
@@ -110,7 +423,9 @@ func reflinkCopy(src, dst string, perm os.FileMode) error {
 		return fmt.Errorf("create destination: %w", err)
 	}
 	defer dstFile.Close()
+	live.FilesOpened.Add(2)
 
+	live.FICLONECalls.Add(1)
 	_, _, errno := unix.Syscall(
 		unix.SYS_IOCTL,
 		dstFile.Fd(),
@@ -124,10 +439,88 @@ func reflinkCopy(src, dst string, perm os.FileMode) error {
 	return nil
 }
 
+// openNoATime opens path for reading without updating its access time, so
+// comparisons don't make every candidate look recently used. O_NOATIME is
+// only permitted to the file's owner (or CAP_FOWNER); otherwise this falls
+// back to a plain open.
+func openNoATime(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOATIME, 0)
+	if errors.Is(err, fs.ErrPermission) {
+		f, err = os.Open(path)
+	}
+	if err == nil {
+		live.FilesOpened.Add(1)
+	}
+	return f, err
+}
+
+// fileAtime returns the last access time of path.
+func fileAtime(path string) (time.Time, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(stat.Atim.Unix()), nil
+}
+
+// isNoCOW reports whether path has the NOCOW attribute (chattr +C). btrfs
+// refuses to reflink between NOCOW and regular files, and a reflink copy is
+// always a regular file, so such files cannot be deduped with reflinks.
+// Files whose flags cannot be read are reported as not NOCOW.
+func isNoCOW(path string) bool {
+	flags, err := fileAttrs(path)
+	return err == nil && flags&_FS_NOCOW_FL != 0
+}
+
+// fileAttrs returns the inode attribute flags of path (as lsattr shows).
+func fileAttrs(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+}
+
+// protectedReason returns why DedupOptions.SkipProtected leaves path
+// alone, or "" if it does not: replacing a file with other hard links
+// splits it from them, and an immutable or append-only file is not meant
+// to be rewritten. Flags that cannot be read protect nothing.
+func protectedReason(path string) string {
+	if _, nlink, err := fileLinks(path); err == nil && nlink > 1 {
+		return "other hard links"
+	}
+	flags, err := fileAttrs(path)
+	switch {
+	case err != nil:
+		return ""
+	case flags&_FS_IMMUTABLE_FL != 0:
+		return "immutable"
+	case flags&_FS_APPEND_FL != 0:
+		return "append-only"
+	}
+	return ""
+}
+
+// renameExchange atomically swaps the directory entries a and b, which must
+// both exist, using renameat2(RENAME_EXCHANGE).
+func renameExchange(a, b string) error {
+	if err := guard.check("renameat2", b); err != nil {
+		return err
+	}
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE); err != nil {
+		return &os.LinkError{Op: "renameat2", Old: a, New: b, Err: err}
+	}
+	return nil
+}
+
 // reflinkInPlace replaces the content of dst with a reflink clone of src,
 // without creating or removing directory entries. The existing dst inode is
 // truncated and FICLONE'd in place, so this works on write-protected directories.
 func reflinkInPlace(src, dst string) error {
+	if err := guard.check("reflink", dst); err != nil {
+		return err
+	}
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("open source: %w", err)
@@ -139,7 +532,9 @@ func reflinkInPlace(src, dst string) error {
 		return fmt.Errorf("open destination: %w", err)
 	}
 	defer dstFile.Close()
+	live.FilesOpened.Add(2)
 
+	live.FICLONECalls.Add(1)
 	_, _, errno := unix.Syscall(
 		unix.SYS_IOCTL,
 		dstFile.Fd(),
@@ -153,6 +548,223 @@ func reflinkInPlace(src, dst string) error {
 	return nil
 }
 
+// defragFile defragments a single file on btrfs via BTRFS_IOC_DEFRAG, so
+// reflinks made from it afterwards share contiguous extents.
+func defragFile(path string) error {
+	if err := guard.check("defragment", path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(_BTRFS_IOC_DEFRAG), 0)
+	if errno != 0 {
+		return fmt.Errorf("BTRFS_IOC_DEFRAG: %w", errno)
+	}
+	return nil
+}
+
+// btrfsSpaceInfo returns the space allocated to each block group type of
+// the btrfs filesystem at path, via BTRFS_IOC_SPACE_INFO. Other
+// filesystems return nil.
+func btrfsSpaceInfo(path string) ([]btrfsSpace, error) {
+	if !isBtrfs(path) {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ioctl := func(buf []byte) error {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(_BTRFS_IOC_SPACE), uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			return fmt.Errorf("BTRFS_IOC_SPACE_INFO: %w", errno)
+		}
+		return nil
+	}
+	// A call with no slots only reports how many there are. The kernel
+	// fills at most the slots given, so the result is always in bounds.
+	buf := make([]byte, 16)
+	if err := ioctl(buf); err != nil {
+		return nil, err
+	}
+	n := binary.NativeEndian.Uint64(buf[8:])
+	buf = make([]byte, 16+n*24)
+	binary.NativeEndian.PutUint64(buf, n)
+	if err := ioctl(buf); err != nil {
+		return nil, err
+	}
+	return parseSpaceInfo(buf), nil
+}
+
+// btrfsFSID returns the UUID of the btrfs filesystem holding path, via
+// BTRFS_IOC_FS_INFO. It is the same in every subvolume. Other filesystems
+// return nil.
+func btrfsFSID(path string) (*[16]byte, error) {
+	if !isBtrfs(path) {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// struct btrfs_ioctl_fs_info_args: max_id and num_devices, then fsid.
+	var buf [1024]byte
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(_BTRFS_IOC_FS_INFO), uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return nil, fmt.Errorf("BTRFS_IOC_FS_INFO: %w", errno)
+	}
+	var uuid [16]byte
+	copy(uuid[:], buf[16:32])
+	return &uuid, nil
+}
+
+// dedupeRange shares length bytes of dst at dstOff with src at srcOff using
+// FIDEDUPERANGE. The kernel compares both ranges and only shares them if they
+// are identical. Returns the number of bytes deduped.
+func dedupeRange(src string, srcOff int64, dst string, dstOff, length int64) (int64, error) {
+	if err := guard.check("dedupe", dst); err != nil {
+		return 0, err
+	}
+	srcFile, err := openNoATime(src)
+	if err != nil {
+		return 0, fmt.Errorf("open source: %w", err)
+	}
+	defer srcFile.Close()
+
+	// FIDEDUPERANGE accepts a read-only destination when the caller owns the
+	// file or is root, so read-only files can be deduped too.
+	dstFile, err := openNoATime(dst)
+	if err != nil {
+		return 0, fmt.Errorf("open destination: %w", err)
+	}
+	defer dstFile.Close()
+
+	req := unix.FileDedupeRange{
+		Src_offset: uint64(srcOff),
+		Src_length: uint64(length),
+		Info: []unix.FileDedupeRangeInfo{{
+			Dest_fd:     int64(dstFile.Fd()),
+			Dest_offset: uint64(dstOff),
+		}},
+	}
+	if err := unix.IoctlFileDedupeRange(int(srcFile.Fd()), &req); err != nil {
+		return 0, fmt.Errorf("FIDEDUPERANGE ioctl: %w", err)
+	}
+	info := req.Info[0]
+	switch {
+	case info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+		return 0, fmt.Errorf("FIDEDUPERANGE: ranges differ")
+	case info.Status < 0:
+		return 0, fmt.Errorf("FIDEDUPERANGE: %w", syscall.Errno(-info.Status))
+	}
+	return int64(info.Bytes_deduped), nil
+}
+
+// dedupeRangeBatch shares the first length bytes of every dst with src,
+// issuing one FIDEDUPERANGE call per dedupeBatchMax destinations and
+// maxDedupeLen bytes rather than one per file. The kernel compares each
+// destination with src before sharing it. The result holds one error per
+// dst, nil where the whole range was deduped; a destination that fails
+// partway keeps its remaining data unshared.
+func dedupeRangeBatch(src string, dsts []string, length int64) []error {
+	errs := make([]error, len(dsts))
+	srcFile, err := openNoATime(src)
+	if err != nil {
+		for i := range errs {
+			errs[i] = fmt.Errorf("open source: %w", err)
+		}
+		return errs
+	}
+	defer srcFile.Close()
+
+	for start := 0; start < len(dsts); start += dedupeBatchMax {
+		end := min(start+dedupeBatchMax, len(dsts))
+		dedupeBatch(srcFile, dsts[start:end], length, errs[start:end])
+	}
+	return errs
+}
+
+// dedupeBatch is dedupeRangeBatch for at most dedupeBatchMax destinations,
+// recording each destination's outcome in errs.
+func dedupeBatch(srcFile *os.File, dsts []string, length int64, errs []error) {
+	files := make([]*os.File, len(dsts))
+	for i, dst := range dsts {
+		if err := guard.check("dedupe", dst); err != nil {
+			errs[i] = err
+			continue
+		}
+		// As in dedupeRange, a read-only descriptor is enough.
+		f, err := openNoATime(dst)
+		if err != nil {
+			errs[i] = fmt.Errorf("open destination: %w", err)
+			continue
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	for off := int64(0); off < length; off += maxDedupeLen {
+		n := min(length-off, maxDedupeLen)
+		req := unix.FileDedupeRange{Src_offset: uint64(off), Src_length: uint64(n)}
+		var idx []int
+		for i, f := range files {
+			if errs[i] != nil {
+				continue
+			}
+			req.Info = append(req.Info, unix.FileDedupeRangeInfo{Dest_fd: int64(f.Fd()), Dest_offset: uint64(off)})
+			idx = append(idx, i)
+		}
+		if len(idx) == 0 {
+			return
+		}
+		if err := unix.IoctlFileDedupeRange(int(srcFile.Fd()), &req); err != nil {
+			for _, i := range idx {
+				errs[i] = fmt.Errorf("FIDEDUPERANGE ioctl: %w", err)
+			}
+			return
+		}
+		for j, info := range req.Info {
+			i := idx[j]
+			switch {
+			case info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+				errs[i] = fmt.Errorf("FIDEDUPERANGE: ranges differ at offset %d", off)
+			case info.Status < 0:
+				errs[i] = fmt.Errorf("FIDEDUPERANGE: %w", syscall.Errno(-info.Status))
+			case int64(info.Bytes_deduped) != n:
+				errs[i] = fmt.Errorf("FIDEDUPERANGE: deduped %d of %d bytes at offset %d", info.Bytes_deduped, n, off)
+			}
+		}
+	}
+}
+
+// fsBlockSize returns the block size of the filesystem containing path,
+// which is the alignment required for range clone and dedup operations.
+func fsBlockSize(path string) int64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil || stat.Bsize <= 0 {
+		return 4096
+	}
+	return int64(stat.Bsize)
+}
+
+// preferredIOSize returns the preferred IO size st_blksize reports for
+// path, or 0 if it cannot be read. Most local filesystems report the page
+// size; network and striped filesystems report their stripe or RPC size.
+func preferredIOSize(path string) int64 {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil || stat.Blksize <= 0 {
+		return 0
+	}
+	return int64(stat.Blksize)
+}
+
 // isMountPoint checks whether path is a filesystem mount point by comparing
 // device IDs with the parent directory.
 func isMountPoint(path string) bool {
@@ -211,6 +823,73 @@ func sameInode(a, b string) (bool, error) {
 	return statA.Dev == statB.Dev && statA.Ino == statB.Ino, nil
 }
 
+// fileInode returns the device and inode number of path.
+func fileInode(path string) (inodeKey, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return inodeKey{}, err
+	}
+	return inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}, nil
+}
+
+// fileLinks returns the device and inode number of path and its number of
+// hard links.
+func fileLinks(path string) (inodeKey, uint64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return inodeKey{}, 0, err
+	}
+	return inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}, uint64(stat.Nlink), nil
+}
+
+// FileStorageInfo returns the inode, link count and extent map summary of
+// path. It queries FIEMAP even when the filesystem being processed was
+// found not to support it, so the error tells callers why.
+func FileStorageInfo(path string) (StorageInfo, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return StorageInfo{}, err
+	}
+	extents, err := getExtents(path)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	shared, exclusive := sharedBytes(extents)
+	var unwritten uint64
+	for _, e := range extents {
+		if e.Flags&extentFlagUnwritten != 0 {
+			unwritten += e.Length
+		}
+	}
+	return StorageInfo{
+		Inode:     stat.Ino,
+		Nlink:     uint64(stat.Nlink),
+		Extents:   len(extents),
+		Allocated: int64(shared + exclusive),
+		Shared:    shared > 0,
+		SharedLen: int64(shared),
+		Unwritten: int64(unwritten),
+	}, nil
+}
+
+// fileOwner returns the owning user and group from info.
+func fileOwner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return stat.Uid, stat.Gid, true
+}
+
+// fileDevice returns the st_dev of path, or 0 if it cannot be stat'ed.
+func fileDevice(path string) uint64 {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0
+	}
+	return uint64(stat.Dev)
+}
+
 // restoreMetadata copies ownership, permissions, and timestamps from the
 // original file info onto the new file at path.
 func restoreMetadata(path string, orig os.FileInfo) error {
@@ -219,18 +898,20 @@ func restoreMetadata(path string, orig os.FileInfo) error {
 		return fmt.Errorf("unexpected stat type for metadata restoration")
 	}
 
-	// Ownership (best-effort; may require root).
-	_ = os.Chown(path, int(stat.Uid), int(stat.Gid))
+	// Ownership (best-effort; may require root), subject to restoreOwner.
+	if uid, gid, ok := restoreOwner.owner(stat.Uid, stat.Gid); ok {
+		_ = guard.chown(path, int(uid), int(gid))
+	}
 
 	// Permissions.
-	if err := os.Chmod(path, orig.Mode()); err != nil {
+	if err := guard.chmod(path, orig.Mode()); err != nil {
 		return fmt.Errorf("chmod: %w", err)
 	}
 
 	// Timestamps.
 	atime := time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
 	mtime := time.Unix(int64(stat.Mtim.Sec), int64(stat.Mtim.Nsec))
-	if err := os.Chtimes(path, atime, mtime); err != nil {
+	if err := guard.chtimes(path, atime, mtime); err != nil {
 		return fmt.Errorf("chtimes: %w", err)
 	}
 
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPlatformSupported(t *testing.T) {
+	if !platformSupported() {
+		t.Error("platformSupported() = false on Linux")
+	}
+}
+
+func TestPreferredIOSize(t *testing.T) {
+	if got := preferredIOSize(t.TempDir()); got <= 0 {
+		t.Errorf("preferredIOSize = %d, want the reported st_blksize", got)
+	}
+	if got := preferredIOSize("/nonexistent/path"); got != 0 {
+		t.Errorf("preferredIOSize of a missing path = %d, want 0", got)
+	}
+}
+
+func TestFileStorageInfo(t *testing.T) {
+	dir := t.TempDir()
+	p := createTempFile(t, dir, "a", bytes.Repeat([]byte("x"), 64<<10))
+	if err := os.Link(p, filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := FileStorageInfo(p)
+	if fiemapUnsupported(err) {
+		t.Skipf("FIEMAP unsupported here: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino, err := fileInode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Inode != ino.ino || info.Nlink != 2 {
+		t.Errorf("inode %d nlink %d, want %d and 2", info.Inode, info.Nlink, ino.ino)
+	}
+	if info.Extents < 1 || info.Allocated < 64<<10 {
+		t.Errorf("%d extents of %d bytes, want 64 KiB in at least one", info.Extents, info.Allocated)
+	}
+	if info.Shared || info.SharedLen != 0 {
+		t.Errorf("a freshly written file reports %d shared bytes", info.SharedLen)
+	}
+
+	if info.Unwritten != 0 {
+		t.Errorf("a written file reports %d unwritten bytes", info.Unwritten)
+	}
+
+	// Preallocated space is reported as unwritten.
+	f, err := os.Create(filepath.Join(dir, "prealloc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := unix.Fallocate(int(f.Fd()), 0, 0, 1<<20); err != nil {
+		t.Logf("fallocate unsupported here: %v", err)
+	} else if info, err := FileStorageInfo(f.Name()); err != nil || info.Unwritten != 1<<20 {
+		t.Errorf("preallocated file: %d unwritten bytes (%v), want 1 MiB", info.Unwritten, err)
+	}
+
+	if _, err := FileStorageInfo(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file error = %v, want not exist", err)
+	}
+}
+
+// TestIOCounters runs a known sequence of operations and checks the
+// LiveStats I/O counters. The clone need not succeed to be counted.
+func TestIOCounters(t *testing.T) {
+	defer func(orig *LiveStats) { live = orig }(live)
+	live = &LiveStats{}
+
+	dir := t.TempDir()
+	content := randomData(4, 4096)
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+	_, _ = getExtents(a)
+	if equal, err := filesEqual(a, b); err != nil || !equal {
+		t.Fatalf("filesEqual = %v, %v", equal, err)
+	}
+	_ = reflinkCopy(a, filepath.Join(dir, "c"), 0644)
+
+	s := live.Snapshot()
+	if s.FIEMAPCalls != 1 || s.FICLONECalls != 1 || s.FilesOpened != 5 || s.BytesCompared != 4096 {
+		t.Errorf("got %d FIEMAP, %d FICLONE, %d opens, %d bytes compared; want 1, 1, 5, 4096",
+			s.FIEMAPCalls, s.FICLONECalls, s.FilesOpened, s.BytesCompared)
+	}
+}
+
+func TestRenameExchange(t *testing.T) {
+	dir := t.TempDir()
+	a := createTempFile(t, dir, "a", []byte("aaa"))
+	b := createTempFile(t, dir, "b", []byte("bbb"))
+
+	if err := renameExchange(a, b); err != nil {
+		t.Skipf("RENAME_EXCHANGE unsupported here: %v", err)
+	}
+	gotA, _ := os.ReadFile(a)
+	gotB, _ := os.ReadFile(b)
+	if string(gotA) != "bbb" || string(gotB) != "aaa" {
+		t.Errorf("after exchange a=%q b=%q, want bbb, aaa", gotA, gotB)
+	}
+
+	if err := renameExchange(a, filepath.Join(dir, "missing")); err == nil {
+		t.Error("exchange with a missing file should fail")
+	}
+}
+
+// watchPresence polls path until stop is closed and reports whether it was
+// ever missing.
+func watchPresence(path string, stop <-chan struct{}, wg *sync.WaitGroup) *atomic.Bool {
+	var missing atomic.Bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := os.Lstat(path); os.IsNotExist(err) {
+				missing.Store(true)
+			}
+		}
+	}()
+	return &missing
+}
+
+func TestRenameExchangeNeverLeavesPathAbsent(t *testing.T) {
+	dir := t.TempDir()
+	a := createTempFile(t, dir, "a", []byte("aaa"))
+	b := createTempFile(t, dir, "b", []byte("bbb"))
+	if err := renameExchange(a, b); err != nil {
+		t.Skipf("RENAME_EXCHANGE unsupported here: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	missing := watchPresence(b, stop, &wg)
+	for range 2000 {
+		if err := renameExchange(a, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if missing.Load() {
+		t.Error("path was absent during an exchange")
+	}
+}
+
+func TestDedupFileKeepsDstPresent(t *testing.T) {
+	dir := t.TempDir()
+	content := randomData(8, 1<<20)
+	src := createTempFile(t, dir, "src", content)
+	if err := reflinkCopy(src, filepath.Join(dir, "probe"), 0644); err != nil {
+		t.Skipf("temp dir does not support reflinks: %v", err)
+	}
+
+	for i := range 20 {
+		dst := createTempFile(t, dir, "dst", content)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		missing := watchPresence(dst, stop, &wg)
+		err := dedupFile(src, dst, nil, false, false)
+		close(stop)
+		wg.Wait()
+		if err != nil {
+			t.Fatalf("dedupFile: %v", err)
+		}
+		if missing.Load() {
+			t.Fatalf("run %d: dst was absent during dedup", i)
+		}
+		if _, err := os.Lstat(dst + ".dedup-tmp"); !os.IsNotExist(err) {
+			t.Fatalf("temp file left behind: %v", err)
+		}
+		if err := os.Remove(dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRenameExchangeUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	missing := renameExchange(filepath.Join(dir, "a"), filepath.Join(dir, "b"))
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&os.LinkError{Op: "renameat2", Err: unix.EINVAL}, true},
+		{&os.LinkError{Op: "renameat2", Err: unix.ENOSYS}, true},
+		{&os.LinkError{Op: "renameat2", Err: unix.EOPNOTSUPP}, true},
+		{missing, false},
+		{&os.LinkError{Op: "renameat2", Err: unix.EACCES}, false},
+	}
+	for _, tt := range tests {
+		if got := renameExchangeUnsupported(tt.err); got != tt.want {
+			t.Errorf("renameExchangeUnsupported(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDedupFileRenameFallback(t *testing.T) {
+	defer func(orig bool) { noRenameExchange.Store(orig) }(noRenameExchange.Load())
+	noRenameExchange.Store(true)
+	content := randomData(9, 64<<10)
+
+	t.Run("replaces an unchanged dst", func(t *testing.T) {
+		dir := t.TempDir()
+		src := createTempFile(t, dir, "src", content)
+		if err := reflinkCopy(src, filepath.Join(dir, "probe"), 0644); err != nil {
+			t.Skipf("temp dir does not support reflinks: %v", err)
+		}
+		dst := createTempFile(t, dir, "dst", content)
+		if err := dedupFile(src, dst, nil, false, false); err != nil {
+			t.Fatalf("dedupFile: %v", err)
+		}
+		if _, err := os.Lstat(dst + tmpSuffix); !os.IsNotExist(err) {
+			t.Errorf("temp file left behind: %v", err)
+		}
+	})
+
+	t.Run("keeps a modified dst", func(t *testing.T) {
+		dir := t.TempDir()
+		dst := createTempFile(t, dir, "dst", content)
+		tmp := createTempFile(t, dir, "dst"+tmpSuffix, content)
+		info, err := os.Lstat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := append(bytes.Clone(content), "appended"...)
+		if err := os.WriteFile(dst, written, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := replaceByRename(tmp, dst, info); err == nil {
+			t.Fatal("replaceByRename succeeded over a modified dst")
+		}
+		if got, _ := os.ReadFile(dst); !bytes.Equal(got, written) {
+			t.Error("the write to dst was lost")
+		}
+		if _, err := os.Lstat(tmp); !os.IsNotExist(err) {
+			t.Errorf("temp file left behind: %v", err)
+		}
+	})
+
+	t.Run("keeps a deleted dst deleted", func(t *testing.T) {
+		dir := t.TempDir()
+		dst := createTempFile(t, dir, "dst", content)
+		tmp := createTempFile(t, dir, "dst"+tmpSuffix, content)
+		info, err := os.Lstat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(dst); err != nil {
+			t.Fatal(err)
+		}
+		if err := replaceByRename(tmp, dst, info); err == nil {
+			t.Fatal("replaceByRename succeeded over a deleted dst")
+		}
+		if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+			t.Errorf("deleted dst came back: %v", err)
+		}
+	})
+}
+
+func TestNoCOWFlag(t *testing.T) {
+	// FS_NOCOW_FL from linux/fs.h, as set by chattr +C.
+	if _FS_NOCOW_FL != 0x00800000 {
+		t.Errorf("_FS_NOCOW_FL = %#x, want 0x00800000", _FS_NOCOW_FL)
+	}
+
+	dir := t.TempDir()
+	path := createTempFile(t, dir, "plain", nil)
+	if isNoCOW(path) {
+		t.Error("regular file reported as nocow")
+	}
+	if isNoCOW(filepath.Join(dir, "missing")) {
+		t.Error("missing file reported as nocow")
+	}
+
+	// The attribute can only be set on an empty file on a filesystem that
+	// supports it (btrfs).
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err == nil {
+		err = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags|_FS_NOCOW_FL))
+	}
+	if err != nil || !isNoCOW(path) {
+		t.Skipf("cannot set nocow attribute here: %v", err)
+	}
+
+	stats := ProcessSizeGroup([]string{createTempFile(t, dir, "a", nil), path}, 0, DedupOptions{DryRun: true}, nil)
+	if stats.NoCOW != 1 {
+		t.Errorf("NoCOW = %d, want 1", stats.NoCOW)
+	}
+}
+
+func TestGetExtentsDevice(t *testing.T) {
+	path := createTempFile(t, t.TempDir(), "f", randomData(3, 64*1024))
+	extents, err := getExtents(path)
+	if err != nil || len(extents) == 0 {
+		t.Skipf("FIEMAP unavailable here: %v", err)
+	}
+	want := fileDevice(path)
+	for _, e := range extents {
+		if e.Device != want {
+			t.Errorf("extent at %d: Device = %d, want %d", e.Logical, e.Device, want)
+		}
+	}
+}
+
+func TestGetExtentsTargetedSync(t *testing.T) {
+	defer func(orig bool) { fiemapTargetedSync = orig }(fiemapTargetedSync)
+	fiemapTargetedSync = true
+
+	// Freshly written and unsynced, so delalloc filesystems report
+	// delayed extents until getExtents flushes the file.
+	path := createTempFile(t, t.TempDir(), "f", randomData(5, 64*1024))
+	extents, err := getExtents(path)
+	if err != nil && fiemapUnsupported(err) {
+		t.Skipf("FIEMAP unavailable here: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) == 0 || hasDelalloc(extents) {
+		t.Errorf("extents = %+v, want allocated extents", extents)
+	}
+}
+
+func TestCopySparse(t *testing.T) {
+	dir := t.TempDir()
+	// 16 MiB with two 4 KiB data regions and a trailing hole.
+	const size = 16 << 20
+	srcPath := filepath.Join(dir, "sparse")
+	f, err := os.Create(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, 8 << 20} {
+		if _, err := f.WriteAt(randomData(uint64(off), 4096), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dstPath := filepath.Join(dir, "copy")
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copySparse(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if equal, err := filesEqual(srcPath, dstPath); err != nil || !equal {
+		t.Fatalf("copy differs from source: equal=%v, err=%v", equal, err)
+	}
+	var srcStat, dstStat unix.Stat_t
+	if err := unix.Stat(srcPath, &srcStat); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Stat(dstPath, &dstStat); err != nil {
+		t.Fatal(err)
+	}
+	if srcStat.Blocks*512 >= size {
+		t.Skipf("filesystem did not keep the source sparse (%d blocks)", srcStat.Blocks)
+	}
+	if dstStat.Blocks > srcStat.Blocks {
+		t.Errorf("copy allocated %d blocks, source %d; holes were filled", dstStat.Blocks, srcStat.Blocks)
+	}
+}
+
+func TestMmapEqual(t *testing.T) {
+	defer func(orig int64) { mmapWindow = orig }(mmapWindow)
+	page := os.Getpagesize()
+	mmapWindow = int64(2 * page) // several windows per file
+
+	dir := t.TempDir()
+	data := randomData(9, 5*page+17)
+	other := bytes.Clone(data)
+	other[4*page+3] ^= 1 // in the third window
+	open := func(name string, content []byte) *os.File {
+		f, err := os.Open(createTempFile(t, dir, name, content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	fa, fb, fc := open("a", data), open("b", data), open("c", other)
+	size := int64(len(data))
+
+	if eq, err := mmapEqual(fa, fb, size); err != nil || !eq {
+		t.Errorf("identical: mmapEqual = %v, %v; want true", eq, err)
+	}
+	if eq, err := mmapEqual(fa, fc, size); err != nil || eq {
+		t.Errorf("mismatch in a later window: mmapEqual = %v, %v; want false", eq, err)
+	}
+	// Mapping past the end of the files faults, as after a truncation.
+	if _, err := mmapEqual(fa, fb, size+int64(2*page)); !errors.Is(err, errSizeMismatch) {
+		t.Errorf("past EOF: err = %v, want errSizeMismatch", err)
+	}
+}
+
+func TestRestoreMetadataOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	defer func(p ownerPolicy) { restoreOwner = p }(restoreOwner)
+
+	dir := t.TempDir()
+	orig := createTempFile(t, dir, "orig", []byte("x"))
+	if err := os.Chown(orig, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, _ := parseIDMap("200000:1000:10")
+
+	for _, tt := range []struct {
+		name     string
+		policy   ownerPolicy
+		uid, gid uint32
+	}{
+		{"preserve", ownerPolicy{}, 1000, 1000},
+		{"map", ownerPolicy{uids: ranges, gids: ranges}, 200000, 200000},
+		{"skip", ownerPolicy{skip: true}, 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			restoreOwner = tt.policy
+			path := createTempFile(t, dir, tt.name, []byte("x"))
+			if err := restoreMetadata(path, info); err != nil {
+				t.Fatal(err)
+			}
+			var st unix.Stat_t
+			if err := unix.Stat(path, &st); err != nil {
+				t.Fatal(err)
+			}
+			if st.Uid != tt.uid || st.Gid != tt.gid {
+				t.Errorf("owner = %d:%d, want %d:%d", st.Uid, st.Gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
+
+// fragmentedFile writes one byte every 64 KiB, n times, giving a sparse
+// file with n extents.
+func fragmentedFile(t *testing.T, path string, n int, b byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := range n {
+		if _, err := f.WriteAt([]byte{b}, int64(i)*64*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtentsEqual(t *testing.T) {
+	dir := t.TempDir()
+	// More extents than one FIEMAP batch holds.
+	const n = 2*_MAX_FIEMAP_EXTENTS + 10
+	frag := filepath.Join(dir, "frag")
+	fragmentedFile(t, frag, n, 'a')
+	extents, err := getExtents(frag)
+	if err != nil {
+		t.Skipf("FIEMAP unavailable here: %v", err)
+	}
+	if len(extents) != n {
+		t.Skipf("got %d extents, want %d; filesystem merges sparse writes", len(extents), n)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Link(frag, link); err != nil {
+		t.Fatal(err)
+	}
+	// Same layout, different blocks: the maps diverge at the first extent.
+	other := filepath.Join(dir, "other")
+	fragmentedFile(t, other, n, 'a')
+	short := filepath.Join(dir, "short")
+	fragmentedFile(t, short, 3, 'a')
+
+	for _, tt := range []struct {
+		name string
+		b    string
+		want bool
+	}{
+		{"same file", link, true},
+		{"early divergence", other, false},
+		{"fewer extents", short, false},
+	} {
+		got, err := extentsEqual(frag, tt.b)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: extentsEqual = %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+		if full, _ := getExtents(tt.b); SameExtents(extents, full) != tt.want {
+			t.Errorf("%s: disagrees with SameExtents", tt.name)
+		}
+	}
+}
+
+func TestGetExtentsMax(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frag")
+	fragmentedFile(t, path, 20, 'a')
+	all, err := getExtentsMax(path, 0)
+	if err != nil || len(all) < 11 {
+		t.Skipf("FIEMAP unavailable or extents merged here: %d extents, %v", len(all), err)
+	}
+	if _, err := getExtentsMax(path, 10); !errors.Is(err, errTooManyExtents) {
+		t.Errorf("getExtentsMax(10) error = %v, want errTooManyExtents", err)
+	}
+	if got, err := getExtentsMax(path, len(all)); err != nil || len(got) != len(all) {
+		t.Errorf("getExtentsMax(%d) = %d extents, %v", len(all), len(got), err)
+	}
+}
+
+func TestGetExtentsPrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frag")
+	// More extents than one FIEMAP batch holds, one every 64 KiB.
+	const n = 2*_MAX_FIEMAP_EXTENTS + 10
+	fragmentedFile(t, path, n, 'a')
+	all, err := getExtents(path)
+	if err != nil || len(all) != n {
+		t.Skipf("FIEMAP unavailable or extents merged here: %d extents, %v", len(all), err)
+	}
+	const prefix = 10 * 64 * 1024
+	calls := live.FIEMAPCalls.Load()
+	got, err := getExtentsPrefix(path, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 10 {
+		t.Errorf("got %d extents in the first %d bytes, want 10", len(got), prefix)
+	}
+	for _, e := range got {
+		if e.Logical >= prefix {
+			t.Errorf("extent at %d is past the %d byte prefix", e.Logical, prefix)
+		}
+	}
+	if c := live.FIEMAPCalls.Load() - calls; c != 1 {
+		t.Errorf("%d FIEMAP calls for a prefix within one batch, want 1", c)
+	}
+}
+
+func TestProcessSizeGroupManyExtents(t *testing.T) {
+	defer func(orig int) { maxRefExtents = orig }(maxRefExtents)
+	maxRefExtents = 4
+
+	discardStdout(t)
+
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	fragmentedFile(t, a, 8, 'x')
+	fragmentedFile(t, b, 8, 'x')
+	info, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Identical content in separate blocks: no longer held as extent
+	// lists, but still not mistaken for already shared.
+	stats := ProcessSizeGroup([]string{a, b}, info.Size(), DedupOptions{DryRun: true}, nil)
+	if stats.FilesDeduped != 1 || stats.AlreadyDeduped != 0 {
+		t.Errorf("got %d deduped, %d already; want 1, 0", stats.FilesDeduped, stats.AlreadyDeduped)
+	}
+}
+
+// BenchmarkFilesEqualCold compares two files after dropping them from the
+// page cache, so every byte comes from the disk. On a spinning disk (set
+// FASTDEDUP_BENCH_DIR to a directory on one) this shows the seeks the
+// overlapped reads cost against --hdd-mode.
+func BenchmarkFilesEqualCold(b *testing.B) {
+	root := benchDir(b)
+	const size = 256 << 20
+	paths := genTree(b, root, treeSpec{Files: 2, Sizes: []int64{size}, DistinctPerSize: 1, Seed: 1})
+	var files []*os.File
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer f.Close()
+		// Only clean pages can be dropped.
+		if err := f.Sync(); err != nil {
+			b.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	for _, hdd := range []bool{false, true} {
+		name := "overlapped"
+		if hdd {
+			name = "hdd"
+		}
+		b.Run(name, func(b *testing.B) {
+			hddCompare = hdd
+			defer func() { hddCompare = false }()
+			b.SetBytes(2 * size)
+			for range b.N {
+				b.StopTimer()
+				for _, f := range files {
+					if err := unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+				if eq, err := filesEqual(paths[0], paths[1]); err != nil || !eq {
+					b.Fatalf("eq=%v err=%v", eq, err)
+				}
+			}
+		})
+	}
+}
@@ -4,23 +4,97 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"time"
 )
 
 var errUnsupported = fmt.Errorf("fastdedup requires Linux (btrfs is Linux-only)")
 
+// platformSupported is false everywhere but Linux: every operation here
+// fails with errUnsupported, so main exits before walking anything.
+func platformSupported() bool {
+	return false
+}
+
 func getExtents(_ string) ([]Extent, error) {
 	return nil, errUnsupported
 }
 
+func getExtentsMax(_ string, _ int) ([]Extent, error) {
+	return nil, errUnsupported
+}
+
+func getExtentsPrefix(_ string, _ uint64) ([]Extent, error) {
+	return nil, errUnsupported
+}
+
+func extentsEqual(_, _ string) (bool, error) {
+	return false, errUnsupported
+}
+
 func reflinkCopy(_, _ string, _ os.FileMode) error {
 	return errUnsupported
 }
 
+func mmapEqual(_, _ *os.File, _ int64) (bool, error) {
+	return false, errUnsupported
+}
+
+func adviseWillNeed(_ *os.File, _, _ int64) {}
+
+func copySparse(dst, src *os.File) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, ioBuffer())
+}
+
+func openNoATime(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+func fileAtime(_ string) (time.Time, error) {
+	return time.Time{}, errUnsupported
+}
+
+func isNoCOW(_ string) bool {
+	return false
+}
+
+func protectedReason(_ string) string {
+	return ""
+}
+
+func renameExchange(_, _ string) error {
+	return errUnsupported
+}
+
 func reflinkInPlace(_, _ string) error {
 	return errUnsupported
 }
 
+func defragFile(_ string) error {
+	return errUnsupported
+}
+
+func dedupeRange(_ string, _ int64, _ string, _, _ int64) (int64, error) {
+	return 0, errUnsupported
+}
+
+func dedupeRangeBatch(_ string, dsts []string, _ int64) []error {
+	errs := make([]error, len(dsts))
+	for i := range errs {
+		errs[i] = errUnsupported
+	}
+	return errs
+}
+
+func fsBlockSize(_ string) int64 {
+	return 4096
+}
+
+func preferredIOSize(_ string) int64 {
+	return 0
+}
+
 func isMountPoint(_ string) bool {
 	return false
 }
@@ -33,6 +107,26 @@ func sameInode(_, _ string) (bool, error) {
 	return false, errUnsupported
 }
 
+func fileInode(_ string) (inodeKey, error) {
+	return inodeKey{}, errUnsupported
+}
+
+func fileLinks(_ string) (inodeKey, uint64, error) {
+	return inodeKey{}, 0, errUnsupported
+}
+
+func FileStorageInfo(_ string) (StorageInfo, error) {
+	return StorageInfo{}, errUnsupported
+}
+
+func fileOwner(_ os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+func fileDevice(_ string) uint64 {
+	return 0
+}
+
 func restoreMetadata(_ string, _ os.FileInfo) error {
 	return errUnsupported
 }
@@ -45,6 +139,14 @@ func isBtrfs(_ string) bool {
 	return false
 }
 
+func btrfsSpaceInfo(_ string) ([]btrfsSpace, error) {
+	return nil, nil
+}
+
+func btrfsFSID(_ string) (*[16]byte, error) {
+	return nil, nil
+}
+
 func runScrub(_ string) error {
 	return errUnsupported
 }
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPlatformSupported(t *testing.T) {
+	if platformSupported() {
+		t.Error("platformSupported() = true on an unsupported platform")
+	}
+	if _, err := getExtents("x"); !errors.Is(err, errUnsupported) {
+		t.Errorf("getExtents error = %v, want errUnsupported", err)
+	}
+	if _, err := FileStorageInfo("x"); !errors.Is(err, errUnsupported) {
+		t.Errorf("FileStorageInfo error = %v, want errUnsupported", err)
+	}
+}
+
+func TestRunSelftestUnsupported(t *testing.T) {
+	var out bytes.Buffer
+	if runSelftest(&out, t.TempDir()) {
+		t.Fatal("self-test passed on an unsupported platform")
+	}
+	if !strings.Contains(out.String(), "FAIL read extents") || !strings.Contains(out.String(), errUnsupported.Error()) {
+		t.Errorf("output does not name the unsupported step:\n%s", out.String())
+	}
+}
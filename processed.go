@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// processedFlushEvery is how often pass 2 appends newly processed paths
+// to the --processed-set file.
+const processedFlushEvery = 30 * time.Second
+
+// ProcessedSet is the --processed-set file: the paths of every size group
+// a run finished without errors, one per line, so a later run can treat
+// them as done. It only grows; delete the file to start over. A nil
+// *ProcessedSet holds nothing and records nothing. It is safe for
+// concurrent use.
+type ProcessedSet struct {
+	path    string
+	mu      sync.Mutex
+	done    map[string]struct{}
+	pending []string // added since the last Flush
+}
+
+// LoadProcessedSet reads the set saved at path; a missing file is an
+// empty set.
+func LoadProcessedSet(path string) (*ProcessedSet, error) {
+	s := &ProcessedSet{path: path, done: make(map[string]struct{})}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for sc.Scan() {
+		if line := sc.Text(); line != "" {
+			s.done[line] = struct{}{}
+		}
+	}
+	return s, sc.Err()
+}
+
+// Len returns the number of paths in the set.
+func (s *ProcessedSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.done)
+}
+
+// Has reports whether path is in the set.
+func (s *ProcessedSet) Has(path string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.done[path]
+	return ok
+}
+
+// Add puts paths in the set; Flush saves them. Paths containing a newline
+// cannot be saved and are left out, so they are processed again.
+func (s *ProcessedSet) Add(paths ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range paths {
+		if _, ok := s.done[p]; ok || strings.ContainsRune(p, '\n') {
+			continue
+		}
+		s.done[p] = struct{}{}
+		s.pending = append(s.pending, p)
+	}
+}
+
+// Flush appends the paths added since the last Flush to the file.
+func (s *ProcessedSet) Flush() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, p := range s.pending {
+		w.WriteString(p)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.pending = s.pending[:0]
+	return nil
+}
+
+// split marks the paths in the set in older, which is created if nil, and
+// moves them first, as splitByMtime does for unchanged files.
+func (s *ProcessedSet) split(paths []string, older map[string]bool) ([]string, map[string]bool) {
+	if older == nil {
+		older = make(map[string]bool)
+	}
+	for _, p := range paths {
+		if s.Has(p) {
+			older[p] = true
+		}
+	}
+	return olderFirst(paths, older), older
+}
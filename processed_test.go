@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessedSet(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "done")
+	s, err := LoadProcessedSet(p)
+	if err != nil || s.Len() != 0 {
+		t.Fatalf("missing file: %d paths, %v", s.Len(), err)
+	}
+	s.Add("/a", "/b", "/a", "/new\nline")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.Add("/c")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = LoadProcessedSet(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		if !s.Has(path) {
+			t.Errorf("%s not loaded", path)
+		}
+	}
+	if s.Len() != 3 {
+		t.Errorf("loaded %d paths, want 3", s.Len())
+	}
+
+	var none *ProcessedSet
+	none.Add("/a")
+	if none.Has("/a") || none.Flush() != nil {
+		t.Error("nil set records paths")
+	}
+}
+
+// TestProcessSizeGroupProcessed records a run's groups as main does and
+// checks the next run skips them.
+func TestProcessSizeGroupProcessed(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	content := []byte("processed last night")
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+	size := int64(len(content))
+	setPath := filepath.Join(dir, "done")
+
+	first, _ := LoadProcessedSet(setPath)
+	opts := DedupOptions{DryRun: true, Processed: first}
+	if stats := ProcessSizeGroup([]string{a, b}, size, opts, nil); stats.FilesDeduped != 1 {
+		t.Fatalf("first run deduped %d, want 1", stats.FilesDeduped)
+	}
+	first.Add(a, b)
+	if err := first.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := LoadProcessedSet(setPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Processed = next
+	if stats := ProcessSizeGroup([]string{a, b}, size, opts, nil); stats.FilesScanned != 0 {
+		t.Errorf("next run scanned %d files of a done group, want 0", stats.FilesScanned)
+	}
+	// A new copy is still deduped, against a done file.
+	c := createTempFile(t, dir, "c", content)
+	stats := ProcessSizeGroup([]string{c, a, b}, size, opts, nil)
+	if stats.FilesDeduped != 1 {
+		t.Errorf("new copy: %d deduped, want 1", stats.FilesDeduped)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,10 +18,43 @@ var (
 		return fi.Mode()&os.ModeCharDevice != 0
 	}()
 	quietMode bool
+	// progressEvery is the interval between progress redraws. It is set
+	// once at startup from --progress-every.
+	progressEvery = 200 * time.Millisecond
 )
 
 const barWidth = 30
 
+// progressTicker paces progress output by time rather than by item count,
+// so redraws come at the same cadence on a slow disk as on a fast one.
+type progressTicker struct {
+	c    <-chan time.Time
+	stop func()
+}
+
+// newProgressTicker returns a progressTicker that is due every interval.
+func newProgressTicker(every time.Duration) *progressTicker {
+	t := time.NewTicker(every)
+	return &progressTicker{c: t.C, stop: t.Stop}
+}
+
+// Due reports whether an interval has passed since Due last returned true.
+// It does not block and is cheap enough to call for every file. Intervals
+// missed while nobody called Due are coalesced into one.
+func (p *progressTicker) Due() bool {
+	select {
+	case <-p.c:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop releases the ticker. Due never reports true afterwards.
+func (p *progressTicker) Stop() {
+	p.stop()
+}
+
 // formatSize formats a byte count as a human-readable string.
 // If raw is true, returns the raw byte count.
 func formatSize(b int64, raw bool) string {
@@ -46,6 +81,25 @@ func formatSize(b int64, raw bool) string {
 	}
 }
 
+// parseSize parses a byte count such as "1048576", "512K", "1.5G" or
+// "2GiB". Suffixes are binary multiples, as formatSize prints them; "B",
+// "iB" and case are optional.
+func parseSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	upper = strings.TrimSuffix(upper, "B")
+	upper = strings.TrimSuffix(upper, "I")
+	mult := int64(1)
+	if i := strings.IndexAny(upper, "KMGT"); i >= 0 && i == len(upper)-1 {
+		mult = int64(1) << (10 * (1 + strings.IndexByte("KMGT", upper[i])))
+		upper = upper[:i]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil || v < 0 || v*float64(mult) > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
 // formatCount formats an integer with comma separators.
 func formatCount(n int64) string {
 	if n < 0 {
@@ -64,6 +64,34 @@ func TestFormatCount(t *testing.T) {
 	}
 }
 
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"1048576", 1 << 20},
+		{"512K", 512 << 10},
+		{"512k", 512 << 10},
+		{"1G", 1 << 30},
+		{"1.5G", 3 << 29},
+		{"2GiB", 2 << 30},
+		{"3MB", 3 << 20},
+		{"1T", 1 << 40},
+		{"100B", 100},
+	}
+	for _, tt := range tests {
+		if got, err := parseSize(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "G", "1X", "-1K", "1KG", "9999999T"} {
+		if _, err := parseSize(bad); err == nil {
+			t.Errorf("parseSize(%q): expected error", bad)
+		}
+	}
+}
+
 func TestFormatETA(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -91,3 +119,40 @@ func TestFormatETA(t *testing.T) {
 		})
 	}
 }
+
+func TestProgressTicker(t *testing.T) {
+	t.Run("fake clock", func(t *testing.T) {
+		c := make(chan time.Time, 1)
+		stopped := false
+		p := &progressTicker{c: c, stop: func() { stopped = true }}
+
+		if p.Due() {
+			t.Fatal("Due before any tick")
+		}
+		for i := range 3 {
+			c <- time.Unix(int64(i), 0)
+			if !p.Due() {
+				t.Fatalf("tick %d: Due = false, want true", i)
+			}
+			if p.Due() {
+				t.Fatalf("tick %d: Due true twice for one tick", i)
+			}
+		}
+		p.Stop()
+		if !stopped {
+			t.Error("Stop did not stop the underlying ticker")
+		}
+	})
+
+	t.Run("real ticker", func(t *testing.T) {
+		p := newProgressTicker(time.Millisecond)
+		defer p.Stop()
+		deadline := time.Now().Add(5 * time.Second)
+		for !p.Due() {
+			if time.Now().After(deadline) {
+				t.Fatal("no tick within 5s of a 1ms interval")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
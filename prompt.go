@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// stdinIsTTY reports whether stdin is attached to a terminal.
+var stdinIsTTY = func() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}()
+
+// Actions for --interactive when stdin is not a terminal.
+const (
+	noTTYAbort   = "abort"
+	noTTYProceed = "proceed"
+)
+
+// confirmPlan prints the pass-2 plan to out and asks the user to confirm on in.
+// Only an explicit "y" or "yes" confirms; anything else (including EOF) aborts.
+// When tty is false no prompt is shown and noTTYAction decides the outcome.
+func confirmPlan(in io.Reader, out io.Writer, tty bool, noTTYAction string, groups int, files, savings int64, rawSizes bool) (bool, error) {
+	if !tty {
+		switch noTTYAction {
+		case noTTYProceed:
+			return true, nil
+		case noTTYAbort:
+			return false, fmt.Errorf("--interactive requires a terminal on stdin (use --interactive-no-tty=proceed to skip the prompt)")
+		default:
+			return false, fmt.Errorf("invalid --interactive-no-tty %q (want %s or %s)", noTTYAction, noTTYAbort, noTTYProceed)
+		}
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	fmt.Fprintf(out, "\nAbout to deduplicate up to %s files in %s size groups (up to %s potential savings).\n",
+		formatCount(files), formatCount(int64(groups)), formatSize(savings, rawSizes))
+	//goland:noinspection GoUnhandledErrorResult
+	fmt.Fprintf(out, "Files will be modified in place. Continue? [y/N] ")
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
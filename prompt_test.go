@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfirmPlan(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"yes", "y\n", true},
+		{"yes word", "yes\n", true},
+		{"uppercase", "Y\n", true},
+		{"no", "n\n", false},
+		{"empty line defaults to no", "\n", false},
+		{"eof defaults to no", "", false},
+		{"garbage", "maybe\n", false},
+		{"no trailing newline", "y", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			got, err := confirmPlan(strings.NewReader(tt.input), &out, true, noTTYAbort, 3, 10, 4096, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("confirmPlan(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+			if !strings.Contains(out.String(), "Continue?") {
+				t.Errorf("prompt not printed: %q", out.String())
+			}
+		})
+	}
+}
+
+func TestConfirmPlanPrintsPlan(t *testing.T) {
+	var out bytes.Buffer
+	_, _ = confirmPlan(strings.NewReader("n\n"), &out, true, noTTYAbort, 2, 1500, 1048576, false)
+	for _, want := range []string{"1,500 files", "2 size groups", "1.0 MiB"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("plan %q missing %q", out.String(), want)
+		}
+	}
+}
+
+func TestConfirmPlanNoTTY(t *testing.T) {
+	t.Run("abort", func(t *testing.T) {
+		ok, err := confirmPlan(strings.NewReader("y\n"), &bytes.Buffer{}, false, noTTYAbort, 1, 2, 3, false)
+		if err == nil || ok {
+			t.Errorf("expected refusal without a terminal, got ok=%v err=%v", ok, err)
+		}
+	})
+
+	t.Run("proceed", func(t *testing.T) {
+		var out bytes.Buffer
+		ok, err := confirmPlan(strings.NewReader(""), &out, false, noTTYProceed, 1, 2, 3, false)
+		if err != nil || !ok {
+			t.Errorf("expected to proceed, got ok=%v err=%v", ok, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("no prompt should be printed without a terminal, got %q", out.String())
+		}
+	})
+
+	t.Run("invalid action", func(t *testing.T) {
+		_, err := confirmPlan(strings.NewReader(""), &bytes.Buffer{}, false, "sometimes", 1, 2, 3, false)
+		if err == nil {
+			t.Error("expected error for invalid action")
+		}
+	})
+}
+
+func TestConfirmPlanDeclinedLeavesFilesUntouched(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("duplicate content")
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+	before, _ := os.Stat(b)
+
+	ok, err := confirmPlan(strings.NewReader("n\n"), &bytes.Buffer{}, true, noTTYAbort, 1, 2, int64(len(content)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats *DedupStats
+	if ok {
+		stats = ProcessSizeGroup([]string{a, b}, int64(len(content)), DedupOptions{}, nil)
+	}
+	if stats != nil {
+		t.Fatalf("pass 2 ran after declining: %+v", stats)
+	}
+	after, _ := os.Stat(b)
+	if !os.SameFile(before, after) || !after.ModTime().Equal(before.ModTime()) {
+		t.Error("file was modified after declining")
+	}
+}
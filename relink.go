@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// RelinkStats tracks the results of a --hardlinks-to-reflinks run.
+type RelinkStats struct {
+	Groups    int64 // inodes with more than one link under root
+	Converted int64 // links replaced by an independent reflinked copy
+	Errors    int64
+}
+
+// collectHardlinks walks root and returns the paths of every inode linked
+// more than once under it, each group sorted so that the first path is the
+// one that keeps the inode. Links from outside root are not counted.
+func collectHardlinks(root string, walk WalkOptions) ([][]string, error) {
+	byInode := make(map[inodeKey][]string)
+	err := walkRandom(root, walk, nil, func(path string, _ int64) {
+		ino, nlink, err := fileLinks(path)
+		if err != nil {
+			slog.Debug("cannot stat file", "path", path, "error", err)
+			return
+		}
+		if nlink > 1 {
+			byInode[ino] = append(byInode[ino], path)
+		}
+	})
+	var groups [][]string
+	for _, paths := range byInode {
+		if len(paths) > 1 {
+			slices.Sort(paths)
+			groups = append(groups, paths)
+		}
+	}
+	slices.SortFunc(groups, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	return groups, err
+}
+
+// runRelink turns hard-link sharing into reflink sharing: every link of a
+// group beyond the first is replaced, through dedupFile, by a new inode
+// that reflinks the same data and starts with the same metadata. The files
+// then keep sharing their blocks, but a change to one, or to its mode or
+// times, no longer shows through the others. opts supplies DryRun,
+// FixPerms and VerifyShared. The optional onProgress callback is called
+// with the 1-based index of each group processed.
+func runRelink(groups [][]string, opts DedupOptions, onProgress func(current int)) RelinkStats {
+	var stats RelinkStats
+	for i, paths := range groups {
+		if onProgress != nil {
+			onProgress(i + 1)
+		}
+		stats.Groups++
+		keep := paths[0]
+		// Without extents, dedupFile verifies the copies by content.
+		extents, _ := fileExtents(keep)
+		for _, path := range paths[1:] {
+			if opts.DryRun {
+				fmt.Printf("[dry-run] relink: %s (hard link of %s)\n", path, keep)
+				stats.Converted++
+				continue
+			}
+			if err := dedupFile(keep, path, extents, opts.FixPerms, opts.VerifyShared); err != nil {
+				slog.Warn("cannot replace hard link with a reflink", "path", path, "ref", keep, "error", err)
+				stats.Errors++
+				continue
+			}
+			slog.Debug("replaced hard link with a reflink", "path", path, "ref", keep)
+			stats.Converted++
+		}
+	}
+	return stats
+}
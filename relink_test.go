@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCollectHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	a := createTempFile(t, dir, "a", []byte("linked"))
+	for _, name := range []string{"b", "sub/c"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := os.Link(a, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createTempFile(t, dir, "alone", []byte("linked"))
+	// A link outside the root makes the inode multiply linked, but only
+	// one of its links is under the root.
+	outside := createTempFile(t, t.TempDir(), "x", []byte("other"))
+	if err := os.Link(outside, filepath.Join(dir, "x")); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := collectHardlinks(dir, WalkOptions{MinSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{a, filepath.Join(dir, "b"), filepath.Join(dir, "sub/c")}}
+	if !slices.EqualFunc(groups, want, slices.Equal) {
+		t.Errorf("groups = %v, want %v", groups, want)
+	}
+}
+
+func TestRunRelink(t *testing.T) {
+	dir := t.TempDir()
+	content := randomData(3, 256<<10)
+	a := createTempFile(t, dir, "a", content)
+	b := filepath.Join(dir, "b")
+	c := filepath.Join(dir, "c")
+	for _, p := range []string{b, c} {
+		if err := os.Link(a, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups := [][]string{{a, b, c}}
+
+	if stats := runRelink(groups, DedupOptions{DryRun: true}, nil); stats.Converted != 2 {
+		t.Errorf("dry run converted %d links, want 2", stats.Converted)
+	}
+	if same, _ := sameInode(a, c); !same {
+		t.Fatal("dry run broke a hard link")
+	}
+
+	stats := runRelink(groups, DedupOptions{}, nil)
+	if stats.Errors > 0 {
+		// Without reflinks every link must be left as it was.
+		for _, p := range []string{b, c} {
+			if same, _ := sameInode(a, p); !same {
+				t.Errorf("%s lost its hard link after a failed conversion", p)
+			}
+		}
+		t.Skipf("temp dir does not support reflinks: %d errors", stats.Errors)
+	}
+	if stats.Groups != 1 || stats.Converted != 2 {
+		t.Errorf("stats = %+v, want 1 group, 2 converted", stats)
+	}
+	aExt, err := getExtents(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{b, c} {
+		if same, _ := sameInode(a, p); same {
+			t.Errorf("%s still shares the inode of %s", p, a)
+		}
+		got, err := os.ReadFile(p)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s content changed (%v)", p, err)
+		}
+		if ext, err := getExtents(p); err != nil || !SameExtents(aExt, ext) {
+			t.Errorf("%s does not share the extents of %s (%v)", p, a, err)
+		}
+	}
+	if same, _ := sameInode(b, c); same {
+		t.Error("converted links share one new inode")
+	}
+}
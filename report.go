@@ -12,11 +12,11 @@ import (
 
 // DedupError captures details of a failed dedup attempt for error reporting.
 type DedupError struct {
-	Size    int64
-	Mode    string // "reflink" or "hardlink"
-	Err     string
-	SrcPath string
-	DstPath string
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"` // "reflink" or "hardlink"
+	Err     string `json:"error"`
+	SrcPath string `json:"src_path"`
+	DstPath string `json:"dst_path"`
 }
 
 // pathPattern returns an anonymized representation of a file path,
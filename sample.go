@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+)
+
+// sampler decides per file whether it belongs to a --sample-percent sample.
+type sampler struct {
+	percent float64
+	rng     *rand.Rand
+}
+
+// newSampler returns a sampler keeping roughly percent% of files.
+func newSampler(percent float64, seed uint64) *sampler {
+	return &sampler{percent: percent, rng: rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15))}
+}
+
+// Take reports whether the next file is sampled.
+func (s *sampler) Take() bool {
+	return s.rng.Float64()*100 < s.percent
+}
+
+// SampleSizes walks root like WalkSizes but records only the files chosen by
+// s in sm. onFile, if non-nil, is called for every visited file. It returns
+// the number of files visited and the number sampled.
+func SampleSizes(root string, sm *SizeMap, walk WalkOptions, special *SpecialFiles, s *sampler, onFile func(path string, size int64)) (visited, sampled int64, err error) {
+	err = walkRandom(root, walk, special, func(path string, size int64) {
+		visited++
+		if s.Take() {
+			sm.Add(size)
+			sampled++
+		}
+		if onFile != nil {
+			onFile(path, size)
+		}
+	})
+	return visited, sampled, err
+}
+
+// estimateSavings extrapolates size-collision savings from a sample taken at
+// percent%. A size seen c times in the sample is estimated to occur c/p
+// times in the tree. Sizes seen only once are ignored, since a single hit
+// cannot distinguish a unique file from a duplicated one.
+func estimateSavings(entries []SizeEntry, percent float64) int64 {
+	p := percent / 100
+	var total float64
+	for _, e := range entries {
+		if e.Count < 2 {
+			continue
+		}
+		total += float64(e.Size) * (float64(e.Count)/p - 1)
+	}
+	return int64(total)
+}
+
+// writeSampleEstimate prints the --sample-percent report.
+func writeSampleEstimate(w io.Writer, entries []SizeEntry, visited, sampled int64, percent float64, rawSizes bool) {
+	var sampleSavings int64
+	for _, e := range entries {
+		sampleSavings += e.Savings()
+	}
+	fmt.Fprintf(w, "Sampled %s of %s files (%.1f%% requested)\n",
+		formatCount(sampled), formatCount(visited), percent)
+	fmt.Fprintf(w, "  Size collisions in sample: %s sizes, %s\n",
+		formatCount(int64(len(entries))), formatSize(sampleSavings, rawSizes))
+	fmt.Fprintf(w, "  Estimated dedupable space: %s (extrapolated; an upper bound by size, biased low for rarely duplicated sizes)\n",
+		formatSize(estimateSavings(entries, percent), rawSizes))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSampleSizesFraction(t *testing.T) {
+	dir := t.TempDir()
+	const files = 2000
+	for i := range files {
+		createTempFile(t, dir, fmt.Sprintf("f%04d", i), []byte{byte(i)})
+	}
+
+	for _, percent := range []float64{5, 25, 100} {
+		sm := NewSizeMap(100)
+		visited, sampled, err := SampleSizes(dir, sm, WalkOptions{}, nil, newSampler(percent, 42), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if visited != files {
+			t.Errorf("%.0f%%: visited %d files, want %d", percent, visited, files)
+		}
+		want := files * percent / 100
+		// Binomial standard deviation is at most ~22 files here; allow 4.
+		if d := float64(sampled) - want; d < -90 || d > 90 {
+			t.Errorf("%.0f%%: sampled %d files, want about %.0f", percent, sampled, want)
+		}
+		if got := sm.TopN(1); len(got) != 1 || got[0].Count != sampled {
+			t.Errorf("%.0f%%: size map recorded %v, want count %d", percent, got, sampled)
+		}
+	}
+}
+
+func TestEstimateSavings(t *testing.T) {
+	entries := []SizeEntry{
+		{Size: 1000, Count: 10}, // ~100 copies in the tree
+		{Size: 500, Count: 2},   // ~20 copies
+		{Size: 7, Count: 1},     // ignored
+	}
+	got := estimateSavings(entries, 10)
+	want := int64(1000*99 + 500*19)
+	if got != want {
+		t.Errorf("estimateSavings = %d, want %d", got, want)
+	}
+	if full := estimateSavings(entries[:2], 100); full != 1000*9+500 {
+		t.Errorf("estimateSavings at 100%% = %d, want exact savings %d", full, 1000*9+500)
+	}
+}
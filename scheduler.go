@@ -0,0 +1,62 @@
+package main
+
+import "sync"
+
+// deviceScheduler runs tasks with a separate bounded worker pool per device,
+// so a slow or busy disk cannot starve work destined for another one. Tasks
+// for the same device run in submission order, at most perDevice at a time.
+type deviceScheduler struct {
+	perDevice int
+
+	mu      sync.Mutex
+	queues  map[uint64][]func()
+	running map[uint64]int
+	wg      sync.WaitGroup
+}
+
+// newDeviceScheduler returns a scheduler running up to perDevice tasks
+// concurrently on each device.
+func newDeviceScheduler(perDevice int) *deviceScheduler {
+	return &deviceScheduler{
+		perDevice: max(perDevice, 1),
+		queues:    make(map[uint64][]func()),
+		running:   make(map[uint64]int),
+	}
+}
+
+// Submit queues fn to run on dev's pool and returns without waiting.
+func (s *deviceScheduler) Submit(dev uint64, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues[dev] = append(s.queues[dev], fn)
+	if s.running[dev] < s.perDevice {
+		s.running[dev]++
+		s.wg.Add(1)
+		go s.worker(dev)
+	}
+}
+
+// worker drains dev's queue, exiting when it is empty.
+func (s *deviceScheduler) worker(dev uint64) {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		q := s.queues[dev]
+		if len(q) == 0 {
+			s.running[dev]--
+			delete(s.queues, dev)
+			s.mu.Unlock()
+			return
+		}
+		fn := q[0]
+		q[0] = nil
+		s.queues[dev] = q[1:]
+		s.mu.Unlock()
+		fn()
+	}
+}
+
+// Wait blocks until every submitted task has finished.
+func (s *deviceScheduler) Wait() {
+	s.wg.Wait()
+}
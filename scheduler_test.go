@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeviceScheduler(t *testing.T) {
+	const perDevice = 2
+	s := newDeviceScheduler(perDevice)
+
+	var mu sync.Mutex
+	active := map[uint64]int{}
+	peak := map[uint64]int{}
+	var overlap atomic.Bool // both devices busy at once
+	var done atomic.Int64
+
+	for i := range 20 {
+		dev := uint64(i % 2)
+		s.Submit(dev, func() {
+			mu.Lock()
+			active[dev]++
+			peak[dev] = max(peak[dev], active[dev])
+			if active[0] > 0 && active[1] > 0 {
+				overlap.Store(true)
+			}
+			mu.Unlock()
+
+			time.Sleep(2 * time.Millisecond)
+
+			mu.Lock()
+			active[dev]--
+			mu.Unlock()
+			done.Add(1)
+		})
+	}
+	s.Wait()
+
+	if done.Load() != 20 {
+		t.Fatalf("%d tasks ran, want 20", done.Load())
+	}
+	for dev, p := range peak {
+		if p > perDevice {
+			t.Errorf("device %d ran %d tasks at once, limit %d", dev, p, perDevice)
+		}
+	}
+	if !overlap.Load() {
+		t.Error("devices never ran concurrently")
+	}
+}
+
+func TestDeviceSchedulerOrder(t *testing.T) {
+	s := newDeviceScheduler(1)
+	var got []int
+	for i := range 10 {
+		s.Submit(7, func() { got = append(got, i) })
+	}
+	s.Wait()
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("single-worker device ran tasks out of order: %v", got)
+		}
+	}
+}
+
+func TestDeviceSchedulerReuse(t *testing.T) {
+	s := newDeviceScheduler(1)
+	var n atomic.Int64
+	s.Submit(1, func() { n.Add(1) })
+	s.Wait()
+	// A device whose pool drained must start a new worker.
+	s.Submit(1, func() { n.Add(1) })
+	s.Wait()
+	if n.Load() != 2 {
+		t.Errorf("ran %d tasks, want 2", n.Load())
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DedupScript writes the dedups found by a dry run as a reviewable shell
+// script of cp --reflink commands. A nil *DedupScript writes nothing.
+type DedupScript struct {
+	mu  sync.Mutex
+	out io.Writer
+	n   int64
+	err error
+}
+
+// NewDedupScript writes the script header to out and returns a script
+// writer for it.
+func NewDedupScript(out io.Writer, root string) (*DedupScript, error) {
+	_, err := fmt.Fprintf(out, "#!/bin/sh\n# Reflink dedup commands found by fastdedup --dry-run in %s.\n# Review before running: each line overwrites dst with a reflink of ref.\nset -e\n\n",
+		strings.ReplaceAll(root, "\n", " "))
+	if err != nil {
+		return nil, err
+	}
+	return &DedupScript{out: out}, nil
+}
+
+// Record appends the command that replaces dst with a reflink of ref.
+// Write errors are kept and reported by Err.
+func (s *DedupScript) Record(dst, ref string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	_, s.err = fmt.Fprintf(s.out, "cp --reflink=always --preserve=all -- %s %s\n", shellQuote(ref), shellQuote(dst))
+	s.n++
+}
+
+// Err returns the first write error, if any, and the number of commands
+// written.
+func (s *DedupScript) Err() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n, s.err
+}
+
+// shellQuote quotes s for POSIX sh by wrapping it in single quotes, which
+// disable every special character except the single quote itself.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
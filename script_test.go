@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"/plain/path", `'/plain/path'`},
+		{"with space", `'with space'`},
+		{"it's", `'it'\''s'`},
+		{"$HOME `x` \"q\"", `'$HOME ` + "`x`" + ` "q"'`},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDedupScript(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	content := []byte("duplicate content")
+	ref := createTempFile(t, dir, "ref", content)
+	dst := createTempFile(t, dir, "it's a copy", content)
+
+	var buf bytes.Buffer
+	script, err := NewDedupScript(&buf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := ProcessSizeGroup([]string{ref, dst}, int64(len(content)), DedupOptions{DryRun: true, Script: script}, nil)
+	if stats.FilesDeduped != 1 {
+		t.Fatalf("FilesDeduped = %d, want 1", stats.FilesDeduped)
+	}
+
+	got := buf.String()
+	if !strings.HasPrefix(got, "#!/bin/sh\n") || !strings.Contains(got, "\nset -e\n") {
+		t.Errorf("missing script header:\n%s", got)
+	}
+	want := "cp --reflink=always --preserve=all -- '" + ref + "' '" + dir + "/it'\\''s a copy'\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("script =\n%s\nwant last line\n%s", got, want)
+	}
+	if n, err := script.Err(); n != 1 || err != nil {
+		t.Errorf("Err() = %d, %v, want 1, nil", n, err)
+	}
+
+	// The script must parse; running it needs a reflink-capable filesystem.
+	path := filepath.Join(t.TempDir(), "dedup.sh")
+	if err := os.WriteFile(path, buf.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("sh", "-n", path).CombinedOutput(); err != nil {
+		t.Errorf("sh -n: %v\n%s", err, out)
+	}
+}
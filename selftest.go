@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// selftestSize is the size of the --selftest files: over one extent's
+// worth of blocks, with a partial last block.
+const selftestSize = 1<<20 + 4097
+
+// selftestMode and selftestMtime are given to the file --selftest
+// replaces, so the check can tell its metadata survived.
+var (
+	selftestMode  os.FileMode = 0640
+	selftestMtime             = time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+)
+
+// runSelftest dedups one of two identical files it creates in a temporary
+// directory under dir against the other, as a run would, then checks they
+// share extents, are byte-identical and that the replaced file kept its
+// mode and mtime. It writes one PASS or FAIL line per step to w, stops at
+// the first failure, removes the files and reports whether all passed.
+func runSelftest(w io.Writer, dir string) bool {
+	say := func(format string, args ...any) {
+		//goland:noinspection GoUnhandledErrorResult
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+	say("Self-test in %s", dir)
+	check := func(step string, err error) bool {
+		if err != nil {
+			say("  FAIL %s: %v", step, err)
+			say("FAIL: reflink dedup does not work here")
+			return false
+		}
+		say("  PASS %s", step)
+		return true
+	}
+
+	tmp, err := os.MkdirTemp(dir, ".fastdedup-selftest-")
+	if !check("create temporary directory", err) {
+		return false
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "ref")
+	dst := filepath.Join(tmp, "copy")
+	if !check("write two identical files", writeSelftestFiles(src, dst)) {
+		return false
+	}
+
+	// Without FIEMAP (ZFS), reflinks are verified by content as in a run.
+	srcExtents, err := getExtents(src)
+	if fiemapUnsupported(err) {
+		say("  SKIP read extents: %v; sharing is verified by content only", err)
+		fiemapSupported = false
+	} else if !check("read extents", err) {
+		return false
+	}
+	if !check("reflink, verify and swap in the copy", dedupFile(src, dst, srcExtents, false, true)) {
+		return false
+	}
+
+	if fiemapSupported {
+		dstExtents, err := getExtents(dst)
+		if err == nil && !SameExtents(srcExtents, dstExtents) {
+			err = errors.New("the files do not share extents")
+		}
+		if !check("files share extents", err) {
+			return false
+		}
+	}
+
+	same, err := filesEqual(src, dst)
+	if err == nil && !same {
+		err = errors.New("the files differ")
+	}
+	if !check("files are byte-identical", err) {
+		return false
+	}
+
+	info, err := os.Stat(dst)
+	if err == nil && info.Mode().Perm() != selftestMode {
+		err = fmt.Errorf("mode %v, want %v", info.Mode().Perm(), selftestMode)
+	}
+	if err == nil && !info.ModTime().Equal(selftestMtime) {
+		err = fmt.Errorf("mtime %v, want %v", info.ModTime(), selftestMtime)
+	}
+	if !check("metadata preserved", err) {
+		return false
+	}
+
+	say("PASS")
+	return true
+}
+
+// writeSelftestFiles writes the same non-sparse content to src and dst,
+// and gives dst selftestMode and selftestMtime.
+func writeSelftestFiles(src, dst string) error {
+	data := make([]byte, selftestSize)
+	for i := range data {
+		data[i] = byte(i*31 + i>>12)
+	}
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, selftestMode); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, selftestMtime, selftestMtime)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunSelftest(t *testing.T) {
+	dir := t.TempDir()
+	probe := createTempFile(t, dir, "probe", []byte("probe"))
+	canReflink := reflinkCopy(probe, probe+".clone", 0644) == nil
+	for _, p := range []string{probe, probe + ".clone"} {
+		os.Remove(p)
+	}
+
+	var out bytes.Buffer
+	passed := runSelftest(&out, dir)
+	t.Logf("output:\n%s", out.String())
+	if canReflink {
+		if !passed || !strings.HasSuffix(out.String(), "\nPASS\n") {
+			t.Error("self-test failed on a filesystem with reflinks")
+		}
+	} else if passed || !strings.Contains(out.String(), "  FAIL reflink") {
+		t.Error("self-test did not fail clearly without reflinks")
+	}
+
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	hidden, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(left)+len(hidden) > 0 {
+		t.Errorf("self-test left %v %v behind", left, hidden)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// SharedBytesReport is the --shared-bytes-report output: for each file,
+// how many of its extent bytes are shared with other files and how many
+// it owns alone, followed by the totals. Exclusive bytes are the physical
+// space deleting the file would free, which is what chargeback on a shared
+// volume needs. Each inode is counted once, under its first path.
+type SharedBytesReport struct {
+	w    io.Writer
+	raw  bool
+	seen map[inodeKey]bool
+
+	Files     int64
+	Shared    uint64
+	Exclusive uint64
+	Errors    int64 // files whose extents could not be read
+}
+
+// NewSharedBytesReport returns a report writing one line per file to w,
+// with sizes as formatSize shows them.
+func NewSharedBytesReport(w io.Writer, raw bool) *SharedBytesReport {
+	return &SharedBytesReport{w: w, raw: raw, seen: make(map[inodeKey]bool)}
+}
+
+// Add reads the extents of path and writes its line. Further links to an
+// inode already reported are skipped. It fails only when FIEMAP is not
+// supported at all, since then no file can be reported.
+func (r *SharedBytesReport) Add(path string) error {
+	if ino, err := fileInode(path); err == nil {
+		if r.seen[ino] {
+			return nil
+		}
+		r.seen[ino] = true
+	}
+	extents, err := getExtents(path)
+	if fiemapUnsupported(err) {
+		return err
+	}
+	if err != nil {
+		slog.Debug("cannot read extents for shared bytes report", "path", path, "error", err)
+		r.Errors++
+		return nil
+	}
+	shared, exclusive := sharedBytes(extents)
+	r.Files++
+	r.Shared += shared
+	r.Exclusive += exclusive
+	//goland:noinspection GoUnhandledErrorResult
+	fmt.Fprintf(r.w, "%s\t%s\t%s\n", formatSize(int64(shared), r.raw), formatSize(int64(exclusive), r.raw), path)
+	return nil
+}
+
+// WriteSummary writes the totals over every file added.
+func (r *SharedBytesReport) WriteSummary(w io.Writer) {
+	var pct float64
+	if total := r.Shared + r.Exclusive; total > 0 {
+		pct = float64(r.Shared) * 100 / float64(total)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	fmt.Fprintf(w, "Shared bytes: %s shared, %s exclusive in %s files (%.1f%% shared)\n",
+		formatSize(int64(r.Shared), r.raw), formatSize(int64(r.Exclusive), r.raw), formatCount(r.Files), pct)
+	if r.Errors > 0 {
+		//goland:noinspection GoUnhandledErrorResult
+		fmt.Fprintf(w, "  %s files skipped: extents unreadable (see -v)\n", formatCount(r.Errors))
+	}
+}
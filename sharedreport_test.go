@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSharedBytes(t *testing.T) {
+	tests := []struct {
+		name              string
+		extents           []Extent
+		shared, exclusive uint64
+	}{
+		{"no extents", nil, 0, 0},
+		{"exclusive", []Extent{{Length: 4096}, {Length: 8192}}, 0, 12288},
+		{"shared", []Extent{{Length: 4096, Flags: extentFlagShared}}, 4096, 0},
+		{"partially shared", []Extent{
+			{Logical: 0, Length: 1 << 20, Flags: extentFlagShared},
+			{Logical: 1 << 20, Length: 64 << 10},
+			{Logical: 1<<20 + 64<<10, Length: 128 << 10, Flags: extentFlagShared | extentFlagEncoded},
+			{Logical: 1<<20 + 192<<10, Length: 4096},
+		}, 1<<20 + 128<<10, 64<<10 + 4096},
+	}
+	for _, tt := range tests {
+		shared, exclusive := sharedBytes(tt.extents)
+		if shared != tt.shared || exclusive != tt.exclusive {
+			t.Errorf("%s: sharedBytes = %d, %d; want %d, %d", tt.name, shared, exclusive, tt.shared, tt.exclusive)
+		}
+	}
+}
+
+func TestSharedBytesReport(t *testing.T) {
+	dir := t.TempDir()
+	a := createTempFile(t, dir, "a", bytes.Repeat([]byte("a"), 64<<10))
+	createTempFile(t, dir, "b", bytes.Repeat([]byte("b"), 8<<10))
+	if err := os.Link(a, filepath.Join(dir, "a-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, summary bytes.Buffer
+	r := NewSharedBytesReport(&out, true)
+	for _, name := range []string{"a", "a-link", "b"} {
+		if err := r.Add(filepath.Join(dir, name)); fiemapUnsupported(err) {
+			t.Skipf("FIEMAP unsupported here: %v", err)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Files != 2 || r.Errors != 0 {
+		t.Errorf("%d files, %d errors; want the hard link counted once", r.Files, r.Errors)
+	}
+	if r.Shared != 0 || r.Exclusive < 72<<10 {
+		t.Errorf("%d shared, %d exclusive; want fresh files all exclusive", r.Shared, r.Exclusive)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[0], "\t"+a) {
+		t.Errorf("report lines = %q", lines)
+	}
+	r.WriteSummary(&summary)
+	if !strings.Contains(summary.String(), "(0.0% shared)") {
+		t.Errorf("summary = %q", summary.String())
+	}
+}
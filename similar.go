@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif" // register decoders for imageHash
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"math/bits"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// imageExts are the file name extensions --similar-images decodes.
+var imageExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+// isImagePath reports whether path has one of imageExts, in any case.
+func isImagePath(path string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// maxImagePixels caps the images --similar-images decodes. Decoding holds
+// every pixel in memory, up to 4 bytes each, so a huge or crafted image
+// could otherwise exhaust memory; larger ones are skipped after reading
+// only their header.
+var maxImagePixels = 64_000_000
+
+// Distances between image hashes, in differing bits of 64.
+const (
+	defaultSimilarDistance = 6
+	maxSimilarDistance     = 16
+)
+
+// imageHash returns the difference hash (dHash) of an image: it is shrunk
+// to 9×8 cells of average luminance, and each bit says whether a cell is
+// brighter than its right neighbour. Re-encodes, resizes and small edits
+// change few bits, so similar images have hashes a short Hamming distance
+// apart, while their bytes may have nothing in common.
+func imageHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	var sum [h][w]uint64
+	var n [h][w]uint64
+	b := img.Bounds()
+	dx, dy := b.Dx(), b.Dy()
+	if dx == 0 || dy == 0 {
+		return 0
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * h / dy
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * w / dx
+			r, g, bl, _ := img.At(x, y).RGBA()
+			sum[cy][cx] += (299*uint64(r) + 587*uint64(g) + 114*uint64(bl)) / 1000
+			n[cy][cx]++
+		}
+	}
+	var hash uint64
+	for y := range h {
+		for x := range w - 1 {
+			// Narrow images leave some cells empty; they count as black.
+			var left, right uint64
+			if n[y][x] > 0 {
+				left = sum[y][x] / n[y][x]
+			}
+			if n[y][x+1] > 0 {
+				right = sum[y][x+1] / n[y][x+1]
+			}
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hashDistance returns how many bits two image hashes differ in.
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// hashedImage is an image file and its imageHash.
+type hashedImage struct {
+	path string
+	hash uint64
+}
+
+// similarCluster is a set of images whose hashes are linked by distances
+// of at most the threshold. Distances are to the first member.
+type similarCluster struct {
+	Paths     []string
+	Distances []int
+}
+
+// clusterSimilar groups images that are within maxDist of each other,
+// directly or through other members (single linkage). Images similar to
+// none are left out. Every pair is compared, so this takes quadratic time
+// in the number of images, which is small next to decoding them.
+func clusterSimilar(images []hashedImage, maxDist int) []similarCluster {
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if hashDistance(images[i].hash, images[j].hash) <= maxDist {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := make(map[int][]hashedImage)
+	for i, img := range images {
+		members[find(i)] = append(members[find(i)], img)
+	}
+	var clusters []similarCluster
+	for _, m := range members {
+		if len(m) < 2 {
+			continue
+		}
+		slices.SortFunc(m, func(a, b hashedImage) int { return strings.Compare(a.path, b.path) })
+		var c similarCluster
+		for _, img := range m {
+			c.Paths = append(c.Paths, img.path)
+			c.Distances = append(c.Distances, hashDistance(m[0].hash, img.hash))
+		}
+		clusters = append(clusters, c)
+	}
+	slices.SortFunc(clusters, func(a, b similarCluster) int { return strings.Compare(a.Paths[0], b.Paths[0]) })
+	return clusters
+}
+
+// SimilarImagesReport is the --similar-images output: clusters of images
+// that look alike without being byte-equal, for manual review. Nothing is
+// deduped, since such files cannot share storage.
+type SimilarImagesReport struct {
+	images []hashedImage
+
+	Skipped int64 // image files that could not be decoded
+}
+
+// Add decodes the image at path and records its hash. Files that are not
+// images by name are ignored; images over maxImagePixels are skipped.
+func (r *SimilarImagesReport) Add(path string) {
+	if !isImagePath(path) {
+		return
+	}
+	f, err := openNoATime(path)
+	if err != nil {
+		slog.Debug("cannot open image", "path", path, "error", err)
+		r.Skipped++
+		return
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		slog.Debug("cannot decode image", "path", path, "error", err)
+		r.Skipped++
+		return
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(maxImagePixels) {
+		slog.Debug("image too large to decode", "path", path, "width", cfg.Width, "height", cfg.Height)
+		r.Skipped++
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		slog.Debug("cannot read image", "path", path, "error", err)
+		r.Skipped++
+		return
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		slog.Debug("cannot decode image", "path", path, "error", err)
+		r.Skipped++
+		return
+	}
+	r.images = append(r.images, hashedImage{path: path, hash: imageHash(img)})
+}
+
+// Write clusters the images added and writes each cluster to w, with
+// each member's distance from the first. It returns the clusters.
+func (r *SimilarImagesReport) Write(w io.Writer, maxDist int) []similarCluster {
+	clusters := clusterSimilar(r.images, maxDist)
+	for _, c := range clusters {
+		//goland:noinspection GoUnhandledErrorResult
+		fmt.Fprintf(w, "%d similar images:\n", len(c.Paths))
+		for i, p := range c.Paths {
+			if i == 0 {
+				//goland:noinspection GoUnhandledErrorResult
+				fmt.Fprintf(w, "  %s\n", p)
+			} else {
+				//goland:noinspection GoUnhandledErrorResult
+				fmt.Fprintf(w, "  %s (distance %d)\n", p, c.Distances[i])
+			}
+		}
+	}
+	return clusters
+}
+
+// WriteSummary writes the totals of a report whose clusters Write found.
+func (r *SimilarImagesReport) WriteSummary(w io.Writer, clusters []similarCluster) {
+	var similar int
+	for _, c := range clusters {
+		similar += len(c.Paths)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	fmt.Fprintf(w, "Similar images: %s of %s images in %s clusters\n",
+		formatCount(int64(similar)), formatCount(int64(len(r.images))), formatCount(int64(len(clusters))))
+	if r.Skipped > 0 {
+		//goland:noinspection GoUnhandledErrorResult
+		fmt.Fprintf(w, "  %s images skipped: unreadable, not decodable or over %d megapixels (see -v)\n", formatCount(r.Skipped), maxImagePixels/1_000_000)
+	}
+}
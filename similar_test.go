@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testImage draws a w×h picture of soft blobs; seed picks their layout.
+func testImage(w, h int, seed uint64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	cx := []float64{float64(seed%5+1) / 7, float64(seed%3+2) / 6, float64(seed%7+1) / 9}
+	cy := []float64{float64(seed%4+1) / 6, float64(seed%5+3) / 9, float64(seed%2+1) / 4}
+	for y := range h {
+		for x := range w {
+			var v float64
+			for i := range cx {
+				dx, dy := float64(x)/float64(w)-cx[i], float64(y)/float64(h)-cy[i]
+				v += 1 / (1 + 40*(dx*dx+dy*dy))
+			}
+			c := uint8(min(v*110, 255))
+			img.Set(x, y, color.RGBA{c, c / 2, 255 - c, 255})
+		}
+	}
+	return img
+}
+
+// shrink returns img scaled down by an integer factor.
+func shrink(img image.Image, factor int) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx()/factor, b.Dy()/factor))
+	for y := range out.Bounds().Dy() {
+		for x := range out.Bounds().Dx() {
+			out.Set(x, y, img.At(x*factor, y*factor))
+		}
+	}
+	return out
+}
+
+func writeImage(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	if filepath.Ext(path) == ".png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 40})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageHash(t *testing.T) {
+	orig := testImage(320, 240, 1)
+	if d := hashDistance(imageHash(orig), imageHash(shrink(orig, 4))); d > defaultSimilarDistance {
+		t.Errorf("thumbnail is %d bits from its original", d)
+	}
+	if d := hashDistance(imageHash(orig), imageHash(testImage(320, 240, 4))); d <= defaultSimilarDistance {
+		t.Errorf("a different picture is only %d bits away", d)
+	}
+	if imageHash(image.NewGray(image.Rect(0, 0, 0, 0))) != 0 {
+		t.Error("empty image has a nonzero hash")
+	}
+}
+
+func TestSimilarImagesReport(t *testing.T) {
+	dir := t.TempDir()
+	orig := testImage(320, 240, 1)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	writeImage(t, path("a.png"), orig)
+	writeImage(t, path("a-reencoded.jpg"), orig)
+	writeImage(t, path("a-thumb.JPEG"), shrink(orig, 4))
+	writeImage(t, path("b.png"), testImage(320, 240, 4))
+	if err := os.WriteFile(path("broken.png"), []byte("not a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path("notes.txt"), []byte("text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &SimilarImagesReport{}
+	for _, name := range []string{"a.png", "a-reencoded.jpg", "a-thumb.JPEG", "b.png", "broken.png", "notes.txt"} {
+		r.Add(path(name))
+	}
+	if r.Skipped != 1 {
+		t.Errorf("skipped %d files, want the broken image", r.Skipped)
+	}
+
+	// Images over the pixel cap are skipped from their header alone.
+	defer func(orig int) { maxImagePixels = orig }(maxImagePixels)
+	maxImagePixels = 320*240 - 1
+	big := &SimilarImagesReport{}
+	big.Add(path("a.png"))
+	big.Add(path("a-thumb.JPEG"))
+	if big.Skipped != 1 || len(big.images) != 1 || big.images[0].path != path("a-thumb.JPEG") {
+		t.Errorf("with a cap below 320x240: skipped %d, kept %v; want only the thumbnail kept", big.Skipped, big.images)
+	}
+	var out bytes.Buffer
+	clusters := r.Write(&out, defaultSimilarDistance)
+	t.Logf("report:\n%s", out.String())
+	want := []string{path("a-reencoded.jpg"), path("a-thumb.JPEG"), path("a.png")}
+	if len(clusters) != 1 || !slices.Equal(clusters[0].Paths, want) {
+		t.Fatalf("clusters = %+v, want one of %v", clusters, want)
+	}
+	if clusters[0].Distances[0] != 0 {
+		t.Errorf("first member's distance = %d, want 0", clusters[0].Distances[0])
+	}
+
+	// With no tolerance, only identical hashes cluster.
+	for _, c := range r.Write(&bytes.Buffer{}, 0) {
+		if slices.Max(c.Distances) != 0 {
+			t.Errorf("distance 0 clustered %v at %v", c.Paths, c.Distances)
+		}
+	}
+}
+
+func TestClusterSimilar(t *testing.T) {
+	// a–b and b–c are close, a–c is not: single linkage joins all three.
+	images := []hashedImage{
+		{"c", 0b111100}, {"a", 0}, {"far", ^uint64(0)}, {"b", 0b11},
+	}
+	clusters := clusterSimilar(images, 4)
+	if len(clusters) != 1 || !slices.Equal(clusters[0].Paths, []string{"a", "b", "c"}) ||
+		!slices.Equal(clusters[0].Distances, []int{0, 2, 4}) {
+		t.Errorf("clusters = %+v", clusters)
+	}
+	if got := clusterSimilar(images, 1); len(got) != 0 {
+		t.Errorf("distance 1: clusters = %+v, want none", got)
+	}
+}
@@ -1,11 +1,26 @@
 package main
 
-import "sort"
+import (
+	"encoding/json"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
 
 // SizeEntry holds a file size and how many times it was encountered.
 type SizeEntry struct {
-	Size  int64
-	Count int64
+	Size  int64 `json:"size"`
+	Count int64 `json:"count"`
+}
+
+// MarshalJSON includes the derived savings alongside size and count.
+func (e SizeEntry) MarshalJSON() ([]byte, error) {
+	type plain SizeEntry
+	return json.Marshal(struct {
+		plain
+		Savings int64 `json:"savings"`
+	}{plain(e), e.Savings()})
 }
 
 // Savings returns the potential space savings: size * (count - 1).
@@ -13,42 +28,238 @@ func (e SizeEntry) Savings() int64 {
 	return e.Size * (e.Count - 1)
 }
 
-// SizeMap is a bounded map from file size to occurrence count.
-// When capacity is exceeded, the least impactful entries (lowest size*count)
-// are evicted in batches of 10% to amortize the cost.
+// SizeMap is a bounded map from file size to occurrence count, safe for
+// concurrent use. Sizes are spread over independently locked shards so
+// parallel walkers rarely contend. When a shard exceeds its share of the
+// capacity, its least impactful entries (lowest size*count) are evicted in
+// batches of 10% to amortize the cost, so the global cap is honored
+// approximately: the total never exceeds it, but an entry may be evicted
+// while a slightly less impactful one survives in another shard.
 type SizeMap struct {
+	shards []sizeShard
+	shift  uint // 64 - log2(len(shards)), for shardFor
+
+	maxSize  atomic.Int64 // total capacity; Shrink lowers it
+	pressure func() bool  // reports memory pressure; see SetPressure
+	shrinkMu sync.Mutex
+	shrinks  atomic.Int64
+}
+
+type sizeShard struct {
+	mu      sync.Mutex
 	m       map[int64]int64
 	maxSize int
+	evicted SizeEvictions // over the initial capacity
+	shrunk  SizeEvictions // by Shrink, or over a capacity Shrink lowered
+	lowered bool          // Shrink has lowered maxSize
+	_       [16]byte      // keep shards on separate cache lines
+}
+
+// SizeEvictions counts the entries a SizeMap has evicted. A size evicted,
+// seen again and evicted again is counted twice, and its count restarts in
+// between, so the totals are approximate.
+type SizeEvictions struct {
+	Sizes      int64 // entries evicted
+	Duplicated int64 // evicted entries seen at least twice, i.e. lost duplicates
+	Savings    int64 // potential savings of the evicted entries
 }
 
+const (
+	// minShrinkSize is the smallest capacity Shrink reduces a SizeMap to.
+	minShrinkSize = 1024
+	// maxSizeShards caps the shard count; minShardSize keeps small maps in
+	// one shard, where eviction is exact.
+	maxSizeShards = 16
+	minShardSize  = 4096
+)
+
 // NewSizeMap creates a SizeMap that holds at most maxSize unique entries.
 func NewSizeMap(maxSize int) *SizeMap {
-	return &SizeMap{
-		m:       make(map[int64]int64, maxSize),
-		maxSize: maxSize,
+	n := 1
+	for n < maxSizeShards && maxSize/(n*2) >= minShardSize {
+		n *= 2
+	}
+	return newSizeMapShards(maxSize, n)
+}
+
+// newSizeMapShards creates a SizeMap with n shards; n must be a power of two.
+func newSizeMapShards(maxSize, n int) *SizeMap {
+	sm := &SizeMap{
+		shards: make([]sizeShard, n),
+		shift:  uint(64 - bits.TrailingZeros(uint(n))),
+	}
+	sm.maxSize.Store(int64(maxSize))
+	per := shardCap(maxSize, n)
+	for i := range sm.shards {
+		sm.shards[i].m = make(map[int64]int64, per)
+		sm.shards[i].maxSize = per
 	}
+	return sm
+}
+
+// shardCap splits a total capacity across n shards without exceeding it.
+func shardCap(total, n int) int {
+	return max(total/n, 1)
+}
+
+// shardFor picks the shard for size. File sizes are often multiples of a
+// block size, so the low bits alone would crowd a few shards; a
+// multiplicative hash spreads them.
+func (sm *SizeMap) shardFor(size int64) *sizeShard {
+	return &sm.shards[(uint64(size)*0x9E3779B97F4A7C15)>>sm.shift]
 }
 
 // Add records one occurrence of a file with the given size.
 func (sm *SizeMap) Add(size int64) {
-	sm.m[size]++
-	if len(sm.m) > sm.maxSize {
-		sm.evict()
+	if sm.pressure != nil && sm.pressure() {
+		sm.Shrink()
+	}
+	sh := sm.shardFor(size)
+	sh.mu.Lock()
+	sh.m[size]++
+	if len(sh.m) > sh.maxSize {
+		sh.evict()
+	}
+	sh.mu.Unlock()
+}
+
+// Counts returns a copy of every size tracked and its count.
+func (sm *SizeMap) Counts() map[int64]int64 {
+	counts := make(map[int64]int64, sm.Len())
+	for i := range sm.shards {
+		sh := &sm.shards[i]
+		sh.mu.Lock()
+		for size, count := range sh.m {
+			counts[size] = count
+		}
+		sh.mu.Unlock()
+	}
+	return counts
+}
+
+// Merge adds counts to the map, as if each size had been added count times.
+// Entries over capacity are evicted as for Add.
+func (sm *SizeMap) Merge(counts map[int64]int64) {
+	for size, count := range counts {
+		if count <= 0 {
+			continue
+		}
+		sh := sm.shardFor(size)
+		sh.mu.Lock()
+		sh.m[size] += count
+		if len(sh.m) > sh.maxSize {
+			sh.evict()
+		}
+		sh.mu.Unlock()
 	}
 }
 
+// SetPressure installs a check, called on every Add from the goroutine
+// doing the adding, that reports whether memory is running short. Each time
+// it returns true the map shrinks. It must be cheap and safe for concurrent
+// use, e.g. an atomic load. Call it before adding from several goroutines.
+func (sm *SizeMap) SetPressure(pressure func() bool) {
+	sm.pressure = pressure
+}
+
+// Shrink halves the capacity (down to minShrinkSize), evicts the least
+// impactful entries to fit, and rebuilds the shards so the memory of
+// evicted entries can be reclaimed.
+func (sm *SizeMap) Shrink() {
+	sm.shrinkMu.Lock()
+	defer sm.shrinkMu.Unlock()
+	maxSize := int(sm.maxSize.Load())
+	target := max(min(maxSize, sm.Len())/2, minShrinkSize)
+	if target >= maxSize {
+		return
+	}
+	sm.maxSize.Store(int64(target))
+	sm.shrinks.Add(1)
+	per := shardCap(target, len(sm.shards))
+	for i := range sm.shards {
+		sh := &sm.shards[i]
+		sh.mu.Lock()
+		sh.maxSize = per
+		sh.lowered = true
+		sh.evictN(len(sh.m)-per, &sh.shrunk)
+		// Deleting from a Go map never releases its buckets.
+		m := make(map[int64]int64, per)
+		for size, count := range sh.m {
+			m[size] = count
+		}
+		sh.m = m
+		sh.mu.Unlock()
+	}
+}
+
+// MaxSize returns the current capacity, which Shrink may have lowered.
+func (sm *SizeMap) MaxSize() int {
+	return int(sm.maxSize.Load())
+}
+
+// Shrinks returns how many times the map has shrunk under memory pressure.
+func (sm *SizeMap) Shrinks() int {
+	return int(sm.shrinks.Load())
+}
+
+// Evictions returns what Add and Merge have evicted to stay within the
+// capacity the map was created with. Many evicted duplicates mean --max-sizes is too small for the
+// tree.
+func (sm *SizeMap) Evictions() SizeEvictions {
+	return sm.sumEvictions(func(sh *sizeShard) *SizeEvictions { return &sh.evicted })
+}
+
+// ShrinkEvictions returns what has been evicted because of memory
+// pressure: by Shrink itself, and by Add and Merge once Shrink had lowered
+// the capacity. These are lost to --max-mem, not --max-sizes.
+func (sm *SizeMap) ShrinkEvictions() SizeEvictions {
+	return sm.sumEvictions(func(sh *sizeShard) *SizeEvictions { return &sh.shrunk })
+}
+
+func (sm *SizeMap) sumEvictions(pick func(*sizeShard) *SizeEvictions) SizeEvictions {
+	var total SizeEvictions
+	for i := range sm.shards {
+		sh := &sm.shards[i]
+		sh.mu.Lock()
+		ev := pick(sh)
+		total.Sizes += ev.Sizes
+		total.Duplicated += ev.Duplicated
+		total.Savings += ev.Savings
+		sh.mu.Unlock()
+	}
+	return total
+}
+
 // Len returns the number of distinct sizes tracked.
 func (sm *SizeMap) Len() int {
-	return len(sm.m)
+	n := 0
+	for i := range sm.shards {
+		sh := &sm.shards[i]
+		sh.mu.Lock()
+		n += len(sh.m)
+		sh.mu.Unlock()
+	}
+	return n
 }
 
 // TopN returns the top n entries with count >= 2, ranked by potential savings descending.
 func (sm *SizeMap) TopN(n int) []SizeEntry {
-	entries := make([]SizeEntry, 0, len(sm.m))
-	for size, count := range sm.m {
-		if count >= 2 {
-			entries = append(entries, SizeEntry{Size: size, Count: count})
+	return sm.TopNMinImpact(n, 0)
+}
+
+// TopNMinImpact is TopN restricted to entries whose potential savings are
+// at least minImpact bytes.
+func (sm *SizeMap) TopNMinImpact(n int, minImpact int64) []SizeEntry {
+	var entries []SizeEntry
+	for i := range sm.shards {
+		sh := &sm.shards[i]
+		sh.mu.Lock()
+		for size, count := range sh.m {
+			if count >= 2 && size*(count-1) >= minImpact {
+				entries = append(entries, SizeEntry{Size: size, Count: count})
+			}
 		}
+		sh.mu.Unlock()
 	}
 
 	sort.Slice(entries, func(i, j int) bool {
@@ -58,27 +269,43 @@ func (sm *SizeMap) TopN(n int) []SizeEntry {
 	return entries[:min(n, len(entries))]
 }
 
-// evict removes the bottom 10% of entries by potential savings.
-func (sm *SizeMap) evict() {
-	evictCount := sm.maxSize / 10
-	if evictCount < 1 {
-		evictCount = 1
+// evict removes the bottom 10% of the shard's entries by potential savings.
+// The caller holds sh.mu.
+func (sh *sizeShard) evict() {
+	into := &sh.evicted
+	if sh.lowered {
+		into = &sh.shrunk
+	}
+	sh.evictN(max(sh.maxSize/10, 1), into)
+}
+
+// evictN removes the evictCount entries with the lowest potential savings,
+// counting them in into. The caller holds sh.mu.
+func (sh *sizeShard) evictN(evictCount int, into *SizeEvictions) {
+	if evictCount <= 0 {
+		return
 	}
 
 	type entry struct {
 		size    int64
+		count   int64
 		savings int64
 	}
-	all := make([]entry, 0, len(sm.m))
-	for size, count := range sm.m {
-		all = append(all, entry{size, size * (count - 1)})
+	all := make([]entry, 0, len(sh.m))
+	for size, count := range sh.m {
+		all = append(all, entry{size, count, size * (count - 1)})
 	}
 
 	sort.Slice(all, func(i, j int) bool {
 		return all[i].savings < all[j].savings
 	})
 
-	for i := range min(evictCount, len(all)) {
-		delete(sm.m, all[i].size)
+	for _, e := range all[:min(evictCount, len(all))] {
+		delete(sh.m, e.size)
+		into.Sizes++
+		if e.count >= 2 {
+			into.Duplicated++
+			into.Savings += e.savings
+		}
 	}
 }
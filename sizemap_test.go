@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSizeMapConcurrentAdd(t *testing.T) {
+	sm := NewSizeMap(1_000_000)
+	if len(sm.shards) != maxSizeShards {
+		t.Fatalf("shards = %d, want %d", len(sm.shards), maxSizeShards)
+	}
+
+	const workers, sizes = 8, 5000
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range sizes {
+				// Every worker adds each size once, in a different order.
+				sm.Add(int64((i+w*sizes/workers)%sizes+1) * 4096)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sm.Len() != sizes {
+		t.Errorf("Len = %d, want %d", sm.Len(), sizes)
+	}
+	top := sm.TopN(sizes)
+	if len(top) != sizes {
+		t.Fatalf("TopN returned %d entries, want %d", len(top), sizes)
+	}
+	for _, e := range top {
+		if e.Count != workers {
+			t.Fatalf("size %d: Count = %d, want %d", e.Size, e.Count, workers)
+		}
+	}
+	if top[0].Size != sizes*4096 {
+		t.Errorf("top size = %d, want %d", top[0].Size, sizes*4096)
+	}
+}
+
+func TestSizeMapShardedCap(t *testing.T) {
+	// Block-aligned sizes must spread over the shards rather than crowd one
+	// and be evicted early.
+	const maxSize = 64 * 1024
+	sm := NewSizeMap(maxSize)
+	for i := range int64(maxSize / 2) {
+		sm.Add((i + 1) * 4096)
+	}
+	if sm.Len() != maxSize/2 {
+		t.Errorf("Len = %d after adding half the capacity, want %d", sm.Len(), maxSize/2)
+	}
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range int64(maxSize) {
+				sm.Add(int64(w+1)<<40 + i)
+			}
+		}()
+	}
+	wg.Wait()
+	if sm.Len() > maxSize {
+		t.Errorf("Len = %d, exceeds cap %d", sm.Len(), maxSize)
+	}
+}
+
+func TestSizeMapSmallIsExact(t *testing.T) {
+	sm := NewSizeMap(100)
+	if len(sm.shards) != 1 {
+		t.Fatalf("shards = %d, want 1 for a small map", len(sm.shards))
+	}
+}
+
+func TestSizeMapTopNMinImpact(t *testing.T) {
+	sm := NewSizeMap(100)
+	add := func(size int64, count int) {
+		for range count {
+			sm.Add(size)
+		}
+	}
+	add(1<<30, 3)    // 2 GiB impact
+	add(100<<20, 12) // 1.07 GiB
+	add(1<<20, 1000) // 999 MiB
+	add(5<<30, 1)    // unique, no impact
+
+	got := sm.TopNMinImpact(sm.Len(), 1<<30)
+	if len(got) != 2 || got[0].Size != 1<<30 || got[1].Size != 100<<20 {
+		t.Errorf("TopNMinImpact(all, 1 GiB) = %+v, want the 1 GiB and 100 MiB sizes", got)
+	}
+	if got := sm.TopNMinImpact(1, 1<<30); len(got) != 1 || got[0].Size != 1<<30 {
+		t.Errorf("TopNMinImpact(1, 1 GiB) = %+v, want only the 1 GiB size", got)
+	}
+	if got := sm.TopN(sm.Len()); len(got) != 3 {
+		t.Errorf("TopN(all) = %+v, want 3 sizes", got)
+	}
+}
+
+func TestSizeMapMergeCapacity(t *testing.T) {
+	sm := NewSizeMap(10)
+	counts := make(map[int64]int64)
+	for i := range int64(20) {
+		counts[1000+i] = i + 1
+	}
+	sm.Merge(counts)
+	if n := sm.Len(); n > 10 {
+		t.Errorf("Len = %d after merging 20 sizes, want at most 10", n)
+	}
+	// The most impactful size survives eviction.
+	if top := sm.TopN(1); len(top) != 1 || top[0].Size != 1019 || top[0].Count != 20 {
+		t.Errorf("TopN(1) = %v, want 1019 x20", top)
+	}
+}
+
+func TestSizeMapEvictions(t *testing.T) {
+	sm := NewSizeMap(10)
+	for i := range int64(5) {
+		sm.Add(1 + i) // unique
+	}
+	for i := range int64(3) {
+		sm.Add(100 + i) // small duplicates
+		sm.Add(100 + i)
+	}
+	if ev := sm.Evictions(); ev != (SizeEvictions{}) {
+		t.Fatalf("Evictions = %+v before the map is full", ev)
+	}
+
+	// Ten more impactful duplicated sizes push out the unique ones first,
+	// then the small duplicates.
+	large := make(map[int64]int64)
+	for i := range int64(10) {
+		large[1<<20+i] = 2
+	}
+	sm.Merge(large)
+	want := SizeEvictions{Sizes: 8, Duplicated: 3, Savings: 100 + 101 + 102}
+	if ev := sm.Evictions(); ev != want {
+		t.Errorf("Evictions = %+v, want %+v", ev, want)
+	}
+	if top := sm.TopN(10); len(top) != 10 || top[9].Size < 1<<20 {
+		t.Errorf("TopN(10) = %v, want the ten large sizes kept", top)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Block group type flags of btrfs space info (linux/btrfs_tree.h).
+const (
+	btrfsBlockGroupData     = 1 << 0
+	btrfsBlockGroupMetadata = 1 << 2
+	btrfsSpaceGlobalRsv     = 1 << 49
+)
+
+// metadataWarnFraction is how full btrfs metadata may get, counting the
+// global reserve as used, before warnMetadataSpace warns.
+const metadataWarnFraction = 0.9
+
+// spaceCheckEvery is how often the metadata check repeats during a run.
+const spaceCheckEvery = 5 * time.Minute
+
+// btrfsSpace is one entry of BTRFS_IOC_SPACE_INFO: the space allocated to
+// block groups of one type and profile, and how much of it is used.
+type btrfsSpace struct {
+	Flags, Total, Used uint64
+}
+
+// parseSpaceInfo decodes the btrfs_ioctl_space_args buffer filled by
+// BTRFS_IOC_SPACE_INFO: two u64 counts, then 24-byte entries.
+func parseSpaceInfo(buf []byte) []btrfsSpace {
+	if len(buf) < 16 {
+		return nil
+	}
+	n := binary.NativeEndian.Uint64(buf[8:])
+	var spaces []btrfsSpace
+	for i := uint64(0); i < n && 16+(i+1)*24 <= uint64(len(buf)); i++ {
+		e := buf[16+i*24:]
+		spaces = append(spaces, btrfsSpace{
+			Flags: binary.NativeEndian.Uint64(e),
+			Total: binary.NativeEndian.Uint64(e[8:]),
+			Used:  binary.NativeEndian.Uint64(e[16:]),
+		})
+	}
+	return spaces
+}
+
+// spaceUsage sums btrfs space info by type.
+type spaceUsage struct {
+	DataTotal, DataUsed uint64
+	MetaTotal, MetaUsed uint64
+	GlobalReserve       uint64
+}
+
+func summarizeSpace(spaces []btrfsSpace) spaceUsage {
+	var u spaceUsage
+	for _, s := range spaces {
+		switch {
+		case s.Flags&btrfsSpaceGlobalRsv != 0:
+			u.GlobalReserve += s.Total
+		case s.Flags&btrfsBlockGroupMetadata != 0:
+			// Mixed block groups hold both and count here.
+			u.MetaTotal += s.Total
+			u.MetaUsed += s.Used
+		case s.Flags&btrfsBlockGroupData != 0:
+			u.DataTotal += s.Total
+			u.DataUsed += s.Used
+		}
+	}
+	return u
+}
+
+// metadataFull returns the fraction of metadata space in use, counting the
+// global reserve, which btrfs keeps back for itself.
+func (u spaceUsage) metadataFull() float64 {
+	if u.MetaTotal == 0 {
+		return 0
+	}
+	return float64(u.MetaUsed+u.GlobalReserve) / float64(u.MetaTotal)
+}
+
+// warning describes nearly full metadata, or returns "" if there is room.
+func (u spaceUsage) warning() string {
+	if u.metadataFull() < metadataWarnFraction {
+		return ""
+	}
+	return fmt.Sprintf("btrfs metadata is %.0f%% full (%s of %s, including %s reserve; data %s free of %s); "+
+		"if no unallocated space is left, reflinks will fail with ENOSPC. Check `btrfs filesystem usage` and consider `btrfs balance start -dusage=50`",
+		100*u.metadataFull(), formatSize(int64(u.MetaUsed+u.GlobalReserve), false), formatSize(int64(u.MetaTotal), false),
+		formatSize(int64(u.GlobalReserve), false), formatSize(int64(u.DataTotal-u.DataUsed), false), formatSize(int64(u.DataTotal), false))
+}
+
+// checkMetadataSpace reads the space info of the btrfs filesystem at path
+// and returns a warning if its metadata is nearly full. It returns "" on
+// other filesystems or if the space info cannot be read.
+func checkMetadataSpace(path string) string {
+	spaces, err := btrfsSpaceInfo(path)
+	if err != nil {
+		slog.Debug("cannot read btrfs space info", "path", path, "error", err)
+		return ""
+	}
+	return summarizeSpace(spaces).warning()
+}
+
+// watchMetadataSpace repeats checkMetadataSpace every interval until the
+// returned stop function is called, logging the first warning it finds.
+func watchMetadataSpace(path string, every time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if w := checkMetadataSpace(path); w != "" {
+					slog.Warn(w)
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
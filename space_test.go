@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestParseSpaceInfo(t *testing.T) {
+	const gib = 1 << 30
+	entries := []btrfsSpace{
+		{Flags: btrfsBlockGroupData, Total: 100 * gib, Used: 40 * gib},
+		{Flags: btrfsBlockGroupData | 1<<4, Total: 20 * gib, Used: 10 * gib}, // RAID1 data
+		{Flags: 1 << 1, Total: 32 << 20, Used: 16 << 10},                     // system
+		{Flags: btrfsBlockGroupMetadata, Total: 2 * gib, Used: 1 * gib},
+		{Flags: btrfsSpaceGlobalRsv, Total: 512 << 20},
+	}
+	buf := make([]byte, 16+24*len(entries))
+	binary.NativeEndian.PutUint64(buf, uint64(len(entries)))
+	binary.NativeEndian.PutUint64(buf[8:], uint64(len(entries)))
+	for i, e := range entries {
+		b := buf[16+24*i:]
+		binary.NativeEndian.PutUint64(b, e.Flags)
+		binary.NativeEndian.PutUint64(b[8:], e.Total)
+		binary.NativeEndian.PutUint64(b[16:], e.Used)
+	}
+
+	spaces := parseSpaceInfo(buf)
+	if len(spaces) != len(entries) {
+		t.Fatalf("parsed %d entries, want %d", len(spaces), len(entries))
+	}
+	for i := range entries {
+		if spaces[i] != entries[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, spaces[i], entries[i])
+		}
+	}
+	if got := parseSpaceInfo(buf[:16+24*2+5]); len(got) != 2 {
+		t.Errorf("truncated buffer: parsed %d entries, want 2", len(got))
+	}
+
+	u := summarizeSpace(spaces)
+	want := spaceUsage{DataTotal: 120 * gib, DataUsed: 50 * gib, MetaTotal: 2 * gib, MetaUsed: 1 * gib, GlobalReserve: 512 << 20}
+	if u != want {
+		t.Errorf("summarizeSpace = %+v, want %+v", u, want)
+	}
+	if w := u.warning(); w != "" {
+		t.Errorf("75%% full metadata: warning %q, want none", w)
+	}
+
+	u.MetaUsed = 1536 << 20 // 2 GiB with the reserve: full
+	w := u.warning()
+	if !strings.Contains(w, "metadata is 100% full") || !strings.Contains(w, "ENOSPC") {
+		t.Errorf("full metadata: warning %q", w)
+	}
+	if (spaceUsage{}).warning() != "" {
+		t.Error("no metadata info should not warn")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// writeSurvey prints the size-collision report for --survey-only: the top
+// sizes by potential savings with their counts, followed by totals over every
+// colliding size. Potential savings assume every file of a size is a
+// duplicate, so they are an upper bound on what pass 2 could reclaim.
+func writeSurvey(w io.Writer, entries []SizeEntry, top int, filesScanned int64, rawSizes bool) {
+	fmtSize := func(b int64) string {
+		return formatSize(b, rawSizes)
+	}
+
+	var collidingFiles, potential int64
+	for _, e := range entries {
+		collidingFiles += e.Count
+		potential += e.Savings()
+	}
+
+	fmt.Fprintf(w, "Size collision survey: %s files scanned, %s sizes with 2+ files\n",
+		formatCount(filesScanned), formatCount(int64(len(entries))))
+	if len(entries) == 0 {
+		return
+	}
+
+	shown := entries[:min(top, len(entries))]
+	fmt.Fprintf(w, "  %4s  %10s  %8s  %10s\n", "#", "Size", "Count", "Savings")
+	for i, e := range shown {
+		fmt.Fprintf(w, "  %4d  %10s  %8s  %10s\n",
+			i+1, fmtSize(e.Size), formatCount(e.Count), fmtSize(e.Savings()))
+	}
+	if len(entries) > len(shown) {
+		fmt.Fprintf(w, "  ... and %s more sizes\n", formatCount(int64(len(entries)-len(shown))))
+	}
+	fmt.Fprintf(w, "Files in colliding sizes: %s\n", formatCount(collidingFiles))
+	fmt.Fprintf(w, "Potential savings:        %s (if every collision is a duplicate)\n", fmtSize(potential))
+}
+
+// growthProjection is what a survey's colliding sizes would hold after the
+// data grows by a factor with the same duplicate distribution: every
+// size's file count scaled by it.
+type growthProjection struct {
+	Factor          float64
+	Bytes, Savings  int64 // in colliding sizes now
+	ProjBytes       int64
+	ProjSavings     int64
+	SavingsFraction float64 // ProjSavings / ProjBytes
+}
+
+// projectGrowth scales the counts of entries by factor. Savings stay an
+// upper bound, size × (count − 1) per size; since every size keeps one
+// reference, they grow slightly faster than the data. Sizes that hold one
+// file now are not in the survey and are assumed to stay unique.
+func projectGrowth(entries []SizeEntry, factor float64) growthProjection {
+	p := growthProjection{Factor: factor}
+	var projBytes, projSavings float64
+	for _, e := range entries {
+		p.Bytes += e.Size * e.Count
+		p.Savings += e.Savings()
+		count := float64(e.Count) * factor
+		projBytes += float64(e.Size) * count
+		projSavings += float64(e.Size) * (count - 1)
+	}
+	p.ProjBytes, p.ProjSavings = int64(projBytes), int64(projSavings)
+	if p.ProjBytes > 0 {
+		p.SavingsFraction = projSavings / projBytes
+	}
+	return p
+}
+
+// Write prints the projection after the survey report.
+func (p growthProjection) Write(w io.Writer, rawSizes bool) {
+	fmt.Fprintf(w, "Projected at %gx growth (same duplicate distribution):\n", p.Factor)
+	fmt.Fprintf(w, "  Data in colliding sizes:  %s (now %s)\n", formatSize(p.ProjBytes, rawSizes), formatSize(p.Bytes, rawSizes))
+	fmt.Fprintf(w, "  Potential savings:        %s (now %s), %.1f%% of that data\n",
+		formatSize(p.ProjSavings, rawSizes), formatSize(p.Savings, rawSizes), 100*p.SavingsFraction)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSurvey(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		createTempFile(t, dir, name, make([]byte, 1000))
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	createTempFile(t, filepath.Join(dir, "sub"), "d", make([]byte, 300))
+	createTempFile(t, dir, "e", make([]byte, 300))
+	createTempFile(t, dir, "unique", make([]byte, 77))
+
+	sm := NewSizeMap(100)
+	files, _, err := WalkSizes(dir, sm, WalkOptions{}, nil, nil, nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	writeSurvey(&out, sm.TopN(sm.Len()), 10, files, true)
+	report := out.String()
+	for _, want := range []string{
+		"6 files scanned, 2 sizes with 2+ files",
+		"1000         3        2000",
+		"300         2         300",
+		"Files in colliding sizes: 5",
+		"Potential savings:        2300",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, " 77 ") {
+		t.Errorf("unique size should not be listed:\n%s", report)
+	}
+
+	t.Run("top limits rows but not totals", func(t *testing.T) {
+		var out bytes.Buffer
+		writeSurvey(&out, sm.TopN(sm.Len()), 1, files, true)
+		if !strings.Contains(out.String(), "... and 1 more sizes") || !strings.Contains(out.String(), "2300") {
+			t.Errorf("unexpected report:\n%s", out.String())
+		}
+	})
+
+	t.Run("no collisions", func(t *testing.T) {
+		var out bytes.Buffer
+		writeSurvey(&out, nil, 10, 3, true)
+		if !strings.Contains(out.String(), "0 sizes with 2+ files") || strings.Contains(out.String(), "Potential") {
+			t.Errorf("unexpected report:\n%s", out.String())
+		}
+	})
+}
+
+func TestProjectGrowth(t *testing.T) {
+	entries := []SizeEntry{{Size: 1000, Count: 3}, {Size: 300, Count: 2}}
+	p := projectGrowth(entries, 2)
+	// Now: 3600 bytes, 2300 saved. At 2x: 1000×6 + 300×4 = 7200 bytes,
+	// 1000×5 + 300×3 = 5900 saved.
+	if p.Bytes != 3600 || p.Savings != 2300 || p.ProjBytes != 7200 || p.ProjSavings != 5900 {
+		t.Errorf("projection = %+v", p)
+	}
+	if p.SavingsFraction < 0.819 || p.SavingsFraction > 0.820 {
+		t.Errorf("savings fraction = %v, want 5900/7200", p.SavingsFraction)
+	}
+	if p := projectGrowth(entries, 1); p.ProjBytes != p.Bytes || p.ProjSavings != p.Savings {
+		t.Errorf("1x projection changed the totals: %+v", p)
+	}
+
+	var out bytes.Buffer
+	projectGrowth(entries, 1.5).Write(&out, true)
+	for _, want := range []string{
+		"Projected at 1.5x growth",
+		"Data in colliding sizes:  5400 (now 3600)",
+		"Potential savings:        4100 (now 2300), 75.9% of that data",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tmpSuffix is appended to a file's path to name the temporary file that
+// dedupFile and hardlinkFile build the replacement in or park the original
+// at. It is set once at startup from --tmp-suffix and read-only afterwards.
+var tmpSuffix = ".dedup-tmp"
+
+// validTmpSuffix reports why s cannot be used as --tmp-suffix. The suffix
+// must keep the temporary file in the same directory as the file it
+// belongs to, since it is renamed over it.
+func validTmpSuffix(s string) error {
+	if s == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if strings.ContainsRune(s, filepath.Separator) {
+		return fmt.Errorf("%q must not contain %q", s, filepath.Separator)
+	}
+	return nil
+}
+
+// TmpCleanStats tracks the results of cleanStaleTmps.
+type TmpCleanStats struct {
+	Restored int64    // renamed back over their missing target
+	Removed  int64    // identical to their target, so deleted
+	Kept     []string // differ from their target or could not be checked
+}
+
+// cleanStaleTmps finds temporary files named with suffix under root, left
+// behind when a run was killed mid-replacement, and resolves each against
+// the file it was made for (its path without the suffix):
+//
+//   - target missing: the temporary file holds the only copy and is renamed
+//     back into place;
+//   - target identical: the temporary file is redundant and removed;
+//   - otherwise it is kept, since either copy may be the one that matters.
+//
+// With dryRun, nothing is changed and the planned actions are printed.
+// Callers must hold the root's lock so no live run's files are touched.
+func cleanStaleTmps(root, suffix string, walk WalkOptions, dryRun bool) (TmpCleanStats, error) {
+	var stats TmpCleanStats
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Debug("skipping unreadable directory", "path", path, "error", err)
+			if d != nil && d.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !walk.IncludeSnapshots && d.Name() == ".snapshots" || walk.Exclude.Has(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || len(name) <= len(suffix) || !strings.HasSuffix(name, suffix) {
+			return nil
+		}
+		target := strings.TrimSuffix(path, suffix)
+
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			if dryRun {
+				fmt.Printf("[dry-run] restore: %s -> %s\n", path, target)
+			} else if err := guard.rename(path, target); err != nil {
+				slog.Debug("cannot restore stale temp file", "path", path, "error", err)
+				stats.Kept = append(stats.Kept, path)
+				return nil
+			}
+			stats.Restored++
+			return nil
+		}
+
+		equal, err := filesEqual(target, path)
+		if err != nil || !equal {
+			slog.Debug("stale temp file differs from its target", "path", path, "target", target, "error", err)
+			stats.Kept = append(stats.Kept, path)
+			return nil
+		}
+		if dryRun {
+			fmt.Printf("[dry-run] remove: %s (same as %s)\n", path, target)
+		} else if err := guard.remove(path); err != nil {
+			slog.Debug("cannot remove stale temp file", "path", path, "error", err)
+			stats.Kept = append(stats.Kept, path)
+			return nil
+		}
+		stats.Removed++
+		return nil
+	})
+	return stats, err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidTmpSuffix(t *testing.T) {
+	for _, s := range []string{".dedup-tmp", "~", ".fastdedup.part"} {
+		if err := validTmpSuffix(s); err != nil {
+			t.Errorf("validTmpSuffix(%q) = %v, want nil", s, err)
+		}
+	}
+	for _, s := range []string{"", "/tmp", "a/b"} {
+		if err := validTmpSuffix(s); err == nil {
+			t.Errorf("validTmpSuffix(%q) = nil, want error", s)
+		}
+	}
+}
+
+func TestCleanStaleTmps(t *testing.T) {
+	const suffix = ".dedup-tmp"
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+		// Target missing: the temp file is the only copy.
+		createTempFile(t, dir, "lost"+suffix, []byte("original"))
+		// Target present and identical.
+		createTempFile(t, dir, "same", []byte("content"))
+		createTempFile(t, dir, "same"+suffix, []byte("content"))
+		// Target present but different.
+		createTempFile(t, dir, "diff", []byte("new data"))
+		createTempFile(t, dir, "diff"+suffix, []byte("old data"))
+		// A file named exactly like the suffix has no target.
+		createTempFile(t, dir, suffix, []byte("x"))
+		return dir
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		dir := setup(t)
+		stats, err := cleanStaleTmps(dir, suffix, WalkOptions{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Restored != 1 || stats.Removed != 1 || len(stats.Kept) != 1 {
+			t.Fatalf("stats = %+v, want 1 restored, 1 removed, 1 kept", stats)
+		}
+		if want := filepath.Join(dir, "diff"+suffix); stats.Kept[0] != want {
+			t.Errorf("kept %q, want %q", stats.Kept[0], want)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "lost")); err != nil || string(data) != "original" {
+			t.Errorf("restored target = %q, %v; want original content", data, err)
+		}
+		for _, name := range []string{"lost" + suffix, "same" + suffix} {
+			if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("%s still exists", name)
+			}
+		}
+		for _, name := range []string{"same", "diff", "diff" + suffix, suffix} {
+			if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dir := setup(t)
+		stats, err := cleanStaleTmps(dir, suffix, WalkOptions{}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Restored != 1 || stats.Removed != 1 || len(stats.Kept) != 1 {
+			t.Fatalf("stats = %+v, want 1 restored, 1 removed, 1 kept", stats)
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "lost")); !os.IsNotExist(err) {
+			t.Error("dry run restored a file")
+		}
+		if _, err := os.Lstat(filepath.Join(dir, "same"+suffix)); err != nil {
+			t.Errorf("dry run removed a file: %v", err)
+		}
+	})
+
+	t.Run("custom suffix", func(t *testing.T) {
+		dir := setup(t)
+		stats, err := cleanStaleTmps(dir, ".other", WalkOptions{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Restored != 0 || stats.Removed != 0 || len(stats.Kept) != 0 {
+			t.Errorf("stats = %+v, want nothing matched", stats)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// How a file in a content group stores its data, for --topology.
+const (
+	topoCopy     = "copy"     // storage of its own: the first file, or an independent duplicate
+	topoHardlink = "hardlink" // same inode as an earlier file
+	topoReflink  = "reflink"  // own inode, same extents as an earlier file
+)
+
+// topoFile is what the topology classification knows about one file.
+type topoFile struct {
+	path    string
+	ino     inodeKey
+	hasIno  bool
+	extents []Extent
+}
+
+// topoMember is a file of a topologyGroup and how it shares storage. Of is
+// the earlier file it shares with, empty for a copy.
+type topoMember struct {
+	Path string
+	Kind string
+	Of   string
+}
+
+// topologyGroup is one content group: files of one size with identical
+// content, in walk order.
+type topologyGroup struct {
+	Size    int64
+	Members []topoMember
+}
+
+// count returns how many members are of the given kind.
+func (g topologyGroup) count(kind string) int64 {
+	var n int64
+	for _, m := range g.Members {
+		if m.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// Reclaimable returns the bytes deduplicating the group would free: all
+// but one copy.
+func (g topologyGroup) Reclaimable() int64 {
+	return (g.count(topoCopy) - 1) * g.Size
+}
+
+// classifyTopology splits same-size files into content groups and
+// classifies each file by how it shares storage with the files before it:
+// a hard link shares the inode, a reflink shares all extents, and anything
+// else is a copy, with content compared by equal. Sharing is detected
+// before content is compared, so shared files are never read. Without
+// extents (no FIEMAP), reflinks are reported as copies. Groups of one file
+// are dropped.
+func classifyTopology(files []topoFile, size int64, equal func(a, b string) (bool, error)) []topologyGroup {
+	type group struct {
+		topologyGroup
+		files []topoFile
+	}
+	var groups []*group
+	shares := func(g *group, f topoFile) (string, string) {
+		for _, m := range g.files {
+			if f.hasIno && m.hasIno && f.ino == m.ino {
+				return topoHardlink, m.path
+			}
+		}
+		for _, m := range g.files {
+			if f.extents != nil && m.extents != nil && SameExtents(f.extents, m.extents) {
+				return topoReflink, m.path
+			}
+		}
+		return "", ""
+	}
+
+	for _, f := range files {
+		var into *group
+		kind, of := topoCopy, ""
+		for _, g := range groups {
+			if k, o := shares(g, f); k != "" {
+				into, kind, of = g, k, o
+				break
+			}
+		}
+		if into == nil {
+			for _, g := range groups {
+				same, err := equal(g.files[0].path, f.path)
+				if err != nil {
+					slog.Debug("content comparison failed", "a", g.files[0].path, "b", f.path, "error", err)
+					continue
+				}
+				if same {
+					into = g
+					break
+				}
+			}
+		}
+		if into == nil {
+			into = &group{topologyGroup: topologyGroup{Size: size}}
+			groups = append(groups, into)
+		}
+		into.files = append(into.files, f)
+		into.Members = append(into.Members, topoMember{Path: f.path, Kind: kind, Of: of})
+	}
+
+	var out []topologyGroup
+	for _, g := range groups {
+		if len(g.Members) > 1 {
+			out = append(out, g.topologyGroup)
+		}
+	}
+	return out
+}
+
+// topologyOf reads the inode and extents of each path and classifies them.
+func topologyOf(paths []string, size int64) []topologyGroup {
+	files := make([]topoFile, 0, len(paths))
+	for _, p := range paths {
+		f := topoFile{path: p}
+		if ino, err := fileInode(p); err == nil {
+			f.ino, f.hasIno = ino, true
+		}
+		f.extents, _ = fileExtents(p)
+		files = append(files, f)
+	}
+	return classifyTopology(files, size, filesEqual)
+}
+
+// TopologyReport writes content groups for --topology and totals them. It
+// is safe for concurrent use.
+type TopologyReport struct {
+	mu  sync.Mutex
+	w   io.Writer
+	raw bool
+
+	groups, files               int64
+	copies, hardlinks, reflinks int64
+	reclaimable                 int64
+}
+
+// NewTopologyReport returns a report writing groups to w, with raw byte
+// counts if raw is set.
+func NewTopologyReport(w io.Writer, raw bool) *TopologyReport {
+	return &TopologyReport{w: w, raw: raw}
+}
+
+// Add writes each group with one line per member and adds it to the totals.
+func (r *TopologyReport) Add(groups []topologyGroup) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, g := range groups {
+		copies, links, reflinks := g.count(topoCopy), g.count(topoHardlink), g.count(topoReflink)
+		fmt.Fprintf(r.w, "%s × %d: %d copies, %d hard links, %d reflinks (%s reclaimable)\n",
+			formatSize(g.Size, r.raw), len(g.Members), copies, links, reflinks, formatSize(g.Reclaimable(), r.raw))
+		for _, m := range g.Members {
+			if m.Of == "" {
+				fmt.Fprintf(r.w, "  %-8s  %s\n", m.Kind, m.Path)
+			} else {
+				fmt.Fprintf(r.w, "  %-8s  %s (of %s)\n", m.Kind, m.Path, m.Of)
+			}
+		}
+		r.groups++
+		r.files += int64(len(g.Members))
+		r.copies += copies
+		r.hardlinks += links
+		r.reflinks += reflinks
+		r.reclaimable += g.Reclaimable()
+	}
+}
+
+// WriteSummary writes the totals over all groups added.
+func (r *TopologyReport) WriteSummary(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(w, "\nTopology: %s content groups, %s files\n", formatCount(r.groups), formatCount(r.files))
+	fmt.Fprintf(w, "  Independent copies: %s\n", formatCount(r.copies))
+	fmt.Fprintf(w, "  Hard links:         %s\n", formatCount(r.hardlinks))
+	fmt.Fprintf(w, "  Reflinks:           %s\n", formatCount(r.reflinks))
+	fmt.Fprintf(w, "  Reclaimable:        %s\n", formatSize(r.reclaimable, r.raw))
+}
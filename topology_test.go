@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClassifyTopology(t *testing.T) {
+	shared := []Extent{{Physical: 1 << 20, Length: 4096, Device: 1}}
+	own := func(phys uint64) []Extent { return []Extent{{Physical: phys, Length: 4096, Device: 1}} }
+	files := []topoFile{
+		{path: "/a", ino: inodeKey{1, 10}, hasIno: true, extents: shared},
+		{path: "/b", ino: inodeKey{1, 10}, hasIno: true, extents: shared}, // hard link of a
+		{path: "/c", ino: inodeKey{1, 11}, hasIno: true, extents: shared}, // reflink of a
+		{path: "/d", ino: inodeKey{1, 12}, hasIno: true, extents: own(2 << 20)},
+		{path: "/x", ino: inodeKey{1, 13}, hasIno: true, extents: own(3 << 20)}, // other content
+		{path: "/e", ino: inodeKey{1, 14}, hasIno: true, extents: own(4 << 20)},
+		{path: "/f", ino: inodeKey{1, 14}, hasIno: true, extents: own(4 << 20)}, // hard link of e
+	}
+	content := map[string]string{"/a": "A", "/b": "A", "/c": "A", "/d": "A", "/e": "A", "/f": "A", "/x": "X"}
+	var compared []string
+	equal := func(a, b string) (bool, error) {
+		compared = append(compared, a+"="+b)
+		return content[a] == content[b], nil
+	}
+
+	groups := classifyTopology(files, 4096, equal)
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups, want 1 (the unique /x is dropped): %+v", len(groups), groups)
+	}
+	want := []topoMember{
+		{"/a", topoCopy, ""},
+		{"/b", topoHardlink, "/a"},
+		{"/c", topoReflink, "/a"},
+		{"/d", topoCopy, ""},
+		{"/e", topoCopy, ""},
+		{"/f", topoHardlink, "/e"},
+	}
+	g := groups[0]
+	if len(g.Members) != len(want) {
+		t.Fatalf("members = %+v, want %+v", g.Members, want)
+	}
+	for i := range want {
+		if g.Members[i] != want[i] {
+			t.Errorf("member %d = %+v, want %+v", i, g.Members[i], want[i])
+		}
+	}
+	if got := g.Reclaimable(); got != 2*4096 {
+		t.Errorf("Reclaimable = %d, want %d", got, 2*4096)
+	}
+	// Shared files are classified without reading them.
+	if got := strings.Join(compared, " "); got != "/a=/d /a=/x /a=/e" {
+		t.Errorf("compared %q, want only the unshared files", got)
+	}
+
+	var out, summary bytes.Buffer
+	r := NewTopologyReport(&out, true)
+	r.Add(groups)
+	r.WriteSummary(&summary)
+	if !strings.HasPrefix(out.String(), "4096 × 6: 3 copies, 2 hard links, 1 reflinks (8192 reclaimable)\n  copy      /a\n  hardlink  /b (of /a)\n") {
+		t.Errorf("report =\n%s", out.String())
+	}
+	if !strings.Contains(summary.String(), "Reflinks:           1") {
+		t.Errorf("summary =\n%s", summary.String())
+	}
+}
+
+func TestTopologyOf(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("same content, stored twice")
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+	link := filepath.Join(dir, "link")
+	if err := os.Link(a, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileInode(a); err != nil {
+		t.Skipf("no inode numbers here: %v", err)
+	}
+
+	groups := topologyOf([]string{a, link, b}, int64(len(content)))
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups, want 1", len(groups))
+	}
+	g := groups[0]
+	if c, l := g.count(topoCopy), g.count(topoHardlink); c != 2 || l != 1 {
+		t.Errorf("got %d copies and %d hard links, want 2 and 1: %+v", c, l, g.Members)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// levelTrace is the log level of the per-file decision paths, below
+// slog.LevelDebug. -vv enables it.
+const levelTrace = slog.LevelDebug - 4
+
+// replaceTraceLevel names levelTrace "TRACE" in text logs, instead of
+// "DEBUG-4".
+func replaceTraceLevel(_ []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey {
+		if l, ok := a.Value.Any().(slog.Level); ok && l == levelTrace {
+			a.Value = slog.StringValue("TRACE")
+		}
+	}
+	return a
+}
+
+// fileTrace collects the checks ProcessSizeGroup makes for one file and
+// logs them as one record at levelTrace, ending with the outcome. A nil
+// *fileTrace, which newFileTrace returns unless tracing is enabled,
+// records nothing.
+type fileTrace struct {
+	path  string
+	steps []string
+}
+
+// newFileTrace starts the trace of path, a file of size bytes with refs
+// refs to be compared against.
+func newFileTrace(path string, size int64, refs int) *fileTrace {
+	if !slog.Default().Enabled(context.Background(), levelTrace) {
+		return nil
+	}
+	t := &fileTrace{path: path}
+	t.step("size %d, refs: %d", size, refs)
+	return t
+}
+
+// step records one check.
+func (t *fileTrace) step(format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, fmt.Sprintf(format, args...))
+}
+
+// end logs the checks recorded, followed by the outcome.
+func (t *fileTrace) end(format string, args ...any) {
+	if t == nil {
+		return
+	}
+	slog.Log(context.Background(), levelTrace, "decision", "path", t.path,
+		"trace", strings.Join(t.steps, ", ")+" → "+fmt.Sprintf(format, args...))
+}
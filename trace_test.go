@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestFileTraceDecisions(t *testing.T) {
+	discardStdout(t)
+
+	dir := t.TempDir()
+	content := randomData(8, 8192)
+	other := randomData(9, 8192)
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+	c := createTempFile(t, dir, "c", other)
+
+	if newFileTrace(a, 1, 0) != nil {
+		t.Error("trace created at the default log level")
+	}
+
+	var buf bytes.Buffer
+	origLog := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: levelTrace, ReplaceAttr: replaceTraceLevel})))
+	defer slog.SetDefault(origLog)
+
+	ProcessSizeGroup([]string{a, b, c}, int64(len(content)), DedupOptions{DryRun: true}, nil)
+
+	var traces []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "level=TRACE msg=decision") {
+			// Without FIEMAP (e.g. tmpfs) the extents are unknown instead.
+			traces = append(traces, strings.ReplaceAll(line, "extents unknown", "extents differ"))
+		}
+	}
+	want := []struct{ path, trace string }{
+		{a, "size 8192, refs: 0 → first file: kept as ref"},
+		{b, "size 8192, refs: 1, checked ref " + a + ", not same inode, extents differ, content equal → would dedup (dry run)"},
+		{c, "size 8192, refs: 1, last matched ref " + a + " first, checked ref " + a + ", not same inode, extents differ, content differs → unique content: kept as ref"},
+	}
+	if len(traces) != len(want) {
+		t.Fatalf("got %d decision records, want %d:\n%s", len(traces), len(want), buf.String())
+	}
+	for i, w := range want {
+		if !strings.Contains(traces[i], "path="+w.path) || !strings.Contains(traces[i], `trace="`+w.trace+`"`) {
+			t.Errorf("record %d = %s\nwant path=%s trace=%q", i, traces[i], w.path, w.trace)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Transaction defers every replacement of a --transactional run to one
+// commit at the end. During the run, each duplicate's replacement is built
+// and verified at its temporary path next to it, but nothing is swapped
+// in. Commit then swaps them all, or none: a failed swap undoes the ones
+// before it. Until then the tree is untouched apart from the temporary
+// files, which Abort, or --clean-tmps after a crash, removes.
+//
+// A nil *Transaction stages nothing; its methods are safe to call from
+// concurrent groups.
+type Transaction struct {
+	// Verify makes Commit re-check every replacement once all are
+	// swapped in (see verifyCommitted), and undo them all if any fails.
+	Verify bool
+
+	mu     sync.Mutex
+	staged []stagedDedup
+	bytes  int64
+}
+
+// stagedDedup is a replacement of dst by src waiting at tmp to be swapped
+// with dst.
+type stagedDedup struct {
+	src, tmp, dst string
+	dstInfo       os.FileInfo // dst as it was when staged
+	size          int64
+	hardlink      bool
+	done          func() // called once committed
+}
+
+// NewTransaction returns an empty transaction.
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+// Stage builds the replacement of dst by src (a hard link with hardlink,
+// otherwise a reflink copy verified against srcExtents, as for
+// verifyReflink, with dst's metadata) at dst's temporary path. done runs
+// after a successful commit. Nothing is staged if an error is returned.
+func (t *Transaction) Stage(src, dst string, srcExtents []Extent, size int64, hardlink, verifyShared bool, done func()) error {
+	tmp := dst + tmpSuffix
+	dstInfo, err := os.Lstat(dst)
+	if err != nil {
+		return fmt.Errorf("stat dst: %w", err)
+	}
+	if hardlink {
+		err = stageHardlink(src, tmp)
+	} else {
+		err = stageReflink(src, tmp, srcExtents, dstInfo, verifyShared)
+	}
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.staged = append(t.staged, stagedDedup{src: src, tmp: tmp, dst: dst, dstInfo: dstInfo, size: size, hardlink: hardlink, done: done})
+	t.bytes += size
+	t.mu.Unlock()
+	return nil
+}
+
+// stageReflink creates the verified reflink copy of src at tmp.
+func stageReflink(src, tmp string, srcExtents []Extent, dstInfo os.FileInfo, verifyShared bool) error {
+	if err := reflinkCopy(src, tmp, dstInfo.Mode()); err != nil {
+		//goland:noinspection GoUnhandledErrorResult
+		guard.remove(tmp)
+		return fmt.Errorf("reflink copy: %w", err)
+	}
+	if err := finishCopy(src, tmp, srcExtents, dstInfo, verifyShared); err != nil {
+		//goland:noinspection GoUnhandledErrorResult
+		guard.remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// stageHardlink links src at tmp. A leftover tmp is not replaced: it may
+// be the only copy of a file from an interrupted run.
+func stageHardlink(src, tmp string) error {
+	if err := guard.link(src, tmp); err != nil {
+		return fmt.Errorf("hard link: %w", err)
+	}
+	if same, err := sameInode(src, tmp); err != nil || !same {
+		//goland:noinspection GoUnhandledErrorResult
+		guard.remove(tmp)
+		return fmt.Errorf("hard link verification failed")
+	}
+	return nil
+}
+
+// Staged returns the number and total size of the staged replacements.
+func (t *Transaction) Staged() (files, bytes int64) {
+	if t == nil {
+		return 0, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int64(len(t.staged)), t.bytes
+}
+
+// Commit swaps every staged replacement into place with RENAME_EXCHANGE.
+// If a swap fails, or the original it swapped out has changed since it
+// was staged, every swap made so far is undone, the staged files are
+// removed, and the error is returned. With Verify, the same happens if any
+// replacement fails verifyCommitted, and the error names each one.
+// Otherwise the originals are removed and each done callback runs.
+func (t *Transaction) Commit() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, s := range t.staged {
+		if err := renameExchange(s.tmp, s.dst); err != nil {
+			return t.rollback(i, fmt.Errorf("swap %s: %w", s.dst, err))
+		}
+		// The original is at s.tmp now.
+		if !unchangedSince(s.tmp, s.dstInfo) {
+			return t.rollback(i+1, fmt.Errorf("%s changed after it was staged", s.dst))
+		}
+	}
+	if t.Verify {
+		var diverged []error
+		for _, s := range t.staged {
+			if err := verifyCommitted(s); err != nil {
+				diverged = append(diverged, err)
+			}
+		}
+		if len(diverged) > 0 {
+			cause := fmt.Errorf("%d of %d replacements failed verification:\n%w", len(diverged), len(t.staged), errors.Join(diverged...))
+			return t.rollback(len(t.staged), cause)
+		}
+	}
+	for _, s := range t.staged {
+		if err := guard.remove(s.tmp); err != nil {
+			slog.Debug("cannot remove replaced original", "path", s.tmp, "error", err)
+		}
+		if s.done != nil {
+			s.done()
+		}
+	}
+	t.staged, t.bytes = nil, 0
+	return nil
+}
+
+// verifyCommitted re-checks a replacement after Commit swapped it in: dst
+// must still share storage with src, and read the same as the original
+// it replaced, which is at tmp until the commit completes. Without FIEMAP
+// only the content of reflinked files is checked.
+func verifyCommitted(s stagedDedup) error {
+	if s.hardlink {
+		if same, err := sameInode(s.src, s.dst); err != nil || !same {
+			return fmt.Errorf("%s is no longer a hard link to %s", s.dst, s.src)
+		}
+	} else if srcExtents, err := fileExtents(s.src); err == nil {
+		if dstExtents, err := fileExtents(s.dst); err != nil || !SameExtents(srcExtents, dstExtents) {
+			return fmt.Errorf("%s no longer shares storage with %s", s.dst, s.src)
+		}
+	}
+	equal, err := filesEqual(s.tmp, s.dst)
+	if err != nil {
+		return fmt.Errorf("compare %s with its original: %w", s.dst, err)
+	}
+	if !equal {
+		return fmt.Errorf("%s differs from its original", s.dst)
+	}
+	return nil
+}
+
+// rollback swaps the first n staged replacements back out, then discards
+// every staged file. An original that cannot be swapped back stays at its
+// temporary path, and the returned error names it.
+func (t *Transaction) rollback(n int, cause error) error {
+	errs := []error{cause}
+	kept := make(map[string]bool)
+	for i := n - 1; i >= 0; i-- {
+		s := t.staged[i]
+		if err := renameExchange(s.tmp, s.dst); err != nil {
+			errs = append(errs, fmt.Errorf("could not restore %s (original kept at %s): %w", s.dst, s.tmp, err))
+			kept[s.tmp] = true
+		}
+	}
+	for _, s := range t.staged {
+		if !kept[s.tmp] {
+			//goland:noinspection GoUnhandledErrorResult
+			guard.remove(s.tmp)
+		}
+	}
+	t.staged, t.bytes = nil, 0
+	return errors.Join(errs...)
+}
+
+// Abort discards every staged replacement, leaving all files as they were.
+func (t *Transaction) Abort() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollback(0, nil)
+}
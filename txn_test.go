@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// txnFiles creates three identical files and returns their paths, skipping
+// the test where RENAME_EXCHANGE is unavailable.
+func txnFiles(t *testing.T) (dir string, paths []string) {
+	t.Helper()
+	dir = t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		paths = append(paths, createTempFile(t, dir, name, []byte("transactional content")))
+	}
+	if err := renameExchange(paths[1], paths[2]); err != nil {
+		t.Skipf("RENAME_EXCHANGE unavailable: %v", err)
+	}
+	return dir, paths
+}
+
+// assertUntouched fails if any path is not its original inode or a
+// temporary file is left in dir.
+func assertUntouched(t *testing.T, dir string, paths []string, orig []os.FileInfo) {
+	t.Helper()
+	for i, p := range paths {
+		if info, err := os.Stat(p); err != nil || !os.SameFile(info, orig[i]) {
+			t.Errorf("%s was replaced", p)
+		}
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "*"+tmpSuffix)); len(tmps) > 0 {
+		t.Errorf("temporary files left: %v", tmps)
+	}
+}
+
+func statAll(t *testing.T, paths []string) []os.FileInfo {
+	t.Helper()
+	var infos []os.FileInfo
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func TestTransactionCommit(t *testing.T) {
+	dir, paths := txnFiles(t)
+	orig := statAll(t, paths)
+	txn := NewTransaction()
+
+	stats := ProcessSizeGroup(paths, 21, DedupOptions{Hardlink: true, Txn: txn}, nil)
+	if stats.FilesDeduped != 2 || stats.Errors != 0 {
+		t.Fatalf("got %d deduped, %d errors; want 2, 0", stats.FilesDeduped, stats.Errors)
+	}
+	if files, bytes := txn.Staged(); files != 2 || bytes != 42 {
+		t.Errorf("Staged() = %d, %d; want 2, 42", files, bytes)
+	}
+	// Nothing is swapped before the commit.
+	for i, p := range paths {
+		if info, _ := os.Stat(p); !os.SameFile(info, orig[i]) {
+			t.Errorf("%s replaced before commit", p)
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths[1:] {
+		if info, _ := os.Stat(p); !os.SameFile(info, orig[0]) {
+			t.Errorf("%s not linked to %s after commit", p, paths[0])
+		}
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "*"+tmpSuffix)); len(tmps) > 0 {
+		t.Errorf("temporary files left: %v", tmps)
+	}
+	if files, _ := txn.Staged(); files != 0 {
+		t.Errorf("%d files still staged after commit", files)
+	}
+}
+
+func TestTransactionDone(t *testing.T) {
+	_, paths := txnFiles(t)
+	txn := NewTransaction()
+	calls := 0
+	if err := txn.Stage(paths[0], paths[1], nil, 21, true, false, func() { calls++ }); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Fatal("done ran before the commit")
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("done ran %d times, want 1", calls)
+	}
+}
+
+func TestTransactionAbort(t *testing.T) {
+	dir, paths := txnFiles(t)
+	orig := statAll(t, paths)
+	txn := NewTransaction()
+	ProcessSizeGroup(paths, 21, DedupOptions{Hardlink: true, Txn: txn}, nil)
+	txn.Abort()
+	assertUntouched(t, dir, paths, orig)
+}
+
+// TestTransactionRollback induces failures in the commit phase: every
+// swap made before the failure must be undone.
+func TestTransactionRollback(t *testing.T) {
+	t.Run("file changed after staging", func(t *testing.T) {
+		dir, paths := txnFiles(t)
+		txn := NewTransaction()
+		ProcessSizeGroup(paths, 21, DedupOptions{Hardlink: true, Txn: txn}, nil)
+		// The last file to be swapped is written to after staging.
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(paths[2], later, later); err != nil {
+			t.Fatal(err)
+		}
+		orig := statAll(t, paths)
+
+		if err := txn.Commit(); err == nil {
+			t.Fatal("commit succeeded over a changed file")
+		}
+		assertUntouched(t, dir, paths, orig)
+	})
+
+	t.Run("swap fails", func(t *testing.T) {
+		dir, paths := txnFiles(t)
+		orig := statAll(t, paths)
+		txn := NewTransaction()
+		ProcessSizeGroup(paths, 21, DedupOptions{Hardlink: true, Txn: txn}, nil)
+		// Without its staged file, the second swap cannot happen.
+		if err := os.Remove(paths[2] + tmpSuffix); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := txn.Commit(); err == nil {
+			t.Fatal("commit succeeded without a staged file")
+		}
+		assertUntouched(t, dir, paths, orig)
+	})
+}
+
+// TestTransactionVerify induces a divergence that the per-file checks
+// cannot see: the ref, which the staged hard links share, is rewritten
+// with other content of the same size before the commit.
+func TestTransactionVerify(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		dir, paths := txnFiles(t)
+		txn := NewTransaction()
+		txn.Verify = verify
+		ProcessSizeGroup(paths, 21, DedupOptions{Hardlink: true, Txn: txn}, nil)
+		if err := os.WriteFile(paths[0], []byte("diverged content here"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		orig := statAll(t, paths)
+
+		err := txn.Commit()
+		if !verify {
+			if err != nil {
+				t.Fatalf("commit without verification: %v", err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatal("commit succeeded over diverged replacements")
+		}
+		for _, p := range paths[1:] {
+			if !strings.Contains(err.Error(), p+" differs from its original") {
+				t.Errorf("error does not name %s: %v", p, err)
+			}
+		}
+		assertUntouched(t, dir, paths, orig)
+		if got, _ := os.ReadFile(paths[1]); string(got) != "transactional content" {
+			t.Errorf("%s = %q after rollback", paths[1], got)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// undoEntry is one recorded dedup: Path was made to share storage with Ref.
+type undoEntry struct {
+	Path string
+	Ref  string
+}
+
+// UndoStats tracks the results of an --undo run.
+type UndoStats struct {
+	Restored int64 // files rewritten as independent copies
+	Missing  int64 // recorded files that no longer exist
+	Errors   int64
+}
+
+// readUndoEntries collects the dedups recorded in an event stream written
+// by --events-file or --output jsonl. Only "dedup" events that changed a
+// file (dry_run false) are returned, once per path, in recorded order.
+// Other events are ignored.
+func readUndoEntries(r io.Reader) ([]undoEntry, error) {
+	var entries []undoEntry
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var ev struct {
+			Event  string `json:"event"`
+			Path   string `json:"path"`
+			Ref    string `json:"ref"`
+			DryRun bool   `json:"dry_run"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if ev.Event != eventDedup || ev.DryRun || ev.Path == "" || seen[ev.Path] {
+			continue
+		}
+		seen[ev.Path] = true
+		entries = append(entries, undoEntry{Path: ev.Path, Ref: ev.Ref})
+	}
+	return entries, sc.Err()
+}
+
+// runUndo rewrites each recorded file as an independent copy, so it no
+// longer shares blocks (or, for hard links, its inode) with anything.
+// The optional onProgress callback is called with the 1-based index of each
+// entry processed.
+func runUndo(entries []undoEntry, dryRun bool, onProgress func(current int)) UndoStats {
+	var stats UndoStats
+	for i, e := range entries {
+		if onProgress != nil {
+			onProgress(i + 1)
+		}
+		if _, err := os.Lstat(e.Path); os.IsNotExist(err) {
+			slog.Debug("recorded file no longer exists", "path", e.Path)
+			stats.Missing++
+			continue
+		}
+		if dryRun {
+			fmt.Printf("[dry-run] undo: %s (shared with %s)\n", e.Path, e.Ref)
+			stats.Restored++
+			continue
+		}
+		if err := unshareFile(e.Path); err != nil {
+			slog.Debug("undo failed", "path", e.Path, "error", err)
+			stats.Errors++
+			continue
+		}
+		stats.Restored++
+	}
+	return stats
+}
+
+// unshareFile replaces path with a byte-for-byte copy in newly allocated
+// blocks and a new inode, keeping its metadata. The copy is written next to
+// path and renamed over it, so path always has complete content.
+func unshareFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", path)
+	}
+
+	src, err := openNoATime(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := guard.check("create", path); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".undo-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	//goland:noinspection GoUnhandledErrorResult
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if _, err := copySparse(tmp, src); err != nil {
+		return fail(fmt.Errorf("copy: %w", err))
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fail(err)
+	}
+	if err := restoreMetadata(tmpPath, info); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("restore metadata: %w", err)
+	}
+	if err := guard.rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadUndoEntries(t *testing.T) {
+	stream := strings.Join([]string{
+		`{"ts":"2024-01-01T00:00:00Z","event":"pass_start","pass":1,"root":"/data"}`,
+		`{"ts":"2024-01-01T00:00:00Z","event":"dedup","path":"/data/dry","ref":"/data/r","dry_run":true}`,
+		`{"ts":"2024-01-01T00:00:00Z","event":"dedup","path":"/data/b","ref":"/data/a","dry_run":false}`,
+		``,
+		`{"ts":"2024-01-01T00:00:00Z","event":"error","path":"/data/c","ref":"/data/a","error":"EXDEV"}`,
+		`{"ts":"2024-01-02T00:00:00Z","event":"dedup","path":"/data/b","ref":"/data/a","dry_run":false}`,
+		`{"ts":"2024-01-02T00:00:00Z","event":"dedup","path":"/data/d","ref":"/data/a","dry_run":false}`,
+	}, "\n")
+	got, err := readUndoEntries(strings.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []undoEntry{{"/data/b", "/data/a"}, {"/data/d", "/data/a"}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+
+	if _, err := readUndoEntries(strings.NewReader("{\"event\":\"dedup\"}\nnot json\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("error = %v, want line 2 error", err)
+	}
+}
+
+func TestUndoAfterDedup(t *testing.T) {
+	discardStdout(t)
+
+	content := randomData(9, 256*1024)
+	size := int64(len(content))
+
+	dedupThenUndo := func(t *testing.T, opts DedupOptions) (ref, dst string) {
+		dir := t.TempDir()
+		ref = createTempFile(t, dir, "ref", content)
+		dst = createTempFile(t, dir, "dst", content)
+		var events bytes.Buffer
+		opts.Events = NewEventLog(&events)
+		stats := ProcessSizeGroup([]string{ref, dst}, size, opts, nil)
+		if stats.FilesDeduped != 1 {
+			t.Skipf("dedup did not succeed here (%d errors): %v", stats.Errors, stats.ErrorDetails)
+		}
+
+		before, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := readUndoEntries(&events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		undo := runUndo(entries, false, nil)
+		if undo.Restored != 1 || undo.Errors != 0 {
+			t.Fatalf("undo = %+v, want 1 restored", undo)
+		}
+		if eq, err := filesEqual(ref, dst); err != nil || !eq {
+			t.Fatalf("content changed by undo: %v", err)
+		}
+		if after, _ := os.Stat(dst); after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+			t.Errorf("metadata changed by undo: mode %v, mtime %v; want %v, %v",
+				after.Mode(), after.ModTime(), before.Mode(), before.ModTime())
+		}
+		if leftovers, _ := filepath.Glob(filepath.Join(dir, ".*undo*")); len(leftovers) != 0 {
+			t.Errorf("temp files left behind: %v", leftovers)
+		}
+		return ref, dst
+	}
+
+	t.Run("hardlink", func(t *testing.T) {
+		ref, dst := dedupThenUndo(t, DedupOptions{Hardlink: true})
+		ri, _ := os.Stat(ref)
+		di, _ := os.Stat(dst)
+		if os.SameFile(ri, di) {
+			t.Error("files still share an inode after undo")
+		}
+	})
+
+	t.Run("reflink", func(t *testing.T) {
+		ref, dst := dedupThenUndo(t, DedupOptions{})
+		refExt, err := fileExtents(ref)
+		if err != nil {
+			t.Skipf("FIEMAP unavailable: %v", err)
+		}
+		dstExt, err := fileExtents(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if SameExtents(refExt, dstExt) {
+			t.Error("extents still shared after undo")
+		}
+		for _, e := range dstExt {
+			if e.Flags&extentFlagShared != 0 {
+				t.Errorf("extent at %d still flagged shared", e.Logical)
+			}
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		stats := runUndo([]undoEntry{{Path: filepath.Join(t.TempDir(), "gone"), Ref: "x"}}, false, nil)
+		if stats.Missing != 1 || stats.Restored != 0 {
+			t.Errorf("stats = %+v, want 1 missing", stats)
+		}
+	})
+}
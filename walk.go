@@ -1,45 +1,246 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+// checkRoot reports why root cannot be scanned: it must exist and be a
+// directory. The walkers skip unreadable directories silently, so without
+// this check a mistyped root would look like a tree without duplicates.
+func checkRoot(root string) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s: no such file or directory", root)
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory; fastdedup needs a directory to scan", root)
+	}
+	return nil
+}
+
+// WalkOptions selects what a walk visits. The zero value visits every
+// non-empty regular file outside .snapshots directories.
+type WalkOptions struct {
+	IncludeSnapshots bool         // descend into .snapshots directories
+	MinSize          int64        // skip files smaller than this
+	Exclude          *ExcludeDirs // subtrees pruned without being read (--exclude-under)
+
+	// ShouldProcess, if set, is asked about every regular file at or
+	// above MinSize, and the files it rejects are skipped as if they were
+	// not there. It lets an embedding program apply inclusion rules the
+	// flags cannot express; --dedup-only is built on it.
+	ShouldProcess func(path string, info os.FileInfo) bool
+}
+
+// accepts reports whether a walk records a regular file. Index entries,
+// which are not stat'ed, pass an info that carries only name and size.
+func (o WalkOptions) accepts(path string, info os.FileInfo) bool {
+	if info.Size() == 0 || info.Size() < o.MinSize {
+		return false
+	}
+	return o.ShouldProcess == nil || o.ShouldProcess(path, info)
+}
+
+// SpecialFiles counts the non-regular files a walk skipped, by kind. A nil
+// *SpecialFiles counts nothing.
+type SpecialFiles struct {
+	FIFOs   int64
+	Sockets int64
+	Devices int64 // character and block devices
+	Other   int64
+}
+
+// add classifies a skipped file by its type bits.
+func (s *SpecialFiles) add(path string, mode os.FileMode) {
+	if s == nil {
+		return
+	}
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		s.FIFOs++
+	case mode&os.ModeSocket != 0:
+		s.Sockets++
+	case mode&os.ModeDevice != 0:
+		// Device nodes rarely belong in a data tree; name them.
+		slog.Debug("skipping device node", "path", path, "char", mode&os.ModeCharDevice != 0)
+		s.Devices++
+		return
+	default:
+		s.Other++
+	}
+	slog.Debug("skipping special file", "path", path, "type", mode.Type().String())
+}
+
+// Total returns the number of special files skipped.
+func (s *SpecialFiles) Total() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.FIFOs + s.Sockets + s.Devices + s.Other
+}
+
+// String lists the non-zero counts, e.g. "2 fifos, 1 device".
+func (s *SpecialFiles) String() string {
+	if s == nil {
+		return ""
+	}
+	var parts []string
+	for _, c := range []struct {
+		n    int64
+		name string
+	}{{s.FIFOs, "fifo"}, {s.Sockets, "socket"}, {s.Devices, "device"}, {s.Other, "other"}} {
+		if c.n == 0 {
+			continue
+		}
+		name := c.name
+		if c.n != 1 && name != "other" {
+			name += "s"
+		}
+		parts = append(parts, formatCount(c.n)+" "+name)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// TreeStats records the shape of a walked tree: how deep its directories
+// go and how many entries the widest one holds. Very wide directories make
+// every walk allocate and shuffle their whole listing at once. A nil
+// *TreeStats records nothing.
+type TreeStats struct {
+	Dirs       int64  // directories read
+	MaxDepth   int    // levels below the root of the deepest directory
+	DeepestDir string // first directory found at MaxDepth
+	MaxEntries int    // entries of the widest directory
+	WidestDir  string // first directory found with MaxEntries
+
+	depth int // of the directory being read
+}
+
+// enter records a directory of n entries and descends into it.
+func (t *TreeStats) enter(dir string, n int) {
+	if t == nil {
+		return
+	}
+	t.Dirs++
+	if t.depth > t.MaxDepth || t.DeepestDir == "" {
+		t.MaxDepth, t.DeepestDir = t.depth, dir
+	}
+	if n > t.MaxEntries || t.WidestDir == "" {
+		t.MaxEntries, t.WidestDir = n, dir
+	}
+	t.depth++
+}
+
+// leave returns from the directory last entered.
+func (t *TreeStats) leave() {
+	if t != nil {
+		t.depth--
+	}
+}
+
 // WalkSizes traverses the directory tree rooted at root, recording each
 // regular file's size in the SizeMap. Symlinks are ignored. Directory
 // entry order is randomized so repeated runs explore different parts of
 // the tree before the bounded map fills up.
-// The optional onFile callback is called for every regular file encountered.
-func WalkSizes(root string, sm *SizeMap, includeSnapshots bool, minSize int64, onFile func(path string, size int64)) (int64, error) {
-	var count int64
-	err := walkRandom(root, includeSnapshots, minSize, func(path string, size int64) {
+// Skipped special files are counted in special and the tree's shape in
+// tree; either may be nil. The walk stops once limit (nil for none) is
+// reached or, unless deadline is zero, once deadline passes; the sizes
+// recorded until then are kept, and cut reports whether the deadline
+// stopped the walk with entries left to visit. The optional onFile
+// callback is called for every regular file recorded.
+func WalkSizes(root string, sm *SizeMap, walk WalkOptions, special *SpecialFiles, tree *TreeStats, limit *FileLimit, deadline time.Time, onFile func(path string, size int64)) (count int64, cut bool, err error) {
+	stop := func() bool {
+		if limit.Reached() {
+			return true
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			cut = true
+		}
+		return cut
+	}
+	err = walkRandomUntil(root, walk, special, tree, stop, func(path string, size int64) {
+		if !limit.Take() {
+			return
+		}
 		sm.Add(size)
 		count++
 		if onFile != nil {
 			onFile(path, size)
 		}
 	})
-	return count, err
+	return count, cut, err
+}
+
+// CountFiles counts the regular files under dir that a walk would visit,
+// for a pass 1 progress total. It reads directories only: the file type
+// comes from the directory entry, so no file is stat'ed. Empty files and
+// files below --min-size are counted too, which makes the count an upper
+// bound on what the walk reports.
+func CountFiles(dir string, walk WalkOptions) int64 {
+	if walk.Exclude.Has(dir) {
+		return 0
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var n int64
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir():
+			if walk.IncludeSnapshots || entry.Name() != ".snapshots" {
+				n += CountFiles(filepath.Join(dir, entry.Name()), walk)
+			}
+		case entry.Type().IsRegular():
+			n++
+		}
+	}
+	return n
 }
 
 // walkRandom recursively walks the directory tree at dir, calling fn for
 // each regular file found. Directory entries are shuffled to randomize
-// traversal order. Symlinks, special files, and empty files are skipped.
+// traversal order. Symlinks, special files, and empty files are skipped;
+// special files are counted in special, which may be nil. Directories in
+// walk.Exclude are pruned without being read, and files walk.ShouldProcess
+// rejects are skipped.
 // Errors reading individual directories are logged and skipped.
-func walkRandom(dir string, includeSnapshots bool, minSize int64, fn func(path string, size int64)) error {
+func walkRandom(dir string, walk WalkOptions, special *SpecialFiles, fn func(path string, size int64)) error {
+	return walkRandomUntil(dir, walk, special, nil, nil, fn)
+}
+
+// walkRandomUntil is walkRandom, stopping early once the optional stop
+// function returns true. It is checked before each directory entry. Every
+// directory read is recorded in tree, which may be nil.
+func walkRandomUntil(dir string, walk WalkOptions, special *SpecialFiles, tree *TreeStats, stop func() bool, fn func(path string, size int64)) error {
+	if walk.Exclude.Has(dir) {
+		slog.Debug("skipping excluded directory", "path", dir)
+		return nil
+	}
 	entries, err := os.ReadDir(dir)
 	if err != nil {
 		slog.Debug("skipping unreadable directory", "path", dir, "error", err)
 		return nil
 	}
+	tree.enter(dir, len(entries))
+	defer tree.leave()
 
 	rand.Shuffle(len(entries), func(i, j int) {
 		entries[i], entries[j] = entries[j], entries[i]
 	})
 
 	for _, entry := range entries {
+		if stop != nil && stop() {
+			return nil
+		}
 		// Skip symlinks entirely.
 		if entry.Type()&os.ModeSymlink != 0 {
 			continue
@@ -48,14 +249,15 @@ func walkRandom(dir string, includeSnapshots bool, minSize int64, fn func(path s
 		path := filepath.Join(dir, entry.Name())
 
 		if entry.IsDir() {
-			if !includeSnapshots && entry.Name() == ".snapshots" {
+			if !walk.IncludeSnapshots && entry.Name() == ".snapshots" {
 				continue
 			}
-			_ = walkRandom(path, includeSnapshots, minSize, fn)
+			_ = walkRandomUntil(path, walk, special, tree, stop, fn)
 			continue
 		}
 
 		if !entry.Type().IsRegular() {
+			special.add(path, entry.Type())
 			continue
 		}
 
@@ -65,7 +267,7 @@ func walkRandom(dir string, includeSnapshots bool, minSize int64, fn func(path s
 			continue
 		}
 
-		if info.Size() == 0 || info.Size() < minSize {
+		if !walk.accepts(path, info) {
 			continue
 		}
 
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCheckRoot(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		root    string
+		wantErr string
+	}{
+		{"directory", dir, ""},
+		{"file", file, "not a directory"},
+		{"missing", filepath.Join(dir, "missing"), "no such file or directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRoot(tt.root)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkRoot(%q) = %v, want nil", tt.root, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkRoot(%q) = %v, want error containing %q", tt.root, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWalkSizesSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	createTempFile(t, dir, "regular", []byte("data"))
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+
+	var special SpecialFiles
+	count, _, err := WalkSizes(dir, NewSizeMap(100), WalkOptions{}, &special, nil, nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("walked %d regular files, want 1", count)
+	}
+	want := SpecialFiles{FIFOs: 1}
+	if special != want {
+		t.Errorf("special = %+v, want %+v", special, want)
+	}
+	if got := special.String(); got != "1 fifo" {
+		t.Errorf("String() = %q, want %q", got, "1 fifo")
+	}
+}
+
+func TestWalkSizesTreeStats(t *testing.T) {
+	// Root holds 2 entries; wide holds 12; a/b/c is 3 levels down.
+	dir := t.TempDir()
+	wide := filepath.Join(dir, "wide")
+	deep := filepath.Join(dir, "a", "b", "c")
+	for _, d := range []string{wide, deep} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 12 {
+		createTempFile(t, wide, strconv.Itoa(i), []byte("data"))
+	}
+	createTempFile(t, deep, "f", []byte("data"))
+
+	var tree TreeStats
+	if _, _, err := WalkSizes(dir, NewSizeMap(100), WalkOptions{}, nil, &tree, nil, time.Time{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := TreeStats{Dirs: 5, MaxDepth: 3, DeepestDir: deep, MaxEntries: 12, WidestDir: wide}
+	if tree != want {
+		t.Errorf("tree = %+v, want %+v", tree, want)
+	}
+}
+
+func TestWalkSizesDeadline(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 20 {
+		createTempFile(t, dir, strconv.Itoa(i), []byte("same size"))
+	}
+
+	// The deadline passes while the second file is recorded.
+	deadline := time.Now().Add(100 * time.Millisecond)
+	sm := NewSizeMap(100)
+	var seen int
+	count, cut, err := WalkSizes(dir, sm, WalkOptions{}, nil, nil, nil, deadline, func(string, int64) {
+		if seen++; seen == 2 {
+			time.Sleep(time.Until(deadline) + time.Millisecond)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || !cut {
+		t.Fatalf("walked %d of 20 files, cut = %v; want 2, cut", count, cut)
+	}
+	// The partial counts still yield a target.
+	if top := sm.TopN(10); len(top) != 1 || top[0].Count != 2 {
+		t.Errorf("TopN = %v, want one size seen twice", top)
+	}
+
+	if count, _, _ := WalkSizes(dir, NewSizeMap(100), WalkOptions{}, nil, nil, nil, time.Now().Add(-time.Second), nil); count != 0 {
+		t.Errorf("walk past its deadline recorded %d files", count)
+	}
+
+	// A walk that finishes on its own just past the deadline, or one
+	// stopped by --limit-files, was not cut by the deadline.
+	deadline = time.Now().Add(50 * time.Millisecond)
+	seen = 0
+	_, cut, _ = WalkSizes(dir, NewSizeMap(100), WalkOptions{}, nil, nil, nil, deadline, func(string, int64) {
+		if seen++; seen == 20 {
+			time.Sleep(time.Until(deadline) + time.Millisecond)
+		}
+	})
+	if cut {
+		t.Error("walk that visited every file reported cut by the deadline")
+	}
+	deadline = time.Now().Add(50 * time.Millisecond)
+	seen = 0
+	_, cut, _ = WalkSizes(dir, NewSizeMap(100), WalkOptions{}, nil, nil, NewFileLimit(5), deadline, func(string, int64) {
+		if seen++; seen == 5 {
+			time.Sleep(time.Until(deadline) + time.Millisecond)
+		}
+	})
+	if cut {
+		t.Error("walk stopped by the file limit reported cut by the deadline")
+	}
+}
+
+func TestWalkShouldProcess(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"keep1", "keep2", "drop.tmp", "owned-by-db"} {
+		createTempFile(t, dir, name, []byte("same size!!"))
+	}
+	var asked []string
+	walk := WalkOptions{ShouldProcess: func(path string, info os.FileInfo) bool {
+		asked = append(asked, filepath.Base(path))
+		return info.Size() > 0 && filepath.Ext(path) != ".tmp" && filepath.Base(path) != "owned-by-db"
+	}}
+
+	var walked []string
+	count, _, err := WalkSizes(dir, NewSizeMap(100), walk, nil, nil, nil, time.Time{}, func(path string, _ int64) {
+		walked = append(walked, filepath.Base(path))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(walked)
+	if count != 2 || !slices.Equal(walked, []string{"keep1", "keep2"}) {
+		t.Errorf("walked %d files %v, want keep1 and keep2", count, walked)
+	}
+	if len(asked) != 4 {
+		t.Errorf("predicate asked about %v, want all 4 files", asked)
+	}
+}
+
+func TestCountFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "sub/b", "sub/deeper/c", "sub/deeper/d", ".snapshots/1/e"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createTempFile(t, dir, "empty", nil)
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := CountFiles(dir, WalkOptions{}); got != 5 {
+		t.Errorf("CountFiles = %d, want 5", got)
+	}
+	if got := CountFiles(dir, WalkOptions{IncludeSnapshots: true}); got != 6 {
+		t.Errorf("CountFiles with snapshots = %d, want 6", got)
+	}
+	if got := CountFiles(filepath.Join(dir, "missing"), WalkOptions{}); got != 0 {
+		t.Errorf("CountFiles of missing dir = %d, want 0", got)
+	}
+}
+
+func TestSpecialFilesString(t *testing.T) {
+	s := &SpecialFiles{FIFOs: 2, Devices: 1, Other: 3}
+	if got, want := s.String(), "2 fifos, 1 device, 3 other"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := s.Total(); got != 6 {
+		t.Errorf("Total() = %d, want 6", got)
+	}
+	var nilSpecial *SpecialFiles
+	nilSpecial.add("/dev/null", os.ModeDevice|os.ModeCharDevice)
+	if nilSpecial.Total() != 0 || nilSpecial.String() != "" {
+		t.Error("nil *SpecialFiles should count nothing")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteGuard(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("identical content")
+	a := createTempFile(t, dir, "a", content)
+	b := createTempFile(t, dir, "b", content)
+	before, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guard.on.Store(true)
+	t.Cleanup(func() {
+		guard.on.Store(false)
+		guard.blocked.Store(0)
+	})
+
+	for name, write := range map[string]func() error{
+		"hardlinkFile": func() error { return hardlinkFile(a, b, false) },
+		"unshareFile":  func() error { return unshareFile(b) },
+		"remove":       func() error { return guard.remove(b) },
+	} {
+		if err := write(); !errors.Is(err, errNoModify) {
+			t.Errorf("%s: got %v, want errNoModify", name, err)
+		}
+	}
+	if got := guard.Blocked(); got != 3 {
+		t.Errorf("Blocked() = %d, want 3", got)
+	}
+
+	after, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("b was replaced")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("want only a and b in %s, got %d entries", filepath.Base(dir), len(entries))
+	}
+
+	guard.on.Store(false)
+	if err := guard.remove(b); err != nil {
+		t.Errorf("remove with guard off: %v", err)
+	}
+}